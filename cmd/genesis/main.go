@@ -0,0 +1,67 @@
+// Command genesis mines the genesis block of a new network, printing the values to be set in its ChainParams.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"plairo/core"
+	"plairo/params"
+	"plairo/utils"
+	"strconv"
+	"time"
+)
+
+func main() {
+	network := flag.String("network", params.RegTestParams.Name, "network whose params are used as a base")
+	timestamp := flag.Int64("time", time.Now().Unix(), "genesis timestamp")
+	bits := flag.String("bits", "", "genesis target bits in hex, the pow limit of the network if empty")
+	message := flag.String("message", "", "message embedded in the genesis coinbase, the one of the network if empty")
+	pubkey := flag.String("pubkey", "", "hex PKIX key the genesis coinbase pays to, a new key pair is generated if empty")
+	flag.Parse()
+
+	base, err := params.ParamsForNetwork(*network)
+	if err != nil {
+		log.Fatalf("%v: %s\n", err, *network)
+	}
+	// working on a copy, the presets are never modified
+	cparams := *base
+	cparams.Genesis.Timestamp = *timestamp
+	cparams.Genesis.TargetBits = cparams.PowLimitBits
+	if *bits != "" {
+		parsed, err := strconv.ParseUint(*bits, 16, 32)
+		if err != nil {
+			log.Fatalf("Error parsing target bits: %v\n", err)
+		}
+		cparams.Genesis.TargetBits = uint32(parsed)
+	}
+	if *message != "" {
+		cparams.Genesis.Message = *message
+	}
+	if *pubkey == "" {
+		privkey, _, err := utils.GenerateKeyPair()
+		if err != nil {
+			log.Fatalf("Error generating key pair: %v\n", err)
+		}
+		privstr, _ := utils.ConvertPrivKeyToString(privkey)
+		*pubkey, _ = utils.ConvertPubKeyToString(&privkey.PublicKey)
+		fmt.Printf("Private key: %s\n", privstr)
+	}
+	cparams.Genesis.RecipientPubKey, err = hex.DecodeString(*pubkey)
+	if err != nil {
+		log.Fatalf("Error decoding public key: %v\n", err)
+	}
+
+	start := time.Now()
+	if err := core.MineGenesisBlock(&cparams); err != nil {
+		log.Fatalf("Error mining genesis block: %v, try a different timestamp\n", err)
+	}
+	fmt.Printf("Mined in %s\n\n", time.Since(start).Round(time.Millisecond))
+	fmt.Printf("RecipientPubKey: %x\n", cparams.Genesis.RecipientPubKey)
+	fmt.Printf("Message:         %q\n", cparams.Genesis.Message)
+	fmt.Printf("Timestamp:       %d\n", cparams.Genesis.Timestamp)
+	fmt.Printf("TargetBits:      0x%08x\n", cparams.Genesis.TargetBits)
+	fmt.Printf("Nonce:           %d\n", cparams.Genesis.Nonce)
+	fmt.Printf("Hash:            %x\n", cparams.Genesis.Hash)
+}
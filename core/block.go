@@ -2,13 +2,14 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"math/big"
 	"plairo/params"
 	"plairo/utils"
-	"time"
 )
 
 var ErrInvalidTxInBlock = errors.New("block contains invalid transaction")
@@ -17,7 +18,14 @@ var ErrStaleBlock = errors.New("stale block")
 var ErrInvalidMerkleRoot = errors.New("merkle root is invalid")
 var ErrTargetNotReached = errors.New("mined block does not satisfy target")
 var ErrInvalidHeaderLength = errors.New("invalid block header length")
-var ErrInvalidTimestamp = errors.New("invalid block timestamp")
+var ErrTimeTooOld = errors.New("block timestamp is not after median-time-past")
+var ErrInvalidTargetBits = errors.New("block target bits do not match the expected target")
+var ErrInvalidCompactBits = errors.New("block target bits are not a valid compact target")
+var ErrTimeTooNew = errors.New("block timestamp is too far in the future")
+var ErrInvalidBlockData = errors.New("invalid block data")
+
+// BlockHeaderSize is the size of a serialized block header, 4 + 32 + 32 + 8 + 4 + 4 bytes
+const BlockHeaderSize = 84
 
 type IBlock interface {
 	GetBlockHash() []byte
@@ -25,9 +33,19 @@ type IBlock interface {
 	GetNoOfTx() int
 	GetBlockHeader() []byte
 	GetUndoData() ([]byte, []byte)
+	TxLocations() []TxLocation
+}
+
+// TxLocation is the position of a transaction inside the serialized block data
+type TxLocation struct {
+	TXID   []byte
+	Offset uint32
+	Length uint32
 }
 
 type BlockHeader struct {
+	// Version signals the deployments the miner supports, see versionbits.go
+	Version           uint32
 	PreviousBlockHash []byte
 	MerkleRoot        []byte
 	Timestamp         int64
@@ -38,13 +56,15 @@ type BlockHeader struct {
 func (bh *BlockHeader) Serialize() []byte {
 	/*
 		Block header consists of:
+		-- Version (4 bytes - Big Endian)
 		-- Previous block hash (32 bytes)
 		-- Merkle root of this block (32 bytes)
 		-- Timestamp of this block (8 bytes - Big Endian)
 		-- TargetBits used when mining the block (4 bytes - Big Endian)
 		-- Nonce (4 bytes - Big Endian)
 	*/
-	var header []byte
+	header := make([]byte, 0, BlockHeaderSize)
+	header = append(header, utils.SerializeUint32(bh.Version, false)...)
 	header = append(header, bh.PreviousBlockHash...)
 	header = append(header, bh.MerkleRoot...)
 	header = append(header, utils.SerializeUint64(uint64(bh.Timestamp), false)...)
@@ -53,6 +73,22 @@ func (bh *BlockHeader) Serialize() []byte {
 	return header
 }
 
+// DeserializeBlockHeader parses a serialized block header
+func DeserializeBlockHeader(data []byte) (*BlockHeader, error) {
+	if len(data) != BlockHeaderSize {
+		return nil, ErrInvalidHeaderLength
+	}
+	br := &BlockHeaderReader{data}
+	return &BlockHeader{
+		Version:           br.ReadVersion(),
+		PreviousBlockHash: append([]byte(nil), br.ReadPreviousHash()...),
+		MerkleRoot:        append([]byte(nil), br.ReadMerkleRoot()...),
+		Timestamp:         br.ReadTimestamp(),
+		TargetBits:        br.ReadTargetBits(),
+		Nonce:             br.ReadNonce(),
+	}, nil
+}
+
 func (bh *BlockHeader) GetHash() []byte {
 	return utils.CalculateSHA256Hash(utils.CalculateSHA256Hash(bh.Serialize()))
 }
@@ -77,6 +113,7 @@ func (b *Block) GetNoOfTx() int {
 func (b *Block) GetBlockHeader() []byte {
 	/*
 		Block header consists of:
+		-- Version (4 bytes - Big Endian)
 		-- Previous block hash (32 bytes)
 		-- Merkle root of this block (32 bytes)
 		-- Timestamp of this block (8 bytes - Big Endian)
@@ -92,22 +129,31 @@ func (b *Block) GetBlockHash() []byte {
 
 //ValidateBlockTx validates every TX contained in the block and removes the UTXOs referenced, if all TXs are valid
 func (b *Block) ValidateBlockTx() error {
+	return b.validateBlockTx(true)
+}
+
+// validateBlockTx is the same as ValidateBlockTx, skipping the signature checks if checkSignatures is false.
+// The signatures are verified concurrently, after the rest of the checks. If multiple transactions are invalid,
+// the error of the one with the lowest index is returned.
+func (b *Block) validateBlockTx(checkSignatures bool) error {
 	// This method will have to remove the UTXOs referenced by each TX.
 	// To avoid referencing UTXOs twice or removing the UTXOs before ensuring the block is valid,
 	// a map will be used to check for duplicates and the cleanUp method will be called after making sure
 	// all the transactions are indeed valid.
 	dedup := make(map[string]bool)
+	// index of the first TX failing the checks other than the signatures
+	failedTx := len(b.allBlockTx)
+	var failedErr error
+txLoop:
 	for i, tx := range b.allBlockTx {
 		// coinbase validation must be done seperately
 		// if a TX other than the first is marked as coinbase, it will be validated as a normal TX
 		if i == 0 {
 			continue
 		}
-		if err := tx.ValidateTransaction(); err != nil {
-			fmt.Println("Validating tx...")
-			// making sure the invalid transaction is removed from mempool if exists
-			mempool.RemoveTX(tx)
-			return err
+		if err := tx.validateTransaction(false, false); err != nil {
+			failedTx, failedErr = i, err
+			break
 		}
 		// Keeping track of each output referenced. If it has been referenced from another TX in the block,
 		// the block should be rejected. OutputID uniquely characterizes an output (hash of parentTXID+Vout).
@@ -117,27 +163,46 @@ func (b *Block) ValidateBlockTx() error {
 				dedup[hex.EncodeToString(inp.OutputReferred.OutputID)] = true
 				continue
 			}
-			// removing from mempool if exists
-			mempool.RemoveTX(tx)
-			return ErrInvalidTxInBlock
+			failedTx, failedErr = i, ErrInvalidTxInBlock
+			break txLoop
 		}
 	}
 
+	// only the signatures of the TXs before the first failure could change the result
+	if checkSignatures && failedTx > 1 {
+		checks := collectSigChecks(b.allBlockTx[1:failedTx], 1)
+		if j, err := verifySignatures(checks, 0); err != nil {
+			failedTx, failedErr = checks[j].txIndex, err
+		}
+	}
+	if failedErr != nil {
+		// making sure the invalid transaction is removed from mempool if exists
+		mempool.RemoveTX(b.allBlockTx[failedTx])
+		return failedErr
+	}
 	return nil
 }
 
-func (b *Block) ConfirmAsValid() error {
+// ConfirmAsValid updates the chainstate with the UTXOs spent and created by the block at the height given
+func (b *Block) ConfirmAsValid(height uint32) error {
 	// by this point, all the TX in the block are valid and the UTXOs they reference should be removed from chainstate
 	// a second iteration is necessary to prevent removing the UTXOs of transactions in an invalid block
 	// since the block is confirmed as valid, the new UTXOs can be added to chainstate
-	for _, tx := range b.allBlockTx {
-		if err := tx.cleanUpInputs(); err != nil {
-			return err
+	for i, tx := range b.allBlockTx {
+		// the coinbase input does not reference an existing UTXO
+		if i != 0 {
+			if err := tx.cleanUpInputs(); err != nil {
+				return err
+			}
 		}
 		if err := cstate.InsertBatchTX(tx); err != nil {
 			return err
 		}
 	}
+	// a block without a header has no hash to record
+	if b.header != nil {
+		cstate.SetBestBlock(b.GetBlockHash(), height)
+	}
 	// Write batch to chainstate
 	return cstate.WriteBatchTX()
 }
@@ -166,23 +231,15 @@ func (b *Block) GetBlockFees(containsCB bool) uint64 {
 	return total
 }
 
-func (b *Block) MineBlock(currentBlockHeight uint32, minerPubKey *ecdsa.PublicKey) error {
-	// timestamping the block
-	b.header.Timestamp = time.Now().Unix()
-	// initializing the nonce
-	b.header.Timestamp = 0
-
-	if err := b.ValidateBlockTx(); err != nil {
-		return err
-	}
-
+// prepareForMining validates the block transactions, prepends the coinbase transaction paying the miner
+// and computes the merkle root of the block
+func (b *Block) prepareForMining(cparams *params.ChainParams, currentBlockHeight uint32, minerPubKey *ecdsa.PublicKey) error {
 	if len(b.allBlockTx) > params.MaxNumberOfTXsInBlock {
 		return ErrExceededMaxTX
 	}
 
-	// calculating number of halvings for block about to be created, not current one
-	halvings := (currentBlockHeight + 1) / params.SubsidyHalvingInterval
-	subsidy := params.InitialBlockSubsidy >> halvings
+	// subsidy is calculated for block about to be created, not current one
+	subsidy := GetBlockSubsidy(cparams, currentBlockHeight+1)
 
 	fees := b.GetBlockFees(false)
 	coinbase, err := NewCoinbaseTransaction("coinbase", subsidy+fees, minerPubKey, currentBlockHeight)
@@ -195,42 +252,38 @@ func (b *Block) MineBlock(currentBlockHeight uint32, minerPubKey *ecdsa.PublicKe
 	tmpTxSlc[0] = coinbase
 	b.allBlockTx = tmpTxSlc
 
-	b.ComputeMerkleRoot()
+	// validating after the coinbase is prepended, since the first TX is always skipped as coinbase
+	if err := b.ValidateBlockTx(); err != nil {
+		return err
+	}
 
-	var blockHash []byte
-	var timeBumps uint8
+	b.ComputeMerkleRoot()
+	return nil
+}
 
-	for {
-		blockHash = b.GetBlockHash()
+func (b *Block) MineBlock(cparams *params.ChainParams, currentBlockHeight uint32, minerPubKey *ecdsa.PublicKey) error {
+	// timestamping the block
+	b.header.Timestamp = AdjustedTime()
+	// initializing the nonce
+	b.header.Nonce = 0
 
-		if bytes.Compare(blockHash, utils.ExpandBits(utils.SerializeUint32(b.header.TargetBits, false))) < 0 {
-			break
-		}
-		b.header.Nonce++
-
-		// if all nonce values have been tried, and it's back again at 0, then bump timestamp if permitted
-		if b.header.Nonce == 0 {
-			if timeBumps < 30 {
-				b.header.Timestamp++
-				timeBumps++
-			} else {
-				return ErrStaleBlock
-			}
-		}
+	if err := b.prepareForMining(cparams, currentBlockHeight, minerPubKey); err != nil {
+		return err
 	}
 
-	return nil
+	// using a single worker, the nonce and extra-nonce space is searched sequentially
+	return solveBlock(context.Background(), b, 1, nil)
 }
 
 func (b *Block) Serialize() []byte {
 	/*
-		Block Header (32 bytes)
+		Block Header (84 bytes)
 		Number of Transactions (4 bytes)
 		-- Size of Transaction Data (4 bytes)
 		-- Transaction Data for every TX in block
 	*/
-	// at least 36 bytes are needed
-	res := make([]byte, 0, 36)
+	// at least 88 bytes are needed
+	res := make([]byte, 0, BlockHeaderSize+4)
 	res = append(res, b.GetBlockHeader()...)
 	res = append(res, utils.SerializeUint32(uint32(len(b.allBlockTx)), false)...)
 	for _, tx := range b.allBlockTx {
@@ -240,6 +293,57 @@ func (b *Block) Serialize() []byte {
 	return res
 }
 
+// TxLocations returns the position of each transaction in the data returned by Serialize
+func (b *Block) TxLocations() []TxLocation {
+	locs := make([]TxLocation, len(b.allBlockTx))
+	offset := uint32(BlockHeaderSize + 4)
+	for i, tx := range b.allBlockTx {
+		length := uint32(len(tx.Serialize()))
+		// skipping the size of the transaction data
+		offset += 4
+		locs[i] = TxLocation{TXID: tx.TXID, Offset: offset, Length: length}
+		offset += length
+	}
+	return locs
+}
+
+// DeserializeBlock parses serialized block data. The first transaction is treated as the coinbase.
+func DeserializeBlock(data []byte) (*Block, error) {
+	if len(data) < BlockHeaderSize+4 {
+		return nil, ErrInvalidBlockData
+	}
+	header, err := DeserializeBlockHeader(data[:BlockHeaderSize])
+	if err != nil {
+		return nil, err
+	}
+	noOfTx := utils.DeserializeUint32(data[BlockHeaderSize:BlockHeaderSize+4], false)
+	if noOfTx == 0 {
+		return nil, ErrInvalidBlockData
+	}
+	caret := uint64(BlockHeaderSize + 4)
+	var txs []*Transaction
+	for i := uint32(0); i < noOfTx; i++ {
+		if uint64(len(data))-caret < 4 {
+			return nil, ErrInvalidBlockData
+		}
+		txSize := uint64(utils.DeserializeUint32(data[caret:caret+4], false))
+		caret += 4
+		if uint64(len(data))-caret < txSize {
+			return nil, ErrInvalidBlockData
+		}
+		tx, err := deserializeTransaction(data[caret:caret+txSize], i == 0)
+		if err != nil {
+			return nil, fmt.Errorf("deserializing transaction #%d: %w", i, err)
+		}
+		caret += txSize
+		txs = append(txs, tx)
+	}
+	if caret != uint64(len(data)) {
+		return nil, ErrInvalidBlockData
+	}
+	return &Block{header: header, allBlockTx: txs}, nil
+}
+
 func (b *Block) IterateBlockTx(ch chan<- interface{}) {
 	for _, tx := range b.allBlockTx {
 		ch <- tx
@@ -261,16 +365,15 @@ func (b *Block) GetUndoData() (res []byte, checksum []byte) {
 			continue
 		}
 		for _, inp := range tx.inputs {
-			// getting the metadata for the UTXO used as input
-			mt, err := cstate.GetTX(inp.OutputReferred.ParentTXID)
-			if err != nil {
-				panic(fmt.Errorf("getting input metadata for undo data: %v", err))
+			// getting the chainstate entry of the UTXO used as input
+			entry, ok := cstate.GetUtxoEntry(inp.OutputReferred.ParentTXID, inp.OutputReferred.Vout)
+			if !ok {
+				panic(fmt.Errorf("getting input entry for undo data: %x:%d", inp.OutputReferred.ParentTXID, inp.OutputReferred.Vout))
 			}
-			tr := NewTxMetadataReader(inp.OutputReferred.ParentTXID, mt)
 			// multiplying the height by 2 will shift one bit to the left
 			// the right-most bit will be used to hold if the UTXO was a coinbase output or not
-			h := 2 * uint64(tr.ReadBlockHeight())
-			if tr.ReadIsCoinbase() {
+			h := 2 * uint64(entry.BlockHeight)
+			if entry.IsCoinbase {
 				h = h + 1
 			}
 			res = append(res, utils.SerializeUint64(h, false)...)
@@ -284,7 +387,14 @@ func (b *Block) GetUndoData() (res []byte, checksum []byte) {
 	return
 }
 
-func ValidateCoinbase(block *Block, minedBlockHeight uint32) error {
+// GetBlockSubsidy returns the subsidy the miner of the block with the height given is rewarded with
+func GetBlockSubsidy(cparams *params.ChainParams, height uint32) uint64 {
+	// calculating number of halvings for the block
+	halvings := height / cparams.SubsidyHalvingInterval
+	return cparams.InitialBlockSubsidy >> halvings
+}
+
+func ValidateCoinbase(cparams *params.ChainParams, block *Block, minedBlockHeight uint32) error {
 	// coinbase transaction is always the first transaction of the block
 	coinbaseTX := block.allBlockTx[0]
 	// getting the value specified in the coinbase transaction as miner reward
@@ -292,9 +402,7 @@ func ValidateCoinbase(block *Block, minedBlockHeight uint32) error {
 	for _, outp := range coinbaseTX.outputs {
 		coinbaseValue += outp.Value
 	}
-	// calculating number of halvings for block received
-	halvings := (minedBlockHeight) / params.SubsidyHalvingInterval
-	subsidy := params.InitialBlockSubsidy >> halvings
+	subsidy := GetBlockSubsidy(cparams, minedBlockHeight)
 
 	// checking against total block fees and current subsidy
 	if coinbaseValue > subsidy+block.GetBlockFees(true) {
@@ -305,32 +413,38 @@ func ValidateCoinbase(block *Block, minedBlockHeight uint32) error {
 
 func ValidateBlockHeader(blockHeader []byte) error {
 	// NOTE: Could more checks be added?
-	// Block header is 32 + 32 + 8 + 4 + 4 = 80 bytes
 	// checking if header length is valid
-	if len(blockHeader) != 80 {
+	if len(blockHeader) != BlockHeaderSize {
 		return ErrInvalidHeaderLength
 	}
-	// ensuring timestamp is not in the future
-	if utils.DeserializeUint64(blockHeader[64:72], false) > uint64(time.Now().Unix()) {
-		return ErrInvalidTimestamp
+	// ensuring timestamp is not too far in the future, the lower bound is checked against the previous blocks
+	br := &BlockHeaderReader{blockHeader}
+	if br.ReadTimestamp() > AdjustedTime()+params.MaxFutureBlockTimeInSec {
+		return ErrTimeTooNew
 	}
-	// TODO: add check for appropriate target bits used in mining (TBA when target and difficulty is implemented)
-	targetBits := utils.DeserializeUint32(blockHeader[76:80], false)
-	if err := ValidateBlockHeader(blockHeader); err != nil {
-		return err
+	// the target bits are checked against the expected target when the block is linked to the chain
+	// the bits are untrusted, they are checked before being expanded
+	targetBits := br.ReadTargetBits()
+	if !utils.IsValidCompact(targetBits) {
+		return ErrInvalidCompactBits
 	}
 	blockHash := utils.CalculateSHA256Hash(utils.CalculateSHA256Hash(blockHeader))
-	if bytes.Compare(blockHash, utils.ExpandBits(utils.SerializeUint32(targetBits, false))) >= 0 {
+	if new(big.Int).SetBytes(blockHash).Cmp(utils.CompactToBig(targetBits)) >= 0 {
 		return ErrTargetNotReached
 	}
 	return nil
 }
 
-func ValidateBlock(block *Block, minedBlockHeight uint32) error {
-	if err := block.ValidateBlockTx(); err != nil {
+func ValidateBlock(cparams *params.ChainParams, block *Block, minedBlockHeight uint32) error {
+	return validateBlock(cparams, block, minedBlockHeight, true)
+}
+
+// validateBlock is the same as ValidateBlock, skipping the signature checks if checkSignatures is false
+func validateBlock(cparams *params.ChainParams, block *Block, minedBlockHeight uint32, checkSignatures bool) error {
+	if err := block.validateBlockTx(checkSignatures); err != nil {
 		return err
 	}
-	if err := ValidateCoinbase(block, minedBlockHeight); err != nil {
+	if err := ValidateCoinbase(cparams, block, minedBlockHeight); err != nil {
 		return err
 	}
 	if !bytes.Equal(block.header.MerkleRoot, block.generateBlockMerkleRoot()) {
@@ -341,39 +455,3 @@ func ValidateBlock(block *Block, minedBlockHeight uint32) error {
 	}
 	return nil
 }
-
-func GetTargetForBlock(bchain *Blockchain, lastBlockHeader *BlockHeader, lastBlockHeight uint32) uint32 {
-	// checking if next block should not have adjusted difficulty
-	if (lastBlockHeight+1)%params.RetargetInterval != 0 {
-		return lastBlockHeader.TargetBits
-	}
-
-	// to properly get actual time needed to mine this block interval, we need to check the timestamp
-	// of the block before the block that starts the interval
-	intervalStartHeight := lastBlockHeight - params.RetargetInterval
-	var timecomp uint64
-	if params.RetargetInterval > lastBlockHeight {
-		// this is true only for the first retarget that will take place
-		// it is not possible to check the timestamp of the block before the genesis
-		// since the genesis is the block that starts the interval
-		// to compensate for this, it is assumed that the genesis
-		// mining time was ideal
-		intervalStartHeight = 0
-		timecomp += params.ExpectedTimePerBlockInSec
-	}
-
-	firstBlockHeader, ok := bchain.GetHeaderAt(intervalStartHeight)
-	if !ok {
-		panic("Out of bounds getting first interval block")
-	}
-	// adding time compensation (if needed) to use in calculation of actual interval time
-	return calculateTargetForBlock(lastBlockHeader, firstBlockHeader.Timestamp+int64(timecomp))
-}
-
-func calculateTargetForBlock(lastBlockHeader *BlockHeader, firstStamp int64) uint32 {
-	prevTarget := lastBlockHeader.TargetBits
-	actualTime := float64(lastBlockHeader.Timestamp - firstStamp)
-	expectedTime := float64(params.ExpectedTimePerBlockInSec * uint64(params.RetargetInterval))
-	coeff := actualTime / expectedTime
-	return utils.ApplyCoeffToTarget(coeff, prevTarget)
-}
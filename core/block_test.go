@@ -1,6 +1,8 @@
 package core
 
 import (
+	"bytes"
+	"encoding/hex"
 	"errors"
 	"plairo/utils"
 	"testing"
@@ -9,7 +11,7 @@ import (
 func initTestMempool() *MemPool {
 	old := mempool
 	// creating new mempool to use for testing purposes
-	mempool = &MemPool{&memTree{}, make(map[string]uint64), make(map[string]bool)}
+	mempool = newMemPool()
 	return old
 }
 
@@ -84,11 +86,11 @@ func TestBlock_ConfirmAsValid(t *testing.T) {
 
 	// Test case #0: Coinbase should be added to chainstate after confirming the block as valid
 	b0 := NewBlock([]*Transaction{cb})
-	if err := b0.ConfirmAsValid(); err != nil {
+	if err := b0.ConfirmAsValid(0); err != nil {
 		t.Errorf("Error confirming block #0 as valid: %v\n", err)
 	}
-	if _, err := cstate.GetTX(cb.TXID); err != nil {
-		t.Errorf("Error getting tx of block #0 from chainstate after confirming: %v\n", err)
+	if _, ok := cstate.(*mockChainstate).txmap[hex.EncodeToString(cb.TXID)]; !ok {
+		t.Errorf("TX of block #0 not in chainstate after confirming.\n")
 	}
 
 	// Test Case #1: A regular TX added in block
@@ -103,7 +105,7 @@ func TestBlock_ConfirmAsValid(t *testing.T) {
 	signTestInputs(tx1, privkey1)
 
 	b1 := NewBlock([]*Transaction{cb, tx1})
-	if err := b1.ConfirmAsValid(); err != nil {
+	if err := b1.ConfirmAsValid(1); err != nil {
 		t.Errorf("Error confirming block #1 as valid: %v\n", err)
 	}
 	for i := range basetx1.outputs {
@@ -156,3 +158,59 @@ func TestBlock_GetBlockFees(t *testing.T) {
 		t.Errorf("For block #1, expected %d, got %d.", 10000, b1.GetBlockFees(true))
 	}
 }
+
+func TestDeserializeBlock(t *testing.T) {
+	oldcstate := initTestCState()
+	defer resetTestCState(oldcstate)
+	oldmp := initTestMempool()
+	defer resetTestMempool(oldmp)
+
+	privkey, pubkey, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+	basetx := NewTransaction(createTestInputs(createTestOutputs(4, 0x01, nil, nil)), createTestOutputs(2, 0x02, nil, pubkey))
+	cstate.InsertBatchTX(basetx)
+	tx := NewTransaction(createTestInputs(createTestOutputs(2, 0x02, basetx.TXID, pubkey)), createTestOutputs(1, 0x03, nil, nil))
+	signTestInputs(tx, privkey)
+	cb, err := NewCoinbaseTransaction("coinbase", 1000, pubkey, 4)
+	if err != nil {
+		t.Fatalf("Error creating coinbase: %v\n", err)
+	}
+
+	b := NewBlock([]*Transaction{cb, tx})
+	b.header = &BlockHeader{Version: VersionBitsTopBits, PreviousBlockHash: make([]byte, 32), Timestamp: 1234, TargetBits: 0x1d00ffff, Nonce: 99}
+	b.ComputeMerkleRoot()
+
+	got, err := DeserializeBlock(b.Serialize())
+	if err != nil {
+		t.Fatalf("Error deserializing block: %v\n", err)
+	}
+	if got.header.Version != VersionBitsTopBits {
+		t.Errorf("Expected version %08x, got %08x\n", VersionBitsTopBits, got.header.Version)
+	}
+	if !bytes.Equal(got.Serialize(), b.Serialize()) {
+		t.Errorf("Deserialized block does not match.\nExp: %x\nGot: %x\n", b.Serialize(), got.Serialize())
+	}
+	if !got.allBlockTx[0].IsCoinbase || got.allBlockTx[0].BlockHeight != 5 {
+		t.Errorf("Expected coinbase with height 5, got coinbase %v with height %d\n", got.allBlockTx[0].IsCoinbase, got.allBlockTx[0].BlockHeight)
+	}
+	if !bytes.Equal(got.allBlockTx[1].TXID, tx.TXID) {
+		t.Errorf("TXID mismatch after deserializing.\n")
+	}
+	// the outputs referred should be filled in from the chainstate
+	for i, inp := range got.allBlockTx[1].inputs {
+		if !inp.OutputReferred.Equal(tx.inputs[i].OutputReferred) {
+			t.Errorf("Output referred by input %d does not match.\n", i)
+		}
+	}
+	if err := got.ValidateBlockTx(); err != nil {
+		t.Errorf("Error validating deserialized block: %v\n", err)
+	}
+
+	// truncated data should be rejected
+	data := b.Serialize()
+	if _, err := DeserializeBlock(data[:len(data)-1]); err == nil {
+		t.Errorf("Expected truncated block to be rejected.\n")
+	}
+}
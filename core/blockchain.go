@@ -4,14 +4,21 @@ import (
 	"bytes"
 	"errors"
 	"plairo/params"
+	"sort"
+	"sync"
 )
 
 var ErrInvalidLink = errors.New("previous block hash does not match")
 var ErrInvalidHeight = errors.New("invalid block height")
+var ErrBlockPruned = errors.New("block data was pruned")
 
 type iStorage interface {
 	WriteBlock(IBlock, uint32) error
 	GetBlockData([]byte) ([]byte, bool)
+	// HasBlock checks if the block was written, even if its data was pruned since
+	HasBlock([]byte) bool
+	// DisconnectBlock stages the removal of the records that only apply while the block is part of the chain
+	DisconnectBlock(IBlock) error
 }
 
 var BStorage iStorage
@@ -32,19 +39,55 @@ func (bn *BNode) InitializeHeaderFromBlock(block *Block) {
 	bn.header = &bnheader
 }
 
-func createGenesisNode() *BNode {
-	return &BNode{
+func (bn *BNode) GetHeader() *BlockHeader {
+	return bn.header
+}
+
+func (bn *BNode) GetHeight() uint32 {
+	return bn.height
+}
+
+// GetPrevious returns the node this node is linked to, nil for the genesis
+func (bn *BNode) GetPrevious() *BNode {
+	return bn.previousBNode
+}
+
+// MedianTimePast returns the median timestamp of this node and up to params.MedianTimeSpan-1 nodes before it.
+// A block built on top of this node should have a timestamp greater than this.
+func (bn *BNode) MedianTimePast() int64 {
+	stamps := make([]int64, 0, params.MedianTimeSpan)
+	for node := bn; node != nil && len(stamps) < params.MedianTimeSpan; node = node.previousBNode {
+		stamps = append(stamps, node.header.Timestamp)
+	}
+	sort.Slice(stamps, func(i, j int) bool { return stamps[i] < stamps[j] })
+	return stamps[len(stamps)/2]
+}
+
+// checkHeaderContext validates the header fields that depend on prevNode, the node the block is linked to.
+// The timestamp should be after the median-time-past, the target bits should match the expected target
+// and the block should match the checkpoint at its height, if any.
+func checkHeaderContext(cparams *params.ChainParams, block *Block, prevNode *BNode) error {
+	if block.header.Timestamp <= prevNode.MedianTimePast() {
+		return ErrTimeTooOld
+	}
+	if block.header.TargetBits != GetTargetForBlock(cparams, prevNode) {
+		return ErrInvalidTargetBits
+	}
+	if hash := checkpointAt(cparams, prevNode.height+1); hash != nil && !bytes.Equal(block.GetBlockHash(), hash) {
+		return ErrCheckpointMismatch
+	}
+	return nil
+}
+
+func createGenesisNode(genesis *Block) *BNode {
+	node := &BNode{
 		previousBNode: nil,
 		nextBNode:     nil,
-		header: &BlockHeader{
-			PreviousBlockHash: []byte{},
-			MerkleRoot:        params.GenesisMerkleRoot,
-			Timestamp:         0,
-			TargetBits:        params.GenesisTargetBits,
-			Nonce:             params.GenesisNonce,
-		},
-		isFork: false,
+		height:        0,
+		isFork:        false,
 	}
+	node.InitializeHeaderFromBlock(genesis)
+	return node
 }
 
 type Fork struct {
@@ -64,19 +107,37 @@ func (f *Fork) couldAttach(hashLink []byte) bool {
 }
 
 type Blockchain struct {
-	chain []*BNode
-	forks []*Fork
+	cparams *params.ChainParams
+	mtx     sync.RWMutex
+	chain   []*BNode
+	forks   []*Fork
+	// tipChanged is notified every time a block is appended to the main chain
+	tipChanged *notifier
+	vbCache    *versionBitsCache
+	// avChain holds the hashes of the header chain leading to the assume-valid block, indexed by height
+	avChain [][]byte
 }
 
-func CreateBlockchain() *Blockchain {
+// CreateBlockchain creates a blockchain containing only the genesis block of the network.
+// Returns ErrInvalidGenesis if the genesis constructed does not match the hash in the params.
+func CreateBlockchain(cparams *params.ChainParams) (*Blockchain, error) {
+	genesis, err := loadGenesisBlock(cparams)
+	if err != nil {
+		return nil, err
+	}
 	// initializing with genesis block
 	return &Blockchain{
-		[]*BNode{createGenesisNode()},
-		[]*Fork{},
-	}
+		cparams:    cparams,
+		chain:      []*BNode{createGenesisNode(genesis)},
+		forks:      []*Fork{},
+		tipChanged: newNotifier(),
+		vbCache:    newVersionBitsCache(),
+	}, nil
 }
 
 func (bc *Blockchain) InsertBlock(block *Block, height uint32) error {
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
 
 	if height > uint32(len(bc.chain)) || height <= 0 {
 		// handling blocks with invalid height
@@ -88,8 +149,14 @@ func (bc *Blockchain) InsertBlock(block *Block, height uint32) error {
 		conflictNode := bc.chain[height]
 		// if they are both linked to the same previous node, then an new fork should be created
 		if bytes.Equal(block.header.PreviousBlockHash, conflictNode.header.PreviousBlockHash) {
+			if height <= bc.lastCheckpointHeight() {
+				return ErrForkBeforeCheckpoint
+			}
 
-			// validating header only for new block
+			// the target bits are checked against the expected ones before the header is validated with them
+			if err := checkHeaderContext(bc.cparams, block, conflictNode.previousBNode); err != nil {
+				return err
+			}
 			if err := ValidateBlockHeader(block.GetBlockHeader()); err != nil {
 				return err
 			}
@@ -122,9 +189,16 @@ func (bc *Blockchain) InsertBlock(block *Block, height uint32) error {
 			if !f.couldReach(height) {
 				continue
 			}
-			if f.couldAttach(block.header.GetHash()) {
+			if f.couldAttach(block.header.PreviousBlockHash) {
+				// the main chain may have reached a checkpoint after the fork was created
+				if f.forkRoot.height <= bc.lastCheckpointHeight() {
+					return ErrForkBeforeCheckpoint
+				}
 				// if block is compatible with this fork, check for valid header
 				// this will check header synta/structure and if the target is reached
+				if err := checkHeaderContext(bc.cparams, block, f.forkHead); err != nil {
+					return err
+				}
 				if err := ValidateBlockHeader(block.GetBlockHeader()); err != nil {
 					return err
 				}
@@ -151,12 +225,21 @@ func (bc *Blockchain) InsertBlock(block *Block, height uint32) error {
 
 	}
 	// handling regular block insertion at the end of the chain
+	return bc.appendBlock(block, height, true)
+}
+
+// appendBlock validates the block and connects it on top of the main chain, writing it to the block storage if store is set
+func (bc *Blockchain) appendBlock(block *Block, height uint32, store bool) error {
 	// checking if link is correct
 	lastnode := bc.chain[len(bc.chain)-1]
 	if !bytes.Equal(block.header.PreviousBlockHash, lastnode.header.GetHash()) {
 		return ErrInvalidLink
 	}
-	if err := ValidateBlock(block, height); err != nil {
+	if err := checkHeaderContext(bc.cparams, block, lastnode); err != nil {
+		return err
+	}
+	// the signatures of the ancestors of the assume-valid block are not verified, the UTXOs are still checked
+	if err := validateBlock(bc.cparams, block, height, !bc.assumedValid(block, height)); err != nil {
 		return err
 	}
 	// creating new node
@@ -172,23 +255,82 @@ func (bc *Blockchain) InsertBlock(block *Block, height uint32) error {
 	lastnode.nextBNode = newnode
 
 	// by now the block has been confirmed, it should be written in storage
-	if err := BStorage.WriteBlock(block, height); err != nil {
-		return err
+	if store {
+		if err := BStorage.WriteBlock(block, height); err != nil {
+			return bc.abortAppend(lastnode, err)
+		}
 	}
 	// confirming block as valid will remove UTXOs used in this block
-	// and add the new UTXOs created in this block to the chainstate
-	if err := block.ConfirmAsValid(); err != nil {
-		return err
+	// and add the new UTXOs created in this block to the chainstate.
+	// When the storage shares a journal with the chainstate, the block records are committed along with them.
+	if err := block.ConfirmAsValid(height); err != nil {
+		return bc.abortAppend(lastnode, err)
 	}
+	// the new node is now the tip of the main chain
+	bc.chain = append(bc.chain, newnode)
+	bc.tipChanged.notify()
 
 	// removing transactions from the mempool
 	mempool.RemoveBlock(block)
 	return nil
 }
 
+// abortAppend unlinks the node appended after lastnode and drops the changes staged for it,
+// so that the records of the failed block are not committed along with the next one
+func (bc *Blockchain) abortAppend(lastnode *BNode, err error) error {
+	lastnode.nextBNode = nil
+	cstate.DiscardBatchTX()
+	return err
+}
+
+// initBlockHeader creates the header of a new block to be mined on top of the current tip and returns the tip height
+func (bc *Blockchain) initBlockHeader(block *Block) uint32 {
+	bc.mtx.RLock()
+	defer bc.mtx.RUnlock()
+	lastnode := bc.chain[len(bc.chain)-1]
+	tipHeight := uint32(len(bc.chain) - 1)
+	block.header = &BlockHeader{
+		Version:           bc.computeBlockVersion(lastnode),
+		PreviousBlockHash: lastnode.header.GetHash(),
+		Timestamp:         blockTimestamp(lastnode),
+		TargetBits:        GetTargetForBlock(bc.cparams, lastnode),
+		Nonce:             0,
+	}
+	return tipHeight
+}
+
+// blockTimestamp returns the timestamp for a new block on top of prevNode, the adjusted time unless
+// it is not after the median-time-past
+func blockTimestamp(prevNode *BNode) int64 {
+	minTime := prevNode.MedianTimePast() + 1
+	if now := AdjustedTime(); now > minTime {
+		return now
+	}
+	return minTime
+}
+
+// Params returns the parameters of the network this blockchain belongs to
+func (bc *Blockchain) Params() *params.ChainParams {
+	return bc.cparams
+}
+
 func (bc *Blockchain) GetHeaderAt(index uint32) (*BlockHeader, bool) {
+	bc.mtx.RLock()
+	defer bc.mtx.RUnlock()
+	return bc.getHeaderAt(index)
+}
+
+// getHeaderAt is the same as GetHeaderAt, without acquiring the lock
+func (bc *Blockchain) getHeaderAt(index uint32) (*BlockHeader, bool) {
 	if index < uint32(len(bc.chain)) {
 		return bc.chain[index].header, true
 	}
 	return nil, false
 }
+
+// GetTip returns the last node of the main chain
+func (bc *Blockchain) GetTip() *BNode {
+	bc.mtx.RLock()
+	defer bc.mtx.RUnlock()
+	return bc.chain[len(bc.chain)-1]
+}
@@ -0,0 +1,144 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"plairo/params"
+	"plairo/utils"
+	"testing"
+)
+
+// solveOnNode creates a block linked to prevNode and solves it for the target bits given
+func solveOnNode(t *testing.T, cparams *params.ChainParams, prevNode *BNode, timestamp int64, targetBits uint32) *Block {
+	_, pubkey, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+	b := NewBlock(nil)
+	b.header = &BlockHeader{
+		PreviousBlockHash: prevNode.header.GetHash(),
+		Timestamp:         timestamp,
+		TargetBits:        targetBits,
+	}
+	if err := b.prepareForMining(cparams, prevNode.height, pubkey); err != nil {
+		t.Fatalf("Error preparing block: %v\n", err)
+	}
+	target := utils.ExpandBits(utils.SerializeUint32(targetBits, false))
+	for bytes.Compare(b.header.GetHash(), target) >= 0 {
+		b.header.Nonce++
+	}
+	return b
+}
+
+func TestBlockchain_InsertBlockTargetBits(t *testing.T) {
+	oldcstate := initTestCState()
+	defer resetTestCState(oldcstate)
+	oldmp := initTestMempool()
+	defer resetTestMempool(oldmp)
+	oldstorage := initTestStorage()
+	defer resetTestStorage(oldstorage)
+
+	const bits = 0x1f00ffff
+	bc := createTestBlockchain(bits)
+	genesis := bc.chain[0]
+	now := AdjustedTime()
+
+	// Test Case #1: block on the main chain declaring an easier target
+	b := solveOnNode(t, bc.cparams, genesis, now, 0x2000ffff)
+	if err := bc.InsertBlock(b, 1); !errors.Is(err, ErrInvalidTargetBits) {
+		t.Errorf("Expected ErrInvalidTargetBits, got %v\n", err)
+	}
+	if err := bc.InsertBlock(solveOnNode(t, bc.cparams, genesis, now, bits), 1); err != nil {
+		t.Fatalf("Expected block #1 to be accepted, got %v\n", err)
+	}
+	if err := bc.InsertBlock(solveOnNode(t, bc.cparams, bc.chain[1], now+1, bits), 2); err != nil {
+		t.Fatalf("Expected block #2 to be accepted, got %v\n", err)
+	}
+
+	// Test Case #2: block creating a fork declaring an easier target
+	b = solveOnNode(t, bc.cparams, genesis, now+2, 0x2000ffff)
+	if err := bc.InsertBlock(b, 1); !errors.Is(err, ErrInvalidTargetBits) {
+		t.Errorf("Expected ErrInvalidTargetBits, got %v\n", err)
+	}
+	forkRoot := solveOnNode(t, bc.cparams, genesis, now+2, bits)
+	if err := bc.InsertBlock(forkRoot, 1); err != nil {
+		t.Fatalf("Expected fork block to be accepted, got %v\n", err)
+	}
+
+	// Test Case #3: block extending the fork declaring an easier target
+	forkNode := bc.forks[0].forkHead
+	b = solveOnNode(t, bc.cparams, forkNode, now+3, 0x2000ffff)
+	if err := bc.InsertBlock(b, 2); !errors.Is(err, ErrInvalidTargetBits) {
+		t.Errorf("Expected ErrInvalidTargetBits, got %v\n", err)
+	}
+	b = solveOnNode(t, bc.cparams, forkNode, now+3, bits)
+	if err := bc.InsertBlock(b, 2); err != nil {
+		t.Fatalf("Expected block extending the fork to be accepted, got %v\n", err)
+	}
+	if !bytes.Equal(bc.forks[0].forkHead.header.GetHash(), b.GetBlockHash()) || bc.forks[0].maxHeight != 2 {
+		t.Errorf("Fork was not extended.\n")
+	}
+}
+
+func TestBlockchain_InsertBlockDiscardsOnFailure(t *testing.T) {
+	oldcstate := initTestCState()
+	defer resetTestCState(oldcstate)
+	oldmp := initTestMempool()
+	defer resetTestMempool(oldmp)
+	oldstorage := initTestStorage()
+	defer resetTestStorage(oldstorage)
+
+	const bits = 0x2000ffff
+	bc := createTestBlockchain(bits)
+	genesis := bc.chain[0]
+	mock := cstate.(*mockChainstate)
+
+	// the chainstate cannot be written, the staged records of the block should be dropped
+	mock.writeErr = errors.New("write failed")
+	b := solveOnNode(t, bc.cparams, genesis, AdjustedTime(), bits)
+	if err := bc.InsertBlock(b, 1); !errors.Is(err, mock.writeErr) {
+		t.Fatalf("Expected the write error, got %v\n", err)
+	}
+	if mock.discarded != 1 {
+		t.Errorf("Expected the staged batches to be discarded once, got %d\n", mock.discarded)
+	}
+	if len(bc.chain) != 1 || genesis.nextBNode != nil {
+		t.Errorf("Failed block was linked to the main chain.\n")
+	}
+
+	// the same block connects once the chainstate can be written again
+	mock.writeErr = nil
+	if err := bc.InsertBlock(b, 1); err != nil {
+		t.Fatalf("Expected block #1 to be accepted, got %v\n", err)
+	}
+	if mock.discarded != 1 || len(bc.chain) != 2 {
+		t.Errorf("Block #1 was not connected.\n")
+	}
+}
+
+func TestBlockchain_InsertBlockInvalidCompactBits(t *testing.T) {
+	oldcstate := initTestCState()
+	defer resetTestCState(oldcstate)
+	oldmp := initTestMempool()
+	defer resetTestMempool(oldmp)
+	oldstorage := initTestStorage()
+	defer resetTestStorage(oldstorage)
+
+	const bits = 0x2000ffff
+	bc := createTestBlockchain(bits)
+	genesis := bc.chain[0]
+	now := AdjustedTime()
+	if err := bc.InsertBlock(solveOnNode(t, bc.cparams, genesis, now, bits), 1); err != nil {
+		t.Fatalf("Expected block #1 to be accepted, got %v\n", err)
+	}
+
+	// bits with an exponent that does not fit in a hash should be rejected without being expanded
+	b := solveOnNode(t, bc.cparams, genesis, now+1, bits)
+	b.header.TargetBits = 0x21000001
+	if err := bc.InsertBlock(b, 1); !errors.Is(err, ErrInvalidTargetBits) {
+		t.Errorf("Expected ErrInvalidTargetBits for a fork block, got %v\n", err)
+	}
+	if err := ValidateBlockHeader(b.GetBlockHeader()); !errors.Is(err, ErrInvalidCompactBits) {
+		t.Errorf("Expected ErrInvalidCompactBits, got %v\n", err)
+	}
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"plairo/params"
+)
+
+var ErrCheckpointMismatch = errors.New("block does not match the checkpoint at its height")
+var ErrForkBeforeCheckpoint = errors.New("fork starts before the last checkpoint")
+var ErrInvalidHeaderChain = errors.New("headers do not link the genesis to the assume-valid block")
+
+// checkpointAt returns the hash the block at the height given is required to have, nil if there is none
+func checkpointAt(cparams *params.ChainParams, height uint32) []byte {
+	for _, cp := range cparams.Checkpoints {
+		if cp.Height == height {
+			return cp.Hash
+		}
+	}
+	// the assume-valid block should be enforced, otherwise invalid signatures could be accepted below it
+	if len(cparams.AssumeValid.Hash) != 0 && cparams.AssumeValid.Height == height {
+		return cparams.AssumeValid.Hash
+	}
+	return nil
+}
+
+// assumedValid checks if the block at the height given is part of the header chain known to lead to the
+// assume-valid block, so that the verification of its signatures can be skipped. Until that chain is known,
+// blocks are verified fully, a fork below the assume-valid height is never trusted.
+func (bc *Blockchain) assumedValid(block *Block, height uint32) bool {
+	return height < uint32(len(bc.avChain)) && bytes.Equal(bc.avChain[height], block.GetBlockHash())
+}
+
+// SetAssumeValidChain records the headers from height 1 up to the assume-valid block, as received by a header sync,
+// so that the signatures of the blocks of that chain are not verified when they are connected. The headers should
+// link to the genesis and to each other and the last one should be the assume-valid block.
+func (bc *Blockchain) SetAssumeValidChain(headers []*BlockHeader) error {
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	av := bc.cparams.AssumeValid
+	if len(av.Hash) == 0 || uint32(len(headers)) != av.Height {
+		return ErrInvalidHeaderChain
+	}
+	hashes := make([][]byte, 1, len(headers)+1)
+	hashes[0] = bc.chain[0].header.GetHash()
+	for _, header := range headers {
+		if !bytes.Equal(header.PreviousBlockHash, hashes[len(hashes)-1]) {
+			return ErrInvalidHeaderChain
+		}
+		if err := ValidateBlockHeader(header.Serialize()); err != nil {
+			return err
+		}
+		hashes = append(hashes, header.GetHash())
+	}
+	if !bytes.Equal(hashes[len(hashes)-1], av.Hash) {
+		return ErrInvalidHeaderChain
+	}
+	bc.avChain = hashes
+	return nil
+}
+
+// setAssumeValidNodes records the header chain leading to the assume-valid block from the nodes of a chain,
+// if the assume-valid block is part of it
+func (bc *Blockchain) setAssumeValidNodes(chain []*BNode) {
+	av := bc.cparams.AssumeValid
+	if len(av.Hash) == 0 || av.Height >= uint32(len(chain)) || !bytes.Equal(chain[av.Height].header.GetHash(), av.Hash) {
+		return
+	}
+	hashes := make([][]byte, av.Height+1)
+	for i := range hashes {
+		hashes[i] = chain[i].header.GetHash()
+	}
+	bc.avChain = hashes
+}
+
+// lastCheckpointHeight returns the height of the last checkpoint the main chain has reached.
+// The genesis is always a checkpoint, so 0 is returned if no other checkpoint was reached.
+func (bc *Blockchain) lastCheckpointHeight() uint32 {
+	var last uint32
+	for _, cp := range bc.cparams.Checkpoints {
+		if cp.Height < uint32(len(bc.chain)) && cp.Height > last {
+			last = cp.Height
+		}
+	}
+	return last
+}
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"plairo/params"
+	"plairo/utils"
+	"testing"
+)
+
+func TestBlockchain_InsertBlockCheckpoints(t *testing.T) {
+	oldcstate := initTestCState()
+	defer resetTestCState(oldcstate)
+	oldmp := initTestMempool()
+	defer resetTestMempool(oldmp)
+	oldstorage := initTestStorage()
+	defer resetTestStorage(oldstorage)
+
+	const bits = 0x207fffff
+	bc := createTestBlockchain(bits)
+	genesis := bc.chain[0]
+	now := AdjustedTime()
+
+	// Test Case #1: block not matching the checkpoint at its height
+	bc.cparams.Checkpoints = []params.Checkpoint{{Height: 1, Hash: make([]byte, 32)}}
+	if err := bc.InsertBlock(solveOnNode(t, bc.cparams, genesis, now, bits), 1); !errors.Is(err, ErrCheckpointMismatch) {
+		t.Errorf("Expected ErrCheckpointMismatch, got %v\n", err)
+	}
+
+	// Test Case #2: blocks matching the checkpoint are accepted
+	b1 := solveOnNode(t, bc.cparams, genesis, now, bits)
+	bc.cparams.Checkpoints = []params.Checkpoint{{Height: 1, Hash: b1.GetBlockHash()}}
+	if err := bc.InsertBlock(b1, 1); err != nil {
+		t.Fatalf("Expected block #1 to be accepted, got %v\n", err)
+	}
+	if err := bc.InsertBlock(solveOnNode(t, bc.cparams, bc.chain[1], now+1, bits), 2); err != nil {
+		t.Fatalf("Expected block #2 to be accepted, got %v\n", err)
+	}
+
+	// Test Case #3: forks replacing the checkpoint are rejected, forks after it are accepted
+	if err := bc.InsertBlock(solveOnNode(t, bc.cparams, genesis, now+2, bits), 1); !errors.Is(err, ErrForkBeforeCheckpoint) {
+		t.Errorf("Expected ErrForkBeforeCheckpoint, got %v\n", err)
+	}
+	fork := solveOnNode(t, bc.cparams, bc.chain[1], now+2, bits)
+	if err := bc.InsertBlock(fork, 2); err != nil {
+		t.Fatalf("Expected fork after the checkpoint to be accepted, got %v\n", err)
+	}
+
+	// Test Case #4: the fork cannot be extended after the main chain reaches a later checkpoint
+	if err := bc.InsertBlock(solveOnNode(t, bc.cparams, bc.chain[2], now+3, bits), 3); err != nil {
+		t.Fatalf("Expected block #3 to be accepted, got %v\n", err)
+	}
+	bc.cparams.Checkpoints = append(bc.cparams.Checkpoints, params.Checkpoint{Height: 3, Hash: bc.chain[3].header.GetHash()})
+	forkNode := bc.forks[0].forkHead
+	if err := bc.InsertBlock(solveOnNode(t, bc.cparams, forkNode, now+4, bits), 3); !errors.Is(err, ErrForkBeforeCheckpoint) {
+		t.Errorf("Expected ErrForkBeforeCheckpoint, got %v\n", err)
+	}
+}
+
+func TestBlockchain_InsertBlockAssumeValid(t *testing.T) {
+	oldcstate := initTestCState()
+	defer resetTestCState(oldcstate)
+	oldmp := initTestMempool()
+	defer resetTestMempool(oldmp)
+	oldstorage := initTestStorage()
+	defer resetTestStorage(oldstorage)
+
+	_, pubkey, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+	otherkey, _, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+
+	const bits = 0x207fffff
+	bc := createTestBlockchain(bits)
+	now := AdjustedTime()
+
+	// a block containing a transaction signed with the wrong key
+	basetx := NewTransaction(createTestInputs(createTestOutputs(2, 0x01, nil, nil)), createTestOutputs(2, 0x02, nil, pubkey))
+	cstate.InsertBatchTX(basetx)
+	tx := NewTransaction(createTestInputs(createTestOutputs(2, 0x02, basetx.TXID, pubkey)), createTestOutputs(1, 0x03, nil, nil))
+	signTestInputs(tx, otherkey)
+	b := solveOnNode(t, bc.cparams, bc.chain[0], now, bits)
+	b.allBlockTx = append(b.allBlockTx, tx)
+	b.ComputeMerkleRoot()
+	for ValidateBlockHeader(b.GetBlockHeader()) != nil {
+		b.header.Nonce++
+	}
+
+	// Test Case #1: signatures are verified without assume-valid
+	if err := bc.InsertBlock(b, 1); !errors.Is(err, ErrInvalidSignatureProvided) {
+		t.Fatalf("Expected ErrInvalidSignatureProvided, got %v\n", err)
+	}
+
+	// Test Case #2: a block below the assume-valid height is verified fully if it does not lead to the assume-valid block
+	bc.cparams.AssumeValid = params.Checkpoint{Height: 2, Hash: make([]byte, 32)}
+	if err := bc.InsertBlock(b, 1); !errors.Is(err, ErrInvalidSignatureProvided) {
+		t.Fatalf("Expected ErrInvalidSignatureProvided below an unknown assume-valid chain, got %v\n", err)
+	}
+	if err := bc.SetAssumeValidChain([]*BlockHeader{b.header, b.header}); !errors.Is(err, ErrInvalidHeaderChain) {
+		t.Errorf("Expected ErrInvalidHeaderChain for headers not leading to the assume-valid block, got %v\n", err)
+	}
+	if _, ok := cstate.GetUtxo(basetx.TXID, 0); !ok {
+		t.Errorf("Expected the UTXOs of the rejected block to be kept.\n")
+	}
+
+	// Test Case #3: the signatures of the blocks of the header chain leading to the assume-valid block are not verified
+	bc.cparams.AssumeValid = params.Checkpoint{Height: 1, Hash: b.GetBlockHash()}
+	if err := bc.SetAssumeValidChain([]*BlockHeader{b.header}); err != nil {
+		t.Fatalf("Error setting the assume-valid chain: %v\n", err)
+	}
+	if err := bc.InsertBlock(b, 1); err != nil {
+		t.Fatalf("Expected block #1 to be accepted, got %v\n", err)
+	}
+	if _, ok := cstate.GetUtxo(basetx.TXID, 0); ok {
+		t.Errorf("Expected the UTXOs spent to be removed from the chainstate.\n")
+	}
+
+	// Test Case #4: the assume-valid block is enforced like a checkpoint
+	bc.cparams.AssumeValid = params.Checkpoint{Height: 2, Hash: make([]byte, 32)}
+	m := NewMiner(bc, pubkey, 1)
+	if _, err := m.Generate(context.Background(), 1); !errors.Is(err, ErrCheckpointMismatch) {
+		t.Errorf("Expected ErrCheckpointMismatch, got %v\n", err)
+	}
+}
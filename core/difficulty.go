@@ -0,0 +1,131 @@
+package core
+
+import (
+	"fmt"
+	"math/big"
+	"plairo/params"
+	"plairo/utils"
+)
+
+// DifficultyAlgorithm calculates the target of new blocks
+type DifficultyAlgorithm interface {
+	// NextTarget returns the target bits a block built on top of prevNode should have
+	NextTarget(cparams *params.ChainParams, prevNode *BNode) uint32
+}
+
+// difficultyAlgorithms maps the names used in ChainParams.DifficultyAlgorithm to their implementation
+var difficultyAlgorithms = map[string]DifficultyAlgorithm{
+	params.DifficultyInterval: IntervalRetarget{},
+	params.DifficultyLWMA:     LWMA{},
+	params.DifficultyFixed:    FixedDifficulty{},
+}
+
+// GetDifficultyAlgorithm returns the algorithm with the name given
+func GetDifficultyAlgorithm(name string) DifficultyAlgorithm {
+	algo, ok := difficultyAlgorithms[name]
+	if !ok {
+		panic(fmt.Sprintf("unknown difficulty algorithm %q", name))
+	}
+	return algo
+}
+
+// GetTargetForBlock returns the target bits a block built on top of prevNode should have.
+// The ancestors of prevNode are used, so the target is correct for blocks on forks as well.
+func GetTargetForBlock(cparams *params.ChainParams, prevNode *BNode) uint32 {
+	return GetDifficultyAlgorithm(cparams.DifficultyAlgorithm).NextTarget(cparams, prevNode)
+}
+
+// IntervalRetarget adjusts the target every ChainParams.RetargetInterval blocks, same as bitcoin
+type IntervalRetarget struct{}
+
+func (IntervalRetarget) NextTarget(cparams *params.ChainParams, prevNode *BNode) uint32 {
+	// checking if next block should not have adjusted difficulty
+	if (prevNode.height+1)%cparams.RetargetInterval != 0 {
+		return prevNode.header.TargetBits
+	}
+
+	// to properly get actual time needed to mine this block interval, we need to check the timestamp
+	// of the block before the block that starts the interval
+	steps := cparams.RetargetInterval
+	var timecomp uint64
+	if cparams.RetargetInterval > prevNode.height {
+		// this is true only for the first retarget that will take place
+		// it is not possible to check the timestamp of the block before the genesis
+		// since the genesis is the block that starts the interval
+		// to compensate for this, it is assumed that the genesis
+		// mining time was ideal
+		steps = prevNode.height
+		timecomp += cparams.ExpectedTimePerBlockInSec
+	}
+
+	firstNode := prevNode
+	for i := uint32(0); i < steps; i++ {
+		firstNode = firstNode.previousBNode
+	}
+	// adding time compensation (if needed) to use in calculation of actual interval time
+	return calculateTargetForBlock(cparams, prevNode.header, firstNode.header.Timestamp+int64(timecomp))
+}
+
+func calculateTargetForBlock(cparams *params.ChainParams, lastBlockHeader *BlockHeader, firstStamp int64) uint32 {
+	actualTimespan := lastBlockHeader.Timestamp - firstStamp
+	expectedTimespan := int64(cparams.ExpectedTimePerBlockInSec) * int64(cparams.RetargetInterval)
+	return utils.CalculateRetarget(lastBlockHeader.TargetBits, actualTimespan, expectedTimespan, cparams.PowLimitBits)
+}
+
+// LWMA adjusts the target every block, using a linearly weighted moving average of the solve times
+// of the last ChainParams.LWMAWindow blocks. Recent blocks have a higher weight, so the target converges quickly.
+type LWMA struct{}
+
+func (LWMA) NextTarget(cparams *params.ChainParams, prevNode *BNode) uint32 {
+	window := cparams.LWMAWindow
+	// the target stays the same until enough blocks exist, the block before the window is needed too
+	if prevNode.height < window {
+		return prevNode.header.TargetBits
+	}
+	nodes := make([]*BNode, window+1)
+	node := prevNode
+	for i := int(window); i >= 0; i-- {
+		nodes[i] = node
+		node = node.previousBNode
+	}
+
+	blockTime := int64(cparams.ExpectedTimePerBlockInSec)
+	sumTargets := new(big.Int)
+	var weightedSolveTimes int64
+	prevStamp := nodes[0].header.Timestamp
+	for i := 1; i <= int(window); i++ {
+		// timestamps going back in time are treated as a solve time of 1 second
+		stamp := nodes[i].header.Timestamp
+		if stamp <= prevStamp {
+			stamp = prevStamp + 1
+		}
+		// limiting the effect of a single timestamp far in the future
+		solveTime := stamp - prevStamp
+		if solveTime > 6*blockTime {
+			solveTime = 6 * blockTime
+		}
+		prevStamp = stamp
+		weightedSolveTimes += solveTime * int64(i)
+		sumTargets.Add(sumTargets, utils.CompactToBig(nodes[i].header.TargetBits))
+	}
+
+	// the weighted sum of solve times if every block was mined in the expected time
+	expectedWeighted := int64(window) * int64(window+1) / 2 * blockTime
+	if weightedSolveTimes < expectedWeighted/10 {
+		weightedSolveTimes = expectedWeighted / 10
+	}
+	// next target is the average target scaled by the ratio of weighted to expected solve times
+	nextTarget := sumTargets.Mul(sumTargets, big.NewInt(weightedSolveTimes))
+	nextTarget.Div(nextTarget, big.NewInt(expectedWeighted*int64(window)))
+	if limit := utils.CompactToBig(cparams.PowLimitBits); nextTarget.Cmp(limit) > 0 {
+		nextTarget = limit
+	}
+	return utils.BigToCompact(nextTarget)
+}
+
+// FixedDifficulty never adjusts the target, every block has the target of the genesis
+type FixedDifficulty struct{}
+
+func (FixedDifficulty) NextTarget(cparams *params.ChainParams, prevNode *BNode) uint32 {
+	return prevNode.header.TargetBits
+}
@@ -0,0 +1,122 @@
+package core
+
+import (
+	"math/big"
+	"plairo/params"
+	"plairo/utils"
+	"testing"
+)
+
+// createTestNodes creates a chain of nodes, each mined the solve time given after the previous one
+func createTestNodes(n int, targetBits uint32, solveTime int64) *BNode {
+	node := &BNode{header: &BlockHeader{Timestamp: 1000, TargetBits: targetBits}}
+	for i := 1; i < n; i++ {
+		node = &BNode{
+			previousBNode: node,
+			header:        &BlockHeader{Timestamp: node.header.Timestamp + solveTime, TargetBits: targetBits},
+			height:        node.height + 1,
+		}
+	}
+	return node
+}
+
+func TestIntervalRetarget_NextTarget(t *testing.T) {
+	cparams := testParams()
+	cparams.DifficultyAlgorithm = params.DifficultyInterval
+	cparams.RetargetInterval = 4
+
+	const bits = 0x1800ffff
+	expectedTimespan := int64(cparams.ExpectedTimePerBlockInSec) * int64(cparams.RetargetInterval)
+	newNode := func(prev *BNode, ts int64) *BNode {
+		n := &BNode{previousBNode: prev, header: &BlockHeader{Timestamp: ts, TargetBits: bits}}
+		if prev != nil {
+			n.height = prev.height + 1
+		}
+		return n
+	}
+	genesis := newNode(nil, 1000)
+	node1 := newNode(genesis, 1060)
+	mainHead := newNode(newNode(node1, 1120), 1180)
+	forkHead := newNode(newNode(node1, 1600), 2000)
+
+	// Test Case #1: no retarget before the end of the interval
+	if got := GetTargetForBlock(cparams, node1); got != bits {
+		t.Errorf("Expected unchanged target %08x, got %08x\n", uint32(bits), got)
+	}
+
+	// Test Case #2: first retarget on the main chain, assuming ideal genesis mining time
+	exp := utils.CalculateRetarget(bits, 1180-1000-int64(cparams.ExpectedTimePerBlockInSec), expectedTimespan, cparams.PowLimitBits)
+	if got := GetTargetForBlock(cparams, mainHead); got != exp {
+		t.Errorf("Expected main chain target %08x, got %08x\n", exp, got)
+	}
+
+	// Test Case #3: the fork uses its own timestamps
+	exp = utils.CalculateRetarget(bits, 2000-1000-int64(cparams.ExpectedTimePerBlockInSec), expectedTimespan, cparams.PowLimitBits)
+	if got := GetTargetForBlock(cparams, forkHead); got != exp {
+		t.Errorf("Expected fork target %08x, got %08x\n", exp, got)
+	}
+	if GetTargetForBlock(cparams, forkHead) == GetTargetForBlock(cparams, mainHead) {
+		t.Errorf("Expected different targets for main chain and fork.\n")
+	}
+}
+
+func TestLWMA_NextTarget(t *testing.T) {
+	cparams := testParams()
+	cparams.DifficultyAlgorithm = params.DifficultyLWMA
+	cparams.PowLimitBits = 0x1d00ffff
+	const bits = 0x1800ffff
+	blockTime := int64(cparams.ExpectedTimePerBlockInSec)
+
+	// Test Case #1: not enough blocks for the window
+	tip := createTestNodes(int(cparams.LWMAWindow), bits, blockTime/2)
+	if got := GetTargetForBlock(cparams, tip); got != bits {
+		t.Errorf("Expected unchanged target %08x, got %08x\n", uint32(bits), got)
+	}
+
+	// Test Case #2: blocks mined in the expected time
+	tip = createTestNodes(int(cparams.LWMAWindow)+1, bits, blockTime)
+	if got := GetTargetForBlock(cparams, tip); got != bits {
+		t.Errorf("Expected unchanged target %08x, got %08x\n", uint32(bits), got)
+	}
+
+	// Test Case #3: blocks mined twice as fast, target should be halved
+	tip = createTestNodes(int(cparams.LWMAWindow)+1, bits, blockTime/2)
+	exp := utils.BigToCompact(new(big.Int).Rsh(utils.CompactToBig(bits), 1))
+	if got := GetTargetForBlock(cparams, tip); got != exp {
+		t.Errorf("Expected target %08x, got %08x\n", exp, got)
+	}
+
+	// Test Case #4: slow blocks, target should not exceed the limit
+	tip = createTestNodes(int(cparams.LWMAWindow)+1, cparams.PowLimitBits, 4*blockTime)
+	if got := GetTargetForBlock(cparams, tip); got != utils.BigToCompact(utils.CompactToBig(cparams.PowLimitBits)) {
+		t.Errorf("Expected limit target, got %08x\n", got)
+	}
+
+	// Test Case #5: only the recent blocks being slower should raise the target
+	tip = createTestNodes(int(cparams.LWMAWindow)+1, bits, blockTime)
+	tip.header.Timestamp += 3 * blockTime
+	if got := GetTargetForBlock(cparams, tip); utils.CompactToBig(got).Cmp(utils.CompactToBig(bits)) <= 0 {
+		t.Errorf("Expected target higher than %08x, got %08x\n", uint32(bits), got)
+	}
+}
+
+func TestFixedDifficulty_NextTarget(t *testing.T) {
+	cparams := testParams()
+	cparams.DifficultyAlgorithm = params.DifficultyFixed
+	const bits = 0x1800ffff
+
+	// the target should stay the same even at the end of a retarget interval
+	tip := createTestNodes(int(cparams.RetargetInterval), bits, 1)
+	if got := GetTargetForBlock(cparams, tip); got != bits {
+		t.Errorf("Expected unchanged target %08x, got %08x\n", uint32(bits), got)
+	}
+}
+
+func TestGetDifficultyAlgorithm(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected panic for unknown difficulty algorithm.\n")
+		}
+	}()
+	GetDifficultyAlgorithm("unknown")
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"plairo/params"
+	"plairo/utils"
+)
+
+var ErrInvalidGenesis = errors.New("genesis block does not match the expected hash")
+
+// NewGenesisBlock constructs the genesis block of the network. The block is fully determined by the params,
+// its coinbase pays the initial subsidy to the genesis recipient.
+func NewGenesisBlock(cparams *params.ChainParams) (*Block, error) {
+	recipient, err := utils.ConvertBytesToPubKey(cparams.Genesis.RecipientPubKey)
+	if err != nil {
+		return nil, fmt.Errorf("parsing genesis recipient key: %v", err)
+	}
+	// the coinbase embeds the height of the previous block + 1, wrapping around to 0 for the genesis
+	coinbase, err := NewCoinbaseTransaction(cparams.Genesis.Message, GetBlockSubsidy(cparams, 0), recipient, math.MaxUint32)
+	if err != nil {
+		return nil, err
+	}
+	b := NewBlock([]*Transaction{coinbase})
+	b.header = &BlockHeader{
+		// the genesis signals for no deployment
+		Version: 1,
+		// there is no previous block, the hash is all zeroes
+		PreviousBlockHash: make([]byte, 32),
+		Timestamp:         cparams.Genesis.Timestamp,
+		TargetBits:        cparams.Genesis.TargetBits,
+		Nonce:             cparams.Genesis.Nonce,
+	}
+	b.ComputeMerkleRoot()
+	return b, nil
+}
+
+// loadGenesisBlock constructs the genesis block and ensures it matches the hash hard-coded in the params
+func loadGenesisBlock(cparams *params.ChainParams) (*Block, error) {
+	b, err := NewGenesisBlock(cparams)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(b.GetBlockHash(), cparams.Genesis.Hash) {
+		return nil, fmt.Errorf("%w: got %x", ErrInvalidGenesis, b.GetBlockHash())
+	}
+	return b, nil
+}
+
+// MineGenesisBlock searches for a nonce satisfying the genesis target and updates the genesis nonce and hash
+// of the params given. Used to create the genesis of new networks.
+func MineGenesisBlock(cparams *params.ChainParams) error {
+	cparams.Genesis.Nonce = 0
+	b, err := NewGenesisBlock(cparams)
+	if err != nil {
+		return err
+	}
+	target := utils.ExpandBits(utils.SerializeUint32(b.header.TargetBits, false))
+	// the timestamp is fixed, so only the nonce space is searched
+	for n := uint64(0); n <= math.MaxUint32; n++ {
+		b.header.Nonce = uint32(n)
+		if hash := b.header.GetHash(); bytes.Compare(hash, target) < 0 {
+			cparams.Genesis.Nonce = b.header.Nonce
+			cparams.Genesis.Hash = hash
+			return nil
+		}
+	}
+	return ErrStaleBlock
+}
+
+// StoreGenesis writes the genesis block to the block storage and its outputs to the chainstate.
+// Does nothing if the genesis is already stored, so it is safe to call on every start.
+func (bc *Blockchain) StoreGenesis() error {
+	genesis, err := loadGenesisBlock(bc.cparams)
+	if err != nil {
+		return err
+	}
+	if BStorage.HasBlock(genesis.GetBlockHash()) {
+		return nil
+	}
+	if err := BStorage.WriteBlock(genesis, 0); err != nil {
+		return err
+	}
+	return genesis.ConfirmAsValid(0)
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"plairo/params"
+	"testing"
+)
+
+func TestCreateBlockchain_Presets(t *testing.T) {
+	for _, cparams := range []*params.ChainParams{params.MainNetParams, params.TestNetParams, params.RegTestParams} {
+		bc, err := CreateBlockchain(cparams)
+		if err != nil {
+			t.Errorf("Error creating %s blockchain: %v\n", cparams.Name, err)
+			continue
+		}
+		genesis, _ := bc.GetHeaderAt(0)
+		if !bytes.Equal(genesis.GetHash(), cparams.Genesis.Hash) {
+			t.Errorf("Unexpected %s genesis hash %x\n", cparams.Name, genesis.GetHash())
+		}
+		if !bytes.Equal(genesis.PreviousBlockHash, make([]byte, 32)) {
+			t.Errorf("Expected %s genesis previous hash to be zero.\n", cparams.Name)
+		}
+		if err := ValidateBlockHeader(genesis.Serialize()); err != nil {
+			t.Errorf("Invalid %s genesis header: %v\n", cparams.Name, err)
+		}
+	}
+}
+
+func TestCreateBlockchain_InvalidGenesis(t *testing.T) {
+	cparams := testParams()
+	cparams.Genesis.Message = "another message"
+	if _, err := CreateBlockchain(cparams); !errors.Is(err, ErrInvalidGenesis) {
+		t.Errorf("Expected ErrInvalidGenesis, got %v\n", err)
+	}
+}
+
+func TestMineGenesisBlock(t *testing.T) {
+	cparams := testParams()
+	cparams.Genesis.Timestamp++
+	cparams.Genesis.TargetBits = 0x2000ffff
+	if err := MineGenesisBlock(cparams); err != nil {
+		t.Fatalf("Error mining genesis block: %v\n", err)
+	}
+	if bytes.Equal(cparams.Genesis.Hash, params.RegTestParams.Genesis.Hash) {
+		t.Errorf("Expected a different genesis hash.\n")
+	}
+	bc, err := CreateBlockchain(cparams)
+	if err != nil {
+		t.Fatalf("Error creating blockchain with the mined genesis: %v\n", err)
+	}
+	genesis, _ := bc.GetHeaderAt(0)
+	if err := ValidateBlockHeader(genesis.Serialize()); err != nil {
+		t.Errorf("Invalid mined genesis header: %v\n", err)
+	}
+}
+
+func TestBlockchain_StoreGenesis(t *testing.T) {
+	oldcstate := initTestCState()
+	defer resetTestCState(oldcstate)
+	oldstorage := initTestStorage()
+	defer resetTestStorage(oldstorage)
+
+	bc, err := CreateBlockchain(testParams())
+	if err != nil {
+		t.Fatalf("Error creating blockchain: %v\n", err)
+	}
+	if err := bc.StoreGenesis(); err != nil {
+		t.Fatalf("Error storing genesis: %v\n", err)
+	}
+	data, ok := BStorage.GetBlockData(params.RegTestParams.Genesis.Hash)
+	if !ok {
+		t.Fatalf("Genesis block was not written to storage.\n")
+	}
+	genesis, err := DeserializeBlock(data)
+	if err != nil {
+		t.Fatalf("Error deserializing stored genesis: %v\n", err)
+	}
+	coinbase := genesis.AllBlockTx()[0]
+	if _, ok := cstate.GetUtxo(coinbase.TXID, 0); !ok {
+		t.Errorf("Genesis coinbase output was not added to the chainstate.\n")
+	}
+
+	// storing again should not fail or rewrite the UTXOs
+	cstate.RemoveUtxo(coinbase.TXID, 0)
+	if err := bc.StoreGenesis(); err != nil {
+		t.Fatalf("Error storing genesis again: %v\n", err)
+	}
+	if _, ok := cstate.GetUtxo(coinbase.TXID, 0); ok {
+		t.Errorf("Genesis was stored twice.\n")
+	}
+}
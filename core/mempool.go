@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"plairo/utils"
+	"sync"
 )
 
 var ErrTxRecNotFound = errors.New("transaction record not found in mempool")
@@ -16,7 +17,7 @@ var ErrTxNotInMemPool = errors.New("transaction does not exist in mempool")
 var mempool *MemPool
 
 func init() {
-	mempool = &MemPool{&memTree{}, make(map[string]uint64), make(map[string]bool)}
+	mempool = newMemPool()
 }
 
 type txRecord struct {
@@ -320,16 +321,26 @@ func (mt *memTree) getMaxElements(node *memTreeNode, out chan<- interface{}, rem
 }
 
 type MemPool struct {
+	mtx            sync.Mutex
 	internalTree   *memTree
 	txmap          map[string]uint64
 	outsReferenced map[string]bool
+	// changed is notified every time a transaction is added or removed
+	changed *notifier
+}
+
+func newMemPool() *MemPool {
+	return &MemPool{internalTree: &memTree{}, txmap: make(map[string]uint64), outsReferenced: make(map[string]bool), changed: newNotifier()}
 }
 
 func (mp *MemPool) AddTX(tx *Transaction) error {
 	// validating TX before adding (this includes fee requirements)
-	if err := tx.ValidateTransaction(); err != nil {
+	// the signatures are cached, so that they are not verified again when the TX is included in a block
+	if err := tx.validateTransaction(true, true); err != nil {
 		return err
 	}
+	mp.mtx.Lock()
+	defer mp.mtx.Unlock()
 	// checking for double-spend with other transactions in the mempool
 	// two iterations will be needed again to ensure a failure at later outputs won't leave behind
 	// outputs marked as seen
@@ -349,10 +360,21 @@ func (mp *MemPool) AddTX(tx *Transaction) error {
 	mp.txmap[hex.EncodeToString(tx.TXID)] = tx.GetFees()
 	// inserting in internal tree
 	mp.internalTree.insert(tx)
+	mp.changed.notify()
 	return nil
 }
 
 func (mp *MemPool) RemoveTX(tx *Transaction) error {
+	mp.mtx.Lock()
+	defer mp.mtx.Unlock()
+	if err := mp.removeTX(tx); err != nil {
+		return err
+	}
+	mp.changed.notify()
+	return nil
+}
+
+func (mp *MemPool) removeTX(tx *Transaction) error {
 	// checking if transaction exists in mempool before trying to remove from internal tree
 	if _, ok := mp.txmap[hex.EncodeToString(tx.TXID)]; !ok {
 		return ErrTxNotInMemPool
@@ -369,16 +391,26 @@ func (mp *MemPool) RemoveTX(tx *Transaction) error {
 }
 
 func (mp *MemPool) RemoveBlock(block *Block) {
+	mp.mtx.Lock()
+	defer mp.mtx.Unlock()
+	removed := false
 	for i, tx := range block.allBlockTx {
 		// coinbase cannot exist in mempool, no point in checking
 		if i == 0 {
 			continue
 		}
 		// does not matter if the TX does not exist in mempool, removing those that do
-		mp.RemoveTX(tx)
+		if mp.removeTX(tx) == nil {
+			removed = true
+		}
+	}
+	if removed {
+		mp.changed.notify()
 	}
 }
 
 func (mp *MemPool) GetMaxTXs(out chan<- interface{}, noOfTxToGet int) {
+	mp.mtx.Lock()
+	defer mp.mtx.Unlock()
 	mp.internalTree.getMaxElements(mp.internalTree.root, out, &noOfTxToGet)
 }
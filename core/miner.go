@@ -0,0 +1,186 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"plairo/params"
+	"plairo/utils"
+)
+
+// hashesPerCheck is the number of hashes a worker calculates before checking for cancellation
+const hashesPerCheck = 4096
+
+// Miner mines blocks on top of the current tip of a blockchain, splitting the search space across
+// multiple worker goroutines.
+type Miner struct {
+	// hashes is placed first to guarantee 64-bit alignment for atomic operations
+	hashes    uint64
+	startedAt int64
+
+	bchain   *Blockchain
+	minerKey *ecdsa.PublicKey
+	workers  int
+}
+
+// NewMiner creates a new miner paying the block rewards to minerKey. If workers is not positive,
+// one worker per available CPU will be used.
+func NewMiner(bchain *Blockchain, minerKey *ecdsa.PublicKey, workers int) *Miner {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &Miner{bchain: bchain, minerKey: minerKey, workers: workers}
+}
+
+// MineBlock mines the block on top of the current tip and inserts it in the blockchain.
+// Mining stops when ctx is cancelled, which should happen when a competing block arrives.
+func (m *Miner) MineBlock(ctx context.Context, block *Block) error {
+	tipHeight := m.bchain.initBlockHeader(block)
+	if err := block.prepareForMining(m.bchain.cparams, tipHeight, m.minerKey); err != nil {
+		return err
+	}
+
+	// resetting the hash rate counters for this run
+	atomic.StoreUint64(&m.hashes, 0)
+	atomic.StoreInt64(&m.startedAt, time.Now().UnixNano())
+
+	if err := solveBlock(ctx, block, m.workers, &m.hashes); err != nil {
+		return err
+	}
+
+	// the block may still be rejected if the tip changed after mining started
+	return m.bchain.InsertBlock(block, tipHeight+1)
+}
+
+// Generate mines n blocks on top of the current tip, filling each one with the transactions of the mempool,
+// and returns their hashes. Meant for regtest, where the target is easy enough for blocks to be mined instantly.
+func (m *Miner) Generate(ctx context.Context, n int) ([][]byte, error) {
+	hashes := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		b := NewBlock(selectTemplateTXs(params.MaxNumberOfTXsInBlock))
+		if err := m.MineBlock(ctx, b); err != nil {
+			return hashes, err
+		}
+		hashes = append(hashes, b.GetBlockHash())
+	}
+	return hashes, nil
+}
+
+// HashRate returns the hashes per second calculated since the last mining run started
+func (m *Miner) HashRate() float64 {
+	started := atomic.LoadInt64(&m.startedAt)
+	if started == 0 {
+		return 0
+	}
+	elapsed := time.Since(time.Unix(0, started)).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(atomic.LoadUint64(&m.hashes)) / elapsed
+}
+
+// solution holds the header and the coinbase transaction of a solved block
+type solution struct {
+	header   *BlockHeader
+	coinbase *Transaction
+}
+
+// solveBlock searches for a header satisfying the block target using the number of workers given.
+// The extra-nonce space is split so that worker i tries extra-nonces i, i+workers, i+2*workers etc.,
+// searching the whole nonce space for each one. On success, the header and coinbase of the block are replaced.
+// If counter is not nil, it is atomically incremented with the number of hashes calculated.
+func solveBlock(ctx context.Context, b *Block, workers int, counter *uint64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the merkle branch of the coinbase is computed once, since the rest of the transactions never change
+	txids := make([][]byte, len(b.allBlockTx))
+	for i, tx := range b.allBlockTx {
+		txids[i] = tx.TXID
+	}
+	branch := utils.ComputeMerkleBranch(txids, 0)
+
+	// buffering so that the worker finding a solution never blocks
+	found := make(chan *solution, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		// every worker operates on its own copy of the header and the coinbase
+		hcopy := *b.header
+		go func(wsol *solution, start uint64) {
+			defer wg.Done()
+			if searchNonce(ctx, wsol, branch, start, uint64(workers), counter) {
+				found <- wsol
+			}
+		}(&solution{&hcopy, b.allBlockTx[0].copyCoinbase()}, uint64(i))
+	}
+
+	// closing the channel after all workers have returned, so that exhaustion can be detected
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
+
+	res, ok := <-found
+	if !ok {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return ErrStaleBlock
+	}
+	// stopping the rest of the workers
+	cancel()
+	b.header = res.header
+	b.allBlockTx[0] = res.coinbase
+	return nil
+}
+
+// searchNonce tries every nonce for each extra-nonce starting from start with the given step.
+// Only the coinbase branch is hashed to get the merkle root when the extra-nonce changes.
+// Returns false if no solution was found or ctx was cancelled.
+func searchNonce(ctx context.Context, sol *solution, branch [][]byte, start, step uint64, counter *uint64) bool {
+	header := sol.header
+	target := utils.ExpandBits(utils.SerializeUint32(header.TargetBits, false))
+	var sinceCheck uint64
+	for extraNonce := start; ; extraNonce += step {
+		sol.coinbase.setExtraNonce(extraNonce)
+		header.MerkleRoot = utils.ComputeMerkleRootFromBranch(sol.coinbase.TXID, branch, 0)
+		// refreshing the timestamp, since the previous extra-nonce may have taken a while
+		if now := AdjustedTime(); now > header.Timestamp {
+			header.Timestamp = now
+		}
+
+		for n := uint64(0); n <= math.MaxUint32; n++ {
+			header.Nonce = uint32(n)
+			if bytes.Compare(header.GetHash(), target) < 0 {
+				addHashes(counter, sinceCheck+1)
+				return true
+			}
+			sinceCheck++
+			if sinceCheck == hashesPerCheck {
+				addHashes(counter, sinceCheck)
+				sinceCheck = 0
+				if ctx.Err() != nil {
+					return false
+				}
+			}
+		}
+		// checking if the extra-nonce space of this worker is exhausted
+		if extraNonce > math.MaxUint64-step {
+			addHashes(counter, sinceCheck)
+			return false
+		}
+	}
+}
+
+func addHashes(counter *uint64, n uint64) {
+	if counter != nil {
+		atomic.AddUint64(counter, n)
+	}
+}
@@ -0,0 +1,258 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"plairo/params"
+	"plairo/utils"
+	"testing"
+	"time"
+)
+
+// mocking the block storage, also used as the BlockReader of the stored blocks
+type mockStorage struct {
+	blocks  map[string][]byte
+	undo    map[string][]byte
+	heights map[string]uint32
+	tip     []byte
+	// disconnected holds the hashes of the blocks passed to DisconnectBlock
+	disconnected [][]byte
+}
+
+func newMockStorage() *mockStorage {
+	return &mockStorage{
+		blocks:  make(map[string][]byte),
+		undo:    make(map[string][]byte),
+		heights: make(map[string]uint32),
+	}
+}
+
+func (ms *mockStorage) WriteBlock(block IBlock, height uint32) error {
+	ms.blocks[string(block.GetBlockHash())] = block.Serialize()
+	ms.undo[string(block.GetBlockHash())], _ = block.GetUndoData()
+	ms.heights[string(block.GetBlockHash())] = height
+	ms.tip = block.GetBlockHash()
+	return nil
+}
+
+func (ms *mockStorage) GetBlockData(bkey []byte) ([]byte, bool) {
+	data, ok := ms.blocks[string(bkey)]
+	return data, ok
+}
+
+func (ms *mockStorage) HasBlock(bkey []byte) bool {
+	_, ok := ms.blocks[string(bkey)]
+	return ok
+}
+
+func (ms *mockStorage) DisconnectBlock(block IBlock) error {
+	ms.disconnected = append(ms.disconnected, block.GetBlockHash())
+	return nil
+}
+
+func (ms *mockStorage) GetBestBlock() ([]byte, bool) {
+	return ms.tip, ms.tip != nil
+}
+
+func (ms *mockStorage) ReadBlockHeader(bkey []byte) (*BlockHeader, uint32, error) {
+	block, err := ms.ReadBlock(bkey)
+	if err != nil {
+		return nil, 0, err
+	}
+	return block.header, ms.heights[string(bkey)], nil
+}
+
+func (ms *mockStorage) ReadBlock(bkey []byte) (*Block, error) {
+	data, ok := ms.blocks[string(bkey)]
+	if !ok {
+		return nil, ErrInvalidBlockData
+	}
+	return DeserializeBlock(data)
+}
+
+func (ms *mockStorage) ReadUndo(bkey []byte) ([]byte, error) {
+	undo, ok := ms.undo[string(bkey)]
+	if !ok {
+		return nil, ErrInvalidUndoData
+	}
+	return undo, nil
+}
+
+func initTestStorage() iStorage {
+	old := BStorage
+	BStorage = newMockStorage()
+	return old
+}
+
+func resetTestStorage(old iStorage) {
+	BStorage = old
+}
+
+// testParams returns a copy of the regtest params, so that tests can change them freely
+func testParams() *params.ChainParams {
+	cparams := *params.RegTestParams
+	return &cparams
+}
+
+// createTestBlockchain creates a blockchain whose genesis uses the target bits given.
+// The genesis header is changed after creation, since the target may be impossible to mine.
+func createTestBlockchain(targetBits uint32) *Blockchain {
+	bc, err := CreateBlockchain(testParams())
+	if err != nil {
+		panic(err)
+	}
+	bc.chain[0].header.TargetBits = targetBits
+	return bc
+}
+
+func TestMiner_MineBlock(t *testing.T) {
+	oldcstate := initTestCState()
+	defer resetTestCState(oldcstate)
+	oldmp := initTestMempool()
+	defer resetTestMempool(oldmp)
+	oldstorage := initTestStorage()
+	defer resetTestStorage(oldstorage)
+
+	_, pubkey, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+
+	// using an easy target, so that a solution is found almost immediately
+	bc := createTestBlockchain(0x2000ffff)
+	m := NewMiner(bc, pubkey, 4)
+
+	for i := 1; i <= 3; i++ {
+		b := NewBlock(nil)
+		if err := m.MineBlock(context.Background(), b); err != nil {
+			t.Fatalf("Error mining block #%d: %v\n", i, err)
+		}
+		header, ok := bc.GetHeaderAt(uint32(i))
+		if !ok {
+			t.Fatalf("Block #%d was not inserted in the blockchain.\n", i)
+		}
+		if !bytes.Equal(header.GetHash(), b.GetBlockHash()) {
+			t.Errorf("Unexpected header at height %d.\n", i)
+		}
+		if _, ok := BStorage.GetBlockData(b.GetBlockHash()); !ok {
+			t.Errorf("Block #%d was not written in storage.\n", i)
+		}
+	}
+	if m.HashRate() <= 0 {
+		t.Errorf("Expected positive hash rate, got %f.\n", m.HashRate())
+	}
+}
+
+func TestMiner_MineBlockCancel(t *testing.T) {
+	oldcstate := initTestCState()
+	defer resetTestCState(oldcstate)
+	oldmp := initTestMempool()
+	defer resetTestMempool(oldmp)
+
+	_, pubkey, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+
+	// a zero target can never be reached, mining should only stop after cancelling
+	bc := createTestBlockchain(0x00000000)
+	m := NewMiner(bc, pubkey, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := m.MineBlock(ctx, NewBlock(nil)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected mining to be cancelled, got: %v\n", err)
+	}
+	if _, ok := bc.GetHeaderAt(1); ok {
+		t.Errorf("Cancelled block should not be inserted.\n")
+	}
+}
+
+func TestBlock_MineBlock(t *testing.T) {
+	oldcstate := initTestCState()
+	defer resetTestCState(oldcstate)
+	oldmp := initTestMempool()
+	defer resetTestMempool(oldmp)
+
+	_, pubkey, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+	b := NewBlock(nil)
+	b.header = &BlockHeader{PreviousBlockHash: make([]byte, 32), TargetBits: 0x2000ffff}
+	if err := b.MineBlock(testParams(), 0, pubkey); err != nil {
+		t.Fatalf("Error mining block: %v\n", err)
+	}
+	if b.header.Timestamp == 0 {
+		t.Errorf("Expected block to be timestamped.\n")
+	}
+	if err := ValidateBlockHeader(b.GetBlockHeader()); err != nil {
+		t.Errorf("Mined block has invalid header: %v\n", err)
+	}
+	// the merkle root computed from the coinbase branch should match the full computation
+	if !bytes.Equal(b.header.MerkleRoot, b.generateBlockMerkleRoot()) {
+		t.Errorf("Invalid merkle root for mined block.\n")
+	}
+}
+
+func TestMiner_Generate(t *testing.T) {
+	oldcstate := initTestCState()
+	defer resetTestCState(oldcstate)
+	oldmp := initTestMempool()
+	defer resetTestMempool(oldmp)
+	oldstorage := initTestStorage()
+	defer resetTestStorage(oldstorage)
+
+	privkey, pubkey, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+	bc, err := CreateBlockchain(testParams())
+	if err != nil {
+		t.Fatalf("Error creating blockchain: %v\n", err)
+	}
+	m := NewMiner(bc, pubkey, 1)
+
+	// sending a transaction to the mempool
+	basetx := NewTransaction(createTestInputs(createTestOutputs(2, 0x01, nil, nil)), createTestOutputs(2, 0x02, nil, pubkey))
+	cstate.InsertBatchTX(basetx)
+	tx := NewTransaction(createTestInputs(createTestOutputs(2, 0x02, basetx.TXID, pubkey)), createTestOutputs(1, 0x03, nil, nil))
+	signTestInputs(tx, privkey)
+	if err := mempool.AddTX(tx); err != nil {
+		t.Fatalf("Error adding transaction to mempool: %v\n", err)
+	}
+
+	hashes, err := m.Generate(context.Background(), 6)
+	if err != nil {
+		t.Fatalf("Error generating blocks: %v\n", err)
+	}
+	if len(hashes) != 6 {
+		t.Fatalf("Expected 6 block hashes, got %d\n", len(hashes))
+	}
+	for i, hash := range hashes {
+		header, ok := bc.GetHeaderAt(uint32(i + 1))
+		if !ok || !bytes.Equal(header.GetHash(), hash) {
+			t.Errorf("Block #%d is not part of the main chain.\n", i+1)
+		}
+	}
+	if _, ok := bc.GetHeaderAt(7); ok {
+		t.Errorf("Expected the tip to be at height 6.\n")
+	}
+
+	// the transaction should be confirmed by the first block and have 6 confirmations
+	data, _ := BStorage.GetBlockData(hashes[0])
+	block, err := DeserializeBlock(data)
+	if err != nil {
+		t.Fatalf("Error deserializing block #1: %v\n", err)
+	}
+	if len(block.AllBlockTx()) != 2 || !bytes.Equal(block.AllBlockTx()[1].TXID, tx.TXID) {
+		t.Errorf("Expected the transaction to be included in block #1.\n")
+	}
+	if _, ok := cstate.GetUtxo(tx.TXID, 0); !ok {
+		t.Errorf("Expected the transaction outputs in the chainstate.\n")
+	}
+	if err := mempool.RemoveTX(tx); err == nil {
+		t.Errorf("Expected the transaction to be removed from the mempool.\n")
+	}
+}
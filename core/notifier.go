@@ -0,0 +1,31 @@
+package core
+
+import "sync"
+
+// notifier wakes up the goroutines waiting for a change, e.g. a new tip of the blockchain
+type notifier struct {
+	mtx sync.Mutex
+	ch  chan struct{}
+	// seq is incremented on every change
+	seq uint64
+}
+
+func newNotifier() *notifier {
+	return &notifier{ch: make(chan struct{})}
+}
+
+// wait returns a channel that will be closed on the next change, along with the current sequence number
+func (n *notifier) wait() (<-chan struct{}, uint64) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.ch, n.seq
+}
+
+// notify wakes up every goroutine waiting for a change
+func (n *notifier) notify() {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+	n.seq++
+}
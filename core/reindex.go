@@ -0,0 +1,58 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ReplayBlocks rebuilds the chainstate by connecting the stored blocks of the main chain again,
+// with the same validation as new blocks. The replay starts after the best block of the chainstate,
+// so a replay that was interrupted continues where it stopped. An empty chainstate starts with the
+// outputs of the genesis. progress is called after each block connected, with its height and the tip height.
+func (bc *Blockchain) ReplayBlocks(br BlockReader, progress func(height, tip uint32)) error {
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	// the headers of the block index give the chain to replay
+	if err := bc.loadChain(br); err != nil {
+		return err
+	}
+	stored := bc.chain
+	tip := stored[len(stored)-1].height
+	// the block index links the stored blocks, the ancestors of the assume-valid block can be trusted
+	bc.setAssumeValidNodes(stored)
+
+	bestHash, bestHeight, ok := cstate.GetBestBlock()
+	if !ok {
+		genesis, err := loadGenesisBlock(bc.cparams)
+		if err != nil {
+			return err
+		}
+		if err := genesis.ConfirmAsValid(0); err != nil {
+			return err
+		}
+		bestHeight = 0
+	} else if !bc.isOnMainChain(bestHash, bestHeight) {
+		return fmt.Errorf("%w: chainstate best block %x is not part of the stored chain", ErrIndexMismatch, bestHash)
+	}
+
+	// keeping the blocks already connected, the rest are validated and connected again
+	bc.chain = stored[:bestHeight+1]
+	bc.chain[bestHeight].nextBNode = nil
+	for _, node := range stored[bestHeight+1:] {
+		hash := node.header.GetHash()
+		block, err := br.ReadBlock(hash)
+		if err != nil {
+			return fmt.Errorf("reading block %x: %w", hash, err)
+		}
+		if !bytes.Equal(block.GetBlockHash(), hash) {
+			return fmt.Errorf("%w: %x", ErrCorruptBlock, hash)
+		}
+		if err := bc.appendBlock(block, node.height, false); err != nil {
+			return fmt.Errorf("connecting block %x at height %d: %w", hash, node.height, err)
+		}
+		if progress != nil {
+			progress(node.height, tip)
+		}
+	}
+	return nil
+}
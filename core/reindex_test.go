@@ -0,0 +1,74 @@
+package core
+
+import (
+	"plairo/params"
+	"testing"
+)
+
+func TestBlockchain_ReplayBlocks(t *testing.T) {
+	oldcstate := initTestCState()
+	defer resetTestCState(oldcstate)
+	oldmp := initTestMempool()
+	defer resetTestMempool(oldmp)
+	oldstorage := initTestStorage()
+	defer resetTestStorage(oldstorage)
+	storage := BStorage.(*mockStorage)
+
+	const bits = 0x2000ffff
+	blocks := createStoredTestChain(t, createTestBlockchain(bits), 3)
+
+	// Test Case #1: an empty chainstate is rebuilt from the genesis
+	initTestCState()
+	var replayed []uint32
+	bc := createTestBlockchain(bits)
+	err := bc.ReplayBlocks(storage, func(height, tip uint32) {
+		if tip != 3 {
+			t.Errorf("Unexpected tip height %d\n", tip)
+		}
+		replayed = append(replayed, height)
+	})
+	if err != nil {
+		t.Fatalf("Error replaying blocks: %v\n", err)
+	}
+	if len(replayed) != 3 || len(bc.chain) != 4 {
+		t.Errorf("Unexpected blocks replayed: %v, chain height %d\n", replayed, len(bc.chain)-1)
+	}
+	for _, b := range blocks {
+		expectTestUtxo(t, b, true)
+	}
+	if _, ok := cstate.GetUtxo(bc.chain[0].header.MerkleRoot, 0); !ok {
+		t.Errorf("Genesis output was not restored.\n")
+	}
+	expectTestBestBlock(t, blocks[2], 3)
+
+	// Test Case #2: an interrupted replay continues after the best block of the chainstate
+	cstate.RemoveUtxo(blocks[2].allBlockTx[0].TXID, 0)
+	cstate.SetBestBlock(blocks[1].GetBlockHash(), 2)
+	replayed = nil
+	bc = createTestBlockchain(bits)
+	bc.cparams.AssumeValid = params.Checkpoint{Height: 2, Hash: blocks[1].GetBlockHash()}
+	if err := bc.ReplayBlocks(storage, func(height, tip uint32) {
+		replayed = append(replayed, height)
+	}); err != nil {
+		t.Fatalf("Error resuming replay: %v\n", err)
+	}
+	if len(replayed) != 1 || replayed[0] != 3 {
+		t.Errorf("Expected only block 3 to be replayed, got %v\n", replayed)
+	}
+	// the stored chain leads to the assume-valid block, its blocks can skip signature checks
+	if !bc.assumedValid(blocks[1], 2) || bc.assumedValid(blocks[2], 3) {
+		t.Errorf("Unexpected assume-valid chain of %d blocks\n", len(bc.avChain))
+	}
+	expectTestUtxo(t, blocks[2], true)
+
+	// Test Case #3: stored blocks are validated again, a block with transactions not matching its header is rejected
+	initTestCState()
+	invalid := &Block{header: blocks[1].header, allBlockTx: blocks[2].allBlockTx}
+	storage.blocks[string(blocks[1].GetBlockHash())] = invalid.Serialize()
+	replayed = nil
+	if err := createTestBlockchain(bits).ReplayBlocks(storage, func(height, tip uint32) {
+		replayed = append(replayed, height)
+	}); err == nil || len(replayed) != 1 {
+		t.Errorf("Expected the replay to stop at block 2, got %v after %v\n", err, replayed)
+	}
+}
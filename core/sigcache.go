@@ -0,0 +1,95 @@
+package core
+
+import (
+	"crypto/sha256"
+	"plairo/params"
+	"sync"
+	"sync/atomic"
+)
+
+// sigcache holds the signatures verified when accepting TXs to the mempool
+var sigcache = newSigCache(params.MaxSigCacheEntries)
+
+// sigCache is a bounded set of valid signatures, safe for concurrent use.
+// An entry is the hash of the signature message, the public key and the signature, so a hit means
+// the exact same signature was already verified for the same message and key.
+type sigCache struct {
+	// hits and misses are placed first to guarantee 64-bit alignment for atomic operations
+	hits   uint64
+	misses uint64
+
+	mtx        sync.RWMutex
+	entries    map[[sha256.Size]byte]struct{}
+	maxEntries int
+}
+
+func newSigCache(maxEntries int) *sigCache {
+	return &sigCache{entries: make(map[[sha256.Size]byte]struct{}, maxEntries), maxEntries: maxEntries}
+}
+
+// sigCacheKey builds the cache key of a signature
+func sigCacheKey(sigMsg, pubkey, sig []byte) [sha256.Size]byte {
+	data := make([]byte, 0, len(sigMsg)+len(pubkey)+len(sig))
+	data = append(data, sigMsg...)
+	data = append(data, pubkey...)
+	return sha256.Sum256(append(data, sig...))
+}
+
+// contains checks if the signature with the key given was verified, updating the hit rate metrics
+func (sc *sigCache) contains(key [sha256.Size]byte) bool {
+	sc.mtx.RLock()
+	_, ok := sc.entries[key]
+	sc.mtx.RUnlock()
+	if ok {
+		atomic.AddUint64(&sc.hits, 1)
+	} else {
+		atomic.AddUint64(&sc.misses, 1)
+	}
+	return ok
+}
+
+// add inserts a verified signature. When the cache is full, a random entry is evicted.
+func (sc *sigCache) add(key [sha256.Size]byte) {
+	if sc.maxEntries <= 0 {
+		return
+	}
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	if _, ok := sc.entries[key]; ok {
+		return
+	}
+	if len(sc.entries) >= sc.maxEntries {
+		// map iteration order is random, so the first key is a random one
+		for k := range sc.entries {
+			delete(sc.entries, k)
+			break
+		}
+	}
+	sc.entries[key] = struct{}{}
+}
+
+// SigCacheStats holds the metrics of the signature cache
+type SigCacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+// HitRate returns the fraction of lookups found in the cache, 0 if there were no lookups
+func (s SigCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// GetSigCacheStats returns the metrics of the signature cache since the node started
+func GetSigCacheStats() SigCacheStats {
+	sigcache.mtx.RLock()
+	defer sigcache.mtx.RUnlock()
+	return SigCacheStats{
+		Hits:    atomic.LoadUint64(&sigcache.hits),
+		Misses:  atomic.LoadUint64(&sigcache.misses),
+		Entries: len(sigcache.entries),
+	}
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"plairo/utils"
+)
+
+func TestSigCache_Add(t *testing.T) {
+	sc := newSigCache(3)
+	keys := make([][sha256.Size]byte, 5)
+	for i := range keys {
+		keys[i] = sigCacheKey([]byte{byte(i)}, []byte("pubkey"), []byte("sig"))
+		sc.add(keys[i])
+	}
+	// older entries should be evicted when the cache is full
+	if len(sc.entries) != 3 {
+		t.Errorf("Expected 3 entries, got %d\n", len(sc.entries))
+	}
+	if !sc.contains(keys[4]) {
+		t.Errorf("Expected the last entry added to be in the cache.\n")
+	}
+	if sc.contains(sigCacheKey([]byte{4}, []byte("pubkey"), []byte("other sig"))) {
+		t.Errorf("Expected a different signature not to be in the cache.\n")
+	}
+	if sc.hits != 1 || sc.misses != 1 {
+		t.Errorf("Expected 1 hit and 1 miss, got %d hits and %d misses\n", sc.hits, sc.misses)
+	}
+
+	// a cache with no capacity never stores entries
+	sc = newSigCache(0)
+	sc.add(keys[0])
+	if sc.contains(keys[0]) {
+		t.Errorf("Expected an empty cache.\n")
+	}
+}
+
+func TestSigCache_MempoolAndBlock(t *testing.T) {
+	oldcstate := initTestCState()
+	defer resetTestCState(oldcstate)
+	oldmp := initTestMempool()
+	defer resetTestMempool(oldmp)
+	oldcache := sigcache
+	sigcache = newSigCache(100)
+	defer func() { sigcache = oldcache }()
+
+	privkey, _, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+	txs, basetxs := createSignedTestTXs(t, 2, 3, privkey)
+	for _, basetx := range basetxs {
+		cstate.InsertBatchTX(basetx)
+	}
+
+	// Test Case #1: the signatures are cached when accepting the TX to the mempool
+	if err := mempool.AddTX(txs[0]); err != nil {
+		t.Fatalf("Error adding TX to mempool: %v\n", err)
+	}
+	if stats := GetSigCacheStats(); stats.Entries != 3 || stats.Misses != 3 || stats.Hits != 0 {
+		t.Errorf("Unexpected stats after mempool acceptance: %+v\n", stats)
+	}
+
+	// Test Case #2: validating a block only verifies the signatures not in the cache, without caching them
+	cb := NewTransaction([]*TransactionInput{}, []*TransactionOutput{})
+	if err := NewBlock([]*Transaction{cb, txs[0], txs[1]}).ValidateBlockTx(); err != nil {
+		t.Fatalf("Error validating block: %v\n", err)
+	}
+	stats := GetSigCacheStats()
+	if stats.Entries != 3 || stats.Hits != 3 || stats.Misses != 6 {
+		t.Errorf("Unexpected stats after block validation: %+v\n", stats)
+	}
+	if rate := stats.HitRate(); rate != 1.0/3 {
+		t.Errorf("Expected hit rate 1/3, got %f\n", rate)
+	}
+}
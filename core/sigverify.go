@@ -0,0 +1,73 @@
+package core
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// sigCheck is the verification of the signature of a single transaction input
+type sigCheck struct {
+	tx      *Transaction
+	txIndex int
+	input   int
+}
+
+// collectSigChecks returns the signature checks of every input of the transactions given, in order
+func collectSigChecks(txs []*Transaction, firstIndex int) []sigCheck {
+	var checks []sigCheck
+	for i, tx := range txs {
+		for inp := range tx.inputs {
+			checks = append(checks, sigCheck{tx, firstIndex + i, inp})
+		}
+	}
+	return checks
+}
+
+// verifySignatures runs the checks on the number of workers given, one per CPU if not positive.
+// Returns the index of the first failing check along with its error, or -1 if all signatures are valid.
+// Checks are handed out in order, so every check before a failing one is always completed, making the result
+// deterministic. Checks after the first failure found are skipped.
+func verifySignatures(checks []sigCheck, workers int) (int, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(checks) {
+		workers = len(checks)
+	}
+	errs := make([]error, len(checks))
+	next := int64(-1)
+	failedAt := int64(len(checks))
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				j := atomic.AddInt64(&next, 1)
+				// there is no need to go past a failure, only an earlier one could change the result
+				if j >= int64(len(checks)) || j > atomic.LoadInt64(&failedAt) {
+					return
+				}
+				c := checks[j]
+				if errs[j] = c.tx.verifyInputSignature(c.input, false); errs[j] == nil {
+					continue
+				}
+				// keeping the lowest failing index
+				for {
+					cur := atomic.LoadInt64(&failedAt)
+					if j >= cur || atomic.CompareAndSwapInt64(&failedAt, cur, j) {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failedAt == int64(len(checks)) {
+		return -1, nil
+	}
+	return int(failedAt), errs[failedAt]
+}
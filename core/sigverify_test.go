@@ -0,0 +1,127 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"plairo/utils"
+)
+
+// createSignedTestTXs creates transactions with the number of inputs given each, signed with privkey, along with
+// the TXs they spend. The TXs at the bad indexes are signed with a different key.
+func createSignedTestTXs(t testing.TB, num, inputs int, privkey *ecdsa.PrivateKey, bad ...int) ([]*Transaction, []*Transaction) {
+	otherkey, _, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+	isBad := make(map[int]bool)
+	for _, i := range bad {
+		isBad[i] = true
+	}
+	txs := make([]*Transaction, num)
+	basetxs := make([]*Transaction, num)
+	for i := range txs {
+		// the number of inputs of the base TXs differs, so that every base TX has a different TXID
+		basetxs[i] = NewTransaction(createTestInputs(createTestOutputs(i+1, 0x01, nil, nil)), createTestOutputs(inputs, 0x02, nil, &privkey.PublicKey))
+		txs[i] = NewTransaction(createTestInputs(createTestOutputs(inputs, 0x02, basetxs[i].TXID, &privkey.PublicKey)), createTestOutputs(1, 0x03, nil, nil))
+		if isBad[i] {
+			signTestInputs(txs[i], otherkey)
+		} else {
+			signTestInputs(txs[i], privkey)
+		}
+	}
+	return txs, basetxs
+}
+
+func TestVerifySignatures(t *testing.T) {
+	privkey, _, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+
+	// Test Case #1: all signatures valid
+	txs, _ := createSignedTestTXs(t, 10, 3, privkey)
+	checks := collectSigChecks(txs, 0)
+	if j, err := verifySignatures(checks, 4); j != -1 || err != nil {
+		t.Errorf("Expected all signatures to be valid, got index %d error %v\n", j, err)
+	}
+
+	// Test Case #2: the lowest failing check is always reported, regardless of the number of workers
+	txs, _ = createSignedTestTXs(t, 10, 3, privkey, 4, 7, 9)
+	checks = collectSigChecks(txs, 0)
+	for _, workers := range []int{1, 2, 4, 8, 64} {
+		for run := 0; run < 10; run++ {
+			j, err := verifySignatures(checks, workers)
+			if !errors.Is(err, ErrInvalidSignatureProvided) || j != 12 || checks[j].txIndex != 4 {
+				t.Fatalf("Expected the first input of TX #4 to fail with %d workers, got index %d error %v\n", workers, j, err)
+			}
+		}
+	}
+
+	// Test Case #3: no checks
+	if j, err := verifySignatures(nil, 0); j != -1 || err != nil {
+		t.Errorf("Expected no failure for empty checks, got index %d error %v\n", j, err)
+	}
+}
+
+func TestBlock_ValidateBlockTxSignatures(t *testing.T) {
+	oldcstate := initTestCState()
+	defer resetTestCState(oldcstate)
+	oldmp := initTestMempool()
+	defer resetTestMempool(oldmp)
+
+	privkey, _, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+	// the coinbase is never validated in this test
+	cb := NewTransaction([]*TransactionInput{}, []*TransactionOutput{})
+
+	newBlock := func(txs, basetxs []*Transaction) *Block {
+		for _, basetx := range basetxs {
+			cstate.InsertBatchTX(basetx)
+		}
+		return NewBlock(append([]*Transaction{cb}, txs...))
+	}
+
+	// Test Case #1: valid signatures
+	if err := newBlock(createSignedTestTXs(t, 8, 2, privkey)).ValidateBlockTx(); err != nil {
+		t.Errorf("Expected valid block, got %v\n", err)
+	}
+
+	// Test Case #2: invalid signatures are detected, skipped when not checking signatures
+	b := newBlock(createSignedTestTXs(t, 8, 2, privkey, 5))
+	if err := b.ValidateBlockTx(); !errors.Is(err, ErrInvalidSignatureProvided) {
+		t.Errorf("Expected ErrInvalidSignatureProvided, got %v\n", err)
+	}
+	if err := b.validateBlockTx(false); err != nil {
+		t.Errorf("Expected block to be valid without checking signatures, got %v\n", err)
+	}
+}
+
+func BenchmarkVerifySignatures(b *testing.B) {
+	privkey, _, err := utils.GenerateKeyPair()
+	if err != nil {
+		b.Fatalf("Error generating key pair: %v\n", err)
+	}
+	txs, _ := createSignedTestTXs(b, 100, 2, privkey)
+	checks := collectSigChecks(txs, 0)
+	counts := []int{1, 2, 4, 8}
+	if n := runtime.NumCPU(); n > 8 {
+		counts = append(counts, n)
+	}
+	for _, workers := range counts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := verifySignatures(checks, workers); err != nil {
+					b.Fatalf("Unexpected error: %v\n", err)
+				}
+			}
+			// reporting throughput, since the number of signatures is fixed
+			b.ReportMetric(float64(len(checks)*b.N)/b.Elapsed().Seconds(), "sigs/s")
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"plairo/params"
+)
+
+var ErrDuplicateBlock = errors.New("block already exists")
+
+// BlockTemplate holds everything an external miner needs to construct a block on top of the current tip
+type BlockTemplate struct {
+	Version           uint32
+	Height            uint32
+	PreviousBlockHash []byte
+	// Transactions are the mempool transactions to be included, the coinbase is constructed by the miner
+	Transactions  []*Transaction
+	CoinbaseValue uint64
+	TargetBits    uint32
+	CurTime       int64
+	MinTime       int64
+	// LongPollID identifies the state of the tip and the mempool this template was built from
+	LongPollID string
+}
+
+// NewBlockTemplate builds a template for the next block using the transactions with the highest fees in the mempool
+func (bc *Blockchain) NewBlockTemplate() *BlockTemplate {
+	// getting the mempool state first, so that a change while building the template is never missed
+	_, mpseq := mempool.changed.wait()
+
+	bc.mtx.RLock()
+	lastnode := bc.chain[len(bc.chain)-1]
+	tipHeight := uint32(len(bc.chain) - 1)
+	tmpl := &BlockTemplate{
+		Version:           bc.computeBlockVersion(lastnode),
+		Height:            tipHeight + 1,
+		PreviousBlockHash: lastnode.header.GetHash(),
+		TargetBits:        GetTargetForBlock(bc.cparams, lastnode),
+		CurTime:           blockTimestamp(lastnode),
+		// the block timestamp should be after the median-time-past
+		MinTime: lastnode.MedianTimePast() + 1,
+	}
+	bc.mtx.RUnlock()
+	tmpl.LongPollID = buildLongPollID(tmpl.PreviousBlockHash, mpseq)
+
+	tmpl.Transactions = selectTemplateTXs(params.MaxNumberOfTXsInBlock)
+	var fees uint64
+	for _, tx := range tmpl.Transactions {
+		fees += tx.GetFees()
+	}
+	tmpl.CoinbaseValue = GetBlockSubsidy(bc.cparams, tmpl.Height) + fees
+	return tmpl
+}
+
+// selectTemplateTXs returns up to max transactions from the mempool, skipping those no longer valid
+func selectTemplateTXs(max int) []*Transaction {
+	// the channel is buffered, so that GetMaxTXs never blocks
+	ch := make(chan interface{}, max)
+	mempool.GetMaxTXs(ch, max)
+	close(ch)
+
+	var txs []*Transaction
+	for item := range ch {
+		tx := item.(*Transaction)
+		// the UTXOs referenced may have been spent by a block since the TX was added to the mempool
+		if err := tx.ValidateTransaction(); err != nil {
+			continue
+		}
+		txs = append(txs, tx)
+	}
+	return txs
+}
+
+// buildLongPollID combines the tip hash and the mempool sequence number
+func buildLongPollID(tipHash []byte, mempoolSeq uint64) string {
+	return fmt.Sprintf("%s%d", hex.EncodeToString(tipHash), mempoolSeq)
+}
+
+// currentLongPollID returns the long poll ID for the current state, along with channels signalling the next changes
+func (bc *Blockchain) currentLongPollID() (string, <-chan struct{}, <-chan struct{}) {
+	mpch, mpseq := mempool.changed.wait()
+	tipch, _ := bc.tipChanged.wait()
+	bc.mtx.RLock()
+	tipHash := bc.chain[len(bc.chain)-1].header.GetHash()
+	bc.mtx.RUnlock()
+	return buildLongPollID(tipHash, mpseq), tipch, mpch
+}
+
+// WaitForTemplateChange blocks until the tip or the mempool differs from the state identified by longPollID
+func (bc *Blockchain) WaitForTemplateChange(ctx context.Context, longPollID string) error {
+	for {
+		current, tipch, mpch := bc.currentLongPollID()
+		if current != longPollID {
+			return nil
+		}
+		select {
+		case <-tipch:
+		case <-mpch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// SubmitBlock inserts a block constructed by an external miner, determining its height by the previous block
+func (bc *Blockchain) SubmitBlock(block *Block) error {
+	height, err := bc.getHeightForNewBlock(block)
+	if err != nil {
+		return err
+	}
+	return bc.InsertBlock(block, height)
+}
+
+// getHeightForNewBlock finds the height of the block by searching for its previous block in the main chain and forks
+func (bc *Blockchain) getHeightForNewBlock(block *Block) (uint32, error) {
+	bc.mtx.RLock()
+	defer bc.mtx.RUnlock()
+	blockHash := block.GetBlockHash()
+	prevHash := block.header.PreviousBlockHash
+	// most blocks are expected to extend the tip, searching from the end of the chain
+	for i := len(bc.chain) - 1; i >= 0; i-- {
+		nodeHash := bc.chain[i].header.GetHash()
+		if bytes.Equal(nodeHash, blockHash) {
+			return 0, ErrDuplicateBlock
+		}
+		if bytes.Equal(nodeHash, prevHash) {
+			return uint32(i) + 1, nil
+		}
+	}
+	for _, f := range bc.forks {
+		if bytes.Equal(f.forkHead.header.GetHash(), prevHash) {
+			return f.maxHeight + 1, nil
+		}
+	}
+	return 0, ErrInvalidLink
+}
@@ -0,0 +1,79 @@
+package core
+
+import (
+	"plairo/params"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxTimeSamples limits the number of peers whose clock is taken into account
+const maxTimeSamples = 200
+
+// minTimeSamples is the number of samples needed before the clock is adjusted
+const minTimeSamples = 5
+
+// timeData keeps the clock offsets reported by peers. The network-adjusted time is the local time
+// shifted by the median offset, as long as it does not exceed params.MaxTimeOffsetInSec.
+type timeData struct {
+	mtx     sync.Mutex
+	offsets map[string]int64
+	// order keeps the insertion order of the peers, so that the oldest sample is dropped first
+	order  []string
+	offset int64
+}
+
+var tdata = newTimeData()
+
+func newTimeData() *timeData {
+	return &timeData{offsets: make(map[string]int64)}
+}
+
+// AddTimeSample records the time reported by a peer. Each peer is only sampled once.
+func AddTimeSample(peer string, peerTime int64) {
+	tdata.addSample(peer, peerTime-time.Now().Unix())
+}
+
+// AdjustedTime returns the local time adjusted by the median clock offset of the peers
+func AdjustedTime() int64 {
+	return time.Now().Unix() + TimeOffset()
+}
+
+// TimeOffset returns the offset currently applied to the local time
+func TimeOffset() int64 {
+	tdata.mtx.Lock()
+	defer tdata.mtx.Unlock()
+	return tdata.offset
+}
+
+func (td *timeData) addSample(peer string, offset int64) {
+	td.mtx.Lock()
+	defer td.mtx.Unlock()
+	if _, ok := td.offsets[peer]; ok {
+		return
+	}
+	if len(td.order) == maxTimeSamples {
+		delete(td.offsets, td.order[0])
+		td.order = td.order[1:]
+	}
+	td.offsets[peer] = offset
+	td.order = append(td.order, peer)
+
+	// using an odd number of samples, so that the median is always one of them
+	if len(td.order) < minTimeSamples || len(td.order)%2 == 0 {
+		return
+	}
+	sorted := make([]int64, 0, len(td.offsets))
+	for _, o := range td.offsets {
+		sorted = append(sorted, o)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median := sorted[len(sorted)/2]
+
+	// if the peers disagree too much with the local clock, the local clock is trusted instead
+	if median > params.MaxTimeOffsetInSec || median < -params.MaxTimeOffsetInSec {
+		td.offset = 0
+		return
+	}
+	td.offset = median
+}
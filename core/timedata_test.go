@@ -0,0 +1,121 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"plairo/params"
+	"plairo/utils"
+	"testing"
+)
+
+func TestBNode_MedianTimePast(t *testing.T) {
+	// building a chain with timestamps out of order
+	stamps := []int64{10, 30, 20, 50, 40, 70, 60, 90, 80, 110, 100, 130, 120}
+	var node *BNode
+	for _, ts := range stamps {
+		node = &BNode{previousBNode: node, header: &BlockHeader{Timestamp: ts}}
+	}
+
+	// Test Case #1: only the last 11 timestamps are considered
+	// sorted: 30 40 50 60 70 80 90 100 110 120 130
+	if mtp := node.MedianTimePast(); mtp != 80 {
+		t.Errorf("Expected median-time-past 80, got %d\n", mtp)
+	}
+
+	// Test Case #2: fewer nodes than the median time span
+	// sorted: 10 20 30
+	if mtp := node.previousBNode.previousBNode.previousBNode.previousBNode.previousBNode.previousBNode.previousBNode.previousBNode.previousBNode.previousBNode.MedianTimePast(); mtp != 20 {
+		t.Errorf("Expected median-time-past 20, got %d\n", mtp)
+	}
+}
+
+func TestTimeData_addSample(t *testing.T) {
+	td := newTimeData()
+
+	// Test Case #1: no adjustment before enough samples are gathered
+	for i, peer := range []string{"a", "b", "c", "d"} {
+		td.addSample(peer, int64(i+1)*10)
+	}
+	if td.offset != 0 {
+		t.Errorf("Expected no offset with 4 samples, got %d\n", td.offset)
+	}
+
+	// Test Case #2: median of 10 20 30 40 50
+	td.addSample("e", 50)
+	if td.offset != 30 {
+		t.Errorf("Expected offset 30, got %d\n", td.offset)
+	}
+
+	// Test Case #3: the same peer is only sampled once
+	td.addSample("e", 1000)
+	if td.offset != 30 || len(td.order) != 5 {
+		t.Errorf("Expected duplicate sample to be ignored, got offset %d with %d samples\n", td.offset, len(td.order))
+	}
+
+	// Test Case #4: offsets exceeding the max allowed are not applied
+	td = newTimeData()
+	for _, peer := range []string{"a", "b", "c", "d", "e"} {
+		td.addSample(peer, params.MaxTimeOffsetInSec+1)
+	}
+	if td.offset != 0 {
+		t.Errorf("Expected offset exceeding max to be ignored, got %d\n", td.offset)
+	}
+}
+
+// solveWithTimestamp prepares a block on top of the tip of bc and solves it keeping the timestamp given
+func solveWithTimestamp(t *testing.T, bc *Blockchain, timestamp int64) *Block {
+	_, pubkey, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+	b := NewBlock(nil)
+	tip := bc.initBlockHeader(b)
+	if err := b.prepareForMining(bc.cparams, tip, pubkey); err != nil {
+		t.Fatalf("Error preparing block: %v\n", err)
+	}
+	b.header.Timestamp = timestamp
+	target := utils.ExpandBits(utils.SerializeUint32(b.header.TargetBits, false))
+	for bytes.Compare(b.header.GetHash(), target) >= 0 {
+		b.header.Nonce++
+	}
+	return b
+}
+
+func TestBlockchain_InsertBlockTimestamp(t *testing.T) {
+	oldcstate := initTestCState()
+	defer resetTestCState(oldcstate)
+	oldmp := initTestMempool()
+	defer resetTestMempool(oldmp)
+	oldstorage := initTestStorage()
+	defer resetTestStorage(oldstorage)
+
+	bc := createTestBlockchain(0x2000ffff)
+	bc.chain[0].header.Timestamp = AdjustedTime() - 1000
+
+	// Test Case #1: timestamp equal to median-time-past
+	b := solveWithTimestamp(t, bc, bc.chain[0].header.Timestamp)
+	if err := bc.InsertBlock(b, 1); !errors.Is(err, ErrTimeTooOld) {
+		t.Errorf("Expected ErrTimeTooOld, got %v\n", err)
+	}
+
+	// Test Case #2: timestamp beyond the future drift allowed
+	b = solveWithTimestamp(t, bc, AdjustedTime()+params.MaxFutureBlockTimeInSec+60)
+	if err := bc.InsertBlock(b, 1); !errors.Is(err, ErrTimeTooNew) {
+		t.Errorf("Expected ErrTimeTooNew, got %v\n", err)
+	}
+
+	// Test Case #3: timestamp before the previous block, but after median-time-past
+	genesisStamp := bc.chain[0].header.Timestamp
+	for height, ts := range []int64{genesisStamp + 10, genesisStamp + 20, genesisStamp + 15} {
+		b = solveWithTimestamp(t, bc, ts)
+		if err := bc.InsertBlock(b, uint32(height+1)); err != nil {
+			t.Fatalf("Expected block #%d to be accepted, got %v\n", height+1, err)
+		}
+	}
+
+	// Test Case #4: timestamp within the future drift allowed
+	b = solveWithTimestamp(t, bc, AdjustedTime()+params.MaxFutureBlockTimeInSec-60)
+	if err := bc.InsertBlock(b, 4); err != nil {
+		t.Errorf("Expected block to be accepted, got %v\n", err)
+	}
+}
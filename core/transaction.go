@@ -25,6 +25,7 @@ var ErrNonExistentUTXO = errors.New("utxo referenced does not exist")
 var ErrInvalidSignatureProvided = errors.New("invalid signature provided for input")
 var ErrInputOutputMismatch = errors.New("output referred does not match actual output")
 var ErrInsufficientFunds = errors.New("input value does not cover output value")
+var ErrInvalidTxData = errors.New("invalid transaction data")
 
 // SIGHASH is a flag used to provide flexibility when signing TXs, allowing multiple pay methods
 type SIGHASH byte
@@ -37,15 +38,36 @@ const (
 
 type CState interface {
 	GetUtxo([]byte, uint32) (*TransactionOutput, bool)
-	GetTX([]byte) ([]byte, error)
+	GetUtxoEntry([]byte, uint32) (*UtxoEntry, bool)
 	RemoveUtxo([]byte, uint32) bool
 	InsertBatchTX(tx *Transaction) error
+	// InsertBatchUtxo adds a single output back, used to restore the outputs spent by a disconnected block
+	InsertBatchUtxo(entry *UtxoEntry) error
+	// SetBestBlock records the hash and height of the block the UTXOs correspond to, written along with the next batch
+	SetBestBlock([]byte, uint32)
+	// GetBestBlock returns the hash and height of the block the UTXOs correspond to, false if none was recorded
+	GetBestBlock() ([]byte, uint32, bool)
 	WriteBatchTX() error
+	// DiscardBatchTX drops the changes made since the last WriteBatchTX, used when a block fails to connect
+	DiscardBatchTX()
 }
 
+const (
+	// CoinbaseExtraNonceOffset is the position of the extra-nonce inside the coinbase input signature,
+	// right after the block height
+	CoinbaseExtraNonceOffset = 4
+	// CoinbaseExtraNonceSize is the size of the extra-nonce in bytes
+	CoinbaseExtraNonceSize = 8
+)
+
 // cstate will be used as a chainstate pointer with injection from the db package
 var cstate CState
 
+// SetChainstate injects the chainstate used to validate transactions
+func SetChainstate(c CState) {
+	cstate = c
+}
+
 // NewTransaction generates a new non-coinbase transaction
 func NewTransaction(inputs []*TransactionInput, outputs []*TransactionOutput) *Transaction {
 	// copying in/output slices to prevent external changes to the slice from modifying transaction internal slice
@@ -62,10 +84,11 @@ func NewTransaction(inputs []*TransactionInput, outputs []*TransactionOutput) *T
 
 // NewCoinbaseTransaction generates a new coinbase transaction
 func NewCoinbaseTransaction(coinbaseMsg string, coinbaseValue uint64, minerKey *ecdsa.PublicKey, blockHeight uint32) (*Transaction, error) {
-	inputSig := make([]byte, 4)
+	inputSig := make([]byte, CoinbaseExtraNonceOffset+CoinbaseExtraNonceSize)
 	// blockheight+1 will be the height of the block to which this coinbase TX will belong
 	// embedding it as inputSig
 	copy(inputSig, utils.SerializeUint32(blockHeight+1, false))
+	// the extra-nonce follows the height, initialized to zero. Miners change it when the nonce space is exhausted
 	// appending the desired message (the sig of the coinbase will not be checked either way)
 	inputSig = append(inputSig, []byte(coinbaseMsg)...)
 	cInput := &TransactionInput{NewTransactionOutput(make([]byte, 32), 0, 0xffffffff, []byte{}), inputSig}
@@ -83,6 +106,36 @@ func NewCoinbaseTransaction(coinbaseMsg string, coinbaseValue uint64, minerKey *
 	return t, nil
 }
 
+// copyCoinbase copies the coinbase transaction, so that the extra-nonce can be changed without affecting the original
+func (t *Transaction) copyCoinbase() *Transaction {
+	cinputs := make([]*TransactionInput, len(t.inputs))
+	for i, inp := range t.inputs {
+		cinputs[i] = &TransactionInput{inp.OutputReferred, append([]byte(nil), inp.ScriptSig...)}
+	}
+	coutputs := make([]*TransactionOutput, len(t.outputs))
+	for i, outp := range t.outputs {
+		coutp := *outp
+		coutputs[i] = &coutp
+	}
+	return &Transaction{TXID: t.TXID, BlockHeight: t.BlockHeight, IsCoinbase: t.IsCoinbase, inputs: cinputs, outputs: coutputs}
+}
+
+// setExtraNonce embeds the extra-nonce in the coinbase input signature and regenerates the TXID
+func (t *Transaction) setExtraNonce(extraNonce uint64) {
+	copy(t.inputs[0].ScriptSig[CoinbaseExtraNonceOffset:], utils.SerializeUint64(extraNonce, false))
+	t.TXID = nil
+	t.updateOutputs()
+}
+
+// SplitAtExtraNonce splits the serialized coinbase into the data before and after the extra-nonce
+func (t *Transaction) SplitAtExtraNonce() ([]byte, []byte) {
+	serial := t.Serialize()
+	// the input signature is preceded by the number of inputs (4 bytes), the parent TXID (32 bytes),
+	// the vout (4 bytes) and the size of the signature (8 bytes)
+	offset := 4 + 32 + 4 + 8 + CoinbaseExtraNonceOffset
+	return serial[:offset], serial[offset+CoinbaseExtraNonceSize:]
+}
+
 func (t *Transaction) GetOutputs() []*TransactionOutput {
 	return t.outputs
 }
@@ -157,6 +210,93 @@ func (t *Transaction) Serialize() []byte {
 	return r
 }
 
+// DeserializeTransaction parses a serialized non-coinbase transaction. The outputs referred by the inputs
+// are looked up in the chainstate. If they do not exist, only their parent TXID and vout will be known.
+func DeserializeTransaction(data []byte) (*Transaction, error) {
+	return deserializeTransaction(data, false)
+}
+
+func deserializeTransaction(data []byte, isCoinbase bool) (*Transaction, error) {
+	var caret uint64
+	// readNext returns the next n bytes of data and moves the caret, or nil if data is not long enough
+	readNext := func(n uint64) []byte {
+		if n > uint64(len(data))-caret {
+			return nil
+		}
+		caret += n
+		return data[caret-n : caret]
+	}
+
+	raw := readNext(4)
+	if raw == nil {
+		return nil, ErrInvalidTxData
+	}
+	noOfInputs := utils.DeserializeUint32(raw, false)
+	var inputs []*TransactionInput
+	for i := uint32(0); i < noOfInputs; i++ {
+		parentTXID := readNext(32)
+		rawVout := readNext(4)
+		rawSigLen := readNext(8)
+		if parentTXID == nil || rawVout == nil || rawSigLen == nil {
+			return nil, ErrInvalidTxData
+		}
+		scriptSig := readNext(utils.DeserializeUint64(rawSigLen, false))
+		if scriptSig == nil {
+			return nil, ErrInvalidTxData
+		}
+		vout := utils.DeserializeUint32(rawVout, false)
+		// copying to avoid keeping a reference to the whole data slice
+		parentTXID = append([]byte(nil), parentTXID...)
+		scriptSig = append([]byte(nil), scriptSig...)
+
+		var outReferred *TransactionOutput
+		if isCoinbase {
+			// the coinbase input does not refer to an actual output, using the same values as NewCoinbaseTransaction
+			outReferred = NewTransactionOutput(parentTXID, 0, 0xffffffff, []byte{})
+		} else if utxo, ok := cstate.GetUtxo(parentTXID, vout); ok {
+			outReferred = utxo
+		} else {
+			// the output will be rejected during validation
+			outReferred = NewTransactionOutput(parentTXID, vout, 0, []byte{})
+		}
+		inputs = append(inputs, &TransactionInput{outReferred, scriptSig})
+	}
+
+	raw = readNext(4)
+	if raw == nil {
+		return nil, ErrInvalidTxData
+	}
+	noOfOutputs := utils.DeserializeUint32(raw, false)
+	var outputs []*TransactionOutput
+	for i := uint32(0); i < noOfOutputs; i++ {
+		rawValue := readNext(8)
+		rawSpkLen := readNext(8)
+		if rawValue == nil || rawSpkLen == nil {
+			return nil, ErrInvalidTxData
+		}
+		scriptPubKey := readNext(utils.DeserializeUint64(rawSpkLen, false))
+		if scriptPubKey == nil {
+			return nil, ErrInvalidTxData
+		}
+		// parent TXID and vout will be set after the TXID is generated
+		outputs = append(outputs, NewTransactionOutput([]byte{}, 0, utils.DeserializeUint64(rawValue, false), append([]byte(nil), scriptPubKey...)))
+	}
+	if caret != uint64(len(data)) {
+		return nil, ErrInvalidTxData
+	}
+
+	t := NewTransaction(inputs, outputs)
+	if isCoinbase {
+		if len(inputs) != 1 || len(inputs[0].ScriptSig) < 4 {
+			return nil, ErrInvalidTxData
+		}
+		t.IsCoinbase = true
+		// the height of the block is embedded in the coinbase input signature
+		t.BlockHeight = utils.DeserializeUint32(inputs[0].ScriptSig[:4], false)
+	}
+	return t, nil
+}
+
 // SerializeTXMetadata returns TX metadata used to store info about UTXOs (in chainstate)
 func (t *Transaction) SerializeTXMetadata() []byte {
 	/*
@@ -171,15 +311,21 @@ func (t *Transaction) SerializeTXMetadata() []byte {
 	 * ---- scriptPubKey (since my version is simplified, this will be the recipient pubkey)
 	 *
 	 */
+	return SerializeUTXOMetadata(t.IsCoinbase, t.BlockHeight, t.outputs)
+}
+
+// SerializeUTXOMetadata returns the metadata of a TX with the outputs given, indexed by vout.
+// Outputs that are nil or marked as spent are not stored. Used to update the metadata as outputs get spent.
+func SerializeUTXOMetadata(isCoinbase bool, blockHeight uint32, outputs []*TransactionOutput) []byte {
 	// calculating the metadata length to allocate appropriately
 	metadataLen := 9
-	unspent := make([]bool, len(t.outputs))
+	unspent := make([]bool, len(outputs))
 	unspentCounter := 0
-	for i, outp := range t.outputs {
+	for i, outp := range outputs {
 		// marking unspent outputs
-		unspent[i] = outp.IsNotSpent
+		unspent[i] = outp != nil && outp.IsNotSpent
 		// only unspent tx metadata will be stored, only taking these into account to calculate length
-		if outp.IsNotSpent {
+		if unspent[i] {
 			// 8 bits for the value and 8 bits to indicate the size of scriptpubkey
 			metadataLen += 16 + len(outp.ScriptPubKey)
 			unspentCounter++
@@ -187,16 +333,16 @@ func (t *Transaction) SerializeTXMetadata() []byte {
 	}
 	metadataLen += int(math.Floor(float64(unspentCounter)/8) + 1)
 	metadata := make([]byte, 0, metadataLen)
-	if t.IsCoinbase {
+	if isCoinbase {
 		metadata = append(metadata, 0x01)
 	} else {
 		metadata = append(metadata, 0x00)
 	}
-	metadata = append(metadata, utils.SerializeUint32(t.BlockHeight, false)...)
-	metadata = append(metadata, utils.SerializeUint32(uint32(len(t.outputs)), false)...)
+	metadata = append(metadata, utils.SerializeUint32(blockHeight, false)...)
+	metadata = append(metadata, utils.SerializeUint32(uint32(len(outputs)), false)...)
 	metadata = append(metadata, utils.SerializeToOneHot(unspent)...)
-	for _, outp := range t.outputs {
-		if !outp.IsNotSpent {
+	for i, outp := range outputs {
+		if !unspent[i] {
 			continue
 		}
 		metadata = append(metadata, utils.SerializeUint64(outp.Value, false)...)
@@ -227,6 +373,13 @@ ValidateTransaction is used to validate a transaction.
 6) Will check if the funds provided are sufficient to cover the fees as well
 */
 func (t *Transaction) ValidateTransaction() error {
+	return t.validateTransaction(true, false)
+}
+
+// validateTransaction is the same as ValidateTransaction, the signature checks are skipped if checkSignatures is false.
+// The UTXOs referenced and the values are always checked. Valid signatures are added to the signature cache
+// if cacheSignatures is true.
+func (t *Transaction) validateTransaction(checkSignatures, cacheSignatures bool) error {
 	var inputValue uint64
 
 	// using a map to make sure no duplicate inputs were used
@@ -248,21 +401,13 @@ func (t *Transaction) ValidateTransaction() error {
 		if !utxo.Equal(inp.OutputReferred) {
 			return ErrInputOutputMismatch
 		}
-		sighashFlag := SIGHASH(inp.ScriptSig[len(inp.ScriptSig)-1])
-		rawSig := inp.ScriptSig[:len(inp.ScriptSig)-1]
-
-		sigMsg := t.gatherSignatureDataForInput(i, sighashFlag)
-		// the public key will be the ScriptPubKey of the outputs, since no script is used
-		// and this is a simplified version, using only the full public key
-		pubkey, err := utils.ConvertBytesToPubKey(utxo.ScriptPubKey)
-		if err != nil {
-			return err
+		inputValue += inp.OutputReferred.Value
+		if !checkSignatures {
+			continue
 		}
-		if !utils.VerifySignature(sigMsg, rawSig, pubkey) {
-			// output cannot be unlocked, so the TX is rejected
-			return ErrInvalidSignatureProvided
+		if err := t.verifyInputSignature(i, cacheSignatures); err != nil {
+			return err
 		}
-		inputValue += inp.OutputReferred.Value
 	}
 
 	// getting the total value of the new outputs
@@ -309,29 +454,24 @@ func (t *Transaction) cleanUpInputs() error {
 func (t *Transaction) gatherSignatureDataForInput(inputIndex int, sighashFlag SIGHASH) []byte {
 	switch sighashFlag {
 	case SIGHASH_ALL:
-		// backing up the rest input signatures
-		backupSigs := make([][]byte, len(t.inputs))
+		// working on a copy of the inputs, so that the TX is never modified while gathering the data
+		// this allows gathering signature data for the same TX from multiple goroutines
+		tmptx := &Transaction{inputs: make([]*TransactionInput, len(t.inputs)), outputs: t.outputs}
 		// replacing the rest of the signatures
 		for i, inp := range t.inputs {
-			backupSigs[i] = inp.ScriptSig
 			if i == inputIndex {
-				t.inputs[i].ScriptSig = inp.OutputReferred.ScriptPubKey
+				tmptx.inputs[i] = &TransactionInput{inp.OutputReferred, inp.OutputReferred.ScriptPubKey}
 				continue
 			}
-			t.inputs[i].ScriptSig = []byte{}
+			tmptx.inputs[i] = &TransactionInput{inp.OutputReferred, []byte{}}
 		}
 		// serializing this new TX without signature
-		customSerialTX := t.Serialize()
+		customSerialTX := tmptx.Serialize()
 		// appending the SIGHASH byte to obtain message data
 		customSerialTX = append(customSerialTX, byte(sighashFlag))
 
 		// double-hashing to obtain the message which will be used to sign the input
-		signatureData := utils.CalculateSHA256Hash(utils.CalculateSHA256Hash(customSerialTX))
-		// restoring the rest of the input signatures
-		for i := range t.inputs {
-			t.inputs[i].ScriptSig = backupSigs[i]
-		}
-		return signatureData
+		return utils.CalculateSHA256Hash(utils.CalculateSHA256Hash(customSerialTX))
 
 	default:
 		return nil
@@ -339,6 +479,38 @@ func (t *Transaction) gatherSignatureDataForInput(inputIndex int, sighashFlag SI
 	}
 }
 
+// verifyInputSignature checks the signature unlocking the output referred by the input.
+// The output referred should already be checked against the chainstate. Safe to call from multiple goroutines.
+// Signatures found in the signature cache are not verified again, valid ones are added to it if store is true.
+func (t *Transaction) verifyInputSignature(inputIndex int, store bool) error {
+	inp := t.inputs[inputIndex]
+	if len(inp.ScriptSig) == 0 {
+		return ErrInvalidSignatureProvided
+	}
+	sighashFlag := SIGHASH(inp.ScriptSig[len(inp.ScriptSig)-1])
+	rawSig := inp.ScriptSig[:len(inp.ScriptSig)-1]
+
+	sigMsg := t.gatherSignatureDataForInput(inputIndex, sighashFlag)
+	// the public key will be the ScriptPubKey of the outputs, since no script is used
+	// and this is a simplified version, using only the full public key
+	key := sigCacheKey(sigMsg, inp.OutputReferred.ScriptPubKey, rawSig)
+	if sigcache.contains(key) {
+		return nil
+	}
+	pubkey, err := utils.ConvertBytesToPubKey(inp.OutputReferred.ScriptPubKey)
+	if err != nil {
+		return err
+	}
+	if !utils.VerifySignature(sigMsg, rawSig, pubkey) {
+		// output cannot be unlocked, so the TX is rejected
+		return ErrInvalidSignatureProvided
+	}
+	if store {
+		sigcache.add(key)
+	}
+	return nil
+}
+
 // signInput provides a signature for a specific input, its message determined by the SIGHASH flag
 func (t *Transaction) signInput(inputIndex int, privateKey *ecdsa.PrivateKey, sighashFlag SIGHASH) error {
 	signatureMsg := t.gatherSignatureDataForInput(inputIndex, sighashFlag)
@@ -347,6 +519,9 @@ func (t *Transaction) signInput(inputIndex int, privateKey *ecdsa.PrivateKey, si
 		return fmt.Errorf("signing input %d: %v", inputIndex, err)
 	}
 	t.inputs[inputIndex].ScriptSig = append(signature, byte(sighashFlag))
+	// the signature is part of the serialized TX, so the TXID must be regenerated
+	t.TXID = nil
+	t.updateOutputs()
 	return nil
 }
 
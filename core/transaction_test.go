@@ -9,8 +9,6 @@ import (
 	"plairo/params"
 	"plairo/utils"
 	"testing"
-
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
 func TestTransaction_SerializeTransaction(t *testing.T) {
@@ -130,9 +128,14 @@ Testing transaction validation methods
 
 // mocking a chainstate database
 type mockChainstate struct {
-	txmap     map[string]*Transaction
-	utxo      map[string]*TransactionOutput
-	utxocount map[string]int
+	txmap      map[string]*Transaction
+	utxo       map[string]*TransactionOutput
+	utxocount  map[string]int
+	bestBlock  []byte
+	bestHeight uint32
+	// writeErr is returned by WriteBatchTX, discarded counts the calls to DiscardBatchTX
+	writeErr  error
+	discarded int
 }
 
 func (mc *mockChainstate) getOutputId(txid []byte, vout uint32) []byte {
@@ -147,13 +150,12 @@ func (mc *mockChainstate) GetUtxo(txid []byte, vout uint32) (*TransactionOutput,
 	return out, ok
 }
 
-func (mc *mockChainstate) GetTX(txid []byte) ([]byte, error) {
-	mt, ok := mc.txmap[hex.EncodeToString(txid)]
+func (mc *mockChainstate) GetUtxoEntry(txid []byte, vout uint32) (*UtxoEntry, bool) {
+	out, ok := mc.GetUtxo(txid, vout)
 	if !ok {
-		return nil, leveldb.ErrNotFound
+		return nil, false
 	}
-	// no need to update output metadata, outputs are accessed using the GetUTXO method
-	return mt.SerializeTXMetadata(), nil
+	return NewUtxoEntry(mc.txmap[hex.EncodeToString(txid)], out), true
 }
 
 func (mc *mockChainstate) RemoveUtxo(txid []byte, vout uint32) bool {
@@ -176,9 +178,29 @@ func (mc *mockChainstate) InsertBatchTX(tx *Transaction) error {
 	mc.utxocount[hex.EncodeToString(tx.TXID)] = count
 	return nil
 }
-func (mc *mockChainstate) WriteBatchTX() error {
+func (mc *mockChainstate) InsertBatchUtxo(entry *UtxoEntry) error {
+	txid := entry.Output.ParentTXID
+	if _, ok := mc.txmap[hex.EncodeToString(txid)]; !ok {
+		tx := NewTransaction(nil, nil)
+		tx.TXID, tx.BlockHeight, tx.IsCoinbase = txid, entry.BlockHeight, entry.IsCoinbase
+		mc.txmap[hex.EncodeToString(txid)] = tx
+	}
+	mc.utxo[hex.EncodeToString(mc.getOutputId(txid, entry.Output.Vout))] = entry.Output
+	mc.utxocount[hex.EncodeToString(txid)]++
 	return nil
 }
+func (mc *mockChainstate) SetBestBlock(hash []byte, height uint32) {
+	mc.bestBlock, mc.bestHeight = hash, height
+}
+func (mc *mockChainstate) GetBestBlock() ([]byte, uint32, bool) {
+	return mc.bestBlock, mc.bestHeight, mc.bestBlock != nil
+}
+func (mc *mockChainstate) WriteBatchTX() error {
+	return mc.writeErr
+}
+func (mc *mockChainstate) DiscardBatchTX() {
+	mc.discarded++
+}
 
 func initTestCState() CState {
 	old := cstate
@@ -186,6 +208,10 @@ func initTestCState() CState {
 		make(map[string]*Transaction),
 		make(map[string]*TransactionOutput),
 		make(map[string]int),
+		nil,
+		0,
+		nil,
+		0,
 	}
 	return old
 }
@@ -395,3 +421,59 @@ func TestTransaction_cleanUpInputs(t *testing.T) {
 		}
 	}
 }
+
+func TestTransaction_setExtraNonce(t *testing.T) {
+	_, pubkey, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+	cb, err := NewCoinbaseTransaction("coinbase", 1000, pubkey, 9)
+	if err != nil {
+		t.Fatalf("Error creating coinbase: %v\n", err)
+	}
+	cbcopy := cb.copyCoinbase()
+	cbcopy.setExtraNonce(0xaabbccdd00112233)
+
+	// the original coinbase should not be affected
+	if bytes.Equal(cb.TXID, cbcopy.TXID) {
+		t.Errorf("Expected TXID to change after setting the extra-nonce.\n")
+	}
+	if !bytes.Equal(cb.inputs[0].ScriptSig[CoinbaseExtraNonceOffset:CoinbaseExtraNonceOffset+CoinbaseExtraNonceSize], make([]byte, CoinbaseExtraNonceSize)) {
+		t.Errorf("Original coinbase extra-nonce was modified.\n")
+	}
+	sig := cbcopy.inputs[0].ScriptSig
+	if utils.DeserializeUint32(sig[:CoinbaseExtraNonceOffset], false) != 10 {
+		t.Errorf("Expected block height to be kept in coinbase signature, got %x\n", sig)
+	}
+	if utils.DeserializeUint64(sig[CoinbaseExtraNonceOffset:CoinbaseExtraNonceOffset+CoinbaseExtraNonceSize], false) != 0xaabbccdd00112233 {
+		t.Errorf("Unexpected extra-nonce in coinbase signature: %x\n", sig)
+	}
+	// outputs should point to the new TXID
+	for _, outp := range cbcopy.outputs {
+		if !bytes.Equal(outp.ParentTXID, cbcopy.TXID) {
+			t.Errorf("Output parent TXID was not updated.\n")
+		}
+	}
+	for _, outp := range cb.outputs {
+		if !bytes.Equal(outp.ParentTXID, cb.TXID) {
+			t.Errorf("Output parent TXID of the original coinbase was modified.\n")
+		}
+	}
+}
+
+func TestTransaction_SplitAtExtraNonce(t *testing.T) {
+	_, pubkey, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+	cb, err := NewCoinbaseTransaction("coinbase", 1000, pubkey, 9)
+	if err != nil {
+		t.Fatalf("Error creating coinbase: %v\n", err)
+	}
+	cb.setExtraNonce(0x0102030405060708)
+	coinb1, coinb2 := cb.SplitAtExtraNonce()
+	joined := append(append(append([]byte(nil), coinb1...), 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08), coinb2...)
+	if !bytes.Equal(joined, cb.Serialize()) {
+		t.Errorf("Coinbase split does not surround the extra-nonce.\nExp: %x\nGot: %x\n", cb.Serialize(), joined)
+	}
+}
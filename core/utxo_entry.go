@@ -0,0 +1,60 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var ErrInvalidUtxoEntry = errors.New("invalid UTXO entry")
+
+// UtxoEntry is an unspent output along with the info about the TX that created it,
+// stored in the chainstate under its own (TXID, vout) key
+type UtxoEntry struct {
+	Output      *TransactionOutput
+	BlockHeight uint32
+	IsCoinbase  bool
+}
+
+// NewUtxoEntry creates the entry of the output of a TX
+func NewUtxoEntry(tx *Transaction, outp *TransactionOutput) *UtxoEntry {
+	return &UtxoEntry{Output: outp, BlockHeight: tx.BlockHeight, IsCoinbase: tx.IsCoinbase}
+}
+
+// Serialize returns the compact value stored for the entry
+func (e *UtxoEntry) Serialize() []byte {
+	/*
+	 UTXO entry structure:
+	 -- 2*height (+ 1 if coinbase output) (varint)
+	 -- value (varint)
+	 -- scriptPubKey (rest of the bytes)
+	*/
+	code := uint64(e.BlockHeight) << 1
+	if e.IsCoinbase {
+		code |= 1
+	}
+	res := make([]byte, 2*binary.MaxVarintLen64+len(e.Output.ScriptPubKey))
+	n := binary.PutUvarint(res, code)
+	n += binary.PutUvarint(res[n:], e.Output.Value)
+	n += copy(res[n:], e.Output.ScriptPubKey)
+	return res[:n]
+}
+
+// DeserializeUtxoEntry reads the entry of the output of the TX with the txid and vout given
+func DeserializeUtxoEntry(txid []byte, vout uint32, data []byte) (*UtxoEntry, error) {
+	code, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, ErrInvalidUtxoEntry
+	}
+	data = data[n:]
+	value, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, ErrInvalidUtxoEntry
+	}
+	// copying the script, the data may be reused by the db
+	script := append([]byte{}, data[n:]...)
+	return &UtxoEntry{
+		Output:      NewTransactionOutput(txid, vout, value, script),
+		BlockHeight: uint32(code >> 1),
+		IsCoinbase:  code&1 == 1,
+	}, nil
+}
@@ -0,0 +1,28 @@
+package core
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUtxoEntry_SerializeDeserialize(t *testing.T) {
+	txid := []byte("parenttxid")
+	tcases := []*UtxoEntry{
+		{NewTransactionOutput(txid, 0, 0, []byte{}), 0, false},
+		{NewTransactionOutput(txid, 3, 5000000000, []byte("pubkey")), 1, true},
+		{NewTransactionOutput(txid, 300, 1<<63, []byte("looooooooooooongkeytest")), 1<<32 - 1, false},
+	}
+	for i, e := range tcases {
+		got, err := DeserializeUtxoEntry(txid, e.Output.Vout, e.Serialize())
+		if err != nil {
+			t.Fatalf("Error deserializing entry %d: %v\n", i, err)
+		}
+		if !got.Output.Equal(e.Output) || got.BlockHeight != e.BlockHeight || got.IsCoinbase != e.IsCoinbase {
+			t.Errorf("Entry %d mismatch.\nExp: %+v\nGot: %+v\n", i, e, got)
+		}
+	}
+
+	if _, err := DeserializeUtxoEntry(txid, 0, []byte{0x80}); !errors.Is(err, ErrInvalidUtxoEntry) {
+		t.Errorf("Expected invalid entry error, got %v\n", err)
+	}
+}
@@ -0,0 +1,227 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"plairo/utils"
+)
+
+var ErrIndexMismatch = errors.New("block index does not link back to the genesis")
+var ErrInvalidUndoData = errors.New("undo data does not match the block")
+var ErrCorruptBlock = errors.New("stored block does not match its header")
+
+// BlockReader gives access to the blocks written to the block storage,
+// used on startup to bring the in-memory chain and the chainstate in line with the block index
+type BlockReader interface {
+	// GetBestBlock returns the hash of the tip of the block index, false if no block was written yet
+	GetBestBlock() ([]byte, bool)
+	ReadBlockHeader([]byte) (*BlockHeader, uint32, error)
+	ReadBlock([]byte) (*Block, error)
+	// ReadUndo returns the undo data of the block, as created by GetUndoData, after checking its checksum
+	ReadUndo([]byte) ([]byte, error)
+}
+
+// VerifyChain loads the chain ending at the tip of the block index and brings the chainstate in line with it.
+// Blocks of the chainstate that are not part of the chain are disconnected using their undo data and the blocks
+// the chainstate is missing are connected again from storage. The last checkDepth blocks are then read back
+// and checked against their headers and undo data.
+func (bc *Blockchain) VerifyChain(br BlockReader, checkDepth uint32) error {
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	if err := bc.loadChain(br); err != nil {
+		return err
+	}
+	if err := bc.syncChainstate(br); err != nil {
+		return err
+	}
+	return bc.checkBlocks(br, checkDepth)
+}
+
+// loadChain replaces the in-memory chain with the one ending at the tip of the block index
+func (bc *Blockchain) loadChain(br BlockReader) error {
+	tip, ok := br.GetBestBlock()
+	if !ok {
+		return nil
+	}
+	genesis := bc.chain[0]
+	// walking back from the tip, the heights should decrease by one until the genesis is reached
+	var nodes []*BNode
+	for hash := tip; !bytes.Equal(hash, genesis.header.GetHash()); {
+		header, height, err := br.ReadBlockHeader(hash)
+		if err != nil {
+			return fmt.Errorf("reading header of block %x: %w", hash, err)
+		}
+		if height == 0 || (len(nodes) > 0 && nodes[len(nodes)-1].height != height+1) {
+			return fmt.Errorf("%w: unexpected height %d for block %x", ErrIndexMismatch, height, hash)
+		}
+		nodes = append(nodes, &BNode{header: header, height: height})
+		hash = header.PreviousBlockHash
+	}
+	if len(nodes) > 0 && nodes[len(nodes)-1].height != 1 {
+		return ErrIndexMismatch
+	}
+
+	chain := []*BNode{genesis}
+	genesis.nextBNode = nil
+	for i := len(nodes) - 1; i >= 0; i-- {
+		prev := chain[len(chain)-1]
+		nodes[i].previousBNode = prev
+		prev.nextBNode = nodes[i]
+		chain = append(chain, nodes[i])
+	}
+	bc.chain = chain
+	bc.forks = []*Fork{}
+	return nil
+}
+
+// isOnMainChain checks if the block with the hash and height given is part of the main chain
+func (bc *Blockchain) isOnMainChain(hash []byte, height uint32) bool {
+	return height < uint32(len(bc.chain)) && bytes.Equal(bc.chain[height].header.GetHash(), hash)
+}
+
+// syncChainstate rolls the chainstate back to the main chain and then forward to its tip
+func (bc *Blockchain) syncChainstate(br BlockReader) error {
+	tip := bc.chain[len(bc.chain)-1]
+	bestHash, bestHeight, ok := cstate.GetBestBlock()
+	if !ok {
+		// chainstates written before the best block was recorded are assumed to match the tip
+		cstate.SetBestBlock(tip.header.GetHash(), tip.height)
+		return cstate.WriteBatchTX()
+	}
+
+	for !bc.isOnMainChain(bestHash, bestHeight) {
+		if bestHeight == 0 {
+			return fmt.Errorf("%w: chainstate is not built on the genesis", ErrIndexMismatch)
+		}
+		block, err := br.ReadBlock(bestHash)
+		if err != nil {
+			return fmt.Errorf("reading block %x to disconnect: %w", bestHash, err)
+		}
+		undo, err := br.ReadUndo(bestHash)
+		if err != nil {
+			return fmt.Errorf("reading undo data of block %x: %w", bestHash, err)
+		}
+		if err := disconnectBlock(block, undo, bestHeight); err != nil {
+			return fmt.Errorf("disconnecting block %x: %w", bestHash, err)
+		}
+		bestHash, bestHeight = block.header.PreviousBlockHash, bestHeight-1
+	}
+
+	for height := bestHeight + 1; height <= tip.height; height++ {
+		hash := bc.chain[height].header.GetHash()
+		block, err := br.ReadBlock(hash)
+		if err != nil {
+			return fmt.Errorf("reading block %x to connect: %w", hash, err)
+		}
+		if err := block.ConfirmAsValid(height); err != nil {
+			return fmt.Errorf("connecting block %x: %w", hash, err)
+		}
+	}
+	return nil
+}
+
+// checkBlocks reads back the last blocks of the main chain, checking that each one matches its header
+// and that its undo data is valid. Blocks below the first pruned one are not checked.
+func (bc *Blockchain) checkBlocks(br BlockReader, depth uint32) error {
+	node := bc.chain[len(bc.chain)-1]
+	for i := uint32(0); i < depth && node.height > 0; i++ {
+		hash := node.header.GetHash()
+		block, err := br.ReadBlock(hash)
+		if errors.Is(err, ErrBlockPruned) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading block %x: %w", hash, err)
+		}
+		if !bytes.Equal(block.GetBlockHash(), hash) || !bytes.Equal(block.generateBlockMerkleRoot(), block.header.MerkleRoot) {
+			return fmt.Errorf("%w: %x", ErrCorruptBlock, hash)
+		}
+		undo, err := br.ReadUndo(hash)
+		if err != nil {
+			return fmt.Errorf("reading undo data of block %x: %w", hash, err)
+		}
+		if _, err := parseUndoData(block, undo); err != nil {
+			return fmt.Errorf("block %x: %w", hash, err)
+		}
+		node = node.previousBNode
+	}
+	return nil
+}
+
+// disconnectBlock reverts the chainstate changes of the block at the height given,
+// which should be the best block of the chainstate
+func disconnectBlock(block *Block, undo []byte, height uint32) (err error) {
+	// the partial changes are dropped if the block cannot be disconnected
+	defer func() {
+		if err != nil {
+			cstate.DiscardBatchTX()
+		}
+	}()
+	spent, err := parseUndoData(block, undo)
+	if err != nil {
+		return err
+	}
+	// removing the outputs created by the block
+	for i := len(block.allBlockTx) - 1; i >= 0; i-- {
+		tx := block.allBlockTx[i]
+		for vout := range tx.outputs {
+			if !cstate.RemoveUtxo(tx.TXID, uint32(vout)) {
+				return fmt.Errorf("%w: %x:%d", ErrNonExistentUTXO, tx.TXID, vout)
+			}
+		}
+	}
+	// restoring the outputs spent by the block
+	for _, entry := range spent {
+		if err := cstate.InsertBatchUtxo(entry); err != nil {
+			return err
+		}
+	}
+	if err := BStorage.DisconnectBlock(block); err != nil {
+		return err
+	}
+	cstate.SetBestBlock(block.header.PreviousBlockHash, height-1)
+	return cstate.WriteBatchTX()
+}
+
+// parseUndoData returns the entries of the outputs spent by the block, in the order of the inputs
+func parseUndoData(block *Block, undo []byte) ([]*UtxoEntry, error) {
+	caret := uint64(0)
+	// readNext returns the next n bytes of undo and moves the caret, or nil if undo is not long enough
+	readNext := func(n uint64) []byte {
+		if n > uint64(len(undo))-caret {
+			return nil
+		}
+		caret += n
+		return undo[caret-n : caret]
+	}
+
+	raw := readNext(4)
+	if raw == nil || int(utils.DeserializeUint32(raw, false)) != len(block.allBlockTx)-1 {
+		return nil, ErrInvalidUndoData
+	}
+	var entries []*UtxoEntry
+	for _, tx := range block.allBlockTx[1:] {
+		for _, inp := range tx.inputs {
+			rawCode := readNext(8)
+			rawSpkLen := readNext(8)
+			if rawCode == nil || rawSpkLen == nil {
+				return nil, ErrInvalidUndoData
+			}
+			scriptPubKey := readNext(utils.DeserializeUint64(rawSpkLen, false))
+			rawValue := readNext(8)
+			if scriptPubKey == nil || rawValue == nil {
+				return nil, ErrInvalidUndoData
+			}
+			// the height was multiplied by 2, with the right-most bit set for coinbase outputs
+			code := utils.DeserializeUint64(rawCode, false)
+			outp := NewTransactionOutput(inp.OutputReferred.ParentTXID, inp.OutputReferred.Vout,
+				utils.DeserializeUint64(rawValue, false), append([]byte(nil), scriptPubKey...))
+			entries = append(entries, &UtxoEntry{Output: outp, BlockHeight: uint32(code >> 1), IsCoinbase: code&1 == 1})
+		}
+	}
+	if caret != uint64(len(undo)) {
+		return nil, ErrInvalidUndoData
+	}
+	return entries, nil
+}
@@ -0,0 +1,136 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// createStoredTestChain inserts blocks on top of the genesis, returning them in order of height
+func createStoredTestChain(t *testing.T, bc *Blockchain, n int) []*Block {
+	blocks := make([]*Block, n)
+	for i := range blocks {
+		tip := bc.chain[len(bc.chain)-1]
+		blocks[i] = solveOnNode(t, bc.cparams, tip, tip.header.Timestamp+60, tip.header.TargetBits)
+		if err := bc.InsertBlock(blocks[i], tip.height+1); err != nil {
+			t.Fatalf("Error inserting block #%d: %v\n", i+1, err)
+		}
+	}
+	return blocks
+}
+
+func expectTestUtxo(t *testing.T, block *Block, exists bool) {
+	t.Helper()
+	cb := block.allBlockTx[0]
+	if _, ok := cstate.GetUtxo(cb.TXID, 0); ok != exists {
+		t.Errorf("Expected coinbase output of block %x to exist: %v\n", block.GetBlockHash(), exists)
+	}
+}
+
+func expectTestBestBlock(t *testing.T, block *Block, height uint32) {
+	t.Helper()
+	hash, gotHeight, ok := cstate.GetBestBlock()
+	if !ok || !bytes.Equal(hash, block.GetBlockHash()) || gotHeight != height {
+		t.Errorf("Unexpected chainstate best block %x at height %d\n", hash, gotHeight)
+	}
+}
+
+func TestBlockchain_VerifyChain(t *testing.T) {
+	oldcstate := initTestCState()
+	defer resetTestCState(oldcstate)
+	oldmp := initTestMempool()
+	defer resetTestMempool(oldmp)
+	oldstorage := initTestStorage()
+	defer resetTestStorage(oldstorage)
+	storage := BStorage.(*mockStorage)
+
+	const bits = 0x2000ffff
+	blocks := createStoredTestChain(t, createTestBlockchain(bits), 3)
+
+	// Test Case #1: a new blockchain should load the stored chain, the chainstate already matches it
+	bc := createTestBlockchain(bits)
+	if err := bc.VerifyChain(storage, 6); err != nil {
+		t.Fatalf("Error verifying chain: %v\n", err)
+	}
+	if len(bc.chain) != 4 || !bytes.Equal(bc.chain[3].header.GetHash(), blocks[2].GetBlockHash()) {
+		t.Fatalf("Stored chain was not loaded, height %d\n", len(bc.chain)-1)
+	}
+	if bc.chain[3].previousBNode != bc.chain[2] || bc.chain[2].nextBNode != bc.chain[3] {
+		t.Errorf("Loaded nodes are not linked.\n")
+	}
+	expectTestBestBlock(t, blocks[2], 3)
+
+	// Test Case #2: the chainstate lags behind, as if the last two blocks were not flushed
+	for _, b := range blocks[1:] {
+		cstate.RemoveUtxo(b.allBlockTx[0].TXID, 0)
+	}
+	cstate.SetBestBlock(blocks[0].GetBlockHash(), 1)
+	if err := createTestBlockchain(bits).VerifyChain(storage, 6); err != nil {
+		t.Fatalf("Error verifying chain: %v\n", err)
+	}
+	for _, b := range blocks {
+		expectTestUtxo(t, b, true)
+	}
+	expectTestBestBlock(t, blocks[2], 3)
+
+	// Test Case #3: the chainstate is at a block which is not part of the chain of the block index
+	cstate.RemoveUtxo(blocks[2].allBlockTx[0].TXID, 0)
+	stale := solveOnNode(t, bc.cparams, bc.chain[2], bc.chain[2].header.Timestamp+120, bits)
+	storage.WriteBlock(stale, 3)
+	storage.tip = blocks[2].GetBlockHash()
+	if err := stale.ConfirmAsValid(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := createTestBlockchain(bits).VerifyChain(storage, 6); err != nil {
+		t.Fatalf("Error verifying chain: %v\n", err)
+	}
+	expectTestUtxo(t, stale, false)
+	if len(storage.disconnected) != 1 || !bytes.Equal(storage.disconnected[0], stale.GetBlockHash()) {
+		t.Errorf("Expected the stale block records to be removed from storage.\n")
+	}
+	expectTestUtxo(t, blocks[2], true)
+	expectTestBestBlock(t, blocks[2], 3)
+
+	// Test Case #4: corrupt undo data should be detected within the check depth only
+	storage.undo[string(blocks[0].GetBlockHash())] = []byte{0x01}
+	if err := createTestBlockchain(bits).VerifyChain(storage, 2); err != nil {
+		t.Errorf("Expected the corrupt block to be below the check depth, got %v\n", err)
+	}
+	if err := createTestBlockchain(bits).VerifyChain(storage, 3); !errors.Is(err, ErrInvalidUndoData) {
+		t.Errorf("Expected ErrInvalidUndoData, got %v\n", err)
+	}
+}
+
+func TestParseUndoData(t *testing.T) {
+	oldcstate := initTestCState()
+	defer resetTestCState(oldcstate)
+
+	// a block spending the outputs of two TXs already in the chainstate
+	basetx := NewTransaction(nil, createTestOutputs(2, 0, nil, nil))
+	basetx.BlockHeight, basetx.IsCoinbase = 5, true
+	cstate.InsertBatchTX(basetx)
+	tx := NewTransaction(createTestInputs(basetx.outputs), createTestOutputs(1, 1, nil, nil))
+	cb := NewTransaction([]*TransactionInput{}, []*TransactionOutput{})
+	block := NewBlock([]*Transaction{cb, tx})
+
+	undo, _ := block.GetUndoData()
+	entries, err := parseUndoData(block, undo)
+	if err != nil {
+		t.Fatalf("Error parsing undo data: %v\n", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d\n", len(entries))
+	}
+	for i, e := range entries {
+		if !e.Output.Equal(basetx.outputs[i]) || e.BlockHeight != 5 || !e.IsCoinbase {
+			t.Errorf("Unexpected entry #%d: %+v\n", i, e)
+		}
+	}
+
+	if _, err := parseUndoData(block, undo[:len(undo)-1]); !errors.Is(err, ErrInvalidUndoData) {
+		t.Errorf("Expected ErrInvalidUndoData for truncated data, got %v\n", err)
+	}
+	if _, err := parseUndoData(NewBlock([]*Transaction{cb}), undo); !errors.Is(err, ErrInvalidUndoData) {
+		t.Errorf("Expected ErrInvalidUndoData for another block, got %v\n", err)
+	}
+}
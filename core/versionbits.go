@@ -0,0 +1,192 @@
+package core
+
+import (
+	"plairo/params"
+	"sync"
+)
+
+const (
+	// VersionBitsTopBits are set in the version of blocks signalling with version bits, as in BIP9
+	VersionBitsTopBits uint32 = 0x20000000
+	// VersionBitsTopMask selects the top 3 bits of the version
+	VersionBitsTopMask uint32 = 0xe0000000
+)
+
+// ThresholdState is the state of a deployment for the blocks of a retarget period
+type ThresholdState int
+
+const (
+	// ThresholdDefined is the state of every deployment at the genesis
+	ThresholdDefined ThresholdState = iota
+	// ThresholdStarted means blocks are counted towards the threshold
+	ThresholdStarted
+	// ThresholdLockedIn means the threshold was reached, the deployment will be active after one more period
+	ThresholdLockedIn
+	// ThresholdActive means the new rules are enforced
+	ThresholdActive
+	// ThresholdFailed means the deployment timed out before locking in
+	ThresholdFailed
+)
+
+func (ts ThresholdState) String() string {
+	switch ts {
+	case ThresholdDefined:
+		return "defined"
+	case ThresholdStarted:
+		return "started"
+	case ThresholdLockedIn:
+		return "locked_in"
+	case ThresholdActive:
+		return "active"
+	case ThresholdFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// versionBitsCache stores the state of each deployment for the last node of every retarget period computed.
+// States never change for a block, so the cache is valid for forks as well. The states are keyed by block hash,
+// so that the nodes dropped when the chain is reloaded or reorganized are not kept reachable.
+type versionBitsCache struct {
+	mtx    sync.Mutex
+	states [params.DefinedDeployments]map[string]ThresholdState
+}
+
+func newVersionBitsCache() *versionBitsCache {
+	c := &versionBitsCache{}
+	for i := range c.states {
+		c.states[i] = make(map[string]ThresholdState)
+	}
+	return c
+}
+
+// cacheKey returns the key of the node in the cache, nil stands for the node before the genesis
+func cacheKey(node *BNode) string {
+	if node == nil {
+		return ""
+	}
+	return string(node.header.GetHash())
+}
+
+// ancestor returns the node of the chain of bn at the height given, nil if the height is above bn
+func (bn *BNode) ancestor(height uint32) *BNode {
+	if height > bn.height {
+		return nil
+	}
+	node := bn
+	for node.height > height {
+		node = node.previousBNode
+	}
+	return node
+}
+
+// signalsDeployment checks if the version of the header signals for the deployment
+func signalsDeployment(d *params.Deployment, header *BlockHeader) bool {
+	return header.Version&VersionBitsTopMask == VersionBitsTopBits && header.Version&(uint32(1)<<d.Bit) != 0
+}
+
+// periodEnd returns the last node of the retarget period before the one the block built on top of prevNode
+// belongs to, nil if that block is in the first period
+func periodEnd(prevNode *BNode, period uint32) *BNode {
+	if prevNode == nil {
+		return nil
+	}
+	// the period of the next block starts at height h if (h % period) == 0
+	sinceStart := (prevNode.height + 1) % period
+	if sinceStart > prevNode.height {
+		return nil
+	}
+	return prevNode.ancestor(prevNode.height - sinceStart)
+}
+
+// state returns the state of the deployment for a block built on top of prevNode.
+// States only change at the start of a period, so they are calculated for the last node of each period,
+// walking back until a cached state is found.
+func (c *versionBitsCache) state(cparams *params.ChainParams, id params.DeploymentID, prevNode *BNode) ThresholdState {
+	d := &cparams.Deployments[id]
+	switch d.StartTime {
+	case params.DeploymentAlwaysActive:
+		return ThresholdActive
+	case params.DeploymentNeverActive:
+		return ThresholdFailed
+	}
+	period := cparams.RetargetInterval
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	cache := c.states[id]
+
+	var toCompute []*BNode
+	node := periodEnd(prevNode, period)
+	for {
+		if _, ok := cache[cacheKey(node)]; ok {
+			break
+		}
+		// every deployment is defined until signalling starts, there is no need to walk back further
+		if node == nil || node.MedianTimePast() < d.StartTime {
+			cache[cacheKey(node)] = ThresholdDefined
+			break
+		}
+		toCompute = append(toCompute, node)
+		node = periodEnd(node.previousBNode, period)
+	}
+
+	// moving forward, one period at a time
+	state := cache[cacheKey(node)]
+	for i := len(toCompute) - 1; i >= 0; i-- {
+		node = toCompute[i]
+		mtp := node.MedianTimePast()
+		switch state {
+		case ThresholdDefined:
+			if mtp >= d.Timeout {
+				state = ThresholdFailed
+			} else if mtp >= d.StartTime {
+				state = ThresholdStarted
+			}
+		case ThresholdStarted:
+			if mtp >= d.Timeout {
+				state = ThresholdFailed
+				break
+			}
+			// counting the blocks of the period that signal for the deployment
+			var count uint32
+			n := node
+			for j := uint32(0); j < period && n != nil; j++ {
+				if signalsDeployment(d, n.header) {
+					count++
+				}
+				n = n.previousBNode
+			}
+			if count >= d.Threshold {
+				state = ThresholdLockedIn
+			}
+		case ThresholdLockedIn:
+			state = ThresholdActive
+		}
+		cache[cacheKey(node)] = state
+	}
+	return state
+}
+
+// DeploymentState returns the state of the deployment for a block built on top of prevNode
+func (bc *Blockchain) DeploymentState(id params.DeploymentID, prevNode *BNode) ThresholdState {
+	return bc.vbCache.state(bc.cparams, id, prevNode)
+}
+
+// IsDeploymentActive checks if the rules of the deployment are enforced for the block of node
+func (bc *Blockchain) IsDeploymentActive(id params.DeploymentID, node *BNode) bool {
+	return bc.DeploymentState(id, node.previousBNode) == ThresholdActive
+}
+
+// computeBlockVersion returns the version of a block built on top of prevNode,
+// signalling for every deployment that has started or locked in
+func (bc *Blockchain) computeBlockVersion(prevNode *BNode) uint32 {
+	version := VersionBitsTopBits
+	for id := params.DeploymentID(0); id < params.DefinedDeployments; id++ {
+		switch bc.DeploymentState(id, prevNode) {
+		case ThresholdStarted, ThresholdLockedIn:
+			version |= uint32(1) << bc.cparams.Deployments[id].Bit
+		}
+	}
+	return version
+}
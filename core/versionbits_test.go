@@ -0,0 +1,117 @@
+package core
+
+import (
+	"plairo/params"
+	"testing"
+)
+
+// createVersionNodes creates a chain of nodes with the versions given, mined a minute apart
+func createVersionNodes(versions []uint32) []*BNode {
+	nodes := make([]*BNode, len(versions))
+	var prev *BNode
+	for i, v := range versions {
+		nodes[i] = &BNode{previousBNode: prev, header: &BlockHeader{Version: v, Timestamp: 1000 + int64(i)*60}, height: uint32(i)}
+		prev = nodes[i]
+	}
+	return nodes
+}
+
+// versionBitsTestChain returns a blockchain using periods of 4 blocks, with 3 signalling blocks needed to lock in
+func versionBitsTestChain(startTime, timeout int64) *Blockchain {
+	cparams := testParams()
+	cparams.RetargetInterval = 4
+	cparams.Deployments[params.DeploymentTestDummy] = params.Deployment{
+		Name: "testdummy", Bit: 28, StartTime: startTime, Timeout: timeout, Threshold: 3,
+	}
+	return &Blockchain{cparams: cparams, vbCache: newVersionBitsCache()}
+}
+
+func TestBlockchain_DeploymentState(t *testing.T) {
+	const yes = VersionBitsTopBits | 1<<28
+	const no = VersionBitsTopBits
+	// the top bits should be set for the signal to count
+	const noTopBits = 1 << 28
+	id := params.DeploymentTestDummy
+
+	checkStates := func(bc *Blockchain, nodes []*BNode, exp []ThresholdState) {
+		t.Helper()
+		for h, state := range exp {
+			var prev *BNode
+			if h > 0 {
+				prev = nodes[h-1]
+			}
+			if got := bc.DeploymentState(id, prev); got != state {
+				t.Errorf("Expected state %s for block at height %d, got %s\n", state, h, got)
+			}
+		}
+	}
+	D, S, L, A, F := ThresholdDefined, ThresholdStarted, ThresholdLockedIn, ThresholdActive, ThresholdFailed
+
+	// Test Case #1: enough signalling in the second period, the deployment activates in the fourth
+	nodes := createVersionNodes([]uint32{1, no, no, no, yes, no, yes, yes, no, no, no, no, no, no, no, no})
+	bc := versionBitsTestChain(0, params.NoTimeout)
+	checkStates(bc, nodes, []ThresholdState{D, D, D, D, S, S, S, S, L, L, L, L, A, A, A, A, A})
+	if !bc.IsDeploymentActive(id, nodes[12]) || bc.IsDeploymentActive(id, nodes[11]) {
+		t.Errorf("Expected the deployment to be active from height 12.\n")
+	}
+
+	// Test Case #2: the signals are not counted without the top bits
+	nodes = createVersionNodes([]uint32{1, no, no, no, yes, noTopBits, yes, noTopBits, no, no, no, no})
+	bc = versionBitsTestChain(0, params.NoTimeout)
+	checkStates(bc, nodes, []ThresholdState{D, D, D, D, S, S, S, S, S, S, S, S, S})
+
+	// Test Case #3: signalling starts after the median-time-past reaches the start time
+	nodes = createVersionNodes([]uint32{1, no, no, no, yes, yes, yes, yes, yes, yes, yes, yes})
+	bc = versionBitsTestChain(1000+3*60, params.NoTimeout)
+	checkStates(bc, nodes, []ThresholdState{D, D, D, D, D, D, D, D, S, S, S, S, L})
+
+	// Test Case #4: timing out before locking in
+	nodes = createVersionNodes([]uint32{1, no, no, no, no, no, no, no, yes, yes, yes, yes})
+	bc = versionBitsTestChain(0, 1000+4*60)
+	checkStates(bc, nodes, []ThresholdState{D, D, D, D, S, S, S, S, F, F, F, F, F})
+
+	// Test Case #5: always and never active deployments
+	bc = versionBitsTestChain(params.DeploymentAlwaysActive, params.NoTimeout)
+	checkStates(bc, nodes, []ThresholdState{A, A, A, A, A})
+	bc = versionBitsTestChain(params.DeploymentNeverActive, params.NoTimeout)
+	checkStates(bc, nodes, []ThresholdState{F, F, F, F, F})
+}
+
+func TestBlockchain_ComputeBlockVersion(t *testing.T) {
+	nodes := createVersionNodes([]uint32{1, 0, 0, 0, 0, 0, 0, 0})
+	bc := versionBitsTestChain(0, params.NoTimeout)
+
+	// signalling only after the deployment has started
+	if v := bc.computeBlockVersion(nodes[0]); v != VersionBitsTopBits {
+		t.Errorf("Expected version %08x, got %08x\n", VersionBitsTopBits, v)
+	}
+	if v := bc.computeBlockVersion(nodes[3]); v != VersionBitsTopBits|1<<28 {
+		t.Errorf("Expected version %08x, got %08x\n", VersionBitsTopBits|1<<28, v)
+	}
+	// no deployment is signalled once active
+	bc = versionBitsTestChain(params.DeploymentAlwaysActive, params.NoTimeout)
+	if v := bc.computeBlockVersion(nodes[3]); v != VersionBitsTopBits {
+		t.Errorf("Expected version %08x, got %08x\n", VersionBitsTopBits, v)
+	}
+}
+
+func TestBlockchain_DeploymentStateReload(t *testing.T) {
+	const yes = VersionBitsTopBits | 1<<28
+	versions := []uint32{1, VersionBitsTopBits, yes, yes, yes, yes, yes, yes}
+	id := params.DeploymentTestDummy
+	bc := versionBitsTestChain(0, params.NoTimeout)
+	nodes := createVersionNodes(versions)
+	if got := bc.DeploymentState(id, nodes[7]); got != ThresholdLockedIn {
+		t.Fatalf("Expected state %s, got %s\n", ThresholdLockedIn, got)
+	}
+	cached := len(bc.vbCache.states[id])
+
+	// the nodes of a reloaded chain are new, the states computed for the same blocks should be reused
+	reloaded := createVersionNodes(versions)
+	if got := bc.DeploymentState(id, reloaded[7]); got != ThresholdLockedIn {
+		t.Errorf("Expected state %s after reloading, got %s\n", ThresholdLockedIn, got)
+	}
+	if len(bc.vbCache.states[id]) != cached {
+		t.Errorf("Expected %d cached states after reloading, got %d\n", cached, len(bc.vbCache.states[id]))
+	}
+}
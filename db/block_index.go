@@ -1,47 +1,202 @@
 package db
 
 import (
-	"os"
-	"path/filepath"
+	"bytes"
+	"errors"
 	"plairo/core"
 	"plairo/utils"
 )
 
+var ErrInvalidIndexRecord = errors.New("invalid block index record")
+var ErrTxNotIndexed = errors.New("transaction not found in the transaction index")
+
 type BlockIndex struct {
 	*DBwrapper
 }
 
-var BlockIndexPath string
+func NewBlockIndex(store KVStore, isObfuscated bool) (*BlockIndex, error) {
+	d, err := NewDBwrapper(store, isObfuscated)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockIndex{d}, nil
+}
+
+// BlockPos locates the records of a block in the blk and rev files with the same file number
+type BlockPos struct {
+	File       uint32
+	DataOffset uint32
+	DataSize   uint32
+	UndoOffset uint32
+	UndoSize   uint32
+	// Pruned is set once the files of the block have been deleted
+	Pruned bool
+}
 
-func init() {
-	homedir, _ := os.UserHomeDir()
-	BlockIndexPath = filepath.Join(homedir, "/.plairo/blocks/index")
+// blockPosSize is the size of a serialized BlockPos, the position fields followed by a status byte
+const blockPosSize = 21
+
+// blockStatusPruned is set in the status byte of pruned blocks
+const blockStatusPruned = 1
+
+func (bp *BlockPos) serialize() []byte {
+	res := make([]byte, 0, blockPosSize)
+	for _, v := range []uint32{bp.File, bp.DataOffset, bp.DataSize, bp.UndoOffset, bp.UndoSize} {
+		res = append(res, utils.SerializeUint32(v, false)...)
+	}
+	var status byte
+	if bp.Pruned {
+		status |= blockStatusPruned
+	}
+	return append(res, status)
 }
 
-func NewBlockIndex(dbpath string, isObfuscated bool) *BlockIndex {
-	return &BlockIndex{NewDBwrapper(dbpath, isObfuscated)}
+func deserializeBlockPos(data []byte) *BlockPos {
+	field := func(i int) uint32 { return utils.DeserializeUint32(data[4*i:4*i+4], false) }
+	return &BlockPos{
+		File:       field(0),
+		DataOffset: field(1),
+		DataSize:   field(2),
+		UndoOffset: field(3),
+		UndoSize:   field(4),
+		Pruned:     data[20]&blockStatusPruned != 0,
+	}
 }
 
-func (bi *BlockIndex) InsertBlockIndexRecord(block core.IBlock, blockHeight uint32) error {
+// InsertBlockIndexRecord adds the block index record of the block to the current batch
+func (bi *BlockIndex) InsertBlockIndexRecord(block core.IBlock, blockHeight uint32, pos *BlockPos) {
 	/*
 		Block index record structure:
-		-- Block Header
-		-- Block Height
-		-- Number of Transactions
+		-- Block Header (84 bytes)
+		-- Block Height (4 bytes)
+		-- Number of Transactions (4 bytes)
+		-- Position of the block in the flat files and its status (21 bytes)
+		Records written by previous versions end after the number of transactions,
+		their blocks are stored in the paged db.
 	*/
-	res := make([]byte, 0, 32) // at least 32 bytes will be needed
+	res := make([]byte, 0, core.BlockHeaderSize+8+blockPosSize)
 	res = append(res, block.GetBlockHeader()...)
 	res = append(res, utils.SerializeUint32(blockHeight, false)...)
 	res = append(res, utils.SerializeUint32(uint32(block.GetNoOfTx()), false)...)
-	return bi.Insert(buildKey(BlockIndexKey, block.GetBlockHash()), res)
+	res = append(res, pos.serialize()...)
+	bi.PutInBatch(buildKey(BlockIndexKey, block.GetBlockHash()), res)
+}
+
+// getBlockIndexRecord returns the block index record of the block and its position in the flat files,
+// nil for blocks written by previous versions
+func (bi *BlockIndex) getBlockIndexRecord(bkey []byte) ([]byte, *BlockPos, error) {
+	record, err := bi.Get(buildKey(BlockIndexKey, bkey))
+	if err != nil {
+		return nil, nil, err
+	}
+	switch len(record) {
+	case core.BlockHeaderSize + 8:
+		return record, nil, nil
+	case core.BlockHeaderSize + 8 + blockPosSize:
+		return record, deserializeBlockPos(record[core.BlockHeaderSize+8:]), nil
+	}
+	return nil, nil, ErrInvalidIndexRecord
+}
+
+// GetBlockHeader reads the header and the height of the block from its block index record
+func (bi *BlockIndex) GetBlockHeader(bkey []byte) (*core.BlockHeader, uint32, error) {
+	record, _, err := bi.getBlockIndexRecord(bkey)
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseBlockHeaderRecord(record)
+}
+
+// parseBlockHeaderRecord reads the header and the height of the block from a block index record
+func parseBlockHeaderRecord(record []byte) (*core.BlockHeader, uint32, error) {
+	if len(record) != core.BlockHeaderSize+8 && len(record) != core.BlockHeaderSize+8+blockPosSize {
+		return nil, 0, ErrInvalidIndexRecord
+	}
+	header, err := core.DeserializeBlockHeader(record[:core.BlockHeaderSize])
+	if err != nil {
+		return nil, 0, err
+	}
+	return header, utils.DeserializeUint32(record[core.BlockHeaderSize:core.BlockHeaderSize+4], false), nil
+}
+
+// ForEachBlockHeader calls fn with the hash, header and height of every block of the block index, ordered by hash,
+// until fn returns false. Blocks of forks and pruned blocks are visited as well. The records are read from snap
+// if it is not nil, so that the batches written meanwhile are not seen.
+func (bi *BlockIndex) ForEachBlockHeader(snap *DBSnapshot, fn func(hash []byte, header *core.BlockHeader, height uint32) bool) error {
+	iter, err := bi.newPrefixIterator(snap, buildKey(BlockIndexKey, nil))
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+	for iter.Next() {
+		header, height, err := parseBlockHeaderRecord(iter.Value())
+		if err != nil {
+			return err
+		}
+		if !fn(append([]byte{}, iter.Key()[1:]...), header, height) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
+// markPruned rewrites the block index records of the blocks stored in the file given with the pruned status,
+// returning the number of records changed
+func (bi *BlockIndex) markPruned(file uint32) (int, error) {
+	type indexRecord struct{ key, value []byte }
+	var records []indexRecord
+	err := bi.forEachWithPrefix([]byte{byte(BlockIndexKey)}, func(key, value []byte) bool {
+		if len(value) == core.BlockHeaderSize+8+blockPosSize {
+			pos := deserializeBlockPos(value[core.BlockHeaderSize+8:])
+			if pos.File == file && !pos.Pruned {
+				records = append(records, indexRecord{append([]byte{}, key...), append([]byte{}, value...)})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range records {
+		r.value[len(r.value)-1] |= blockStatusPruned
+		if err := bi.Insert(r.key, r.value); err != nil {
+			return 0, err
+		}
+	}
+	return len(records), nil
+}
+
+// GetBlockPos returns the position of the block in the flat files, nil if it was written by a previous version
+func (bi *BlockIndex) GetBlockPos(bkey []byte) (*BlockPos, error) {
+	_, pos, err := bi.getBlockIndexRecord(bkey)
+	return pos, err
+}
+
+// SetBestBlock adds the hash of the tip of the chain in the current batch
+func (bi *BlockIndex) SetBestBlock(hash []byte) {
+	bi.PutInBatch(buildKey(BestBlockKey, nil), hash)
+}
+
+// GetBestBlock returns the hash of the tip of the chain, false if no block was indexed yet
+func (bi *BlockIndex) GetBestBlock() ([]byte, bool) {
+	hash, err := bi.Get(buildKey(BestBlockKey, nil))
+	if err != nil {
+		return nil, false
+	}
+	return hash, true
 }
 
-func (bi *BlockIndex) InsertTXIndexRecord(txid []byte, txOffsetInBlock uint32, batchMode bool) error {
+func (bi *BlockIndex) InsertTXIndexRecord(txid, blockHash []byte, loc core.TxLocation, batchMode bool) error {
 	/*
 		Transaction Index record structure:
+		-- Hash of the block containing the transaction (32 bytes)
 		-- Offset of transaction inside the block data (4 bytes)
+		-- Length of the transaction data (4 bytes)
 	*/
-	res := utils.SerializeUint32(txOffsetInBlock, false)
+	res := make([]byte, 0, len(blockHash)+8)
+	res = append(res, blockHash...)
+	res = append(res, utils.SerializeUint32(loc.Offset, false)...)
+	res = append(res, utils.SerializeUint32(loc.Length, false)...)
 	if batchMode {
 		bi.PutInBatch(buildKey(TxIndexKey, txid), res)
 		return nil
@@ -49,6 +204,129 @@ func (bi *BlockIndex) InsertTXIndexRecord(txid []byte, txOffsetInBlock uint32, b
 	return bi.Insert(buildKey(TxIndexKey, txid), res)
 }
 
+// GetTXIndexRecord returns the hash of the block containing the transaction and its location in the block data
+func (bi *BlockIndex) GetTXIndexRecord(txid []byte) ([]byte, core.TxLocation, error) {
+	record, err := bi.Get(buildKey(TxIndexKey, txid))
+	if errors.Is(err, ErrNotFound) {
+		return nil, core.TxLocation{}, ErrTxNotIndexed
+	}
+	if err != nil {
+		return nil, core.TxLocation{}, err
+	}
+	return parseTXIndexRecord(txid, record)
+}
+
+// parseTXIndexRecord reads the hash of the block and the location of the transaction from a transaction index record
+func parseTXIndexRecord(txid, record []byte) ([]byte, core.TxLocation, error) {
+	if len(record) <= 8 {
+		return nil, core.TxLocation{}, ErrInvalidIndexRecord
+	}
+	n := len(record) - 8
+	return record[:n], core.TxLocation{
+		TXID:   txid,
+		Offset: utils.DeserializeUint32(record[n:n+4], false),
+		Length: utils.DeserializeUint32(record[n+4:], false),
+	}, nil
+}
+
+// ForEachTXIndexRecord calls fn with the hash of the block containing each indexed transaction and its location,
+// ordered by TXID, until fn returns false. The records are read from snap if it is not nil.
+func (bi *BlockIndex) ForEachTXIndexRecord(snap *DBSnapshot, fn func(blockHash []byte, loc core.TxLocation) bool) error {
+	iter, err := bi.newPrefixIterator(snap, buildKey(TxIndexKey, nil))
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+	for iter.Next() {
+		// key and value are copied, the iterator reuses them
+		hash, loc, err := parseTXIndexRecord(append([]byte{}, iter.Key()[1:]...), append([]byte{}, iter.Value()...))
+		if err != nil {
+			return err
+		}
+		if !fn(hash, loc) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
+// RemoveTXIndexRecord adds the removal of the transaction index record to the current batch,
+// if the record points to the block given. The transaction may also be part of another block.
+func (bi *BlockIndex) RemoveTXIndexRecord(txid, blockHash []byte) {
+	if hash, _, err := bi.GetTXIndexRecord(txid); err == nil && bytes.Equal(hash, blockHash) {
+		bi.DeleteInBatch(buildKey(TxIndexKey, txid))
+	}
+}
+
+// BlockFileInfo describes the content of a blk file and of the rev file with the same number
+type BlockFileInfo struct {
+	Blocks      uint32
+	HeightFirst uint32
+	HeightLast  uint32
+	// Size and UndoSize are the bytes used in the blk and rev file, new records are appended there
+	Size     uint32
+	UndoSize uint32
+}
+
+// addBlock updates the info with a block appended to the files
+func (fi *BlockFileInfo) addBlock(height uint32, pos *BlockPos) {
+	if fi.Blocks == 0 || height < fi.HeightFirst {
+		fi.HeightFirst = height
+	}
+	if height > fi.HeightLast {
+		fi.HeightLast = height
+	}
+	fi.Blocks++
+	fi.Size = pos.DataOffset + flatRecordHeaderSize + pos.DataSize
+	fi.UndoSize = pos.UndoOffset + flatRecordHeaderSize + pos.UndoSize
+}
+
+func (fi *BlockFileInfo) serialize() []byte {
+	/*
+		File info record structure:
+		-- Number of blocks (4 bytes)
+		-- Lowest block height (4 bytes)
+		-- Highest block height (4 bytes)
+		-- Size of the blk file (4 bytes)
+		-- Size of the rev file (4 bytes)
+	*/
+	res := make([]byte, 0, 20)
+	for _, v := range []uint32{fi.Blocks, fi.HeightFirst, fi.HeightLast, fi.Size, fi.UndoSize} {
+		res = append(res, utils.SerializeUint32(v, false)...)
+	}
+	return res
+}
+
+func fileInfoKey(file uint32) []byte {
+	return buildKey(FileInfoKey, utils.SerializeUint32(file, false))
+}
+
+// SetFileInfo adds the file info record of the file number given to the current batch, along with the
+// number of the last file
+func (bi *BlockIndex) SetFileInfo(file uint32, info *BlockFileInfo) {
+	bi.PutInBatch(fileInfoKey(file), info.serialize())
+	bi.PutInBatch(buildKey(LastFileKey, nil), utils.SerializeUint32(file, false))
+}
+
+// GetFileInfo returns the file info record of the file number given
+func (bi *BlockIndex) GetFileInfo(file uint32) (*BlockFileInfo, bool) {
+	record, err := bi.Get(fileInfoKey(file))
+	if err != nil || len(record) != 20 {
+		return nil, false
+	}
+	field := func(i int) uint32 { return utils.DeserializeUint32(record[4*i:4*i+4], false) }
+	return &BlockFileInfo{Blocks: field(0), HeightFirst: field(1), HeightLast: field(2), Size: field(3), UndoSize: field(4)}, true
+}
+
+// GetLastFile returns the number of the file new blocks are appended to
+func (bi *BlockIndex) GetLastFile() uint32 {
+	record, err := bi.Get(buildKey(LastFileKey, nil))
+	if err != nil || len(record) != 4 {
+		return 0
+	}
+	return utils.DeserializeUint32(record, false)
+}
+
 func (bi *BlockIndex) WriteBatchBI() error {
 	return bi.WriteBatch()
 }
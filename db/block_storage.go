@@ -1,78 +1,299 @@
 package db
 
 import (
-	"os"
-	"path/filepath"
+	"bytes"
+	"errors"
+	"io"
 	"plairo/core"
 	"plairo/params"
+	"plairo/utils"
 )
 
+var ErrBlockNotFound = errors.New("block not found in storage")
+var ErrUndoNotFound = errors.New("undo record not found in storage")
+var ErrInvalidMagic = errors.New("record does not start with the network magic bytes")
+var ErrUndoChecksum = errors.New("undo record checksum mismatch")
+
+// BlockStorage appends blocks and their undo data to blk and rev flat files, located through the block index.
+// Blocks written by previous versions are still read from the paged db.
 type BlockStorage struct {
 	*DBwrapper
 	maxPageSize int
+	maxFileSize uint32
+	cparams     *params.ChainParams
+	undo        *undoStorage
+	index       *BlockIndex
+	blkFiles    *flatFileSeq
+	revFiles    *flatFileSeq
+	// lastFile is the file new blocks are appended to, lastInfo its committed file info
+	lastFile uint32
+	lastInfo *BlockFileInfo
+	// pendingFile and pendingInfo follow the blocks staged in the block index batch,
+	// they replace lastFile and lastInfo once the batch is committed
+	pendingFile uint32
+	pendingInfo *BlockFileInfo
+	// txIndex enables the transaction index records of the blocks written
+	txIndex bool
+	// pruneTarget is the size in bytes the flat files are pruned to, 0 if pruning is disabled
+	pruneTarget uint64
+	pruneDepth  uint32
+}
+
+// NewBlockStorage opens the block storage at dbpath. The undo and block index databases and the
+// flat files are found in the data directory of the network, the databases are opened with open.
+func NewBlockStorage(cparams *params.ChainParams, open StoreOpener, dbpath string, isObfuscated bool) (*BlockStorage, error) {
+	blocks, err := openDBwrapper(open, dbpath, isObfuscated)
+	if err != nil {
+		return nil, err
+	}
+	undo, err := openDBwrapper(open, UndoStoragePath(cparams), true)
+	if err != nil {
+		blocks.Close()
+		return nil, err
+	}
+	index, err := openDBwrapper(open, BlockIndexPath(cparams), true)
+	if err != nil {
+		undo.Close()
+		blocks.Close()
+		return nil, err
+	}
+	// using max size of 100kb
+	bs := &BlockStorage{
+		DBwrapper:   blocks,
+		maxPageSize: 102400,
+		maxFileSize: uint32(params.MaxBlockFileSize),
+		cparams:     cparams,
+		undo:        &undoStorage{undo, 102400},
+		index:       &BlockIndex{index},
+		blkFiles:    &flatFileSeq{BlockFilesPath(cparams), "blk"},
+		revFiles:    &flatFileSeq{BlockFilesPath(cparams), "rev"},
+	}
+	bs.lastFile = bs.index.GetLastFile()
+	if info, ok := bs.index.GetFileInfo(bs.lastFile); ok {
+		bs.lastInfo = info
+	} else {
+		bs.lastInfo = &BlockFileInfo{}
+	}
+	bs.index.onCommit = bs.commitPosition
+	bs.index.onDiscard = bs.discardPosition
+	return bs, nil
 }
 
-var BlockStoragePath string
-var UndoStoragePath string
+// commitPosition makes the position after the staged blocks the one new blocks are appended to
+func (bs *BlockStorage) commitPosition() {
+	if bs.pendingInfo != nil {
+		bs.lastFile, bs.lastInfo = bs.pendingFile, bs.pendingInfo
+		bs.pendingInfo = nil
+	}
+}
 
-func init() {
-	homedir, _ := os.UserHomeDir()
-	BlockStoragePath = filepath.Join(homedir, params.StoragePath)
-	UndoStoragePath = filepath.Join(homedir, params.UndoStoragePath)
+// discardPosition drops the position after the staged blocks, their data is overwritten by the next block
+func (bs *BlockStorage) discardPosition() {
+	bs.pendingInfo = nil
 }
 
-func NewBlockStorage(dbpath string, isObfuscated bool) *BlockStorage {
-	// using max size of 100kb
-	return &BlockStorage{NewDBwrapper(dbpath, isObfuscated), 102400}
+// RegisterInJournal makes the block, undo and block index records part of the journal commits
+func (bs *BlockStorage) RegisterInJournal(j *Journal) {
+	j.Register(JournalBlocks, bs.DBwrapper)
+	j.Register(JournalUndo, bs.undo.DBwrapper)
+	j.Register(JournalIndex, bs.index.DBwrapper)
 }
 
+// WriteBlock appends the block data and its undo record to the flat files and adds the block index
+// and file info records to the current batch. If the block storage is registered in a journal,
+// the records are committed along with the UTXO changes of the block, otherwise they are written right away.
+// Data appended but never committed is overwritten by the next block.
 func (bs *BlockStorage) WriteBlock(block core.IBlock, height uint32) error {
-	/*
-	 Block key structure:
-	 -- Block hash (32 bytes)
-	 -- Record Number (1 byte)
-	 Block storage record structure:
-	 -- isContinued (1 byte)
-	 -- Magic bytes (first record) (4 bytes)
-	 -- Block data
-	*/
-	key := block.GetBlockHash()
-
-	data := params.BlockMagicBytes
-	data = append(data, block.Serialize()...)
-
-	// storing block data
-	if err := bs.PageInsert(key, data, bs.maxPageSize); err != nil {
-		return err
+	data := block.Serialize()
+	undo, checksum := block.GetUndoData()
+	undo = append(append([]byte{}, undo...), checksum...)
+
+	// appending after the blocks already staged, the file info is copied until the records are committed
+	file, info := bs.lastFile, *bs.lastInfo
+	if bs.pendingInfo != nil {
+		file, info = bs.pendingFile, *bs.pendingInfo
 	}
-	// writing undo record
-	uw := newUndoStorage(UndoStoragePath, true)
-	defer uw.Close()
-	if err := uw.writeUndo(block); err != nil {
+	// starting a new file if the block does not fit in the last one
+	if info.Size > 0 && uint64(info.Size)+flatRecordHeaderSize+uint64(len(data)) > uint64(bs.maxFileSize) {
+		file++
+		info = BlockFileInfo{}
+	}
+	pos := &BlockPos{
+		File:       file,
+		DataOffset: info.Size,
+		DataSize:   uint32(len(data)),
+		UndoOffset: info.UndoSize,
+		UndoSize:   uint32(len(undo)),
+	}
+	if err := bs.blkFiles.writeRecord(pos.File, pos.DataOffset, bs.cparams.MagicBytes, data); err != nil {
 		return err
 	}
-	// inserting block index record
-	bi := NewBlockIndex(BlockIndexPath, true)
-	defer bi.Close()
-	if err := bi.InsertBlockIndexRecord(block, height); err != nil {
+	if err := bs.revFiles.writeRecord(pos.File, pos.UndoOffset, bs.cparams.MagicBytes, undo); err != nil {
 		return err
 	}
+	info.addBlock(height, pos)
+
+	// staging block index record, file info and the new tip
+	bs.index.InsertBlockIndexRecord(block, height, pos)
+	bs.index.SetFileInfo(file, &info)
+	bs.pendingFile, bs.pendingInfo = file, &info
+	bs.index.SetBestBlock(block.GetBlockHash())
+	if bs.txIndex {
+		bs.indexBlockTxs(block, true)
+	}
+
+	if bs.journal != nil {
+		return nil
+	}
+	return bs.index.WriteBatchBI()
+}
+
+// OpenBlock returns a reader streaming the serialized block with the hash given
+func (bs *BlockStorage) OpenBlock(bkey []byte) (*RecordReader, error) {
+	pos, err := bs.index.GetBlockPos(bkey)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrBlockNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pos != nil {
+		if pos.Pruned {
+			return nil, core.ErrBlockPruned
+		}
+		return bs.blkFiles.openRecord(pos.File, pos.DataOffset, pos.DataSize, bs.cparams.MagicBytes)
+	}
+	// legacy blocks are stored in pages, starting with the magic bytes
+	data, ok := bs.PageGet(bkey, bs.maxPageSize)
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+	if !bytes.HasPrefix(data, bs.cparams.MagicBytes) {
+		return nil, ErrInvalidMagic
+	}
+	return newBytesRecordReader(data[len(bs.cparams.MagicBytes):]), nil
+}
 
-	return nil
+// HasBlock checks if the block has a block index record, its data may have been pruned since
+func (bs *BlockStorage) HasBlock(bkey []byte) bool {
+	_, err := bs.index.GetBlockPos(bkey)
+	return err == nil
 }
 
+// GetBlockData returns the serialized block with the hash given
 func (bs *BlockStorage) GetBlockData(bkey []byte) ([]byte, bool) {
-	return bs.PageGet(bkey, bs.maxPageSize)
+	rr, err := bs.OpenBlock(bkey)
+	if err != nil {
+		return nil, false
+	}
+	defer rr.Close()
+	data, err := io.ReadAll(rr)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// ReadBlock returns the stored block with the hash given
+func (bs *BlockStorage) ReadBlock(bkey []byte) (*core.Block, error) {
+	rr, err := bs.OpenBlock(bkey)
+	if err != nil {
+		return nil, err
+	}
+	defer rr.Close()
+	data, err := io.ReadAll(rr)
+	if err != nil {
+		return nil, err
+	}
+	return core.DeserializeBlock(data)
+}
+
+// ReadUndo returns the undo data of the block with the hash given, after checking its magic bytes and checksum
+func (bs *BlockStorage) ReadUndo(bkey []byte) ([]byte, error) {
+	pos, err := bs.index.GetBlockPos(bkey)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrUndoNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if pos != nil {
+		if pos.Pruned {
+			return nil, core.ErrBlockPruned
+		}
+		rr, err := bs.revFiles.openRecord(pos.File, pos.UndoOffset, pos.UndoSize, bs.cparams.MagicBytes)
+		if err != nil {
+			return nil, err
+		}
+		defer rr.Close()
+		if data, err = io.ReadAll(rr); err != nil {
+			return nil, err
+		}
+	} else {
+		// legacy undo records are stored in pages, starting with the magic bytes
+		legacy, ok := bs.undo.GetUndoData(bkey)
+		if !ok {
+			return nil, ErrUndoNotFound
+		}
+		if !bytes.HasPrefix(legacy, bs.cparams.MagicBytes) {
+			return nil, ErrInvalidMagic
+		}
+		data = legacy[len(bs.cparams.MagicBytes):]
+	}
+	if len(data) < 32 {
+		return nil, ErrUndoChecksum
+	}
+	undo, checksum := data[:len(data)-32], data[len(data)-32:]
+	if !bytes.Equal(utils.CalculateSHA256Hash(utils.CalculateSHA256Hash(undo)), checksum) {
+		return nil, ErrUndoChecksum
+	}
+	return undo, nil
+}
+
+// ReadBlockHeader returns the header and the height of the block with the hash given from its block index record
+func (bs *BlockStorage) ReadBlockHeader(bkey []byte) (*core.BlockHeader, uint32, error) {
+	return bs.index.GetBlockHeader(bkey)
+}
+
+// GetBestBlock returns the hash of the last block written, false if no block was written yet
+func (bs *BlockStorage) GetBestBlock() ([]byte, bool) {
+	return bs.index.GetBestBlock()
+}
+
+// GetFileInfo returns the file info record of the blk and rev files with the number given
+func (bs *BlockStorage) GetFileInfo(file uint32) (*BlockFileInfo, bool) {
+	return bs.index.GetFileInfo(file)
+}
+
+// GetIndexSnapshot takes a snapshot of the block index, to walk the block headers and the transaction index
+// records without seeing the blocks written meanwhile
+func (bs *BlockStorage) GetIndexSnapshot() (*DBSnapshot, error) {
+	return bs.index.GetSnapshot()
 }
 
-func (bs *BlockStorage) GetUndoData(bkey []byte) ([]byte, bool) {
-	uw := newUndoStorage(UndoStoragePath, true)
-	defer uw.Close()
-	return uw.GetUndoData(bkey)
+// ForEachBlockHeader calls fn with the hash, header and height of every block of the block index, see
+// BlockIndex.ForEachBlockHeader. snap should be taken with GetIndexSnapshot, or be nil.
+func (bs *BlockStorage) ForEachBlockHeader(snap *DBSnapshot, fn func(hash []byte, header *core.BlockHeader, height uint32) bool) error {
+	return bs.index.ForEachBlockHeader(snap, fn)
 }
 
-func (bs *BlockStorage) Close() {
-	bs.DBwrapper.Close()
+// ForEachTXIndexRecord calls fn with every transaction index record, see BlockIndex.ForEachTXIndexRecord.
+// snap should be taken with GetIndexSnapshot, or be nil.
+func (bs *BlockStorage) ForEachTXIndexRecord(snap *DBSnapshot, fn func(blockHash []byte, loc core.TxLocation) bool) error {
+	return bs.index.ForEachTXIndexRecord(snap, fn)
+}
+
+// Close closes the undo, block index and block databases, returning the first error
+func (bs *BlockStorage) Close() error {
+	err := bs.undo.Close()
+	if ierr := bs.index.Close(); err == nil {
+		err = ierr
+	}
+	if berr := bs.DBwrapper.Close(); err == nil {
+		err = berr
+	}
+	return err
 }
 
 type undoStorage struct {
@@ -80,28 +301,6 @@ type undoStorage struct {
 	maxPageSize int
 }
 
-func newUndoStorage(dbpath string, isObfuscated bool) *undoStorage {
-	// using max size of 100kb
-	return &undoStorage{NewDBwrapper(dbpath, isObfuscated), 102400}
-}
-
-func (us *undoStorage) writeUndo(block core.IBlock) error {
-	/*
-		Structure of undo record:
-			Magic Bytes (4 bytes)
-			Size of Block Undo record (8 bytes)
-			Block Undo record
-			Double-SHA256 checksum for Block Undo record (32 bytes)
-	*/
-	key := block.GetBlockHash()
-	undodata := params.BlockMagicBytes
-	blockUndo, checksum := block.GetUndoData()
-	undodata = append(undodata, blockUndo...)
-	undodata = append(undodata, checksum...)
-
-	return us.PageInsert(key, undodata, us.maxPageSize)
-}
-
 func (us *undoStorage) GetUndoData(bkey []byte) ([]byte, bool) {
 	return us.PageGet(bkey, us.maxPageSize)
 }
@@ -2,14 +2,14 @@ package db
 
 import (
 	"bytes"
+	"errors"
 	"os"
 	"path/filepath"
+	"plairo/core"
 	"plairo/params"
 	"testing"
 )
 
-var testBlockStoragePath string
-
 type testBlock struct {
 	blockHash  []byte
 	serialData []byte
@@ -35,21 +35,22 @@ func (tb *testBlock) GetNoOfTx() int {
 }
 
 func (tb *testBlock) GetBlockHeader() []byte {
-	return []byte("header")
+	return make([]byte, core.BlockHeaderSize)
 }
 
 func (tb *testBlock) GetUndoData() ([]byte, []byte) {
 	return []byte("undo"), []byte("checksum")
 }
 
+func (tb *testBlock) TxLocations() []core.TxLocation {
+	return []core.TxLocation{{TXID: append([]byte("tx"), tb.blockHash...), Offset: 0, Length: uint32(len(tb.serialData))}}
+}
+
 func (tb *testBlock) GetExpData() []byte {
-	return append(params.BlockMagicBytes, tb.Serialize()...)
+	return tb.Serialize()
 }
 
 func testBlockStorageSetup() []*testBlock {
-	homedir, _ := os.UserHomeDir()
-	testBlockStoragePath = filepath.Join(homedir, "/.plairo/blockstoragetest")
-
 	tcases := []*testBlock{
 		{[]byte("aa"), []byte{0xd, 0xa, 0xd, 0xa}},
 		{[]byte("ab"), []byte{}},
@@ -60,20 +61,315 @@ func testBlockStorageSetup() []*testBlock {
 	return tcases
 }
 
+// newTestBlockStorage opens a block storage with its databases and flat files in a temporary data directory
+func newTestBlockStorage(t *testing.T, open StoreOpener) *BlockStorage {
+	t.Helper()
+	cparams := *params.RegTestParams
+	homedir, _ := os.UserHomeDir()
+	cparams.DataDir, _ = filepath.Rel(homedir, t.TempDir())
+	bs, err := NewBlockStorage(&cparams, open, BlockStoragePath(&cparams), true)
+	if err != nil {
+		t.Fatalf("Error opening block storage: %v\n", err)
+	}
+	t.Cleanup(func() { bs.Close() })
+	return bs
+}
+
 func TestBlockStorage_WriteBlock_GetBlockData(t *testing.T) {
-	cases := testBlockStorageSetup()
-	bs := NewBlockStorage(testBlockStoragePath, true)
-	for i, tcase := range cases {
-		if err := bs.WriteBlock(tcase, 1); err != nil {
-			t.Errorf("Error writing block #%d\n", i)
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		cases := testBlockStorageSetup()
+		bs := newTestBlockStorage(t, open)
+		for i, tcase := range cases {
+			if err := bs.WriteBlock(tcase, 1); err != nil {
+				t.Errorf("Error writing block #%d\n", i)
+			}
+			got, err := bs.GetBlockData(tcase.GetBlockHash())
+			if !err {
+				t.Errorf("Error getting data block #%d\n", i)
+			}
+			if !bytes.Equal(got, tcase.GetExpData()) {
+				t.Errorf("Got unexpected data for block #%d\n", i)
+			}
+
 		}
-		got, err := bs.GetBlockData(tcase.GetBlockHash())
-		if !err {
-			t.Errorf("Error getting data block #%d\n", i)
+	})
+}
+
+func TestBlockStorage_JournaledWriteBlock(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		bs := newTestBlockStorage(t, open)
+		cstate := newTestChainstate(t, open)
+		journal := newTestJournalDB(t, open)
+		cstate.RegisterInJournal(journal)
+		bs.RegisterInJournal(journal)
+
+		block := &testBlock{[]byte("journaled"), []byte{0xd, 0xa}}
+		if err := bs.WriteBlock(block, 1); err != nil {
+			t.Fatalf("Error writing block: %v\n", err)
+		}
+		// the block records are only staged until the chainstate commits
+		if _, ok := bs.GetBlockData(block.GetBlockHash()); ok {
+			t.Errorf("Block was written before the commit.\n")
+		}
+		cstate.SetBestBlock(block.GetBlockHash(), 1)
+		if err := cstate.WriteBatchTX(); err != nil {
+			t.Fatalf("Error committing: %v\n", err)
 		}
-		if !bytes.Equal(got, tcase.GetExpData()) {
-			t.Errorf("Got unexpected data for block #%d\n", i)
+		if got, ok := bs.GetBlockData(block.GetBlockHash()); !ok || !bytes.Equal(got, block.GetExpData()) {
+			t.Errorf("Unexpected block data after commit: %x\n", got)
 		}
+		if _, err := bs.ReadUndo(block.GetBlockHash()); errors.Is(err, ErrUndoNotFound) {
+			t.Errorf("Undo record was not committed.\n")
+		}
+		if hash, ok := bs.GetBestBlock(); !ok || !bytes.Equal(hash, block.GetBlockHash()) {
+			t.Errorf("Unexpected block index tip: %s\n", hash)
+		}
+		if hash, height, ok := cstate.GetBestBlock(); !ok || !bytes.Equal(hash, block.GetBlockHash()) || height != 1 {
+			t.Errorf("Unexpected chainstate best block: %s %d\n", hash, height)
+		}
+	})
+}
 
-	}
+func TestBlockStorage_JournaledDiscard(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		bs := newTestBlockStorage(t, open)
+		cstate := newTestChainstate(t, open)
+		journal := newTestJournalDB(t, open)
+		cstate.RegisterInJournal(journal)
+		bs.RegisterInJournal(journal)
+
+		// the position of the staged block is dropped along with its records
+		failed := &testBlock{[]byte("failed"), []byte{0xd, 0xa, 0xd, 0xa}}
+		if err := bs.WriteBlock(failed, 1); err != nil {
+			t.Fatalf("Error writing block: %v\n", err)
+		}
+		if bs.lastInfo.Blocks != 0 {
+			t.Errorf("Last file info was updated before the commit: %+v\n", bs.lastInfo)
+		}
+		cstate.DiscardBatchTX()
+		if bs.lastInfo.Blocks != 0 || bs.pendingInfo != nil {
+			t.Errorf("Position of the discarded block was kept: %+v\n", bs.lastInfo)
+		}
+
+		// blocks staged together are appended one after the other, over the data of the discarded block
+		blocks := []*testBlock{{[]byte("first"), []byte{0xd, 0xa}}, {[]byte("second"), []byte{0xa, 0xd, 0xa}}}
+		for i, block := range blocks {
+			if err := bs.WriteBlock(block, uint32(i+1)); err != nil {
+				t.Fatalf("Error writing block #%d: %v\n", i+1, err)
+			}
+		}
+		if err := cstate.WriteBatchTX(); err != nil {
+			t.Fatalf("Error committing: %v\n", err)
+		}
+		for i, block := range blocks {
+			if got, ok := bs.GetBlockData(block.GetBlockHash()); !ok || !bytes.Equal(got, block.GetExpData()) {
+				t.Errorf("Unexpected data of block #%d: %x\n", i+1, got)
+			}
+		}
+		if _, ok := bs.GetBlockData(failed.GetBlockHash()); ok {
+			t.Errorf("Discarded block was committed.\n")
+		}
+		pos, err := bs.index.GetBlockPos(blocks[0].GetBlockHash())
+		if err != nil || pos.DataOffset != 0 {
+			t.Errorf("Expected the first block at the start of the file, got %+v %v\n", pos, err)
+		}
+		if info, ok := bs.GetFileInfo(0); !ok || *info != *bs.lastInfo || info.Blocks != 2 {
+			t.Errorf("Unexpected last file info after the commit: %+v\n", bs.lastInfo)
+		}
+	})
+}
+
+func TestBlockStorage_ReadUndo(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		bs := newTestBlockStorage(t, open)
+
+		if _, err := bs.ReadUndo([]byte("missing")); !errors.Is(err, ErrUndoNotFound) {
+			t.Errorf("Expected ErrUndoNotFound, got %v\n", err)
+		}
+		// the checksum of the test block is not the hash of its undo data
+		block := &testBlock{[]byte("undo"), []byte{0xd, 0xa}}
+		if err := bs.WriteBlock(block, 1); err != nil {
+			t.Fatalf("Error writing block: %v\n", err)
+		}
+		if _, err := bs.ReadUndo(block.GetBlockHash()); !errors.Is(err, ErrUndoChecksum) {
+			t.Errorf("Expected ErrUndoChecksum, got %v\n", err)
+		}
+	})
+}
+
+func TestBlockStorage_FlatFiles(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		bs := newTestBlockStorage(t, open)
+		// two blocks of 1000 bytes fit in a file, along with the record headers
+		bs.maxFileSize = 2100
+
+		var blocks []*testBlock
+		for i := 0; i < 5; i++ {
+			block := &testBlock{[]byte{byte(i)}, bytes.Repeat([]byte{byte(i)}, 1000)}
+			if err := bs.WriteBlock(block, uint32(10+i)); err != nil {
+				t.Fatalf("Error writing block #%d: %v\n", i, err)
+			}
+			blocks = append(blocks, block)
+		}
+
+		expInfo := []*BlockFileInfo{
+			{Blocks: 2, HeightFirst: 10, HeightLast: 11, Size: 2016, UndoSize: 40},
+			{Blocks: 2, HeightFirst: 12, HeightLast: 13, Size: 2016, UndoSize: 40},
+			{Blocks: 1, HeightFirst: 14, HeightLast: 14, Size: 1008, UndoSize: 20},
+		}
+		for i, exp := range expInfo {
+			if info, ok := bs.GetFileInfo(uint32(i)); !ok || *info != *exp {
+				t.Errorf("Unexpected info for file #%d: %+v\n", i, info)
+			}
+		}
+		for i, block := range blocks {
+			pos, err := bs.index.GetBlockPos(block.GetBlockHash())
+			if err != nil || pos.File != uint32(i/2) {
+				t.Errorf("Unexpected position of block #%d: %+v %v\n", i, pos, err)
+			}
+			if got, ok := bs.GetBlockData(block.GetBlockHash()); !ok || !bytes.Equal(got, block.Serialize()) {
+				t.Errorf("Unexpected data for block #%d\n", i)
+			}
+		}
+
+		// reading part of a block only
+		rr, err := bs.OpenBlock(blocks[3].GetBlockHash())
+		if err != nil {
+			t.Fatalf("Error opening block: %v\n", err)
+		}
+		defer rr.Close()
+		part := make([]byte, 10)
+		if _, err := rr.ReadAt(part, 500); err != nil || !bytes.Equal(part, bytes.Repeat([]byte{3}, 10)) || rr.Size() != 1000 {
+			t.Errorf("Unexpected data read from block: %x %v\n", part, err)
+		}
+
+		// the last file is found again when the storage is reopened
+		bs.Close()
+		reopened, err := NewBlockStorage(bs.cparams, open, BlockStoragePath(bs.cparams), true)
+		if err != nil {
+			t.Fatalf("Error reopening block storage: %v\n", err)
+		}
+		defer reopened.Close()
+		if reopened.lastFile != 2 || *reopened.lastInfo != *expInfo[2] {
+			t.Errorf("Unexpected last file %d after reopening: %+v\n", reopened.lastFile, reopened.lastInfo)
+		}
+	})
+}
+
+func TestBlockStorage_LegacyRecords(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		bs := newTestBlockStorage(t, open)
+		block := &testBlock{[]byte("legacy"), []byte{0xd, 0xa, 0xd, 0xa}}
+
+		// blocks written by previous versions are paged and their index records have no position
+		magic := bs.cparams.MagicBytes
+		bs.PageInsert(block.GetBlockHash(), append(append([]byte{}, magic...), block.Serialize()...), bs.maxPageSize)
+		bs.undo.PageInsert(block.GetBlockHash(), append(append([]byte{}, magic...), make([]byte, 32)...), bs.maxPageSize)
+		record := append(block.GetBlockHeader(), make([]byte, 8)...)
+		bs.index.Insert(buildKey(BlockIndexKey, block.GetBlockHash()), record)
+
+		if got, ok := bs.GetBlockData(block.GetBlockHash()); !ok || !bytes.Equal(got, block.Serialize()) {
+			t.Errorf("Unexpected legacy block data: %x\n", got)
+		}
+		if _, err := bs.ReadUndo(block.GetBlockHash()); !errors.Is(err, ErrUndoChecksum) {
+			t.Errorf("Expected ErrUndoChecksum for the legacy undo record, got %v\n", err)
+		}
+		if _, ok := bs.GetBlockData([]byte("missing")); ok {
+			t.Errorf("Got data for a block never written.\n")
+		}
+	})
+}
+
+func TestBlockIndex_ForEachBlockHeader(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		bs := newTestBlockStorage(t, open)
+		heights := map[string]uint32{"b": 2, "a": 1}
+		for _, hash := range []string{"b", "a"} {
+			if err := bs.WriteBlock(&testBlock{[]byte(hash), []byte{0xd, 0xa}}, heights[hash]); err != nil {
+				t.Fatalf("Error writing block %s: %v\n", hash, err)
+			}
+		}
+		snap, err := bs.index.GetSnapshot()
+		if err != nil {
+			t.Fatalf("Error taking snapshot: %v\n", err)
+		}
+		defer snap.Release()
+		bs.WriteBlock(&testBlock{[]byte("c"), []byte{0xd, 0xa}}, 3)
+
+		var visited []string
+		err = bs.index.ForEachBlockHeader(snap, func(hash []byte, header *core.BlockHeader, height uint32) bool {
+			if height != heights[string(hash)] || header == nil {
+				t.Errorf("Unexpected height %d for block %s\n", height, hash)
+			}
+			visited = append(visited, string(hash))
+			return true
+		})
+		if err != nil {
+			t.Fatalf("Error walking headers: %v\n", err)
+		}
+		expectTestRecords(t, visited, "a", "b")
+
+		n := 0
+		bs.index.ForEachBlockHeader(nil, func([]byte, *core.BlockHeader, uint32) bool {
+			n++
+			return true
+		})
+		if n != 3 {
+			t.Errorf("Expected 3 headers in the current state, got %d\n", n)
+		}
+	})
+}
+
+func TestBlockStorage_IndexSnapshot(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		bs := newTestBlockStorage(t, open)
+		bs.EnableTxIndex()
+		prev := make([]byte, 32)
+		for height := uint32(0); height < 2; height++ {
+			block := createTestChainBlock(t, prev, height)
+			if err := bs.WriteBlock(block, height); err != nil {
+				t.Fatalf("Error writing block #%d: %v\n", height, err)
+			}
+			prev = block.GetBlockHash()
+		}
+		snap, err := bs.GetIndexSnapshot()
+		if err != nil {
+			t.Fatalf("Error taking snapshot: %v\n", err)
+		}
+		defer snap.Release()
+		bs.WriteBlock(createTestChainBlock(t, prev, 2), 2)
+
+		headers, records := 0, 0
+		err = bs.ForEachBlockHeader(snap, func([]byte, *core.BlockHeader, uint32) bool {
+			headers++
+			return true
+		})
+		if err != nil || headers != 2 {
+			t.Errorf("Expected 2 headers in the snapshot, got %d: %v\n", headers, err)
+		}
+		err = bs.ForEachTXIndexRecord(snap, func([]byte, core.TxLocation) bool {
+			records++
+			return true
+		})
+		if err != nil || records != 2 {
+			t.Errorf("Expected 2 transaction index records in the snapshot, got %d: %v\n", records, err)
+		}
+
+		// snapshots of the other databases cannot be used to walk the block index
+		blocksSnap, err := bs.GetSnapshot()
+		if err != nil {
+			t.Fatalf("Error taking snapshot: %v\n", err)
+		}
+		defer blocksSnap.Release()
+		fn := func([]byte, *core.BlockHeader, uint32) bool { return true }
+		if err := bs.ForEachBlockHeader(blocksSnap, fn); !errors.Is(err, ErrForeignSnapshot) {
+			t.Errorf("Expected ErrForeignSnapshot walking headers, got %v\n", err)
+		}
+		if err := bs.ForEachTXIndexRecord(blocksSnap, func([]byte, core.TxLocation) bool { return true }); !errors.Is(err, ErrForeignSnapshot) {
+			t.Errorf("Expected ErrForeignSnapshot walking the transaction index, got %v\n", err)
+		}
+		if err := newTestChainstate(t, open).ForEachUtxo(snap, func(*core.UtxoEntry) bool { return true }); !errors.Is(err, ErrForeignSnapshot) {
+			t.Errorf("Expected ErrForeignSnapshot walking the UTXOs, got %v\n", err)
+		}
+	})
 }
@@ -1,30 +1,54 @@
 package db
 
 import (
+	"encoding/binary"
 	"errors"
-	"os"
-	"path/filepath"
+	"fmt"
 	"plairo/core"
-
-	"github.com/syndtr/goleveldb/leveldb"
+	"plairo/utils"
 )
 
 type Chainstate struct {
 	*DBwrapper
 }
 
-var ChainstatePath string
+var ErrSpentTX = errors.New("TX has no unspent outputs")
+var ErrInvalidUtxoKey = errors.New("invalid UTXO key")
+var ErrCorruptLegacyRecord = errors.New("legacy chainstate record is corrupt")
+
+// legacyMigrationBatchSize is the number of legacy TX records converted in each batch of the migration
+const legacyMigrationBatchSize = 1000
 
-func init() {
-	homedir, _ := os.UserHomeDir()
-	ChainstatePath = filepath.Join(homedir, "/.plairo/chainstate")
-	// instead of initializing the chainstate db here, it will be initialized when injecting to core objects
+func NewChainstate(store KVStore, isObfuscated bool) (*Chainstate, error) {
+	d, err := NewDBwrapper(store, isObfuscated)
+	if err != nil {
+		return nil, err
+	}
+	return &Chainstate{d}, nil
 }
 
-var ErrSpentTX = errors.New("TX has no unspent outputs")
+// OpenChainstate opens the store at dbpath and creates the chainstate on top of it
+func OpenChainstate(open StoreOpener, dbpath string, isObfuscated bool) (*Chainstate, error) {
+	store, err := open(dbpath)
+	if err != nil {
+		return nil, err
+	}
+	return NewChainstate(store, isObfuscated)
+}
 
-func NewChainstate(dbpath string, isObfuscated bool) *Chainstate {
-	return &Chainstate{NewDBwrapper(dbpath, isObfuscated)}
+// utxoKey builds the key of the output of a TX
+func utxoKey(txid []byte, vout uint32) []byte {
+	/*
+	 UTXO key structure:
+	 -- UtxoKey (1 byte)
+	 -- TXID
+	 -- vout (4 bytes), big endian so that the outputs of a TX are stored in order
+	*/
+	bkey := make([]byte, 1+len(txid)+4)
+	bkey[0] = byte(UtxoKey)
+	copy(bkey[1:], txid)
+	binary.BigEndian.PutUint32(bkey[1+len(txid):], vout)
+	return bkey
 }
 
 func (c *Chainstate) InsertTX(tx *core.Transaction) error {
@@ -32,7 +56,15 @@ func (c *Chainstate) InsertTX(tx *core.Transaction) error {
 	if tx.IsSpent() {
 		return ErrSpentTX
 	}
-	return c.Insert(buildKey(TxKey, tx.TXID), tx.SerializeTXMetadata())
+	for i, outp := range tx.GetOutputs() {
+		if !outp.IsNotSpent {
+			continue
+		}
+		if err := c.Insert(utxoKey(tx.TXID, uint32(i)), core.NewUtxoEntry(tx, outp).Serialize()); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (c *Chainstate) InsertBatchTX(tx *core.Transaction) error {
@@ -40,106 +72,266 @@ func (c *Chainstate) InsertBatchTX(tx *core.Transaction) error {
 	if tx.IsSpent() {
 		return ErrSpentTX
 	}
-	c.PutInBatch(buildKey(TxKey, tx.TXID), tx.SerializeTXMetadata())
+	for i, outp := range tx.GetOutputs() {
+		if outp.IsNotSpent {
+			c.PutInBatch(utxoKey(tx.TXID, uint32(i)), core.NewUtxoEntry(tx, outp).Serialize())
+		}
+	}
 	return nil
 }
 
+// InsertBatchUtxo adds a single output to the current batch
+func (c *Chainstate) InsertBatchUtxo(entry *core.UtxoEntry) error {
+	c.PutInBatch(utxoKey(entry.Output.ParentTXID, entry.Output.Vout), entry.Serialize())
+	return nil
+}
+
+// SetBestBlock adds the hash and height of the block the UTXOs correspond to in the current batch
+func (c *Chainstate) SetBestBlock(hash []byte, height uint32) {
+	/*
+		Best block record structure:
+		-- Block hash (32 bytes)
+		-- Block height (4 bytes)
+	*/
+	c.PutInBatch(buildKey(BestBlockKey, nil), append(append([]byte{}, hash...), utils.SerializeUint32(height, false)...))
+}
+
+// GetBestBlock returns the hash and height of the block the UTXOs correspond to, false if no block was connected yet
+func (c *Chainstate) GetBestBlock() ([]byte, uint32, bool) {
+	data, err := c.Get(buildKey(BestBlockKey, nil))
+	if err != nil || len(data) < 4 {
+		return nil, 0, false
+	}
+	return data[:len(data)-4], utils.DeserializeUint32(data[len(data)-4:], false), true
+}
+
+// RegisterInJournal makes the UTXO changes part of the journal commits
+func (c *Chainstate) RegisterInJournal(j *Journal) {
+	j.Register(JournalChainstate, c.DBwrapper)
+}
+
+// WriteBatchTX commits the current batch, along with the block records staged in the same journal
 func (c *Chainstate) WriteBatchTX() error {
-	return c.WriteBatch()
+	return c.CommitBatch()
 }
 
-func (c *Chainstate) RemoveTX(txid []byte) error {
-	return c.Remove(buildKey(TxKey, txid))
+// DiscardBatchTX drops the changes staged since the last commit, along with the block records staged in the same journal
+func (c *Chainstate) DiscardBatchTX() {
+	c.DiscardBatch()
 }
 
-func (c *Chainstate) GetTX(txid []byte) ([]byte, error) {
-	return c.Get(buildKey(TxKey, txid))
+// RemoveTX removes every unspent output of the TX
+func (c *Chainstate) RemoveTX(txid []byte) error {
+	var keys [][]byte
+	err := c.forEachWithPrefix(buildKey(UtxoKey, txid), func(key, _ []byte) bool {
+		keys = append(keys, append([]byte{}, key...))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := c.Remove(key); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (c *Chainstate) UtxoExists(txid []byte, vout uint32) bool {
-	txmeta, err := c.GetTX(txid)
-	if errors.Is(err, leveldb.ErrNotFound) {
-		return false
+	_, err := c.Get(utxoKey(txid, vout))
+	return err == nil
+}
+
+// GetUtxoEntry returns the output along with the height and the coinbase flag of the TX that created it
+func (c *Chainstate) GetUtxoEntry(txid []byte, vout uint32) (*core.UtxoEntry, bool) {
+	data, err := c.Get(utxoKey(txid, vout))
+	if err != nil {
+		return nil, false
 	}
-	tr := core.NewTxMetadataReader(txid, txmeta)
-	bitvec, _ := tr.ReadBitVector()
-	if uint32(len(bitvec)) < vout {
-		return false
+	entry, err := core.DeserializeUtxoEntry(txid, vout, data)
+	if err != nil {
+		return nil, false
 	}
-	return bitvec[vout]
+	return entry, true
 }
 
 func (c *Chainstate) GetUtxo(txid []byte, vout uint32) (*core.TransactionOutput, bool) {
-	txmeta, err := c.GetTX(txid)
-	if errors.Is(err, leveldb.ErrNotFound) {
+	entry, ok := c.GetUtxoEntry(txid, vout)
+	if !ok {
 		return nil, false
 	}
-	tr := core.NewTxMetadataReader(txid, txmeta)
-	bv, vouts := tr.ReadBitVector()
-	for i := 0; i < len(vouts); i++ {
-		if vouts[i] == vout {
-			return tr.ReadOutputs(bv, vouts)[i], true
-		}
-	}
-	return nil, false
+	return entry.Output, true
 }
 
+// RemoveUtxo adds the removal of the UTXO to the current batch, so that spending the inputs of a block
+// is written along with its new outputs
 func (c *Chainstate) RemoveUtxo(txid []byte, vout uint32) bool {
-	// no need to use the getUtxo method, will perform linear search in vouts since
-	// number of outputs is expected to be small
-	txmeta, err := c.GetTX(txid)
-	if errors.Is(err, leveldb.ErrNotFound) {
+	// each output has its own entry, spending it is a single delete
+	if !c.UtxoExists(txid, vout) {
 		return false
 	}
+	c.DeleteInBatch(utxoKey(txid, vout))
+	return true
+}
 
-	tr := core.NewTxMetadataReader(txid, txmeta)
-	// getting the slice of unspent tx and their vouts
-	bv, vouts := tr.ReadBitVector()
-
-	// if utxo to-be-removed is the last unspent output, then
-	// the TX entry must be removed completely
-	if len(vouts) == 1 && vouts[0] == vout {
-		return c.Remove(buildKey(TxKey, txid)) == nil
+func (c *Chainstate) GetNoOfUTXOs(txid []byte) (int, bool) {
+	count := 0
+	err := c.forEachWithPrefix(buildKey(UtxoKey, txid), func(_, _ []byte) bool {
+		count++
+		return true
+	})
+	if err != nil || count == 0 {
+		return 0, false
 	}
+	return count, true
+}
 
-	// checking if UTXO exists before removing
-	if vout >= uint32(len(bv)) || !bv[vout] {
-		return false
+// ForEachUtxo calls fn with every UTXO entry of the chainstate, ordered by TXID and vout, until fn returns false.
+// The entries are read from snap if it is not nil, so that the batches written meanwhile are not seen.
+// Records of the legacy format are not visited, they should have been migrated first.
+func (c *Chainstate) ForEachUtxo(snap *DBSnapshot, fn func(entry *core.UtxoEntry) bool) error {
+	iter, err := c.newPrefixIterator(snap, buildKey(UtxoKey, nil))
+	if err != nil {
+		return err
 	}
-	outs := tr.ReadOutputs(bv, vouts)
-
-	// creating a new fake transaction without this utxo to serialize
-	fakeouts := make([]*core.TransactionOutput, tr.ReadNoOfOutputs())
+	defer iter.Release()
+	for iter.Next() {
+		key := iter.Key()
+		if len(key) < 1+4 {
+			return ErrInvalidUtxoKey
+		}
+		// the TXID is kept by the entry, it is copied since the key is reused by the iterator
+		txid := append([]byte{}, key[1:len(key)-4]...)
+		entry, err := core.DeserializeUtxoEntry(txid, binary.BigEndian.Uint32(key[len(key)-4:]), iter.Value())
+		if err != nil {
+			return err
+		}
+		if !fn(entry) {
+			break
+		}
+	}
+	return iter.Error()
+}
 
-	// placing each remaining unspent output to appropriate position in the new fake outputs
-	for _, outp := range outs {
-		if outp.Vout == vout {
-			continue
+// parseLegacyRecord checks the layout of a per-TX record of the legacy format and returns its unspent outputs
+func parseLegacyRecord(txid, record []byte) ([]*core.UtxoEntry, error) {
+	if len(record) < 9 || record[0] > 1 {
+		return nil, ErrCorruptLegacyRecord
+	}
+	tr := core.NewTxMetadataReader(txid, record)
+	outputs := uint64(tr.ReadNoOfOutputs())
+	vecSize := (outputs + 7) / 8
+	if uint64(len(record)) < 9+vecSize {
+		return nil, ErrCorruptLegacyRecord
+	}
+	// the bits of the first byte of the vector past the last output are never set
+	if outputs%8 != 0 && record[9]>>(outputs%8) != 0 {
+		return nil, ErrCorruptLegacyRecord
+	}
+	// each unspent output is stored with its value, the size of its script and the script
+	_, vouts := tr.ReadBitVector()
+	caret := 9 + vecSize
+	for range vouts {
+		if uint64(len(record)) < caret+16 {
+			return nil, ErrCorruptLegacyRecord
+		}
+		size := utils.DeserializeUint64(record[caret+8:caret+16], false)
+		caret += 16
+		if uint64(len(record))-caret < size {
+			return nil, ErrCorruptLegacyRecord
 		}
-		fakeouts[outp.Vout] = outp
+		caret += size
 	}
-	// filling in the fake outputs with dummy spent outputs
-	for i, fakeout := range fakeouts {
-		if fakeout == nil {
-			fakeouts[i] = core.NewTransactionOutput([]byte{}, 0, 0, []byte{})
-			fakeouts[i].IsNotSpent = false
+	if caret != uint64(len(record)) {
+		return nil, ErrCorruptLegacyRecord
+	}
+	var entries []*core.UtxoEntry
+	for _, outp := range tr.ReadOutputs(nil, nil) {
+		entries = append(entries, &core.UtxoEntry{Output: outp, BlockHeight: tr.ReadBlockHeight(), IsCoinbase: tr.ReadIsCoinbase()})
+	}
+	return entries, nil
+}
+
+// MigrateLegacyUTXOs converts the per-TX records of the legacy format, with a bit vector of the unspent outputs,
+// into per-output entries and returns the number of records converted. The converted records are removed in the
+// same batch as the entries are written, so an interrupted migration continues where it stopped.
+// Legacy versions only obfuscated the records written outside of a batch, so on an obfuscated chainstate
+// a record that is not valid once revealed is read as stored. ErrCorruptLegacyRecord is returned if neither is valid.
+func (c *Chainstate) MigrateLegacyUTXOs() (int, error) {
+	migrated := 0
+	for {
+		n := 0
+		var parseErr error
+		err := c.forEachWithPrefix(buildKey(TxKey, nil), func(key, value []byte) bool {
+			txid := append([]byte{}, key[1:]...)
+			entries, err := parseLegacyRecord(txid, value)
+			if err != nil && c.IsObfuscated {
+				// obfuscating the revealed value again gives the value as stored
+				entries, err = parseLegacyRecord(txid, c.obfuscateValue(value))
+			}
+			if err != nil {
+				parseErr = fmt.Errorf("%w: TX %x", err, txid)
+				return false
+			}
+			for _, entry := range entries {
+				c.PutInBatch(utxoKey(txid, entry.Output.Vout), entry.Serialize())
+			}
+			c.DeleteInBatch(buildKey(TxKey, txid))
+			n++
+			return n < legacyMigrationBatchSize
+		})
+		if err == nil {
+			err = parseErr
+		}
+		if err != nil {
+			// the records converted in the batch so far are not written
+			c.currentBatch = nil
+			return migrated, err
 		}
+		if n == 0 {
+			return migrated, nil
+		}
+		if err := c.WriteBatch(); err != nil {
+			return migrated, err
+		}
+		migrated += n
 	}
-	newmeta := core.NewTransaction(nil, fakeouts).SerializeTXMetadata()
-	err = c.Insert(buildKey(TxKey, txid), newmeta)
-	return err == nil
 }
 
-func (c *Chainstate) GetNoOfUTXOs(txid []byte) (int, bool) {
-	txmeta, err := c.GetTX(txid)
-	if errors.Is(err, leveldb.ErrNotFound) {
-		return 0, false
+// The reindex record holds the stage of the rebuild of the chainstate
+const (
+	reindexWiping    = byte(0)
+	reindexReplaying = byte(1)
+)
+
+// BeginReindex wipes the chainstate so that it can be rebuilt from the stored blocks, unless a rebuild is already
+// in progress. The rebuild is recorded first, so a wipe that was interrupted is completed on the next call.
+func (c *Chainstate) BeginReindex() error {
+	stage, err := c.Get(buildKey(ReindexKey, nil))
+	if err == nil && len(stage) == 1 && stage[0] == reindexReplaying {
+		return nil
+	}
+	if err := c.Insert(buildKey(ReindexKey, nil), []byte{reindexWiping}); err != nil {
+		return err
+	}
+	if err := c.wipe(buildKey(ReindexKey, nil)); err != nil {
+		return err
 	}
-	_, vouts := core.NewTxMetadataReader(txid, txmeta).ReadBitVector()
-	return len(vouts), true
+	return c.Insert(buildKey(ReindexKey, nil), []byte{reindexReplaying})
+}
+
+// IsReindexing checks if a rebuild of the chainstate was started and not completed
+func (c *Chainstate) IsReindexing() bool {
+	_, err := c.Get(buildKey(ReindexKey, nil))
+	return err == nil
+}
 
+// EndReindex marks the rebuild as completed, it should be called once the rebuilt UTXOs are written to disk
+func (c *Chainstate) EndReindex() error {
+	return c.Remove(buildKey(ReindexKey, nil))
 }
 
-func (c *Chainstate) Close() {
-	c.DBwrapper.Close()
+func (c *Chainstate) Close() error {
+	return c.DBwrapper.Close()
 }
@@ -3,20 +3,10 @@ package db
 import (
 	"bytes"
 	"errors"
-	"github.com/syndtr/goleveldb/leveldb"
-	"os"
-	"path/filepath"
 	"plairo/core"
 	"testing"
 )
 
-var testChainstatePath string
-
-func init() {
-	homedir, _ := os.UserHomeDir()
-	testChainstatePath = filepath.Join(homedir, "/.plairo/chainstatetest")
-}
-
 type cTestCase struct {
 	tx   *core.Transaction
 	outs []*core.TransactionOutput
@@ -53,151 +43,420 @@ func TestBuildTXKey(t *testing.T) {
 	}
 }
 
-func TestChainstate_InsertTXGetTxRemoveTX(t *testing.T) {
-	cstate := NewChainstate(testChainstatePath, true)
-	defer cstate.Close()
+func TestUtxoKey(t *testing.T) {
+	testtxid := []byte{0x01, 0x0a, 0x02, 0x0b}
+	expected := []byte{0x43, 0x01, 0x0a, 0x02, 0x0b, 0x00, 0x00, 0x01, 0x02}
+	if !bytes.Equal(utxoKey(testtxid, 258), expected) {
+		t.Errorf("Expected %x\nGot %x\n", expected, utxoKey(testtxid, 258))
+	}
+}
+
+func TestChainstate_InsertTXGetUtxoEntryRemoveTX(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		cstate := newTestChainstate(t, open)
 
-	for i, tcase := range testChainstateSetup() {
-		if err := cstate.InsertTX(tcase.tx); err != nil {
-			if errors.Is(err, ErrSpentTX) && tcase.tx.IsSpent() {
-				continue
-			} else {
-				t.Errorf("Error inserting to chainstate TX with index: %d\n", i)
+		for i, tcase := range testChainstateSetup() {
+			if err := cstate.InsertTX(tcase.tx); err != nil {
+				if errors.Is(err, ErrSpentTX) && tcase.tx.IsSpent() {
+					continue
+				} else {
+					t.Errorf("Error inserting to chainstate TX with index: %d\n", i)
+				}
+			}
+			for j, outp := range tcase.outs {
+				entry, ok := cstate.GetUtxoEntry(tcase.tx.TXID, uint32(j))
+				if ok != outp.IsNotSpent {
+					t.Errorf("TX %d vout %d: Expected entry to exist: %v\n", i, j, outp.IsNotSpent)
+				}
+				if !ok {
+					continue
+				}
+				if !entry.Output.Equal(outp) || entry.BlockHeight != tcase.tx.BlockHeight || entry.IsCoinbase != tcase.tx.IsCoinbase {
+					t.Errorf("TX %d vout %d: Entry mismatch.\n", i, j)
+				}
+			}
+			if err := cstate.RemoveTX(tcase.tx.TXID); err != nil {
+				t.Errorf("Error removing TX with index %d from chainstate.\n", i)
+			}
+			if _, ok := cstate.GetNoOfUTXOs(tcase.tx.TXID); ok {
+				t.Errorf("Expected TX with index %d not to be found in chainstate.\n", i)
 			}
 		}
-		val, err := cstate.GetTX(tcase.tx.TXID)
-		if err != nil {
-			t.Errorf("Error getting from chainstate TX with index: %d\n", i)
+	})
+}
+
+func TestChainstate_UtxoExists(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		cstate := newTestChainstate(t, open)
+
+		for i, tcase := range testChainstateSetup() {
+			// inserting every TX to chainstate
+			if err := cstate.InsertTX(tcase.tx); err != nil {
+				if errors.Is(err, ErrSpentTX) && tcase.tx.IsSpent() {
+					continue
+				} else {
+					t.Errorf("Error inserting to chainstate TX with index: %d\n", i)
+				}
+			}
+
+			// checking every utxo
+			for j, outp := range tcase.outs {
+				if cstate.UtxoExists(tcase.tx.TXID, uint32(j)) != outp.IsNotSpent {
+					t.Errorf("TX: %d Vout:%d Expected output isNotSpent to be %v, got %v", i, j, outp.IsNotSpent, cstate.UtxoExists(tcase.tx.TXID, uint32(j)))
+				}
+			}
+			// cleaning up
+			if err := cstate.RemoveTX(tcase.tx.TXID); err != nil {
+				t.Errorf("Error removing TX with index %d from chainstate.\n", i)
+			}
 		}
-		if !bytes.Equal(val, tcase.tx.SerializeTXMetadata()) {
-			t.Errorf("Value/Metadata mismatch index %d: Expected %x\n Got%x\n", i, tcase.tx.SerializeTXMetadata(), val)
+	})
+}
+
+func TestChainstate_GetUtxo(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		cstate := newTestChainstate(t, open)
+
+		for i, tcase := range testChainstateSetup() {
+			// inserting every TX to chainstate
+			if err := cstate.InsertTX(tcase.tx); err != nil {
+				if errors.Is(err, ErrSpentTX) && tcase.tx.IsSpent() {
+					continue
+				} else {
+					t.Errorf("Error inserting to chainstate TX with index: %d\n", i)
+				}
+			}
+
+			// checking each output individually
+			for j, outp := range tcase.outs {
+				gotout, exists := cstate.GetUtxo(tcase.tx.TXID, uint32(j))
+				if exists != outp.IsNotSpent {
+					t.Errorf("Expected TX %d vout %d not to exist.\n", i, j)
+				}
+				if !exists {
+					continue
+				}
+				if !gotout.Equal(outp) {
+					t.Errorf("TX %d vout %d: Got different output than expected.\n", i, j)
+				}
+			}
+			// cleaning up
+			if err := cstate.RemoveTX(tcase.tx.TXID); err != nil {
+				t.Errorf("Error removing TX with index %d from chainstate.\n", i)
+			}
 		}
-		if err := cstate.RemoveTX(tcase.tx.TXID); err != nil {
-			t.Errorf("Error removing TX with index %d from chainstate.\n", i)
+	})
+}
+
+func TestChainstate_GetNoOfUTXOs(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		cstate := newTestChainstate(t, open)
+
+		for i, tcase := range testChainstateSetup() {
+			// inserting every TX to chainstate
+			if err := cstate.InsertTX(tcase.tx); err != nil {
+				if errors.Is(err, ErrSpentTX) && tcase.tx.IsSpent() {
+					continue
+				} else {
+					t.Errorf("Error inserting to chainstate TX with index: %d\n", i)
+				}
+			}
+
+			unspentCounter := 0
+			for _, outp := range tcase.outs {
+				if outp.IsNotSpent {
+					unspentCounter++
+				}
+			}
+			gotNoOfUtxos, txexists := cstate.GetNoOfUTXOs(tcase.tx.TXID)
+			if !txexists || gotNoOfUtxos != unspentCounter {
+				t.Errorf("UTXOs number mismatch. Expected: %d Got: %d\n", unspentCounter, gotNoOfUtxos)
+			}
+			// cleaning up, some test cases share the same TXID
+			if err := cstate.RemoveTX(tcase.tx.TXID); err != nil {
+				t.Errorf("Error removing TX with index %d from chainstate.\n", i)
+			}
 		}
-		if _, err := cstate.GetTX(tcase.tx.TXID); !errors.Is(err, leveldb.ErrNotFound) {
-			t.Errorf("Expected TX with index %d not to be found in chainstate.\n", i)
+	})
+}
+
+func TestChainstate_RemoveUtxo(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+
+		cstate := newTestChainstate(t, open)
+
+		for i, tcase := range testChainstateSetup() {
+			// inserting every TX to chainstate
+			if err := cstate.InsertTX(tcase.tx); err != nil {
+				if errors.Is(err, ErrSpentTX) && tcase.tx.IsSpent() {
+					continue
+				} else {
+					t.Errorf("Error inserting to chainstate TX with index: %d\n", i)
+				}
+			}
+
+			_, txexists := cstate.GetNoOfUTXOs(tcase.tx.TXID)
+			if !txexists {
+				t.Errorf("Error getting TX with index: %d\n", i)
+			}
+
+			for j, outp := range tcase.outs {
+				utxoRemoved := cstate.RemoveUtxo(tcase.tx.TXID, uint32(j))
+				if utxoRemoved != outp.IsNotSpent {
+					t.Errorf("Expected TXID %d vout %d to be removed.\n", i, j)
+				}
+			}
+			if err := cstate.WriteBatchTX(); err != nil {
+				t.Errorf("Error writing removed UTXOs of TX with index %d: %v\n", i, err)
+			}
+
+			if n, ok := cstate.GetNoOfUTXOs(tcase.tx.TXID); ok {
+				t.Errorf("Expected tx with index %d not to be found. Got %d UTXOs\n", i, n)
+			}
 		}
-	}
+	})
 }
 
-func TestChainstate_UtxoExists(t *testing.T) {
-	cstate := NewChainstate(testChainstatePath, true)
-	defer cstate.Close()
+func TestChainstate_MigrateLegacyUTXOs(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		cstate := newTestChainstate(t, open)
 
-	for i, tcase := range testChainstateSetup() {
-		// inserting every TX to chainstate
-		if err := cstate.InsertTX(tcase.tx); err != nil {
-			if errors.Is(err, ErrSpentTX) && tcase.tx.IsSpent() {
-				continue
-			} else {
-				t.Errorf("Error inserting to chainstate TX with index: %d\n", i)
+		tcases := testChainstateSetup()
+		for i, tcase := range tcases {
+			// some test cases only differ in the spent outputs, making their TXIDs unique
+			tcase.tx.TXID = append(tcase.tx.TXID, byte(i))
+			tcase.tx.BlockHeight = uint32(i)
+			tcase.tx.IsCoinbase = i == 0
+			if !tcase.tx.IsSpent() {
+				// writing the per-TX record of the legacy format
+				if err := cstate.Insert(buildKey(TxKey, tcase.tx.TXID), tcase.tx.SerializeTXMetadata()); err != nil {
+					t.Fatal(err)
+				}
 			}
 		}
 
-		// checking every utxo
-		for j, outp := range tcase.outs {
-			if cstate.UtxoExists(tcase.tx.TXID, uint32(j)) != outp.IsNotSpent {
-				t.Errorf("TX: %d Vout:%d Expected output isNotSpent to be %v, got %v", i, j, outp.IsNotSpent, cstate.UtxoExists(tcase.tx.TXID, uint32(j)))
+		migrated, err := cstate.MigrateLegacyUTXOs()
+		if err != nil {
+			t.Fatalf("Error migrating legacy UTXOs: %v\n", err)
+		}
+		if migrated != len(tcases)-1 {
+			t.Errorf("Expected %d migrated TXs, got %d\n", len(tcases)-1, migrated)
+		}
+		for i, tcase := range tcases {
+			if _, err := cstate.Get(buildKey(TxKey, tcase.tx.TXID)); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Legacy record of TX %d was not removed.\n", i)
+			}
+			for j, outp := range tcase.outs {
+				entry, ok := cstate.GetUtxoEntry(tcase.tx.TXID, uint32(j))
+				if ok != outp.IsNotSpent {
+					t.Errorf("TX %d vout %d: Expected entry to exist: %v\n", i, j, outp.IsNotSpent)
+				}
+				if ok && (entry.Output.Value != outp.Value || !bytes.Equal(entry.Output.ScriptPubKey, outp.ScriptPubKey) || entry.BlockHeight != uint32(i) || entry.IsCoinbase != (i == 0)) {
+					t.Errorf("TX %d vout %d: Migrated entry mismatch.\n", i, j)
+				}
 			}
 		}
-		// cleaning up
-		if err := cstate.RemoveTX(tcase.tx.TXID); err != nil {
-			t.Errorf("Error removing TX with index %d from chainstate.\n", i)
+
+		// running the migration again should be a no-op
+		if migrated, err := cstate.MigrateLegacyUTXOs(); err != nil || migrated != 0 {
+			t.Errorf("Expected no records to migrate, got %d %v\n", migrated, err)
 		}
-	}
+	})
 }
 
-func TestChainstate_GetUtxo(t *testing.T) {
-	cstate := NewChainstate(testChainstatePath, true)
-	defer cstate.Close()
-
-	for i, tcase := range testChainstateSetup() {
-		// inserting every TX to chainstate
-		if err := cstate.InsertTX(tcase.tx); err != nil {
-			if errors.Is(err, ErrSpentTX) && tcase.tx.IsSpent() {
-				continue
-			} else {
-				t.Errorf("Error inserting to chainstate TX with index: %d\n", i)
+func TestChainstate_MigrateLegacyPlainRecords(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		cstate := newTestChainstate(t, open)
+		tx := newCacheTestTX(1, 10, 20)
+		// legacy versions wrote the records of a batch without obfuscating them
+		if err := cstate.db.Put(buildKey(TxKey, tx.TXID), tx.SerializeTXMetadata(), false); err != nil {
+			t.Fatal(err)
+		}
+		if migrated, err := cstate.MigrateLegacyUTXOs(); err != nil || migrated != 1 {
+			t.Fatalf("Expected 1 migrated TX, got %d: %v\n", migrated, err)
+		}
+		for vout, value := range []uint64{10, 20} {
+			if utxo, ok := cstate.GetUtxo(tx.TXID, uint32(vout)); !ok || utxo.Value != value {
+				t.Errorf("Unexpected migrated UTXO %d: %v %v\n", vout, utxo, ok)
 			}
 		}
+	})
+}
 
-		// checking each output individually
-		for j, outp := range tcase.outs {
-			gotout, exists := cstate.GetUtxo(tcase.tx.TXID, uint32(j))
-			if exists != outp.IsNotSpent {
-				t.Errorf("Expected TX %d vout %d not to exist.\n", i, j)
-			}
-			if !exists {
-				continue
+func TestChainstate_MigrateLegacyCorruptRecords(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		tx := newCacheTestTX(1, 10, 20)
+		record := tx.SerializeTXMetadata()
+		tcases := map[string][]byte{
+			"header":    record[:5],
+			"vector":    record[:9],
+			"outputs":   record[:len(record)-1],
+			"trailing":  append(append([]byte{}, record...), 0x00),
+			"padding":   append(append(append([]byte{}, record[:9]...), record[9]|0x80), record[10:]...),
+			"coinbase":  append([]byte{0x07}, record[1:]...),
+			"scriptlen": append(append([]byte{}, record[:9+1+8]...), bytes.Repeat([]byte{0xff}, 8)...),
+		}
+		for name, value := range tcases {
+			cstate := newTestChainstate(t, open)
+			cstate.Insert(buildKey(TxKey, tx.TXID), value)
+			if _, err := cstate.MigrateLegacyUTXOs(); !errors.Is(err, ErrCorruptLegacyRecord) {
+				t.Errorf("Expected ErrCorruptLegacyRecord for the %s case, got %v\n", name, err)
 			}
-			if !gotout.Equal(outp) {
-				t.Errorf("TX %d vout %d: Got different output than expected.\n", i, j)
+			// the record is left for inspection, nothing is written
+			if _, err := cstate.Get(buildKey(TxKey, tx.TXID)); err != nil {
+				t.Errorf("Corrupt record was removed in the %s case.\n", name)
 			}
 		}
-		// cleaning up
-		if err := cstate.RemoveTX(tcase.tx.TXID); err != nil {
-			t.Errorf("Error removing TX with index %d from chainstate.\n", i)
+	})
+}
+
+// legacyRemoveUtxo spends an output stored in the legacy per-TX format, rewriting the whole record right away
+func legacyRemoveUtxo(c *Chainstate, txid []byte, vout uint32) bool {
+	txmeta, err := c.Get(buildKey(TxKey, txid))
+	if err != nil {
+		return false
+	}
+	tr := core.NewTxMetadataReader(txid, txmeta)
+	bv, vouts := tr.ReadBitVector()
+	if len(vouts) == 1 && vouts[0] == vout {
+		return c.Remove(buildKey(TxKey, txid)) == nil
+	}
+	if vout >= uint32(len(bv)) || !bv[vout] {
+		return false
+	}
+	fakeouts := make([]*core.TransactionOutput, tr.ReadNoOfOutputs())
+	for _, outp := range tr.ReadOutputs(bv, vouts) {
+		if outp.Vout != vout {
+			fakeouts[outp.Vout] = outp
+		}
+	}
+	for i, fakeout := range fakeouts {
+		if fakeout == nil {
+			fakeouts[i] = core.NewTransactionOutput([]byte{}, 0, 0, []byte{})
+			fakeouts[i].IsNotSpent = false
 		}
 	}
+	return c.Insert(buildKey(TxKey, txid), core.NewTransaction(nil, fakeouts).SerializeTXMetadata()) == nil
 }
 
-func TestChainstate_GetNoOfUTXOs(t *testing.T) {
-	cstate := NewChainstate(testChainstatePath, true)
+// benchmarkSpendBlock measures spending every output of a block of TXs with many outputs each
+func benchmarkSpendBlock(b *testing.B, insert func(*Chainstate, *core.Transaction) error, spend func(*Chainstate, []byte, uint32) bool, commit func(*Chainstate) error) {
+	const noOfTXs, noOfOutputs = 50, 40
+	store, err := OpenLevelDB(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	cstate, err := NewChainstate(store, true)
+	if err != nil {
+		b.Fatal(err)
+	}
 	defer cstate.Close()
 
-	for i, tcase := range testChainstateSetup() {
-		// inserting every TX to chainstate
-		if err := cstate.InsertTX(tcase.tx); err != nil {
-			if errors.Is(err, ErrSpentTX) && tcase.tx.IsSpent() {
-				continue
-			} else {
-				t.Errorf("Error inserting to chainstate TX with index: %d\n", i)
-			}
+	txs := make([]*core.Transaction, noOfTXs)
+	for i := range txs {
+		outs := make([]*core.TransactionOutput, noOfOutputs)
+		for j := range outs {
+			outs[j] = core.NewTransactionOutput([]byte{}, 0, uint64(j+1), []byte("looooooooooooongkeytest"))
 		}
+		txs[i] = core.NewTransaction(nil, outs)
+		txs[i].TXID = append(txs[i].TXID, byte(i))
+	}
 
-		unspentCounter := 0
-		for _, outp := range tcase.outs {
-			if outp.IsNotSpent {
-				unspentCounter++
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		for _, tx := range txs {
+			if err := insert(cstate, tx); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StartTimer()
+		// spending the outputs of every TX in turn, as the inputs of a block would
+		for vout := uint32(0); vout < noOfOutputs; vout++ {
+			for _, tx := range txs {
+				if !spend(cstate, tx.TXID, vout) {
+					b.Fatalf("Error spending %x:%d\n", tx.TXID, vout)
+				}
 			}
 		}
-		gotNoOfUtxos, txexists := cstate.GetNoOfUTXOs(tcase.tx.TXID)
-		if !txexists || gotNoOfUtxos != unspentCounter {
-			t.Errorf("UTXOs number mismatch. Expected: %d Got: %d\n", unspentCounter, gotNoOfUtxos)
+		if err := commit(cstate); err != nil {
+			b.Fatal(err)
 		}
 	}
 }
 
-func TestChainstate_RemoveUtxo(t *testing.T) {
+func BenchmarkChainstate_SpendLegacy(b *testing.B) {
+	benchmarkSpendBlock(b, func(c *Chainstate, tx *core.Transaction) error {
+		return c.Insert(buildKey(TxKey, tx.TXID), tx.SerializeTXMetadata())
+	}, legacyRemoveUtxo, func(*Chainstate) error { return nil })
+}
 
-	cstate := NewChainstate(testChainstatePath, true)
-	defer cstate.Close()
+func BenchmarkChainstate_SpendPerOutput(b *testing.B) {
+	benchmarkSpendBlock(b, (*Chainstate).InsertTX, (*Chainstate).RemoveUtxo, (*Chainstate).WriteBatchTX)
+}
 
-	for i, tcase := range testChainstateSetup() {
-		// inserting every TX to chainstate
-		if err := cstate.InsertTX(tcase.tx); err != nil {
-			if errors.Is(err, ErrSpentTX) && tcase.tx.IsSpent() {
-				continue
-			} else {
-				t.Errorf("Error inserting to chainstate TX with index: %d\n", i)
+func TestChainstate_ForEachUtxo(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		cstate := newTestChainstate(t, open)
+		first := newCacheTestTX(2, 10, 20)
+		second := newCacheTestTX(1, 30)
+		for _, tx := range []*core.Transaction{first, second} {
+			if err := cstate.InsertTX(tx); err != nil {
+				t.Fatal(err)
 			}
 		}
-
-		_, txexists := cstate.GetNoOfUTXOs(tcase.tx.TXID)
-		if !txexists {
-			t.Errorf("Error getting TX with index: %d\n", i)
+		snap, err := cstate.GetSnapshot()
+		if err != nil {
+			t.Fatalf("Error taking snapshot: %v\n", err)
+		}
+		defer snap.Release()
+		cstate.RemoveUtxo(first.TXID, 0)
+		if err := cstate.WriteBatchTX(); err != nil {
+			t.Fatal(err)
 		}
 
-		for j, outp := range tcase.outs {
-			utxoRemoved := cstate.RemoveUtxo(tcase.tx.TXID, uint32(j))
-			if utxoRemoved != outp.IsNotSpent {
-				t.Errorf("Expected TXID %d vout %d to be removed.\n", i, j)
+		// the entries should be ordered by TXID and vout
+		collect := func(snap *DBSnapshot) []*core.UtxoEntry {
+			var entries []*core.UtxoEntry
+			if err := cstate.ForEachUtxo(snap, func(entry *core.UtxoEntry) bool {
+				entries = append(entries, entry)
+				return true
+			}); err != nil {
+				t.Fatalf("Error walking UTXOs: %v\n", err)
 			}
+			return entries
+		}
+		entries := collect(snap)
+		exp := []struct {
+			txid  []byte
+			vout  uint32
+			value uint64
+		}{{second.TXID, 0, 30}, {first.TXID, 0, 10}, {first.TXID, 1, 20}}
+		if len(entries) != len(exp) {
+			t.Fatalf("Expected %d UTXOs in the snapshot, got %d\n", len(exp), len(entries))
+		}
+		for i, entry := range entries {
+			outp := entry.Output
+			if !bytes.Equal(outp.ParentTXID, exp[i].txid) || outp.Vout != exp[i].vout || outp.Value != exp[i].value {
+				t.Errorf("Unexpected UTXO #%d: %+v\n", i, outp)
+			}
+		}
+		if entries[0].BlockHeight != 1 || entries[1].BlockHeight != 2 {
+			t.Errorf("Unexpected heights: %d %d\n", entries[0].BlockHeight, entries[1].BlockHeight)
+		}
+		// the spent output is only missing from the current state
+		if entries := collect(nil); len(entries) != 2 || entries[1].Output.Vout != 1 {
+			t.Errorf("Unexpected UTXOs in the current state: %d\n", len(entries))
 		}
 
-		if val, err := cstate.GetTX(tcase.tx.TXID); !errors.Is(err, leveldb.ErrNotFound) {
-			t.Errorf("Expected tx with index %d not to be found. Got %x\n", i, val)
+		// stopping the walk after the first entry
+		n := 0
+		cstate.ForEachUtxo(nil, func(*core.UtxoEntry) bool {
+			n++
+			return false
+		})
+		if n != 1 {
+			t.Errorf("Walk was not stopped, %d entries visited\n", n)
 		}
-	}
+	})
 }
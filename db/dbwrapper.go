@@ -1,22 +1,34 @@
 package db
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"math/rand"
-
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
+var ErrForeignSnapshot = errors.New("snapshot was taken from another database")
+
 type KeyType byte
 
 const (
+	// TxKey is used by the per-TX records of the legacy chainstate format
 	TxKey         = KeyType('c')
+	UtxoKey       = KeyType('C')
 	BlockIndexKey = KeyType('b')
 	FileInfoKey   = KeyType('f')
+	LastFileKey   = KeyType('l')
 	TxIndexKey    = KeyType('t')
+	BestBlockKey  = KeyType('B')
+	// TxIndexSyncKey holds the tip at which the last build of the transaction index completed
+	TxIndexSyncKey = KeyType('T')
+	// ReindexKey is set while the records of a database are being rebuilt
+	ReindexKey = KeyType('R')
 )
 
+// wipeBatchSize is the number of keys removed in each batch when a database is wiped
+const wipeBatchSize = 1000
+
 func buildKey(keyType KeyType, data []byte) []byte {
 	bkey := make([]byte, 1+len(data))
 	bkey[0] = byte(keyType)
@@ -26,32 +38,43 @@ func buildKey(keyType KeyType, data []byte) []byte {
 
 type DBwrapper struct {
 	IsObfuscated   bool
-	db             *leveldb.DB
+	db             KVStore
 	obfuscationKey []byte
-	currentBatch   *leveldb.Batch // NOTE: This implementation is blocking if concurrent batch actions are needed
+	currentBatch   *Batch // NOTE: This implementation is blocking if concurrent batch actions are needed
+	journal        *Journal
+	// onCommit and onDiscard are called once the current batch is written or dropped
+	onCommit  func()
+	onDiscard func()
 }
 
-// NewDBwrapper creates a new DBwrapper struct
-func NewDBwrapper(dbpath string, isObfuscated bool) *DBwrapper {
-	db, err := leveldb.OpenFile(dbpath, nil)
-	if err != nil {
-		panic(err)
-	}
+// NewDBwrapper creates a new DBwrapper struct on top of the store given.
+// The store is closed if the obfuscation key cannot be read or saved.
+func NewDBwrapper(db KVStore, isObfuscated bool) (*DBwrapper, error) {
 	var obfkey []byte
 	if isObfuscated {
 		// looking up the obfuscation key in the db
-		obfkey, err = db.Get(constructObfKeyKey(), nil)
-		if errors.Is(err, leveldb.ErrNotFound) {
+		var err error
+		obfkey, err = db.Get(constructObfKeyKey())
+		if errors.Is(err, ErrNotFound) {
 			// if not found, generating a new one and saving in the db
 			obfkey = generateObfuscationKey()
-			err = db.Put(constructObfKeyKey(), obfkey, nil)
-			if err != nil {
-				// if the Put failed, then the db is not ok
-				panic(err)
-			}
+			err = db.Put(constructObfKeyKey(), obfkey, false)
 		}
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &DBwrapper{IsObfuscated: isObfuscated, db: db, obfuscationKey: obfkey}, nil
+}
+
+// openDBwrapper opens the store at the path given and creates a DBwrapper on top of it
+func openDBwrapper(open StoreOpener, dbpath string, isObfuscated bool) (*DBwrapper, error) {
+	store, err := open(dbpath)
+	if err != nil {
+		return nil, err
 	}
-	return &DBwrapper{IsObfuscated: isObfuscated, db: db, obfuscationKey: obfkey}
+	return NewDBwrapper(store, isObfuscated)
 }
 
 func (d *DBwrapper) obfuscateValue(value []byte) []byte {
@@ -68,55 +91,245 @@ func (d *DBwrapper) obfuscateValue(value []byte) []byte {
 func (d *DBwrapper) Insert(key, value []byte) error {
 	if d.IsObfuscated {
 		// obfuscating key and value stored
-		return d.db.Put(key, d.obfuscateValue(value), nil)
+		return d.db.Put(key, d.obfuscateValue(value), false)
 	} else {
-		return d.db.Put(key, value, nil)
+		return d.db.Put(key, value, false)
 	}
 }
 
 func (d *DBwrapper) PutInBatch(key, value []byte) {
 	// initializes a batch and adds to it
 	if d.currentBatch == nil {
-		d.currentBatch = new(leveldb.Batch)
+		d.currentBatch = NewBatch()
+	}
+	// values are obfuscated the same way as in Insert, so that Get can read them
+	if d.IsObfuscated {
+		value = d.obfuscateValue(value)
 	}
 	d.currentBatch.Put(key, value)
 }
 
+// DeleteInBatch adds the removal of the key to the current batch
+func (d *DBwrapper) DeleteInBatch(key []byte) {
+	if d.currentBatch == nil {
+		d.currentBatch = NewBatch()
+	}
+	d.currentBatch.Delete(key)
+}
+
 // WriteBatch performs the batch write and resets the batch field
 func (d *DBwrapper) WriteBatch() error {
+	if d.currentBatch == nil {
+		return nil
+	}
 	// writing the batch
-	err := d.db.Write(d.currentBatch, nil)
+	err := d.db.Write(d.currentBatch, false)
 	if err != nil {
 		return err
 	}
 	// resetting the field
 	d.currentBatch = nil
+	if d.onCommit != nil {
+		d.onCommit()
+	}
 	return nil
 }
 
+// CommitBatch writes the current batch. If the database is registered in a journal,
+// the batches of every database of the journal are committed together.
+func (d *DBwrapper) CommitBatch() error {
+	if d.journal != nil {
+		return d.journal.Commit()
+	}
+	return d.WriteBatch()
+}
+
+// DiscardBatch drops the current batch. If the database is registered in a journal,
+// the batches of every database of the journal are dropped together.
+func (d *DBwrapper) DiscardBatch() {
+	if d.journal != nil {
+		d.journal.Discard()
+		return
+	}
+	d.currentBatch = nil
+	if d.onDiscard != nil {
+		d.onDiscard()
+	}
+}
+
 func (d *DBwrapper) Get(key []byte) ([]byte, error) {
+	return d.readValue(d.db.Get(key))
+}
+
+// readValue reveals the content of a value read from the db
+func (d *DBwrapper) readValue(val []byte, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
 	if d.IsObfuscated {
-		val, err := d.db.Get(key, nil)
 		// double obfuscation reveals the original content
-		return d.obfuscateValue(val), err
-	} else {
-		return d.db.Get(key, nil)
+		return d.obfuscateValue(val), nil
 	}
+	return val, nil
+}
+
+// DBIterator iterates over the records with keys starting with a prefix, in key order.
+// Values are de-obfuscated, key and value are only valid until the next call to Next.
+type DBIterator struct {
+	iter Iterator
+	d    *DBwrapper
+}
+
+// NewIterator returns an iterator over the records of the key type given
+func (d *DBwrapper) NewIterator(keyType KeyType) *DBIterator {
+	return d.NewPrefixIterator(buildKey(keyType, nil))
+}
+
+// NewPrefixIterator returns an iterator over the records with keys starting with the prefix
+func (d *DBwrapper) NewPrefixIterator(prefix []byte) *DBIterator {
+	return &DBIterator{d.db.NewIterator(prefix), d}
+}
+
+// newPrefixIterator returns an iterator reading from snap, or from the current state of the db if snap is nil.
+// ErrForeignSnapshot is returned if snap was taken from another db.
+func (d *DBwrapper) newPrefixIterator(snap *DBSnapshot, prefix []byte) (*DBIterator, error) {
+	if snap == nil {
+		return d.NewPrefixIterator(prefix), nil
+	}
+	if snap.d != d {
+		return nil, ErrForeignSnapshot
+	}
+	return snap.NewPrefixIterator(prefix), nil
+}
+
+// Next moves to the next record, returning false once there are no records left or an error occurred
+func (it *DBIterator) Next() bool {
+	return it.iter.Next()
+}
+
+// Key returns the full key of the current record, starting with its key type
+func (it *DBIterator) Key() []byte {
+	return it.iter.Key()
+}
+
+// Value returns the de-obfuscated value of the current record
+func (it *DBIterator) Value() []byte {
+	if it.d.IsObfuscated {
+		return it.d.obfuscateValue(it.iter.Value())
+	}
+	return it.iter.Value()
+}
+
+func (it *DBIterator) Release() {
+	it.iter.Release()
+}
+
+// Error returns the error that stopped the iteration, if any
+func (it *DBIterator) Error() error {
+	return it.iter.Error()
+}
+
+// DBSnapshot is a consistent read-only view of a db, values are de-obfuscated as in Get.
+// It should be released once it is no longer used.
+type DBSnapshot struct {
+	snap Snapshot
+	d    *DBwrapper
+}
+
+// GetSnapshot takes a snapshot of the current state of the db, the batches written after it are not seen through it
+func (d *DBwrapper) GetSnapshot() (*DBSnapshot, error) {
+	snap, err := d.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &DBSnapshot{snap, d}, nil
+}
+
+func (s *DBSnapshot) Get(key []byte) ([]byte, error) {
+	return s.d.readValue(s.snap.Get(key))
+}
+
+// NewIterator returns an iterator over the records of the key type given, as they were when the snapshot was taken
+func (s *DBSnapshot) NewIterator(keyType KeyType) *DBIterator {
+	return s.NewPrefixIterator(buildKey(keyType, nil))
+}
+
+func (s *DBSnapshot) NewPrefixIterator(prefix []byte) *DBIterator {
+	return &DBIterator{s.snap.NewIterator(prefix), s.d}
+}
+
+func (s *DBSnapshot) Release() {
+	s.snap.Release()
+}
+
+// forEachWithPrefix calls fn for every key starting with the prefix and its value, until fn returns false.
+// Key and value are only valid during the call.
+func (d *DBwrapper) forEachWithPrefix(prefix []byte, fn func(key, value []byte) bool) error {
+	iter := d.NewPrefixIterator(prefix)
+	defer iter.Release()
+	for iter.Next() {
+		if !fn(iter.Key(), iter.Value()) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
+// wipe removes every key except the obfuscation key and the keys given
+func (d *DBwrapper) wipe(keep ...[]byte) error {
+	keep = append(keep, constructObfKeyKey())
+	batch := NewBatch()
+	iter := d.db.NewIterator(nil)
+	defer iter.Release()
+	for iter.Next() {
+		kept := false
+		for _, k := range keep {
+			kept = kept || bytes.Equal(iter.Key(), k)
+		}
+		if kept {
+			continue
+		}
+		batch.Delete(append([]byte{}, iter.Key()...))
+		if batch.Len() >= wipeBatchSize {
+			if err := d.db.Write(batch, false); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return d.db.Write(batch, false)
 }
 
 func (d *DBwrapper) Remove(key []byte) error {
-	return d.db.Delete(key, nil)
+	return d.db.Delete(key, false)
 }
 
 func (d *DBwrapper) PageInsert(key, value []byte, maxPageSize int) error {
-	// appending page number byte
-	key = append(key, 0)
+	return forEachPage(key, value, maxPageSize, d.Insert)
+}
+
+// PagePutInBatch adds the pages of the value to the current batch
+func (d *DBwrapper) PagePutInBatch(key, value []byte, maxPageSize int) {
+	forEachPage(key, value, maxPageSize, func(pkey, page []byte) error {
+		d.PutInBatch(pkey, page)
+		return nil
+	})
+}
+
+// forEachPage splits the value in pages of maxPageSize and calls put with the key and data of each page
+func forEachPage(key, value []byte, maxPageSize int, put func(key, page []byte) error) error {
+	// appending page number byte, on a copy so that the caller's key is not modified
+	key = append(append([]byte{}, key...), 0)
 
 	rem := len(value)
 	idx := 0
 	for rem > maxPageSize {
 		// if page is continued, add an extra byte
-		if err := d.Insert(key, append(value[idx:idx+maxPageSize], 0)); err != nil {
+		page := append(append([]byte{}, value[idx:idx+maxPageSize]...), 0)
+		if err := put(key, page); err != nil {
 			return err
 		}
 		// increment page number in key
@@ -125,10 +338,7 @@ func (d *DBwrapper) PageInsert(key, value []byte, maxPageSize int) error {
 		rem -= maxPageSize
 		idx += maxPageSize
 	}
-	if err := d.Insert(key, value[idx:]); err != nil {
-		return err
-	}
-	return nil
+	return put(key, value[idx:])
 }
 
 func (d *DBwrapper) PageGet(key []byte, maxPageSize int) ([]byte, bool) {
@@ -150,8 +360,8 @@ func (d *DBwrapper) PageGet(key []byte, maxPageSize int) ([]byte, bool) {
 	return res, true
 }
 
-func (d *DBwrapper) Close() {
-	d.db.Close()
+func (d *DBwrapper) Close() error {
+	return d.db.Close()
 }
 
 // generateObfuscationKey generates 8 random bytes to be used as obfuscation key
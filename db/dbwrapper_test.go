@@ -3,76 +3,69 @@ package db
 import (
 	"bytes"
 	"errors"
-	"os"
 	"testing"
-
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
-var testDBWrapperPath string
-
-func init() {
-	homedir, _ := os.UserHomeDir()
-	testDBWrapperPath = homedir + "/.plairo/wrappertest"
-}
-
 func TestObfKey(t *testing.T) {
-	db := NewDBwrapper(testDBWrapperPath, true)
-	defer db.Close()
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		db := newTestDBwrapper(t, open, true)
 
-	key, err := db.Get(constructObfKeyKey())
-	if errors.Is(err, leveldb.ErrNotFound) {
-		t.Errorf("Error getting obfuscation key from database.")
-	}
-	if len(key) != 8 {
-		t.Errorf("Invalid obfuscation key length.")
-	}
+		key, err := db.Get(constructObfKeyKey())
+		if errors.Is(err, ErrNotFound) {
+			t.Errorf("Error getting obfuscation key from database.")
+		}
+		if len(key) != 8 {
+			t.Errorf("Invalid obfuscation key length.")
+		}
+	})
 }
 
 func TestDBwrapper_InsertGet(t *testing.T) {
-	db := NewDBwrapper(testDBWrapperPath, true)
-	defer db.Close()
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		db := newTestDBwrapper(t, open, true)
 
-	// testing insert and get methods
-	err := db.Insert([]byte("testkey1"), []byte("testval1"))
-	if err != nil {
-		t.Error(err)
-	}
-	val, err := db.Get([]byte("testkey1"))
-	if err != nil {
-		t.Error(err)
-	}
-	if !bytes.Equal(val, []byte("testval1")) {
-		t.Errorf("Unexpected value for testkey1. Got: %x\n", val)
-	}
+		// testing insert and get methods
+		err := db.Insert([]byte("testkey1"), []byte("testval1"))
+		if err != nil {
+			t.Error(err)
+		}
+		val, err := db.Get([]byte("testkey1"))
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(val, []byte("testval1")) {
+			t.Errorf("Unexpected value for testkey1. Got: %x\n", val)
+		}
 
-	// testing a get call with non-existant key
-	val, err = db.Get([]byte("non-existant"))
-	if !errors.Is(err, leveldb.ErrNotFound) {
-		t.Errorf("Expected value not to be found. Got value: %x\n", val)
-	}
+		// testing a get call with non-existant key
+		val, err = db.Get([]byte("non-existant"))
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected value not to be found. Got value: %x\n", val)
+		}
+	})
 }
 
 func TestDBwrapper_Remove(t *testing.T) {
-	db := NewDBwrapper(testDBWrapperPath, true)
-	defer db.Close()
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		db := newTestDBwrapper(t, open, true)
 
-	if err := db.Insert([]byte("remove_key"), []byte("remove_value")); err != nil {
-		t.Error(err)
-	}
+		if err := db.Insert([]byte("remove_key"), []byte("remove_value")); err != nil {
+			t.Error(err)
+		}
 
-	if err := db.Remove([]byte("remove_key")); err != nil {
-		t.Error(err)
-	}
+		if err := db.Remove([]byte("remove_key")); err != nil {
+			t.Error(err)
+		}
 
-	val, err := db.Get([]byte("remove_key"))
-	if !errors.Is(err, leveldb.ErrNotFound) {
-		t.Errorf("Expected value not to be found, instead got: %x\n", val)
-	}
+		val, err := db.Get([]byte("remove_key"))
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected value not to be found, instead got: %x\n", val)
+		}
+	})
 }
 
 func TestObfuscation(t *testing.T) {
-	db := NewDBwrapper(testDBWrapperPath, true)
+	db := &DBwrapper{IsObfuscated: true}
 	// setting a manual obfkey to predict obfuscation results
 	db.obfuscationKey = []byte{0x0}
 	expObfVal := []byte{0x01, 0x0a, 0x02, 0x0b, 0x03, 0x0c}
@@ -93,3 +86,80 @@ func TestObfuscation(t *testing.T) {
 		t.Errorf("Expected obfuscation result to be: %x. Got %x\n", expObfVal, obfval)
 	}
 }
+
+func TestDBwrapper_BatchObfuscated(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		db := newTestDBwrapper(t, open, true)
+
+		db.PutInBatch([]byte("batchkey1"), []byte("batchval1"))
+		db.PutInBatch([]byte("batchkey2"), []byte("batchval2"))
+		db.DeleteInBatch([]byte("batchkey2"))
+		if err := db.WriteBatch(); err != nil {
+			t.Fatal(err)
+		}
+		val, err := db.Get([]byte("batchkey1"))
+		if err != nil || !bytes.Equal(val, []byte("batchval1")) {
+			t.Errorf("Unexpected value for batchkey1. Got: %x %v\n", val, err)
+		}
+		if _, err := db.Get([]byte("batchkey2")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected batchkey2 to be deleted, got %v\n", err)
+		}
+	})
+}
+
+func TestDBwrapper_Iterator(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		db := newTestDBwrapper(t, open, true)
+		db.Insert(buildKey(UtxoKey, []byte("b")), []byte("utxo2"))
+		db.Insert(buildKey(UtxoKey, []byte("a")), []byte("utxo1"))
+		db.Insert(buildKey(BlockIndexKey, []byte("a")), []byte("block"))
+
+		// values should be de-obfuscated and other key types skipped
+		iter := db.NewIterator(UtxoKey)
+		var got []string
+		for iter.Next() {
+			got = append(got, string(iter.Key())+"="+string(iter.Value()))
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			t.Fatalf("Error iterating: %v\n", err)
+		}
+		expectTestRecords(t, got, "Ca=utxo1", "Cb=utxo2")
+
+		iter = db.NewPrefixIterator(buildKey(UtxoKey, []byte("b")))
+		if !iter.Next() || string(iter.Value()) != "utxo2" || iter.Next() {
+			t.Errorf("Unexpected records for the prefix.\n")
+		}
+		iter.Release()
+	})
+}
+
+func TestDBwrapper_Snapshot(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		db := newTestDBwrapper(t, open, true)
+		db.Insert(buildKey(UtxoKey, []byte("a")), []byte("utxo1"))
+
+		snap, err := db.GetSnapshot()
+		if err != nil {
+			t.Fatalf("Error taking snapshot: %v\n", err)
+		}
+		defer snap.Release()
+		db.PutInBatch(buildKey(UtxoKey, []byte("b")), []byte("utxo2"))
+		db.DeleteInBatch(buildKey(UtxoKey, []byte("a")))
+		if err := db.WriteBatch(); err != nil {
+			t.Fatal(err)
+		}
+
+		if val, err := snap.Get(buildKey(UtxoKey, []byte("a"))); err != nil || !bytes.Equal(val, []byte("utxo1")) {
+			t.Errorf("Unexpected value in snapshot: %s %v\n", val, err)
+		}
+		if _, err := snap.Get(buildKey(UtxoKey, []byte("b"))); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected key written after the snapshot to be missing, got %v\n", err)
+		}
+		iter := snap.NewIterator(UtxoKey)
+		defer iter.Release()
+		if !iter.Next() || string(iter.Value()) != "utxo1" || iter.Next() {
+			t.Errorf("Unexpected records in snapshot.\n")
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"plairo/utils"
+)
+
+var ErrInvalidRecordSize = errors.New("flat file record size does not match the block index")
+
+// flatRecordHeaderSize is the size of the magic bytes and the size field preceding each flat file record
+const flatRecordHeaderSize = 8
+
+// flatFileSeq is a sequence of append-only files, named after a prefix and the file number
+type flatFileSeq struct {
+	dir    string
+	prefix string
+}
+
+func (fs *flatFileSeq) path(file uint32) string {
+	return filepath.Join(fs.dir, fmt.Sprintf("%s%05d.dat", fs.prefix, file))
+}
+
+// writeRecord writes the magic bytes, the size of the data and the data at the offset of the file given.
+// The file is synced, so that the block index never points to data that is not on disk.
+func (fs *flatFileSeq) writeRecord(file, offset uint32, magic, data []byte) error {
+	if err := os.MkdirAll(fs.dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fs.path(file), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	record := make([]byte, 0, flatRecordHeaderSize+len(data))
+	record = append(record, magic...)
+	record = append(record, utils.SerializeUint32(uint32(len(data)), false)...)
+	record = append(record, data...)
+	if _, err := f.WriteAt(record, int64(offset)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// openRecord checks the header of the record at the offset of the file given and returns a reader for its data
+func (fs *flatFileSeq) openRecord(file, offset, size uint32, magic []byte) (*RecordReader, error) {
+	f, err := os.Open(fs.path(file))
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, flatRecordHeaderSize)
+	if _, err := f.ReadAt(header, int64(offset)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(magic)], magic) {
+		f.Close()
+		return nil, ErrInvalidMagic
+	}
+	if utils.DeserializeUint32(header[len(magic):], false) != size {
+		f.Close()
+		return nil, ErrInvalidRecordSize
+	}
+	return &RecordReader{io.NewSectionReader(f, int64(offset)+flatRecordHeaderSize, int64(size)), f}, nil
+}
+
+// RecordReader streams the data of a single record, so that a block does not have to be loaded at once.
+// It has to be closed once done.
+type RecordReader struct {
+	*io.SectionReader
+	closer io.Closer
+}
+
+// newBytesRecordReader returns a reader for data already in memory
+func newBytesRecordReader(data []byte) *RecordReader {
+	return &RecordReader{io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), nil}
+}
+
+func (rr *RecordReader) Close() error {
+	if rr.closer == nil {
+		return nil
+	}
+	return rr.closer.Close()
+}
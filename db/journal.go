@@ -0,0 +1,161 @@
+package db
+
+import (
+	"errors"
+	"plairo/utils"
+)
+
+// JournalID identifies a database whose batches are committed through the journal
+type JournalID byte
+
+const (
+	JournalChainstate = JournalID('c')
+	JournalBlocks     = JournalID('b')
+	JournalUndo       = JournalID('u')
+	JournalIndex      = JournalID('i')
+)
+
+var ErrCorruptJournal = errors.New("corrupt journal record")
+var ErrUnknownJournalID = errors.New("journal record for unknown database")
+
+// journal writes are synced, a record must be on disk before the batches it contains are applied
+const syncWrite = true
+
+// journalRecordKey is the key of the pending commit, there is at most one at any time
+var journalRecordKey = []byte("pending")
+
+// Journal is a write-ahead log making the batches of several databases a single atomic commit.
+// The batches are written to the journal before being applied, so a commit interrupted by a crash
+// can be applied again on the next startup.
+type Journal struct {
+	*DBwrapper
+	ids     []JournalID
+	targets map[JournalID]*DBwrapper
+}
+
+func NewJournal(store KVStore) (*Journal, error) {
+	// batches are already obfuscated by the databases they belong to
+	d, err := NewDBwrapper(store, false)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{DBwrapper: d, targets: make(map[JournalID]*DBwrapper)}, nil
+}
+
+// OpenJournal opens the store at dbpath and creates the journal on top of it
+func OpenJournal(open StoreOpener, dbpath string) (*Journal, error) {
+	store, err := open(dbpath)
+	if err != nil {
+		return nil, err
+	}
+	return NewJournal(store)
+}
+
+// Register adds a database to the commits of the journal, its batches will only be written by Commit
+func (j *Journal) Register(id JournalID, d *DBwrapper) {
+	if _, ok := j.targets[id]; !ok {
+		j.ids = append(j.ids, id)
+	}
+	j.targets[id] = d
+	d.journal = j
+}
+
+// Commit writes the current batches of every registered database as a single journal record,
+// applies them and then removes the record
+func (j *Journal) Commit() error {
+	record := j.record()
+	if len(record) == 0 {
+		return nil
+	}
+	if err := j.db.Put(journalRecordKey, record, syncWrite); err != nil {
+		return err
+	}
+	if err := j.apply(record); err != nil {
+		// the record is kept, the commit will be completed on recovery
+		return err
+	}
+	for _, d := range j.targets {
+		d.currentBatch = nil
+		if d.onCommit != nil {
+			d.onCommit()
+		}
+	}
+	return j.db.Delete(journalRecordKey, syncWrite)
+}
+
+// Discard drops the current batches of every registered database without writing them,
+// so that the records staged for a block that failed to connect are never committed
+func (j *Journal) Discard() {
+	for _, d := range j.targets {
+		d.currentBatch = nil
+		if d.onDiscard != nil {
+			d.onDiscard()
+		}
+	}
+}
+
+// record serializes the current batches of the registered databases
+func (j *Journal) record() []byte {
+	/*
+		Journal record structure, for each database with a batch:
+		-- Journal ID (1 byte)
+		-- Size of the batch (4 bytes)
+		-- Batch data
+	*/
+	var record []byte
+	for _, id := range j.ids {
+		batch := j.targets[id].currentBatch
+		if batch == nil || batch.Len() == 0 {
+			continue
+		}
+		dump := batch.Dump()
+		record = append(record, byte(id))
+		record = append(record, utils.SerializeUint32(uint32(len(dump)), false)...)
+		record = append(record, dump...)
+	}
+	return record
+}
+
+// Recover applies the record of a commit that was interrupted, returning true if there was one.
+// Applying a batch twice has no further effect, so it does not matter how much of the commit was written.
+func (j *Journal) Recover() (bool, error) {
+	record, err := j.db.Get(journalRecordKey)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := j.apply(record); err != nil {
+		return false, err
+	}
+	return true, j.db.Delete(journalRecordKey, syncWrite)
+}
+
+// apply writes the batches of a journal record to their databases
+func (j *Journal) apply(record []byte) error {
+	for len(record) > 0 {
+		if len(record) < 5 {
+			return ErrCorruptJournal
+		}
+		id := JournalID(record[0])
+		size := int(utils.DeserializeUint32(record[1:5], false))
+		record = record[5:]
+		if len(record) < size {
+			return ErrCorruptJournal
+		}
+		d, ok := j.targets[id]
+		if !ok {
+			return ErrUnknownJournalID
+		}
+		batch := NewBatch()
+		if err := batch.Load(record[:size]); err != nil {
+			return ErrCorruptJournal
+		}
+		if err := d.db.Write(batch, syncWrite); err != nil {
+			return err
+		}
+		record = record[size:]
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func newTestJournal(t *testing.T, open StoreOpener) (*Journal, *DBwrapper, *DBwrapper) {
+	j := newTestJournalDB(t, open)
+	first := newTestDBwrapper(t, open, true)
+	second := newTestDBwrapper(t, open, false)
+	j.Register(JournalChainstate, first)
+	j.Register(JournalBlocks, second)
+	return j, first, second
+}
+
+func TestJournal_Commit(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		j, first, second := newTestJournal(t, open)
+
+		if err := first.Insert([]byte("spent"), []byte("utxo")); err != nil {
+			t.Fatal(err)
+		}
+		first.PutInBatch([]byte("new"), []byte("utxo"))
+		first.DeleteInBatch([]byte("spent"))
+		second.PutInBatch([]byte("block"), []byte("data"))
+
+		// committing through any of the databases writes the batches of both
+		if err := first.CommitBatch(); err != nil {
+			t.Fatalf("Error committing: %v\n", err)
+		}
+		if val, err := first.Get([]byte("new")); err != nil || !bytes.Equal(val, []byte("utxo")) {
+			t.Errorf("Unexpected value in first db: %s %v\n", val, err)
+		}
+		if _, err := first.Get([]byte("spent")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected deleted key in first db, got %v\n", err)
+		}
+		if val, err := second.Get([]byte("block")); err != nil || !bytes.Equal(val, []byte("data")) {
+			t.Errorf("Unexpected value in second db: %s %v\n", val, err)
+		}
+		// the record should be removed once applied
+		if _, err := j.Get(journalRecordKey); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Journal record was not removed after commit.\n")
+		}
+		if first.currentBatch != nil || second.currentBatch != nil {
+			t.Errorf("Batches were not reset after commit.\n")
+		}
+	})
+}
+
+func TestJournal_Recover(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		j, first, second := newTestJournal(t, open)
+
+		if recovered, err := j.Recover(); err != nil || recovered {
+			t.Errorf("Expected nothing to recover, got %v %v\n", recovered, err)
+		}
+
+		// simulating a crash after the record was written and only the first batch was applied
+		first.PutInBatch([]byte("new"), []byte("utxo"))
+		second.PutInBatch([]byte("block"), []byte("data"))
+		if err := j.Insert(journalRecordKey, j.record()); err != nil {
+			t.Fatal(err)
+		}
+		if err := first.WriteBatch(); err != nil {
+			t.Fatal(err)
+		}
+		second.currentBatch = nil
+
+		recovered, err := j.Recover()
+		if err != nil || !recovered {
+			t.Fatalf("Expected interrupted commit to be recovered, got %v %v\n", recovered, err)
+		}
+		if val, err := first.Get([]byte("new")); err != nil || !bytes.Equal(val, []byte("utxo")) {
+			t.Errorf("Unexpected value in first db: %s %v\n", val, err)
+		}
+		if val, err := second.Get([]byte("block")); err != nil || !bytes.Equal(val, []byte("data")) {
+			t.Errorf("Unexpected value in second db: %s %v\n", val, err)
+		}
+		if recovered, _ := j.Recover(); recovered {
+			t.Errorf("Commit was recovered twice.\n")
+		}
+
+		// a corrupt record should not be applied
+		if err := j.Insert(journalRecordKey, []byte{byte(JournalBlocks), 0, 0, 0, 9}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := j.Recover(); !errors.Is(err, ErrCorruptJournal) {
+			t.Errorf("Expected corrupt journal error, got %v\n", err)
+		}
+	})
+}
+
+func TestJournal_Discard(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		_, first, second := newTestJournal(t, open)
+
+		first.PutInBatch([]byte("new"), []byte("utxo"))
+		second.PutInBatch([]byte("block"), []byte("failed"))
+		// discarding through any of the databases drops the batches of both
+		second.DiscardBatch()
+		if first.currentBatch != nil || second.currentBatch != nil {
+			t.Fatalf("Batches were not dropped.\n")
+		}
+
+		// the next commit should not contain the dropped records
+		second.PutInBatch([]byte("next"), []byte("data"))
+		if err := first.CommitBatch(); err != nil {
+			t.Fatalf("Error committing: %v\n", err)
+		}
+		if _, err := first.Get([]byte("new")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Discarded record was committed in first db: %v\n", err)
+		}
+		if _, err := second.Get([]byte("block")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Discarded record was committed in second db: %v\n", err)
+		}
+		if val, err := second.Get([]byte("next")); err != nil || !bytes.Equal(val, []byte("data")) {
+			t.Errorf("Unexpected value in second db: %s %v\n", val, err)
+		}
+	})
+}
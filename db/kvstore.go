@@ -0,0 +1,172 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var ErrNotFound = errors.New("key not found")
+var ErrStoreClosed = errors.New("store is closed")
+
+// KVStore is the key-value store the records of a database are kept in
+type KVStore interface {
+	// Get returns the value of the key, ErrNotFound if the key does not exist
+	Get(key []byte) ([]byte, error)
+	// Put sets the value of the key, sync makes the write durable before returning
+	Put(key, value []byte, sync bool) error
+	Delete(key []byte, sync bool) error
+	// Write applies the operations of the batch atomically
+	Write(batch *Batch, sync bool) error
+	// NewIterator returns an iterator over the keys starting with the prefix, in byte order.
+	// A nil prefix iterates over every key.
+	NewIterator(prefix []byte) Iterator
+	// GetSnapshot returns a read-only view of the current state of the store
+	GetSnapshot() (Snapshot, error)
+	Close() error
+}
+
+// Iterator walks over the records of a store. Key and Value are only valid until the next call to Next.
+type Iterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Release()
+	Error() error
+}
+
+// Snapshot is a consistent view of a store, unaffected by the writes made after it was taken
+type Snapshot interface {
+	Get(key []byte) ([]byte, error)
+	NewIterator(prefix []byte) Iterator
+	Release()
+}
+
+// StoreOpener opens the store at the path given, creating it if it does not exist
+type StoreOpener func(path string) (KVStore, error)
+
+// Batch is a list of puts and deletes applied together by KVStore.Write
+type Batch struct {
+	b leveldb.Batch
+}
+
+func NewBatch() *Batch {
+	return new(Batch)
+}
+
+func (b *Batch) Put(key, value []byte) {
+	b.b.Put(key, value)
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.b.Delete(key)
+}
+
+// Len returns the number of operations in the batch
+func (b *Batch) Len() int {
+	return b.b.Len()
+}
+
+func (b *Batch) Reset() {
+	b.b.Reset()
+}
+
+// Dump serializes the operations of the batch, they can be added back to a batch with Load
+func (b *Batch) Dump() []byte {
+	return b.b.Dump()
+}
+
+func (b *Batch) Load(data []byte) error {
+	return b.b.Load(data)
+}
+
+// batchReplay calls put and del for each operation of a batch, in order
+type batchReplay struct {
+	put func(key, value []byte)
+	del func(key []byte)
+}
+
+func (r batchReplay) Put(key, value []byte) { r.put(key, value) }
+func (r batchReplay) Delete(key []byte)     { r.del(key) }
+
+// replay calls put and del for each operation of the batch, in order
+func (b *Batch) replay(put func(key, value []byte), del func(key []byte)) error {
+	return b.b.Replay(batchReplay{put, del})
+}
+
+// levelDBStore is a KVStore kept on disk by LevelDB
+type levelDBStore struct {
+	db *leveldb.DB
+}
+
+// OpenLevelDB opens the LevelDB database in the directory given, creating it if it does not exist
+func OpenLevelDB(path string) (KVStore, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &levelDBStore{db}, nil
+}
+
+func writeOptions(sync bool) *opt.WriteOptions {
+	return &opt.WriteOptions{Sync: sync}
+}
+
+// levelDBGet converts the not found error of LevelDB to ErrNotFound
+func levelDBGet(get func([]byte, *opt.ReadOptions) ([]byte, error), key []byte) ([]byte, error) {
+	value, err := get(key, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (s *levelDBStore) Get(key []byte) ([]byte, error) {
+	return levelDBGet(s.db.Get, key)
+}
+
+func (s *levelDBStore) Put(key, value []byte, sync bool) error {
+	return s.db.Put(key, value, writeOptions(sync))
+}
+
+func (s *levelDBStore) Delete(key []byte, sync bool) error {
+	return s.db.Delete(key, writeOptions(sync))
+}
+
+func (s *levelDBStore) Write(batch *Batch, sync bool) error {
+	return s.db.Write(&batch.b, writeOptions(sync))
+}
+
+func (s *levelDBStore) NewIterator(prefix []byte) Iterator {
+	return s.db.NewIterator(util.BytesPrefix(prefix), nil)
+}
+
+func (s *levelDBStore) GetSnapshot() (Snapshot, error) {
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &levelDBSnapshot{snap}, nil
+}
+
+func (s *levelDBStore) Close() error {
+	return s.db.Close()
+}
+
+type levelDBSnapshot struct {
+	snap *leveldb.Snapshot
+}
+
+func (s *levelDBSnapshot) Get(key []byte) ([]byte, error) {
+	return levelDBGet(s.snap.Get, key)
+}
+
+func (s *levelDBSnapshot) NewIterator(prefix []byte) Iterator {
+	return s.snap.NewIterator(util.BytesPrefix(prefix), nil)
+}
+
+func (s *levelDBSnapshot) Release() {
+	s.snap.Release()
+}
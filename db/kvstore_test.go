@@ -0,0 +1,224 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// testBackends are the stores the db tests run against, each run gets a new opener
+var testBackends = []struct {
+	name   string
+	opener func() StoreOpener
+}{
+	{"leveldb", func() StoreOpener { return OpenLevelDB }},
+	{"memory", MemStoreOpener},
+}
+
+// forEachBackend runs the test as a subtest for each backend
+func forEachBackend(t *testing.T, test func(t *testing.T, open StoreOpener)) {
+	for _, backend := range testBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) { test(t, backend.opener()) })
+	}
+}
+
+// openTestStore opens a store in a temporary directory, closed when the test ends
+func openTestStore(t *testing.T, open StoreOpener) KVStore {
+	t.Helper()
+	store, err := open(filepath.Join(t.TempDir(), "store"))
+	if err != nil {
+		t.Fatalf("Error opening store: %v\n", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func newTestDBwrapper(t *testing.T, open StoreOpener, isObfuscated bool) *DBwrapper {
+	t.Helper()
+	d, err := NewDBwrapper(openTestStore(t, open), isObfuscated)
+	if err != nil {
+		t.Fatalf("Error creating DBwrapper: %v\n", err)
+	}
+	return d
+}
+
+func newTestChainstate(t *testing.T, open StoreOpener) *Chainstate {
+	t.Helper()
+	cstate, err := NewChainstate(openTestStore(t, open), true)
+	if err != nil {
+		t.Fatalf("Error creating chainstate: %v\n", err)
+	}
+	return cstate
+}
+
+func newTestJournalDB(t *testing.T, open StoreOpener) *Journal {
+	t.Helper()
+	j, err := NewJournal(openTestStore(t, open))
+	if err != nil {
+		t.Fatalf("Error creating journal: %v\n", err)
+	}
+	return j
+}
+
+// collectTestIterator returns the keys and values of the iterator, joined with '='
+func collectTestIterator(t *testing.T, iter Iterator) []string {
+	t.Helper()
+	defer iter.Release()
+	var res []string
+	for iter.Next() {
+		res = append(res, string(iter.Key())+"="+string(iter.Value()))
+	}
+	if err := iter.Error(); err != nil {
+		t.Fatalf("Error iterating: %v\n", err)
+	}
+	return res
+}
+
+func expectTestRecords(t *testing.T, got []string, exp ...string) {
+	t.Helper()
+	if len(got) != len(exp) {
+		t.Fatalf("Expected records %v, got %v\n", exp, got)
+	}
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Errorf("Expected records %v, got %v\n", exp, got)
+			return
+		}
+	}
+}
+
+func TestKVStore_PutGetDelete(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		store := openTestStore(t, open)
+
+		if _, err := store.Get([]byte("key")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v\n", err)
+		}
+		if err := store.Put([]byte("key"), []byte("value"), true); err != nil {
+			t.Fatal(err)
+		}
+		if val, err := store.Get([]byte("key")); err != nil || !bytes.Equal(val, []byte("value")) {
+			t.Errorf("Unexpected value: %s %v\n", val, err)
+		}
+		if err := store.Delete([]byte("key"), false); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Get([]byte("key")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected deleted key, got %v\n", err)
+		}
+		// deleting a missing key is not an error
+		if err := store.Delete([]byte("missing"), false); err != nil {
+			t.Errorf("Error deleting missing key: %v\n", err)
+		}
+	})
+}
+
+func TestKVStore_Batch(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		store := openTestStore(t, open)
+		store.Put([]byte("a"), []byte("1"), false)
+
+		batch := NewBatch()
+		batch.Put([]byte("b"), []byte("2"))
+		batch.Delete([]byte("a"))
+		batch.Put([]byte("c"), []byte("3"))
+		batch.Delete([]byte("c"))
+		batch.Put([]byte("d"), []byte("4"))
+		if batch.Len() != 5 {
+			t.Errorf("Expected 5 operations, got %d\n", batch.Len())
+		}
+		// the batch should survive a dump, as done by the journal
+		loaded := NewBatch()
+		if err := loaded.Load(batch.Dump()); err != nil {
+			t.Fatalf("Error loading batch: %v\n", err)
+		}
+		if err := store.Write(loaded, true); err != nil {
+			t.Fatalf("Error writing batch: %v\n", err)
+		}
+		expectTestRecords(t, collectTestIterator(t, store.NewIterator(nil)), "b=2", "d=4")
+	})
+}
+
+func TestKVStore_Iterator(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		store := openTestStore(t, open)
+		for _, k := range []string{"pb", "q", "pa", "p", "o"} {
+			store.Put([]byte(k), []byte(k), false)
+		}
+		expectTestRecords(t, collectTestIterator(t, store.NewIterator([]byte("p"))), "p=p", "pa=pa", "pb=pb")
+		expectTestRecords(t, collectTestIterator(t, store.NewIterator(nil)), "o=o", "p=p", "pa=pa", "pb=pb", "q=q")
+		expectTestRecords(t, collectTestIterator(t, store.NewIterator([]byte("z"))))
+	})
+}
+
+func TestKVStore_Snapshot(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		store := openTestStore(t, open)
+		store.Put([]byte("a"), []byte("1"), false)
+		store.Put([]byte("b"), []byte("2"), false)
+
+		snap, err := store.GetSnapshot()
+		if err != nil {
+			t.Fatalf("Error taking snapshot: %v\n", err)
+		}
+		defer snap.Release()
+		store.Put([]byte("a"), []byte("changed"), false)
+		store.Delete([]byte("b"), false)
+		store.Put([]byte("c"), []byte("3"), false)
+
+		// the writes after the snapshot should not be visible through it
+		if val, err := snap.Get([]byte("a")); err != nil || !bytes.Equal(val, []byte("1")) {
+			t.Errorf("Unexpected value in snapshot: %s %v\n", val, err)
+		}
+		if _, err := snap.Get([]byte("c")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected key written after the snapshot to be missing, got %v\n", err)
+		}
+		expectTestRecords(t, collectTestIterator(t, snap.NewIterator(nil)), "a=1", "b=2")
+		expectTestRecords(t, collectTestIterator(t, store.NewIterator(nil)), "a=changed", "c=3")
+	})
+}
+
+func TestKVStore_Reopen(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		path := filepath.Join(t.TempDir(), "store")
+		store, err := open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Put([]byte("key"), []byte("value"), true)
+		if err := store.Close(); err != nil {
+			t.Fatalf("Error closing store: %v\n", err)
+		}
+		if _, err := store.Get([]byte("key")); err == nil {
+			t.Errorf("Expected an error reading from a closed store.\n")
+		}
+		if err := store.Put([]byte("key"), []byte("value"), false); err == nil {
+			t.Errorf("Expected an error writing to a closed store.\n")
+		}
+
+		reopened, err := open(path)
+		if err != nil {
+			t.Fatalf("Error reopening store: %v\n", err)
+		}
+		defer reopened.Close()
+		if val, err := reopened.Get([]byte("key")); err != nil || !bytes.Equal(val, []byte("value")) {
+			t.Errorf("Unexpected value after reopening: %s %v\n", val, err)
+		}
+	})
+}
+
+func TestNewDBwrapper_ClosedStore(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		store, err := open(filepath.Join(t.TempDir(), "store"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Close()
+		// the obfuscation key cannot be read, an error should be returned instead of a panic
+		if _, err := NewDBwrapper(store, true); err == nil {
+			t.Errorf("Expected an error creating a DBwrapper on a closed store.\n")
+		}
+	})
+}
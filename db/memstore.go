@@ -0,0 +1,205 @@
+package db
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// memData holds the records of an in-memory store, shared by every handle opened on the same path
+type memData struct {
+	mtx     sync.RWMutex
+	records map[string][]byte
+}
+
+// sortedRecords returns copies of the records with keys starting with the prefix, in byte order.
+// The caller should hold the lock.
+func (md *memData) sortedRecords(prefix []byte) []memRecord {
+	var res []memRecord
+	for k, v := range md.records {
+		if bytes.HasPrefix([]byte(k), prefix) {
+			res = append(res, memRecord{[]byte(k), append([]byte{}, v...)})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return bytes.Compare(res[i].key, res[j].key) < 0 })
+	return res
+}
+
+// memStore is a KVStore kept in memory, its records are lost when the process exits
+type memStore struct {
+	*memData
+	closed bool
+}
+
+// NewMemStore creates an empty in-memory store
+func NewMemStore() KVStore {
+	return &memStore{memData: &memData{records: make(map[string][]byte)}}
+}
+
+// MemStoreOpener returns a StoreOpener creating in-memory stores. Opening a path again returns
+// a store with the records written under that path by the same opener, even after it was closed.
+func MemStoreOpener() StoreOpener {
+	var mtx sync.Mutex
+	stores := make(map[string]*memData)
+	return func(path string) (KVStore, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		data, ok := stores[path]
+		if !ok {
+			data = &memData{records: make(map[string][]byte)}
+			stores[path] = data
+		}
+		return &memStore{memData: data}, nil
+	}
+}
+
+func (s *memStore) Get(key []byte) ([]byte, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	value, ok := s.records[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (s *memStore) Put(key, value []byte, sync bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	s.records[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (s *memStore) Delete(key []byte, sync bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	delete(s.records, string(key))
+	return nil
+}
+
+func (s *memStore) Write(batch *Batch, sync bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	// the batch is applied to a copy first, so that an invalid batch leaves the records unchanged
+	puts := make(map[string][]byte)
+	dels := make(map[string]bool)
+	err := batch.replay(func(key, value []byte) {
+		puts[string(key)] = append([]byte{}, value...)
+		delete(dels, string(key))
+	}, func(key []byte) {
+		delete(puts, string(key))
+		dels[string(key)] = true
+	})
+	if err != nil {
+		return err
+	}
+	for k := range dels {
+		delete(s.records, k)
+	}
+	for k, v := range puts {
+		s.records[k] = v
+	}
+	return nil
+}
+
+func (s *memStore) NewIterator(prefix []byte) Iterator {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.closed {
+		return &memIterator{idx: -1, err: ErrStoreClosed}
+	}
+	return &memIterator{records: s.sortedRecords(prefix), idx: -1}
+}
+
+func (s *memStore) GetSnapshot() (Snapshot, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	snap := &memData{records: make(map[string][]byte, len(s.records))}
+	for k, v := range s.records {
+		// values are never modified in place, they can be shared with the snapshot
+		snap.records[k] = v
+	}
+	return &memSnapshot{snap}, nil
+}
+
+// Close closes this handle, the records are kept for the next store opened on the same path
+func (s *memStore) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.closed = true
+	return nil
+}
+
+type memSnapshot struct {
+	*memData
+}
+
+func (s *memSnapshot) Get(key []byte) ([]byte, error) {
+	value, ok := s.records[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (s *memSnapshot) NewIterator(prefix []byte) Iterator {
+	return &memIterator{records: s.sortedRecords(prefix), idx: -1}
+}
+
+func (s *memSnapshot) Release() {}
+
+type memRecord struct {
+	key, value []byte
+}
+
+// memIterator iterates over the records copied when it was created
+type memIterator struct {
+	records []memRecord
+	idx     int
+	err     error
+}
+
+func (it *memIterator) Next() bool {
+	if it.err != nil || it.idx >= len(it.records) {
+		return false
+	}
+	it.idx++
+	return it.idx < len(it.records)
+}
+
+func (it *memIterator) Key() []byte {
+	if it.idx < 0 || it.idx >= len(it.records) {
+		return nil
+	}
+	return it.records[it.idx].key
+}
+
+func (it *memIterator) Value() []byte {
+	if it.idx < 0 || it.idx >= len(it.records) {
+		return nil
+	}
+	return it.records[it.idx].value
+}
+
+func (it *memIterator) Release() {
+	it.records = nil
+}
+
+func (it *memIterator) Error() error {
+	return it.err
+}
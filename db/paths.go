@@ -0,0 +1,33 @@
+package db
+
+import (
+	"path/filepath"
+	"plairo/params"
+)
+
+// The databases of each network are kept in its own data directory
+
+func BlockStoragePath(cparams *params.ChainParams) string {
+	return filepath.Join(cparams.DataDirPath(), "blocks", "storage")
+}
+
+// BlockFilesPath is the directory of the blk and rev flat files
+func BlockFilesPath(cparams *params.ChainParams) string {
+	return filepath.Join(cparams.DataDirPath(), "blocks")
+}
+
+func UndoStoragePath(cparams *params.ChainParams) string {
+	return filepath.Join(cparams.DataDirPath(), "blocks", "undo")
+}
+
+func BlockIndexPath(cparams *params.ChainParams) string {
+	return filepath.Join(cparams.DataDirPath(), "blocks", "index")
+}
+
+func JournalPath(cparams *params.ChainParams) string {
+	return filepath.Join(cparams.DataDirPath(), "journal")
+}
+
+func ChainstatePath(cparams *params.ChainParams) string {
+	return filepath.Join(cparams.DataDirPath(), "chainstate")
+}
@@ -0,0 +1,68 @@
+package db
+
+import "os"
+
+// EnablePruning makes Prune delete the oldest blk and rev files once they use more than targetBytes.
+// Files with blocks less than depth blocks below the chainstate are kept, so that reorgs up to depth
+// blocks deep can be handled.
+func (bs *BlockStorage) EnablePruning(targetBytes uint64, depth uint32) {
+	bs.pruneTarget = targetBytes
+	bs.pruneDepth = depth
+}
+
+// DiskUsage returns the bytes used by the blk and rev files that have not been pruned
+func (bs *BlockStorage) DiskUsage() uint64 {
+	usage := uint64(bs.lastInfo.Size) + uint64(bs.lastInfo.UndoSize)
+	for file := uint32(0); file < bs.lastFile; file++ {
+		if info, ok := bs.index.GetFileInfo(file); ok {
+			usage += uint64(info.Size) + uint64(info.UndoSize)
+		}
+	}
+	return usage
+}
+
+// Prune deletes the oldest files until the disk usage is below the prune target, returning the number
+// of files deleted. height is the best block of the chainstate written to disk, the blocks above it may
+// have to be connected again on startup so they are never pruned. The file new blocks are appended to
+// is never pruned either.
+func (bs *BlockStorage) Prune(height uint32) (int, error) {
+	if bs.pruneTarget == 0 || height < bs.pruneDepth {
+		return 0, nil
+	}
+	maxHeight := height - bs.pruneDepth
+	usage := bs.DiskUsage()
+	pruned := 0
+	for file := uint32(0); file < bs.lastFile && usage > bs.pruneTarget; file++ {
+		info, ok := bs.index.GetFileInfo(file)
+		if !ok || info.Size+info.UndoSize == 0 || info.HeightLast > maxHeight {
+			continue
+		}
+		if err := bs.pruneFile(file, info); err != nil {
+			return pruned, err
+		}
+		usage -= uint64(info.Size) + uint64(info.UndoSize)
+		pruned++
+	}
+	return pruned, nil
+}
+
+// pruneFile marks the blocks of the file as pruned and deletes the blk and rev files.
+// The block index is updated first, so that a block is never read from a file being deleted.
+func (bs *BlockStorage) pruneFile(file uint32, info *BlockFileInfo) error {
+	// records are written directly, the current batch belongs to the block being connected
+	if _, err := bs.index.markPruned(file); err != nil {
+		return err
+	}
+	// the block count and heights are kept, a pruned file uses no space
+	pruned := *info
+	pruned.Size, pruned.UndoSize = 0, 0
+	if err := bs.index.Insert(fileInfoKey(file), pruned.serialize()); err != nil {
+		return err
+	}
+	for _, path := range []string{bs.blkFiles.path(file), bs.revFiles.path(file)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
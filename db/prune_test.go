@@ -0,0 +1,69 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"plairo/core"
+	"testing"
+)
+
+func TestBlockStorage_Prune(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		bs := newTestBlockStorage(t, open)
+		// two blocks per file, every file uses 2056 bytes with its rev file
+		bs.maxFileSize = 2100
+		bs.EnablePruning(5000, 3)
+
+		var blocks []*testBlock
+		for i := 0; i < 9; i++ {
+			block := &testBlock{[]byte{byte(i)}, bytes.Repeat([]byte{byte(i)}, 1000)}
+			if err := bs.WriteBlock(block, uint32(i)); err != nil {
+				t.Fatalf("Error writing block #%d: %v\n", i, err)
+			}
+			blocks = append(blocks, block)
+		}
+		if usage := bs.DiskUsage(); usage != 4*2056+1028 {
+			t.Fatalf("Unexpected disk usage %d\n", usage)
+		}
+
+		// Test Case #1: files with blocks less than 3 blocks below the height given are kept
+		if n, err := bs.Prune(3); err != nil || n != 0 {
+			t.Errorf("Expected no files pruned, got %d: %v\n", n, err)
+		}
+		// Test Case #2: the oldest files are pruned until the usage is below the target
+		if n, err := bs.Prune(8); err != nil || n != 3 {
+			t.Errorf("Expected 3 files pruned, got %d: %v\n", n, err)
+		}
+		if usage := bs.DiskUsage(); usage != 2056+1028 {
+			t.Errorf("Unexpected disk usage %d after pruning\n", usage)
+		}
+		for i, block := range blocks {
+			_, err := bs.OpenBlock(block.GetBlockHash())
+			if pruned := i < 6; pruned != errors.Is(err, core.ErrBlockPruned) {
+				t.Errorf("Unexpected result reading block #%d: %v\n", i, err)
+			}
+			if !bs.HasBlock(block.GetBlockHash()) {
+				t.Errorf("Block #%d should still be in the block index\n", i)
+			}
+		}
+		if _, err := bs.ReadUndo(blocks[0].GetBlockHash()); !errors.Is(err, core.ErrBlockPruned) {
+			t.Errorf("Expected ErrBlockPruned reading undo data, got %v\n", err)
+		}
+		if _, err := os.Stat(bs.blkFiles.path(0)); !os.IsNotExist(err) {
+			t.Errorf("Pruned blk file still exists: %v\n", err)
+		}
+		if info, ok := bs.GetFileInfo(0); !ok || info.Blocks != 2 || info.Size != 0 || info.UndoSize != 0 {
+			t.Errorf("Unexpected info of pruned file: %+v\n", info)
+		}
+
+		// Test Case #3: the file new blocks are appended to is never pruned
+		bs.EnablePruning(1, 0)
+		if n, err := bs.Prune(100); err != nil || n != 1 {
+			t.Errorf("Expected 1 file pruned, got %d: %v\n", n, err)
+		}
+		if _, ok := bs.GetBlockData(blocks[8].GetBlockHash()); !ok {
+			t.Errorf("Block of the last file was pruned.\n")
+		}
+	})
+}
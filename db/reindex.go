@@ -0,0 +1,182 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"plairo/core"
+	"plairo/utils"
+	"sort"
+)
+
+var ErrPrunedBlockFiles = errors.New("block files were pruned, the block index cannot be rebuilt from them")
+
+// errStopScan stops the scan of a file once a record is not a block that can be indexed
+var errStopScan = errors.New("stop scan")
+
+// scanRecords calls fn with the offset and data of each record of the file, until a record does not start
+// with the magic bytes or is incomplete. Data appended but never committed may be found after the last record.
+func (fs *flatFileSeq) scanRecords(file uint32, magic []byte, fn func(offset uint32, data []byte) error) error {
+	f, err := os.Open(fs.path(file))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	header := make([]byte, flatRecordHeaderSize)
+	for offset := uint32(0); ; {
+		if _, err := io.ReadFull(r, header); err != nil || !bytes.Equal(header[:len(magic)], magic) {
+			return nil
+		}
+		data := make([]byte, utils.DeserializeUint32(header[len(magic):], false))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil
+		}
+		if err := fn(offset, data); err != nil {
+			return err
+		}
+		offset += flatRecordHeaderSize + uint32(len(data))
+	}
+}
+
+// files returns the number of files of the sequence, which should be numbered from 0 without gaps
+func (fs *flatFileSeq) files() (uint32, error) {
+	paths, err := filepath.Glob(filepath.Join(fs.dir, fs.prefix+"*.dat"))
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(paths)
+	for i, path := range paths {
+		if path != fs.path(uint32(i)) {
+			return 0, ErrPrunedBlockFiles
+		}
+	}
+	return uint32(len(paths)), nil
+}
+
+// IsReindexing checks if a rebuild of the block index was started and not completed
+func (bs *BlockStorage) IsReindexing() bool {
+	_, err := bs.index.Get(buildKey(ReindexKey, nil))
+	return err == nil
+}
+
+// Reindex rebuilds the block index by scanning the blk and rev files, returning the number of blocks found.
+// The records of each file are committed along with the number of the next file to scan, so a reindex that
+// was interrupted continues from there. progress is called after each file with the number of files scanned
+// and the total. Blocks stored in pages by previous versions are not found, the files cannot have been pruned.
+// The file info records are kept, the scan of each file stops at the size committed there, so that the blocks
+// appended but never committed are not indexed. Files are scanned to their end if the block index has no file info.
+func (bs *BlockStorage) Reindex(progress func(scanned, files uint32)) (int, error) {
+	files, err := bs.blkFiles.files()
+	if err != nil {
+		return 0, err
+	}
+	next := uint32(0)
+	if record, err := bs.index.Get(buildKey(ReindexKey, nil)); err == nil && len(record) == 4 {
+		next = utils.DeserializeUint32(record, false)
+	}
+	if next == 0 {
+		// nothing was rebuilt yet, the old records are all removed except the file info
+		if err := bs.index.Insert(buildKey(ReindexKey, nil), utils.SerializeUint32(0, false)); err != nil {
+			return 0, err
+		}
+		keep := [][]byte{buildKey(ReindexKey, nil)}
+		for file := uint32(0); file < files; file++ {
+			keep = append(keep, fileInfoKey(file))
+		}
+		if err := bs.index.wipe(keep...); err != nil {
+			return 0, err
+		}
+		bs.lastFile, bs.lastInfo = 0, &BlockFileInfo{}
+	}
+
+	// the height of each block is found from the one it is linked to, blocks are written in order of height
+	heights := make(map[string]uint32)
+	heightOf := func(hash []byte) (uint32, bool) {
+		if height, ok := heights[string(hash)]; ok {
+			return height, true
+		}
+		_, height, err := bs.index.GetBlockHeader(hash)
+		return height, err == nil
+	}
+	bestHeight, hasBest := uint32(0), false
+	if hash, ok := bs.index.GetBestBlock(); ok {
+		bestHeight, hasBest = heightOf(hash)
+	}
+
+	// the genesis is in the first file, once it has a file info every committed file has one
+	_, hasInfo := bs.index.GetFileInfo(0)
+	found := 0
+	for file := next; file < files; file++ {
+		// the file info is read before it is replaced by the one rebuilt
+		committed, ok := bs.index.GetFileInfo(file)
+		if !ok && hasInfo {
+			// the file was started by a block that was never committed
+			committed = &BlockFileInfo{}
+		}
+		info := &BlockFileInfo{}
+		// the undo records are written in the same order as the blocks of the file
+		var undoPos []*BlockPos
+		err := bs.revFiles.scanRecords(file, bs.cparams.MagicBytes, func(offset uint32, data []byte) error {
+			if committed != nil && offset >= committed.UndoSize {
+				return errStopScan
+			}
+			undoPos = append(undoPos, &BlockPos{UndoOffset: offset, UndoSize: uint32(len(data))})
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopScan) && !os.IsNotExist(err) {
+			return found, err
+		}
+		blocks := 0
+		err = bs.blkFiles.scanRecords(file, bs.cparams.MagicBytes, func(offset uint32, data []byte) error {
+			if committed != nil && offset >= committed.Size {
+				return errStopScan
+			}
+			block, err := core.DeserializeBlock(data)
+			if err != nil || blocks >= len(undoPos) {
+				// not a block that was committed, the rest of the file is skipped
+				return errStopScan
+			}
+			header, _ := core.DeserializeBlockHeader(block.GetBlockHeader())
+			hash := block.GetBlockHash()
+			height := uint32(0)
+			if !bytes.Equal(hash, bs.cparams.Genesis.Hash) {
+				prevHeight, ok := heightOf(header.PreviousBlockHash)
+				if !ok {
+					return errStopScan
+				}
+				height = prevHeight + 1
+			}
+			pos := undoPos[blocks]
+			pos.File, pos.DataOffset, pos.DataSize = file, offset, uint32(len(data))
+			blocks++
+
+			bs.index.InsertBlockIndexRecord(block, height, pos)
+			info.addBlock(height, pos)
+			heights[string(hash)] = height
+			if !hasBest || height > bestHeight {
+				bs.index.SetBestBlock(hash)
+				bestHeight, hasBest = height, true
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopScan) {
+			return found, err
+		}
+		found += blocks
+
+		bs.index.SetFileInfo(file, info)
+		bs.index.PutInBatch(buildKey(ReindexKey, nil), utils.SerializeUint32(file+1, false))
+		if err := bs.index.WriteBatchBI(); err != nil {
+			return found, err
+		}
+		bs.lastFile, bs.lastInfo = file, info
+		if progress != nil {
+			progress(file+1, files)
+		}
+	}
+	return found, bs.index.Remove(buildKey(ReindexKey, nil))
+}
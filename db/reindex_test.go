@@ -0,0 +1,164 @@
+package db
+
+import (
+	"bytes"
+	"os"
+	"plairo/core"
+	"testing"
+)
+
+func TestBlockStorage_Reindex(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		bs := newTestBlockStorage(t, open)
+		var hashes [][]byte
+		prev := make([]byte, 32)
+		for height := uint32(0); height < 5; height++ {
+			block := createTestChainBlock(t, prev, height)
+			if height == 0 {
+				bs.cparams.Genesis.Hash = block.GetBlockHash()
+				// two blocks per file
+				bs.maxFileSize = uint32(2*(flatRecordHeaderSize+len(block.Serialize())) + 10)
+			}
+			if err := bs.WriteBlock(block, height); err != nil {
+				t.Fatalf("Error writing block #%d: %v\n", height, err)
+			}
+			hashes = append(hashes, block.GetBlockHash())
+			prev = block.GetBlockHash()
+		}
+		// data of a block that was never committed, found after the last record
+		f, _ := os.OpenFile(bs.blkFiles.path(2), os.O_APPEND|os.O_WRONLY, 0600)
+		f.Write([]byte("uncommitted"))
+		f.Close()
+
+		expPos := make([]*BlockPos, len(hashes))
+		for i, hash := range hashes {
+			expPos[i], _ = bs.index.GetBlockPos(hash)
+		}
+		expInfo, _ := bs.GetFileInfo(2)
+		checkIndex := func() {
+			t.Helper()
+			for i, hash := range hashes {
+				_, height, err := bs.ReadBlockHeader(hash)
+				pos, _ := bs.index.GetBlockPos(hash)
+				if err != nil || height != uint32(i) || pos == nil || *pos != *expPos[i] {
+					t.Errorf("Unexpected record of block #%d: %d %+v %v\n", i, height, pos, err)
+				}
+			}
+			if tip, ok := bs.GetBestBlock(); !ok || !bytes.Equal(tip, hashes[4]) {
+				t.Errorf("Unexpected tip after reindex: %x\n", tip)
+			}
+			if info, ok := bs.GetFileInfo(2); !ok || *info != *expInfo || bs.lastFile != 2 {
+				t.Errorf("Unexpected info of last file %d: %+v\n", bs.lastFile, info)
+			}
+		}
+
+		// Test Case #1: the whole block index is rebuilt
+		var scanned []uint32
+		found, err := bs.Reindex(func(n, files uint32) { scanned = append(scanned, n) })
+		if err != nil || found != 5 {
+			t.Fatalf("Expected 5 blocks found, got %d: %v\n", found, err)
+		}
+		if len(scanned) != 3 || bs.IsReindexing() {
+			t.Errorf("Unexpected progress %v\n", scanned)
+		}
+		checkIndex()
+
+		// Test Case #2: an interrupted reindex continues from the next file to scan
+		bs.index.Insert(buildKey(ReindexKey, nil), []byte{0, 0, 0, 2})
+		bs.index.Remove(buildKey(BlockIndexKey, hashes[4]))
+		scanned = nil
+		if found, err := bs.Reindex(func(n, files uint32) { scanned = append(scanned, n) }); err != nil || found != 1 {
+			t.Fatalf("Expected 1 block found, got %d: %v\n", found, err)
+		}
+		if len(scanned) != 1 || scanned[0] != 3 {
+			t.Errorf("Unexpected progress %v\n", scanned)
+		}
+		checkIndex()
+
+		// Test Case #3: pruned files cannot be scanned
+		os.Remove(bs.blkFiles.path(0))
+		if _, err := bs.Reindex(nil); err != ErrPrunedBlockFiles {
+			t.Errorf("Expected ErrPrunedBlockFiles, got %v\n", err)
+		}
+	})
+}
+
+func TestChainstate_Reindex(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		cstate := newTestChainstate(t, open)
+		tx := newCacheTestTX(1, 10)
+		cstate.InsertTX(tx)
+		cstate.SetBestBlock([]byte("best"), 1)
+		cstate.WriteBatchTX()
+
+		if err := cstate.BeginReindex(); err != nil {
+			t.Fatalf("Error beginning reindex: %v\n", err)
+		}
+		if _, ok := cstate.GetUtxo(tx.TXID, 0); ok || !cstate.IsReindexing() {
+			t.Errorf("Chainstate was not wiped.\n")
+		}
+		if _, _, ok := cstate.GetBestBlock(); ok {
+			t.Errorf("Best block was not wiped.\n")
+		}
+		// a rebuild in progress is not wiped again
+		cstate.InsertTX(tx)
+		if err := cstate.BeginReindex(); err != nil {
+			t.Fatalf("Error resuming reindex: %v\n", err)
+		}
+		if _, ok := cstate.GetUtxo(tx.TXID, 0); !ok {
+			t.Errorf("Rebuilt UTXO was wiped.\n")
+		}
+		if err := cstate.EndReindex(); err != nil || cstate.IsReindexing() {
+			t.Errorf("Reindex was not completed: %v\n", err)
+		}
+	})
+}
+
+func TestBlockStorage_ReindexUncommitted(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		bs := newTestBlockStorage(t, open)
+		var hashes [][]byte
+		prev := make([]byte, 32)
+		for height := uint32(0); height < 3; height++ {
+			block := createTestChainBlock(t, prev, height)
+			if height == 0 {
+				bs.cparams.Genesis.Hash = block.GetBlockHash()
+				// two blocks per file
+				bs.maxFileSize = uint32(2*(flatRecordHeaderSize+len(block.Serialize())) + 10)
+			}
+			if err := bs.WriteBlock(block, height); err != nil {
+				t.Fatalf("Error writing block #%d: %v\n", height, err)
+			}
+			hashes = append(hashes, block.GetBlockHash())
+			prev = block.GetBlockHash()
+		}
+		// complete records of blocks that were never committed, after the last block and in a new file
+		writeUncommitted := func(block *core.Block, file uint32, info *BlockFileInfo) {
+			undo, checksum := block.GetUndoData()
+			bs.blkFiles.writeRecord(file, info.Size, bs.cparams.MagicBytes, block.Serialize())
+			bs.revFiles.writeRecord(file, info.UndoSize, bs.cparams.MagicBytes, append(undo, checksum...))
+		}
+		expInfo, _ := bs.GetFileInfo(1)
+		uncommitted := createTestChainBlock(t, prev, 3)
+		writeUncommitted(uncommitted, 1, expInfo)
+		writeUncommitted(createTestChainBlock(t, uncommitted.GetBlockHash(), 4), 2, &BlockFileInfo{})
+
+		found, err := bs.Reindex(nil)
+		if err != nil || found != 3 {
+			t.Fatalf("Expected 3 blocks found, got %d: %v\n", found, err)
+		}
+		if tip, ok := bs.GetBestBlock(); !ok || !bytes.Equal(tip, hashes[2]) {
+			t.Errorf("Unexpected tip after reindex: %x\n", tip)
+		}
+		if _, _, err := bs.ReadBlockHeader(uncommitted.GetBlockHash()); err == nil {
+			t.Errorf("Uncommitted block was indexed.\n")
+		}
+		if info, ok := bs.GetFileInfo(1); !ok || *info != *expInfo {
+			t.Errorf("Unexpected info of file 1: %+v\n", info)
+		}
+		// new blocks are appended over the uncommitted data
+		if info, ok := bs.GetFileInfo(2); !ok || info.Blocks != 0 || bs.lastFile != 2 {
+			t.Errorf("Unexpected info of last file %d: %+v\n", bs.lastFile, info)
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"plairo/core"
+)
+
+var ErrTxIndexInterrupted = errors.New("transaction index build interrupted")
+
+// EnableTxIndex makes WriteBlock add a transaction index record for every transaction of the block.
+// Blocks written before the index was enabled are indexed by BuildTxIndex.
+func (bs *BlockStorage) EnableTxIndex() {
+	bs.txIndex = true
+}
+
+// indexBlockTxs adds the transaction index records of the block, either in the current batch or right away
+func (bs *BlockStorage) indexBlockTxs(block core.IBlock, batchMode bool) error {
+	hash := block.GetBlockHash()
+	for _, loc := range block.TxLocations() {
+		if err := bs.index.InsertTXIndexRecord(loc.TXID, hash, loc, batchMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DisconnectBlock adds the removal of the transaction index records of the block to the current batch,
+// so that they are committed along with the chainstate changes of the disconnection
+func (bs *BlockStorage) DisconnectBlock(block core.IBlock) error {
+	hash := block.GetBlockHash()
+	for _, loc := range block.TxLocations() {
+		bs.index.RemoveTXIndexRecord(loc.TXID, hash)
+	}
+	if bs.journal != nil {
+		return nil
+	}
+	return bs.index.WriteBatchBI()
+}
+
+// GetTransaction returns the serialized transaction with the TXID given and the hash of the block containing it
+func (bs *BlockStorage) GetTransaction(txid []byte) ([]byte, []byte, error) {
+	hash, loc, err := bs.index.GetTXIndexRecord(txid)
+	if err != nil {
+		return nil, nil, err
+	}
+	rr, err := bs.OpenBlock(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rr.Close()
+	// only the transaction is read, not the whole block
+	if uint64(loc.Offset)+uint64(loc.Length) > uint64(rr.Size()) {
+		return nil, nil, ErrInvalidIndexRecord
+	}
+	data := make([]byte, loc.Length)
+	if _, err := rr.ReadAt(data, int64(loc.Offset)); err != nil {
+		return nil, nil, err
+	}
+	return data, hash, nil
+}
+
+// BuildTxIndex indexes the transactions of the blocks written before the transaction index was enabled,
+// returning the number of blocks indexed. The chain is walked back from the current tip until the genesis,
+// a pruned block or the tip at which the previous build completed. Blocks written meanwhile are indexed
+// by WriteBlock, so the build can run in the background. Returns ErrTxIndexInterrupted if quit is closed before it completes.
+func (bs *BlockStorage) BuildTxIndex(quit <-chan struct{}) (int, error) {
+	tip, ok := bs.index.GetBestBlock()
+	if !ok {
+		return 0, nil
+	}
+	synced, err := bs.index.Get(buildKey(TxIndexSyncKey, nil))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return 0, err
+	}
+
+	indexed := 0
+	for hash := tip; !bytes.Equal(hash, synced); {
+		select {
+		case <-quit:
+			return indexed, ErrTxIndexInterrupted
+		default:
+		}
+		// records are written directly, the current batch belongs to the block being connected
+		block, err := bs.ReadBlock(hash)
+		if errors.Is(err, core.ErrBlockPruned) {
+			// the blocks below were pruned as well, their transactions cannot be looked up
+			break
+		}
+		if err != nil {
+			return indexed, err
+		}
+		if err := bs.indexBlockTxs(block, false); err != nil {
+			return indexed, err
+		}
+		header, height, err := bs.ReadBlockHeader(hash)
+		if err != nil {
+			return indexed, err
+		}
+		indexed++
+		if height == 0 {
+			break
+		}
+		hash = header.PreviousBlockHash
+	}
+	return indexed, bs.index.Insert(buildKey(TxIndexSyncKey, nil), tip)
+}
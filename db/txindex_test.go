@@ -0,0 +1,105 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"plairo/core"
+	"plairo/utils"
+	"testing"
+)
+
+// createTestChainBlock creates a block containing only a coinbase, linked to the block with hash prev
+func createTestChainBlock(t *testing.T, prev []byte, height uint32) *core.Block {
+	_, pubkey, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+	// the height is embedded in the coinbase, so the TXID of each block is different
+	cb, err := core.NewCoinbaseTransaction("txindex test", 50, pubkey, height)
+	if err != nil {
+		t.Fatalf("Error creating coinbase: %v\n", err)
+	}
+	header := &core.BlockHeader{PreviousBlockHash: prev, MerkleRoot: cb.TXID, Timestamp: int64(height)}
+	data := header.Serialize()
+	data = append(data, utils.SerializeUint32(1, false)...)
+	data = append(data, utils.SerializeUint32(uint32(len(cb.Serialize())), false)...)
+	data = append(data, cb.Serialize()...)
+	block, err := core.DeserializeBlock(data)
+	if err != nil {
+		t.Fatalf("Error creating block: %v\n", err)
+	}
+	return block
+}
+
+func TestBlockStorage_TxIndex(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		bs := newTestBlockStorage(t, open)
+
+		// the first two blocks are written before the transaction index is enabled
+		var blocks []*core.Block
+		prev := make([]byte, 32)
+		for height := uint32(0); height < 4; height++ {
+			if height == 2 {
+				bs.EnableTxIndex()
+			}
+			block := createTestChainBlock(t, prev, height)
+			if err := bs.WriteBlock(block, height); err != nil {
+				t.Fatalf("Error writing block #%d: %v\n", height, err)
+			}
+			blocks = append(blocks, block)
+			prev = block.GetBlockHash()
+		}
+		cbOf := func(i int) *core.Transaction { return blocks[i].AllBlockTx()[0] }
+
+		if _, _, err := bs.GetTransaction(cbOf(0).TXID); !errors.Is(err, ErrTxNotIndexed) {
+			t.Errorf("Expected ErrTxNotIndexed before the build, got %v\n", err)
+		}
+		// blocks written with the index enabled can be looked up right away
+		data, hash, err := bs.GetTransaction(cbOf(3).TXID)
+		if err != nil || !bytes.Equal(data, cbOf(3).Serialize()) || !bytes.Equal(hash, blocks[3].GetBlockHash()) {
+			t.Errorf("Unexpected lookup result: %x %x %v\n", data, hash, err)
+		}
+
+		// Test Case #1: an interrupted build does not record its progress
+		quit := make(chan struct{})
+		close(quit)
+		if _, err := bs.BuildTxIndex(quit); !errors.Is(err, ErrTxIndexInterrupted) {
+			t.Errorf("Expected ErrTxIndexInterrupted, got %v\n", err)
+		}
+		// Test Case #2: the build indexes every block down to the genesis
+		if n, err := bs.BuildTxIndex(nil); err != nil || n != 4 {
+			t.Errorf("Expected 4 blocks indexed, got %d: %v\n", n, err)
+		}
+		for i := range blocks {
+			if data, _, err := bs.GetTransaction(cbOf(i).TXID); err != nil || !bytes.Equal(data, cbOf(i).Serialize()) {
+				t.Errorf("Unexpected lookup result for block #%d: %x %v\n", i, data, err)
+			}
+		}
+		records := 0
+		err = bs.index.ForEachTXIndexRecord(nil, func(hash []byte, loc core.TxLocation) bool {
+			if data, _, err := bs.GetTransaction(loc.TXID); err != nil || int(loc.Length) != len(data) {
+				t.Errorf("Unexpected record of TX %x in block %x\n", loc.TXID, hash)
+			}
+			records++
+			return true
+		})
+		if n := len(blocks[0].AllBlockTx()) * len(blocks); err != nil || records != n {
+			t.Errorf("Expected %d records, got %d: %v\n", n, records, err)
+		}
+		// Test Case #3: a new build only covers the blocks written after the previous one
+		block := createTestChainBlock(t, prev, 4)
+		bs.WriteBlock(block, 4)
+		if n, err := bs.BuildTxIndex(nil); err != nil || n != 1 {
+			t.Errorf("Expected 1 block indexed, got %d: %v\n", n, err)
+		}
+
+		// Test Case #4: disconnecting a block removes its records
+		bs.DisconnectBlock(blocks[2])
+		if _, _, err := bs.GetTransaction(cbOf(3).TXID); err != nil {
+			t.Errorf("Record of another block was removed: %v\n", err)
+		}
+		if _, _, err := bs.GetTransaction(cbOf(2).TXID); !errors.Is(err, ErrTxNotIndexed) {
+			t.Errorf("Expected ErrTxNotIndexed after disconnection, got %v\n", err)
+		}
+	})
+}
@@ -0,0 +1,286 @@
+package db
+
+import (
+	"plairo/core"
+	"sync"
+)
+
+// rough memory estimation of a cached entry without its script, used to keep track of the cache size
+const cachedUtxoOverhead = 160
+
+// cachedUtxo is the in-memory version of a chainstate UTXO entry
+type cachedUtxo struct {
+	// entry is nil once the output is spent
+	entry *core.UtxoEntry
+	// dirty entries differ from the ones in the chainstate db
+	dirty bool
+	// fresh entries do not exist in the chainstate db, so they can be dropped when spent
+	fresh bool
+}
+
+func (cu *cachedUtxo) usage() int {
+	if cu.entry == nil {
+		return cachedUtxoOverhead
+	}
+	return cachedUtxoOverhead + len(cu.entry.Output.ScriptPubKey)
+}
+
+// UTXOCache is a write-back cache in front of the chainstate db.
+// Changes are kept in memory and written in a single batch, along with the best block hash,
+// when the memory budget is exceeded or when the cache is closed.
+type UTXOCache struct {
+	base       *Chainstate
+	mtx        sync.Mutex
+	entries    map[string]*cachedUtxo
+	usage      int
+	maxUsage   int
+	bestBlock  []byte
+	bestHeight uint32
+	// pending keeps the state of the entries before the changes of the block being connected,
+	// nil for entries that were not cached, so that the changes can be discarded
+	pending    map[string]*cachedUtxo
+	prevBest   []byte
+	prevHeight uint32
+	bestStaged bool
+	// onFlush is called with the height of the best block written by each flush
+	onFlush func(uint32)
+}
+
+// NewUTXOCache creates a cache on top of the chainstate, flushing when its size exceeds maxBytes
+func NewUTXOCache(base *Chainstate, maxBytes int) *UTXOCache {
+	return &UTXOCache{base: base, entries: make(map[string]*cachedUtxo), pending: make(map[string]*cachedUtxo), maxUsage: maxBytes}
+}
+
+// stage records the state of the entry before its first change since the last write
+func (c *UTXOCache) stage(key string) {
+	if _, ok := c.pending[key]; ok {
+		return
+	}
+	var prev *cachedUtxo
+	if cu, ok := c.entries[key]; ok {
+		cp := *cu
+		prev = &cp
+	}
+	c.pending[key] = prev
+}
+
+// fetch returns the cached UTXO, loading it from the chainstate db if needed.
+// nil is returned if the UTXO does not exist.
+func (c *UTXOCache) fetch(txid []byte, vout uint32) *cachedUtxo {
+	key := string(utxoKey(txid, vout))
+	if cu, ok := c.entries[key]; ok {
+		return cu
+	}
+	entry, ok := c.base.GetUtxoEntry(txid, vout)
+	if !ok {
+		return nil
+	}
+	cu := &cachedUtxo{entry: entry}
+	c.entries[key] = cu
+	c.usage += cu.usage()
+	return cu
+}
+
+func (c *UTXOCache) GetUtxoEntry(txid []byte, vout uint32) (*core.UtxoEntry, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	cu := c.fetch(txid, vout)
+	if cu == nil || cu.entry == nil {
+		return nil, false
+	}
+	// returning a copy, so that callers cannot modify the cached output
+	e := *cu.entry
+	e.Output = core.NewTransactionOutput(txid, vout, e.Output.Value, e.Output.ScriptPubKey)
+	return &e, true
+}
+
+func (c *UTXOCache) GetUtxo(txid []byte, vout uint32) (*core.TransactionOutput, bool) {
+	entry, ok := c.GetUtxoEntry(txid, vout)
+	if !ok {
+		return nil, false
+	}
+	return entry.Output, true
+}
+
+func (c *UTXOCache) RemoveUtxo(txid []byte, vout uint32) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	cu := c.fetch(txid, vout)
+	if cu == nil || cu.entry == nil {
+		return false
+	}
+	c.stage(string(utxoKey(txid, vout)))
+	c.usage -= cu.usage()
+	// a fresh UTXO that gets spent never has to reach the db
+	if cu.fresh {
+		delete(c.entries, string(utxoKey(txid, vout)))
+		return true
+	}
+	cu.entry = nil
+	cu.dirty = true
+	c.usage += cu.usage()
+	return true
+}
+
+func (c *UTXOCache) InsertBatchTX(tx *core.Transaction) error {
+	// checking if there are unspent outputs left before inserting
+	if tx.IsSpent() {
+		return ErrSpentTX
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for i, outp := range tx.GetOutputs() {
+		if !outp.IsNotSpent {
+			continue
+		}
+		key := string(utxoKey(tx.TXID, uint32(i)))
+		// TXIDs are unique, so the output is only in the db if it was already cached from there
+		c.stage(key)
+		cu := &cachedUtxo{entry: core.NewUtxoEntry(tx, outp), dirty: true, fresh: true}
+		if old, ok := c.entries[key]; ok {
+			cu.fresh = old.fresh
+			c.usage -= old.usage()
+		}
+		c.entries[key] = cu
+		c.usage += cu.usage()
+	}
+	return nil
+}
+
+// InsertBatchUtxo adds a single output, used to restore the outputs spent by a disconnected block
+func (c *UTXOCache) InsertBatchUtxo(entry *core.UtxoEntry) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	key := string(utxoKey(entry.Output.ParentTXID, entry.Output.Vout))
+	// the output may have been in the db before it was spent, so it is never fresh
+	c.stage(key)
+	cu := &cachedUtxo{entry: entry, dirty: true}
+	if old, ok := c.entries[key]; ok {
+		c.usage -= old.usage()
+	}
+	c.entries[key] = cu
+	c.usage += cu.usage()
+	return nil
+}
+
+// OnFlush sets a function called after each flush that writes a new best block, with its height.
+// It is called while the cache is locked, so it should not use the cache.
+func (c *UTXOCache) OnFlush(fn func(height uint32)) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.onFlush = fn
+}
+
+// SetBestBlock records the hash and height of the block the cached UTXOs correspond to, written on the next flush
+func (c *UTXOCache) SetBestBlock(hash []byte, height uint32) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if !c.bestStaged {
+		c.prevBest, c.prevHeight, c.bestStaged = c.bestBlock, c.bestHeight, true
+	}
+	c.bestBlock, c.bestHeight = hash, height
+}
+
+// GetBestBlock returns the hash and height of the block the UTXOs correspond to, false if no block was connected yet
+func (c *UTXOCache) GetBestBlock() ([]byte, uint32, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.bestBlock != nil {
+		return c.bestBlock, c.bestHeight, true
+	}
+	return c.base.GetBestBlock()
+}
+
+// WriteBatchTX is called once a block is connected, the cache is only flushed if it exceeds its memory budget.
+// The block records staged in the journal of the chainstate are committed either way, so the block index
+// may run ahead of the chainstate db after a crash. The db is still consistent with the best block it records,
+// and VerifyChain reconnects the missing blocks on startup.
+func (c *UTXOCache) WriteBatchTX() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.usage <= c.maxUsage {
+		if err := c.base.WriteBatchTX(); err != nil {
+			return err
+		}
+		c.clearPending()
+		return nil
+	}
+	return c.flush()
+}
+
+// DiscardBatchTX restores the entries and the best block changed since the last WriteBatchTX,
+// and drops the records staged in the journal of the chainstate
+func (c *UTXOCache) DiscardBatchTX() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for key, prev := range c.pending {
+		if cu, ok := c.entries[key]; ok {
+			c.usage -= cu.usage()
+			delete(c.entries, key)
+		}
+		if prev != nil {
+			c.entries[key] = prev
+			c.usage += prev.usage()
+		}
+	}
+	if c.bestStaged {
+		c.bestBlock, c.bestHeight = c.prevBest, c.prevHeight
+	}
+	c.clearPending()
+	c.base.DiscardBatchTX()
+}
+
+func (c *UTXOCache) clearPending() {
+	c.pending = make(map[string]*cachedUtxo)
+	c.prevBest, c.prevHeight, c.bestStaged = nil, 0, false
+}
+
+// Flush writes every modified entry along with the best block hash in a single batch and empties the cache
+func (c *UTXOCache) Flush() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.flush()
+}
+
+func (c *UTXOCache) flush() error {
+	for key, cu := range c.entries {
+		if !cu.dirty {
+			continue
+		}
+		if cu.entry == nil {
+			c.base.DeleteInBatch([]byte(key))
+		} else {
+			c.base.PutInBatch([]byte(key), cu.entry.Serialize())
+		}
+	}
+	if c.bestBlock != nil {
+		c.base.SetBestBlock(c.bestBlock, c.bestHeight)
+	}
+	if err := c.base.WriteBatchTX(); err != nil {
+		return err
+	}
+	if c.bestBlock != nil && c.onFlush != nil {
+		c.onFlush(c.bestHeight)
+	}
+	c.entries = make(map[string]*cachedUtxo)
+	c.usage = 0
+	c.bestBlock = nil
+	c.clearPending()
+	return nil
+}
+
+// Size returns the estimated memory used by the cache in bytes
+func (c *UTXOCache) Size() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.usage
+}
+
+// Close flushes the cache and closes the chainstate db
+func (c *UTXOCache) Close() error {
+	err := c.Flush()
+	if cerr := c.base.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,311 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"plairo/core"
+	"plairo/params"
+	"testing"
+)
+
+// newCacheTestTX creates a transaction with unspent outputs of the values given, made unique by the height
+func newCacheTestTX(height uint32, values ...uint64) *core.Transaction {
+	outs := make([]*core.TransactionOutput, len(values))
+	for i, value := range values {
+		outs[i] = core.NewTransactionOutput([]byte{}, 0, value, []byte("pubkey"))
+	}
+	tx := core.NewTransaction(nil, outs)
+	tx.BlockHeight = height
+	tx.TXID = []byte{byte(height), 0xca, 0xfe}
+	return tx
+}
+
+func TestUTXOCache_ReadWrite(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		cstate := newTestChainstate(t, open)
+		cache := NewUTXOCache(cstate, 1<<20)
+
+		tx := newCacheTestTX(1, 10, 20, 30)
+		if err := cache.InsertBatchTX(tx); err != nil {
+			t.Fatalf("Error inserting TX: %v\n", err)
+		}
+		if err := cache.WriteBatchTX(); err != nil {
+			t.Fatalf("Error writing batch: %v\n", err)
+		}
+		// the cache is below its budget, nothing should have been written
+		if _, ok := cstate.GetNoOfUTXOs(tx.TXID); ok {
+			t.Errorf("TX was written to the db before flushing.\n")
+		}
+		utxo, ok := cache.GetUtxo(tx.TXID, 1)
+		if !ok || utxo.Value != 20 || utxo.Vout != 1 || !bytes.Equal(utxo.ParentTXID, tx.TXID) {
+			t.Fatalf("Unexpected cached UTXO: %v %v\n", utxo, ok)
+		}
+
+		if !cache.RemoveUtxo(tx.TXID, 1) {
+			t.Fatalf("Error removing UTXO.\n")
+		}
+		if cache.RemoveUtxo(tx.TXID, 1) {
+			t.Errorf("Removed the same UTXO twice.\n")
+		}
+		if _, ok := cache.GetUtxo(tx.TXID, 1); ok {
+			t.Errorf("Spent UTXO is still returned.\n")
+		}
+
+		if err := cache.Flush(); err != nil {
+			t.Fatalf("Error flushing cache: %v\n", err)
+		}
+		if cache.Size() != 0 {
+			t.Errorf("Expected empty cache after flushing, size is %d\n", cache.Size())
+		}
+		// the db should now contain the TX with outputs 0 and 2
+		for vout, exp := range []bool{true, false, true} {
+			if _, ok := cstate.GetUtxo(tx.TXID, uint32(vout)); ok != exp {
+				t.Errorf("Unexpected state of UTXO %d in db, exists: %v\n", vout, ok)
+			}
+		}
+		// reads should be served from the db again
+		if utxo, ok := cache.GetUtxo(tx.TXID, 2); !ok || utxo.Value != 30 {
+			t.Errorf("Unexpected UTXO loaded from db: %v %v\n", utxo, ok)
+		}
+
+		// spending the remaining outputs should delete the TX from the db on flush
+		cache.RemoveUtxo(tx.TXID, 0)
+		cache.RemoveUtxo(tx.TXID, 2)
+		if _, ok := cache.GetUtxoEntry(tx.TXID, 2); ok {
+			t.Errorf("Spent UTXO entry is still returned.\n")
+		}
+		if err := cache.Flush(); err != nil {
+			t.Fatalf("Error flushing cache: %v\n", err)
+		}
+		if _, ok := cstate.GetNoOfUTXOs(tx.TXID); ok {
+			t.Errorf("Spent TX was not deleted from the db.\n")
+		}
+
+		if err := cache.InsertBatchTX(newCacheTestTX(2)); !errors.Is(err, ErrSpentTX) {
+			t.Errorf("Expected spent TX error, got %v\n", err)
+		}
+	})
+}
+
+func TestUTXOCache_FreshSpent(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		cstate := newTestChainstate(t, open)
+		cache := NewUTXOCache(cstate, 1<<20)
+
+		tx := newCacheTestTX(1, 10)
+		cache.InsertBatchTX(tx)
+		if !cache.RemoveUtxo(tx.TXID, 0) {
+			t.Fatalf("Error removing UTXO.\n")
+		}
+		// the entry never reached the db, so it should have been dropped
+		if cache.Size() != 0 {
+			t.Errorf("Fresh spent TX is still cached, size is %d\n", cache.Size())
+		}
+		if err := cache.Flush(); err != nil {
+			t.Fatalf("Error flushing cache: %v\n", err)
+		}
+		if _, ok := cstate.GetNoOfUTXOs(tx.TXID); ok {
+			t.Errorf("Fresh spent TX was written to the db.\n")
+		}
+	})
+}
+
+func TestUTXOCache_BestBlock(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		cstate := newTestChainstate(t, open)
+		cache := NewUTXOCache(cstate, 1<<20)
+		var flushed []uint32
+		cache.OnFlush(func(height uint32) { flushed = append(flushed, height) })
+
+		if _, _, ok := cache.GetBestBlock(); ok {
+			t.Errorf("Expected no best block on an empty db.\n")
+		}
+		tx := newCacheTestTX(1, 10)
+		cache.InsertBatchTX(tx)
+		hash := []byte("blockhash")
+		cache.SetBestBlock(hash, 7)
+		cache.WriteBatchTX()
+		if _, _, ok := cstate.GetBestBlock(); ok {
+			t.Errorf("Best block was written before flushing.\n")
+		}
+		if got, height, ok := cache.GetBestBlock(); !ok || !bytes.Equal(got, hash) || height != 7 {
+			t.Errorf("Unexpected cached best block: %s %d\n", got, height)
+		}
+
+		if err := cache.Flush(); err != nil {
+			t.Fatalf("Error flushing cache: %v\n", err)
+		}
+		if got, height, ok := cstate.GetBestBlock(); !ok || !bytes.Equal(got, hash) || height != 7 {
+			t.Errorf("Unexpected best block in db: %s %d\n", got, height)
+		}
+		if _, ok := cstate.GetUtxo(tx.TXID, 0); !ok {
+			t.Errorf("UTXO was not flushed along with the best block.\n")
+		}
+		// flushing again without a new best block should not call the function again
+		cache.Flush()
+		if len(flushed) != 1 || flushed[0] != 7 {
+			t.Errorf("Unexpected heights passed to the flush function: %v\n", flushed)
+		}
+	})
+}
+
+func TestUTXOCache_FlushOnBudget(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		cstate := newTestChainstate(t, open)
+		// the budget fits a single TX
+		cache := NewUTXOCache(cstate, 200)
+
+		first := newCacheTestTX(1, 10)
+		cache.InsertBatchTX(first)
+		cache.WriteBatchTX()
+		if _, ok := cstate.GetNoOfUTXOs(first.TXID); ok {
+			t.Fatalf("Cache was flushed below its budget.\n")
+		}
+
+		second := newCacheTestTX(2, 10)
+		cache.InsertBatchTX(second)
+		if err := cache.WriteBatchTX(); err != nil {
+			t.Fatalf("Error writing batch: %v\n", err)
+		}
+		for _, tx := range []*core.Transaction{first, second} {
+			if _, ok := cstate.GetUtxo(tx.TXID, 0); !ok {
+				t.Errorf("TX %x was not flushed when the budget was exceeded.\n", tx.TXID)
+			}
+		}
+	})
+}
+
+func TestUTXOCache_DiscardBatchTX(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		cstate := newTestChainstate(t, open)
+		cache := NewUTXOCache(cstate, 1<<20)
+
+		// an output written to the db and another one only cached
+		stored := newCacheTestTX(1, 10)
+		cache.InsertBatchTX(stored)
+		cache.SetBestBlock([]byte("first"), 1)
+		cache.Flush()
+		cached := newCacheTestTX(2, 20)
+		cache.InsertBatchTX(cached)
+		cache.SetBestBlock([]byte("second"), 2)
+		if err := cache.WriteBatchTX(); err != nil {
+			t.Fatalf("Error writing batch: %v\n", err)
+		}
+		size := cache.Size()
+
+		// a block spending both outputs that fails to connect
+		cache.RemoveUtxo(stored.TXID, 0)
+		cache.RemoveUtxo(cached.TXID, 0)
+		failed := newCacheTestTX(3, 30)
+		cache.InsertBatchTX(failed)
+		cache.SetBestBlock([]byte("failed"), 3)
+		cache.DiscardBatchTX()
+
+		for _, tx := range []*core.Transaction{stored, cached} {
+			if _, ok := cache.GetUtxo(tx.TXID, 0); !ok {
+				t.Errorf("Output of TX %x was not restored.\n", tx.TXID)
+			}
+		}
+		if _, ok := cache.GetUtxo(failed.TXID, 0); ok {
+			t.Errorf("Output of the failed block is still cached.\n")
+		}
+		if hash, height, ok := cache.GetBestBlock(); !ok || !bytes.Equal(hash, []byte("second")) || height != 2 {
+			t.Errorf("Unexpected best block after discarding: %s %d\n", hash, height)
+		}
+		// the stored output was loaded into the cache when spent
+		if cache.Size() <= size {
+			t.Errorf("Unexpected cache size after discarding: %d, was %d\n", cache.Size(), size)
+		}
+
+		// the restored entries should still be written on the next flush
+		if err := cache.Flush(); err != nil {
+			t.Fatalf("Error flushing cache: %v\n", err)
+		}
+		for _, tx := range []*core.Transaction{stored, cached} {
+			if _, ok := cstate.GetUtxo(tx.TXID, 0); !ok {
+				t.Errorf("Output of TX %x is missing from the db.\n", tx.TXID)
+			}
+		}
+		if _, ok := cstate.GetNoOfUTXOs(failed.TXID); ok {
+			t.Errorf("TX of the failed block was written to the db.\n")
+		}
+		if hash, height, ok := cstate.GetBestBlock(); !ok || !bytes.Equal(hash, []byte("second")) || height != 2 {
+			t.Errorf("Unexpected best block in db: %s %d\n", hash, height)
+		}
+	})
+}
+
+func TestUTXOCache_JournaledRestart(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open StoreOpener) {
+		bs := newTestBlockStorage(t, open)
+		cstate := newTestChainstate(t, open)
+		journal := newTestJournalDB(t, open)
+		cstate.RegisterInJournal(journal)
+		bs.RegisterInJournal(journal)
+		core.BStorage = bs
+		defer func() {
+			core.BStorage = nil
+			core.SetChainstate(nil)
+		}()
+
+		cache := NewUTXOCache(cstate, 1<<20)
+		core.SetChainstate(cache)
+		bc, err := core.CreateBlockchain(params.RegTestParams)
+		if err != nil {
+			t.Fatalf("Error creating blockchain: %v\n", err)
+		}
+		if err := bc.StoreGenesis(); err != nil {
+			t.Fatalf("Error storing genesis: %v\n", err)
+		}
+		genesis, _ := bc.GetHeaderAt(0)
+		cache.Flush()
+
+		// the blocks are committed to the block index while their UTXOs stay in the cache
+		var blocks []*core.Block
+		prev := genesis.GetHash()
+		for height := uint32(1); height <= 2; height++ {
+			block := createTestChainBlock(t, prev, height)
+			if err := bs.WriteBlock(block, height); err != nil {
+				t.Fatalf("Error writing block #%d: %v\n", height, err)
+			}
+			if err := block.ConfirmAsValid(height); err != nil {
+				t.Fatalf("Error connecting block #%d: %v\n", height, err)
+			}
+			blocks = append(blocks, block)
+			prev = block.GetBlockHash()
+		}
+		if hash, ok := bs.GetBestBlock(); !ok || !bytes.Equal(hash, prev) {
+			t.Errorf("Unexpected block index tip: %x\n", hash)
+		}
+		// the chainstate db is behind the block index, but consistent with the best block it records
+		if hash, height, ok := cstate.GetBestBlock(); !ok || !bytes.Equal(hash, genesis.GetHash()) || height != 0 {
+			t.Errorf("Unexpected chainstate best block: %x %d\n", hash, height)
+		}
+		for _, block := range blocks {
+			if _, ok := cstate.GetUtxo(block.AllBlockTx()[0].TXID, 0); ok {
+				t.Errorf("Cached UTXO of block %x was written with the block records.\n", block.GetBlockHash())
+			}
+		}
+
+		// restarting without flushing the cache, the missing blocks are reconnected from the block storage
+		cache = NewUTXOCache(cstate, 1<<20)
+		core.SetChainstate(cache)
+		if bc, err = core.CreateBlockchain(params.RegTestParams); err != nil {
+			t.Fatalf("Error creating blockchain: %v\n", err)
+		}
+		if err := bc.VerifyChain(bs, 0); err != nil {
+			t.Fatalf("Error verifying chain: %v\n", err)
+		}
+		if err := cache.Flush(); err != nil {
+			t.Fatalf("Error flushing cache: %v\n", err)
+		}
+		if hash, height, ok := cstate.GetBestBlock(); !ok || !bytes.Equal(hash, prev) || height != 2 {
+			t.Errorf("Unexpected chainstate best block after restart: %x %d\n", hash, height)
+		}
+		for _, block := range blocks {
+			if _, ok := cstate.GetUtxo(block.AllBlockTx()[0].TXID, 0); !ok {
+				t.Errorf("UTXO of block %x was not reconnected.\n", block.GetBlockHash())
+			}
+		}
+	})
+}
@@ -1,4 +1,187 @@
 package main
 
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"plairo/core"
+	"plairo/db"
+	"plairo/params"
+	"plairo/rpc"
+	"plairo/utils"
+	"syscall"
+)
+
 func main() {
+	network := flag.String("network", params.MainNetParams.Name, "network to use: main, testnet or regtest")
+	minerPubKey := flag.String("minerpubkey", "", "hex PKIX key the rewards of blocks mined by the generate RPC are paid to")
+	checkBlocks := flag.Uint("checkblocks", params.DefaultCheckBlocks, "number of blocks checked against their undo data on startup")
+	txIndex := flag.Bool("txindex", false, "keep an index of every confirmed transaction, used by getrawtransaction")
+	prune := flag.Uint("prune", 0, "target size of the block files in Mb, the oldest blocks are deleted above it, 0 disables pruning")
+	pruneDepth := flag.Uint("prunedepth", params.DefaultPruneDepth, "number of blocks below the tip that are never pruned")
+	reindex := flag.Bool("reindex", false, "rebuild the block index from the block files, along with the chainstate")
+	reindexChainstate := flag.Bool("reindex-chainstate", false, "rebuild the chainstate by connecting the stored blocks again")
+	dbCache := flag.Int("dbcache", params.DefaultUTXOCacheSize>>20, "size of the UTXO cache in Mb")
+	flag.Parse()
+
+	cparams, err := params.ParamsForNetwork(*network)
+	if err != nil {
+		log.Fatalf("%v: %s\n", err, *network)
+	}
+	if *prune > 0 && *prune < params.MinPruneTargetMB {
+		log.Fatalf("Prune target should be at least %dMb\n", params.MinPruneTargetMB)
+	}
+
+	journal, err := db.OpenJournal(db.OpenLevelDB, db.JournalPath(cparams))
+	if err != nil {
+		log.Fatalf("Error opening journal: %v\n", err)
+	}
+	defer journal.Close()
+	cstate, err := db.OpenChainstate(db.OpenLevelDB, db.ChainstatePath(cparams), true)
+	if err != nil {
+		log.Fatalf("Error opening chainstate: %v\n", err)
+	}
+	bstorage, err := db.NewBlockStorage(cparams, db.OpenLevelDB, db.BlockStoragePath(cparams), true)
+	if err != nil {
+		log.Fatalf("Error opening block storage: %v\n", err)
+	}
+	defer bstorage.Close()
+	// connecting a block is a single commit across the chainstate and the block storage
+	cstate.RegisterInJournal(journal)
+	bstorage.RegisterInJournal(journal)
+	if recovered, err := journal.Recover(); err != nil {
+		log.Fatalf("Error recovering interrupted commit: %v\n", err)
+	} else if recovered {
+		log.Printf("Completed a block commit interrupted on the last shutdown\n")
+	}
+	if *txIndex {
+		bstorage.EnableTxIndex()
+	}
+	if *prune > 0 {
+		bstorage.EnablePruning(uint64(*prune)<<20, uint32(*pruneDepth))
+	}
+	core.BStorage = bstorage
+	// an interrupted reindex is resumed even without the flag, the block index is incomplete until it is done
+	if *reindex || bstorage.IsReindexing() {
+		log.Printf("Rebuilding block index from the block files\n")
+		found, err := bstorage.Reindex(func(scanned, files uint32) {
+			log.Printf("Reindexing block files: %d/%d\n", scanned, files)
+		})
+		if err != nil {
+			log.Fatalf("Error rebuilding block index: %v\n", err)
+		}
+		log.Printf("Block index rebuilt, %d blocks found\n", found)
+		// the chainstate has to match the new block index
+		*reindexChainstate = true
+	}
+
+	// converting the UTXOs of the per-TX format used by previous versions
+	if migrated, err := cstate.MigrateLegacyUTXOs(); err != nil {
+		log.Fatalf("Error migrating chainstate: %v\n", err)
+	} else if migrated > 0 {
+		log.Printf("Migrated %d chainstate records to per-output entries\n", migrated)
+	}
+	if *reindexChainstate || cstate.IsReindexing() {
+		if err := cstate.BeginReindex(); err != nil {
+			log.Fatalf("Error wiping chainstate: %v\n", err)
+		}
+	}
+	utxoCache := db.NewUTXOCache(cstate, *dbCache<<20)
+	// flushing the cached UTXOs on shutdown, before the databases of the journal are closed
+	defer func() {
+		if err := utxoCache.Close(); err != nil {
+			log.Printf("Error flushing UTXO cache: %v\n", err)
+		}
+	}()
+	if *prune > 0 {
+		// only the blocks below the chainstate written to disk can be pruned
+		utxoCache.OnFlush(func(height uint32) {
+			if n, err := bstorage.Prune(height); err != nil {
+				log.Printf("Error pruning block files: %v\n", err)
+			} else if n > 0 {
+				log.Printf("Pruned %d block files, %d bytes used\n", n, bstorage.DiskUsage())
+			}
+		})
+	}
+	core.SetChainstate(utxoCache)
+
+	bchain, err := core.CreateBlockchain(cparams)
+	if err != nil {
+		log.Fatalf("Error creating blockchain: %v\n", err)
+	}
+	if cstate.IsReindexing() {
+		log.Printf("Rebuilding chainstate from the stored blocks\n")
+		err := bchain.ReplayBlocks(bstorage, func(height, tip uint32) {
+			if height%1000 == 0 || height == tip {
+				log.Printf("Replaying blocks: %d/%d\n", height, tip)
+			}
+		})
+		if err != nil {
+			log.Fatalf("Error rebuilding chainstate: %v\n", err)
+		}
+		// the rebuild is only complete once the UTXOs are on disk
+		if err := utxoCache.Flush(); err != nil {
+			log.Fatalf("Error flushing rebuilt chainstate: %v\n", err)
+		}
+		if err := cstate.EndReindex(); err != nil {
+			log.Fatalf("Error completing chainstate rebuild: %v\n", err)
+		}
+	}
+	if err := bchain.StoreGenesis(); err != nil {
+		log.Fatalf("Error storing genesis block: %v\n", err)
+	}
+	// the block index runs ahead of the cached UTXOs, so the chainstate db should record a best block
+	// before any other block is connected, a chainstate db without one is assumed to match the block index
+	if err := utxoCache.Flush(); err != nil {
+		log.Fatalf("Error flushing chainstate: %v\n", err)
+	}
+	// bringing the chain and the chainstate in line with the block index
+	if err := bchain.VerifyChain(bstorage, uint32(*checkBlocks)); err != nil {
+		log.Fatalf("Error verifying chain: %v\n", err)
+	}
+	tip := bchain.GetTip()
+	log.Printf("Loaded chain at height %d, tip %x\n", tip.GetHeight(), tip.GetHeader().GetHash())
+	if *txIndex {
+		// indexing the blocks written while the index was disabled, new blocks are indexed as they are connected
+		quit, done := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(done)
+			n, err := bstorage.BuildTxIndex(quit)
+			if err != nil && !errors.Is(err, db.ErrTxIndexInterrupted) {
+				log.Printf("Error building transaction index: %v\n", err)
+			} else if err == nil {
+				log.Printf("Transaction index built, %d blocks indexed\n", n)
+			}
+		}()
+		// the build has to stop before the block storage is closed
+		defer func() {
+			close(quit)
+			<-done
+		}()
+	}
+	rpcServer := rpc.NewServer(bchain)
+	if *txIndex {
+		rpcServer.SetTxIndex(bstorage)
+	}
+	if *minerPubKey != "" {
+		key, err := utils.ConvertStringToPubKey(*minerPubKey)
+		if err != nil {
+			log.Fatalf("Error parsing miner public key: %v\n", err)
+		}
+		rpcServer.SetMiningKey(key)
+	}
+	rpcAddr := fmt.Sprintf("127.0.0.1:%d", cparams.RPCPort)
+	if err := rpcServer.Start(rpcAddr); err != nil {
+		log.Fatalf("Error starting RPC server: %v\n", err)
+	}
+	defer rpcServer.Close()
+	log.Printf("Running on %s network, RPC server listening on %s\n", cparams.Name, rpcAddr)
+
+	// running until interrupted
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
 }
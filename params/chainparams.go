@@ -0,0 +1,200 @@
+package params
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+var ErrUnknownNetwork = errors.New("unknown network")
+
+// GenesisParams holds the values the genesis block is constructed from
+type GenesisParams struct {
+	// RecipientPubKey is the PKIX encoded key the genesis coinbase pays to
+	RecipientPubKey []byte
+	// Message is embedded in the genesis coinbase
+	Message    string
+	Timestamp  int64
+	TargetBits uint32
+	Nonce      uint32
+	// Hash is the expected hash of the genesis block
+	Hash []byte
+}
+
+// Checkpoint is a block known to be part of the main chain
+type Checkpoint struct {
+	Height uint32
+	Hash   []byte
+}
+
+// ChainParams holds the values that differ between networks
+type ChainParams struct {
+	Name string
+	// MagicBytes are prepended to every block stored
+	MagicBytes []byte
+	Genesis    GenesisParams
+
+	InitialBlockSubsidy    uint64
+	SubsidyHalvingInterval uint32
+
+	// DifficultyAlgorithm selects how the target is adjusted, one of the Difficulty* names
+	DifficultyAlgorithm       string
+	RetargetInterval          uint32
+	ExpectedTimePerBlockInSec uint64
+	// LWMAWindow is the number of blocks averaged by the LWMA difficulty algorithm
+	LWMAWindow uint32
+	// PowLimitBits is the limit target in compact form, the easiest target a retarget can result in
+	PowLimitBits uint32
+
+	// Checkpoints are blocks hard-coded as part of the main chain, sorted by height.
+	// Blocks at their height should match them and forks starting before the last one reached are rejected.
+	Checkpoints []Checkpoint
+	// AssumeValid is a block whose ancestors are assumed to have valid signatures, so their verification is skipped
+	// during sync. The block itself is enforced like a checkpoint. Disabled if the hash is empty.
+	AssumeValid Checkpoint
+
+	// Deployments holds the consensus changes rolled out with version bits, indexed by their ID
+	Deployments [DefinedDeployments]Deployment
+
+	// MineBlocksOnDemand enables the RPC methods generating blocks right away, only meant for testing
+	MineBlocksOnDemand bool
+
+	// PubKeyHashAddrPrefix is the first byte of the addresses used in this network
+	PubKeyHashAddrPrefix byte
+
+	DefaultPort uint16
+	RPCPort     uint16
+	StratumPort uint16
+	// DataDir is the directory of the databases, relative to the home directory of the user
+	DataDir string
+}
+
+// DataDirPath returns the absolute path of the data directory
+func (cp *ChainParams) DataDirPath() string {
+	homedir, _ := os.UserHomeDir()
+	return filepath.Join(homedir, cp.DataDir)
+}
+
+// genesisRecipientPubKey is the key the genesis coinbase of every network pays to
+var genesisRecipientPubKey = mustDecodeHex("3059301306072a8648ce3d020106082a8648ce3d030107034200049772ee3dda7c03638cf1cfdf43b3e500da242f3f4db7db7cedd1d16b9f4daa3114f379d7cfc22935bf47c215d4a19405b47145bf31ae8c1f861982331c9c66b5")
+
+const genesisMessage = "plairo genesis"
+
+// mustDecodeHex decodes the hard-coded values of the presets
+func mustDecodeHex(s string) []byte {
+	res, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// The genesis hashes are shared by the genesis params and the checkpoints of the networks
+var (
+	mainNetGenesisHash = mustDecodeHex("000000d671724dfb6b7170fd89e7580de92dc61e0cdda7c4c5b86304d613baa2")
+	testNetGenesisHash = mustDecodeHex("000033ac895fe82f8178b2fc775001864a9ed62a7fe7223f8cb48a147e544a65")
+)
+
+var MainNetParams = &ChainParams{
+	Name: "main",
+	// same as bitcoin
+	MagicBytes: []byte{0xf9, 0xbe, 0xb4, 0xd9},
+	Genesis: GenesisParams{
+		RecipientPubKey: genesisRecipientPubKey,
+		Message:         genesisMessage,
+		Timestamp:       1672531200,
+		TargetBits:      0x1e00ffff,
+		Nonce:           462343,
+		Hash:            mainNetGenesisHash,
+	},
+	InitialBlockSubsidy:       500 * uint64(RoToTickRation),
+	SubsidyHalvingInterval:    1000,
+	DifficultyAlgorithm:       DifficultyInterval,
+	RetargetInterval:          2016,
+	ExpectedTimePerBlockInSec: 2 * 60, // 2 minutes
+	LWMAWindow:                45,
+	PowLimitBits:              0x1e00ffff,
+	// the chain has no blocks past the genesis yet, later blocks are added here with each release
+	Checkpoints:          []Checkpoint{{Height: 0, Hash: mainNetGenesisHash}},
+	AssumeValid:          Checkpoint{Height: 0, Hash: mainNetGenesisHash},
+	PubKeyHashAddrPrefix: 0x37,
+	DefaultPort:          8733,
+	RPCPort:              8732,
+	StratumPort:          8734,
+	DataDir:              ".plairo",
+	Deployments: [DefinedDeployments]Deployment{
+		DeploymentTestDummy: {Name: "testdummy", Bit: 28, StartTime: DeploymentNeverActive, Timeout: NoTimeout, Threshold: 1916}, // 95%
+	},
+}
+
+var TestNetParams = &ChainParams{
+	Name:       "testnet",
+	MagicBytes: []byte{0x0b, 0x11, 0x09, 0x07},
+	Genesis: GenesisParams{
+		RecipientPubKey: genesisRecipientPubKey,
+		Message:         genesisMessage,
+		Timestamp:       1672531200,
+		TargetBits:      0x1f00ffff,
+		Nonce:           89385,
+		Hash:            testNetGenesisHash,
+	},
+	InitialBlockSubsidy:    500 * uint64(RoToTickRation),
+	SubsidyHalvingInterval: 1000,
+	// blocks are mined by few miners, the target should follow their hash rate closely
+	DifficultyAlgorithm:       DifficultyLWMA,
+	RetargetInterval:          2016,
+	ExpectedTimePerBlockInSec: 2 * 60, // 2 minutes
+	LWMAWindow:                45,
+	PowLimitBits:              0x1f00ffff,
+	// the chain has no blocks past the genesis yet, later blocks are added here with each release
+	Checkpoints:          []Checkpoint{{Height: 0, Hash: testNetGenesisHash}},
+	AssumeValid:          Checkpoint{Height: 0, Hash: testNetGenesisHash},
+	PubKeyHashAddrPrefix: 0x7f,
+	DefaultPort:          18733,
+	RPCPort:              18732,
+	StratumPort:          18734,
+	DataDir:              filepath.Join(".plairo", "testnet"),
+	Deployments: [DefinedDeployments]Deployment{
+		DeploymentTestDummy: {Name: "testdummy", Bit: 28, StartTime: DeploymentNeverActive, Timeout: NoTimeout, Threshold: 1512}, // 75%
+	},
+}
+
+var RegTestParams = &ChainParams{
+	Name:       "regtest",
+	MagicBytes: []byte{0xfa, 0xbf, 0xb5, 0xda},
+	Genesis: GenesisParams{
+		RecipientPubKey: genesisRecipientPubKey,
+		Message:         genesisMessage,
+		Timestamp:       1672531200,
+		TargetBits:      0x207fffff,
+		Nonce:           0,
+		Hash:            mustDecodeHex("6623ac001d6028743d13e483559cd6a71e0728b41f61b61dc63aded36acebe08"),
+	},
+	InitialBlockSubsidy:       500 * uint64(RoToTickRation),
+	SubsidyHalvingInterval:    150,
+	DifficultyAlgorithm:       DifficultyFixed,
+	RetargetInterval:          144,    // only the version bits signalling period, the target is fixed
+	ExpectedTimePerBlockInSec: 2 * 60, // 2 minutes
+	LWMAWindow:                45,
+	PowLimitBits:              0x207fffff,
+	MineBlocksOnDemand:        true,
+	PubKeyHashAddrPrefix:      0x7f,
+	DefaultPort:               28733,
+	RPCPort:                   28732,
+	StratumPort:               28734,
+	DataDir:                   filepath.Join(".plairo", "regtest"),
+	Deployments: [DefinedDeployments]Deployment{
+		DeploymentTestDummy: {Name: "testdummy", Bit: 28, StartTime: 0, Timeout: NoTimeout, Threshold: 108}, // 75%
+	},
+}
+
+// ParamsForNetwork returns the preset of the network with the name given
+func ParamsForNetwork(name string) (*ChainParams, error) {
+	for _, cp := range []*ChainParams{MainNetParams, TestNetParams, RegTestParams} {
+		if cp.Name == name {
+			return cp, nil
+		}
+	}
+	return nil, ErrUnknownNetwork
+}
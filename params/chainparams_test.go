@@ -0,0 +1,56 @@
+package params
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParamsForNetwork(t *testing.T) {
+	for _, exp := range []*ChainParams{MainNetParams, TestNetParams, RegTestParams} {
+		got, err := ParamsForNetwork(exp.Name)
+		if err != nil || got != exp {
+			t.Errorf("Expected params of network %s, got %v\n", exp.Name, err)
+		}
+	}
+	if _, err := ParamsForNetwork("unknown"); !errors.Is(err, ErrUnknownNetwork) {
+		t.Errorf("Expected ErrUnknownNetwork, got %v\n", err)
+	}
+}
+
+func TestChainParams_Unique(t *testing.T) {
+	// networks should never be mistaken for each other
+	presets := []*ChainParams{MainNetParams, TestNetParams, RegTestParams}
+	for i := range presets {
+		for j := i + 1; j < len(presets); j++ {
+			a, b := presets[i], presets[j]
+			if string(a.MagicBytes) == string(b.MagicBytes) {
+				t.Errorf("Networks %s and %s use the same magic bytes.\n", a.Name, b.Name)
+			}
+			if a.DefaultPort == b.DefaultPort || a.RPCPort == b.RPCPort || a.StratumPort == b.StratumPort {
+				t.Errorf("Networks %s and %s use the same ports.\n", a.Name, b.Name)
+			}
+			if a.DataDirPath() == b.DataDirPath() {
+				t.Errorf("Networks %s and %s use the same data directory.\n", a.Name, b.Name)
+			}
+		}
+	}
+}
+
+func TestChainParams_Checkpoints(t *testing.T) {
+	for _, cp := range []*ChainParams{MainNetParams, TestNetParams} {
+		// checkpoints should be sorted by height and start with the genesis
+		if len(cp.Checkpoints) == 0 || cp.Checkpoints[0].Height != 0 || string(cp.Checkpoints[0].Hash) != string(cp.Genesis.Hash) {
+			t.Errorf("Network %s does not start its checkpoints with the genesis.\n", cp.Name)
+			continue
+		}
+		for i := 1; i < len(cp.Checkpoints); i++ {
+			if cp.Checkpoints[i].Height <= cp.Checkpoints[i-1].Height {
+				t.Errorf("Checkpoints of network %s are not sorted by height.\n", cp.Name)
+			}
+		}
+		last := cp.Checkpoints[len(cp.Checkpoints)-1]
+		if len(cp.AssumeValid.Hash) == 0 || cp.AssumeValid.Height < last.Height {
+			t.Errorf("Assume-valid block of network %s is below its last checkpoint.\n", cp.Name)
+		}
+	}
+}
@@ -2,29 +2,51 @@ package params
 
 import "errors"
 
-var (
-	RoToTickRation                = 100000000
-	InitialBlockSubsidy           = 500 * uint64(RoToTickRation)
-	SubsidyHalvingInterval uint32 = 1000
+// Values common to every network, the ones differing between networks are found in ChainParams
+const (
+	RoToTickRation = 100000000
 
 	MaxValidAmount = 100000000 * uint64(RoToTickRation)
 
 	MaxNumberOfTXsInBlock = 1000
 
-	BitsSize                  int    = 4
-	RetargetInterval          uint32 = 2016
-	ExpectedTimePerBlockInSec uint64 = 2 * 60 // 2 minutes
-	MaxDifficulty             uint32 = 0x18ffffff
+	BitsSize int = 4
+
+	// MedianTimeSpan is the number of previous blocks used to compute the median-time-past
+	MedianTimeSpan = 11
+	// MaxFutureBlockTimeInSec is how far ahead of the network-adjusted time a block timestamp may be
+	MaxFutureBlockTimeInSec int64 = 2 * 60 * 60 // 2 hours
+	// MaxTimeOffsetInSec is the max adjustment applied to the local clock based on the time of peers
+	MaxTimeOffsetInSec int64 = 70 * 60 // 70 minutes
 
 	// FeePerByte means 1 tick per byte is used as a fee, used as placeholder for now
 	FeePerByte uint64 = 1
 
-	StoragePath            = "/.plairo/blocks/storage"
-	UndoStoragePath        = "/.plairo/blocks/undo"
 	MaxBlockFileSize int32 = 134217728 // 128Mb in bytes
 
-	// BlockMagicBytes are the same as bitcoin
-	BlockMagicBytes = []byte{0xf9, 0xbe, 0xb4, 0xd9}
+	// DefaultUTXOCacheSize is the default memory budget of the UTXO cache in bytes
+	DefaultUTXOCacheSize = 100 << 20 // 100Mb
+
+	// MinPruneTargetMB is the lowest prune target allowed, so that a few block files are always kept
+	MinPruneTargetMB = 550
+	// DefaultPruneDepth is the default number of blocks below the tip whose data is never pruned
+	DefaultPruneDepth = 288
+
+	// DefaultCheckBlocks is the default number of blocks checked on startup
+	DefaultCheckBlocks = 6
+
+	// MaxSigCacheEntries is the number of verified signatures kept in memory
+	MaxSigCacheEntries = 50000
+)
+
+// Names of the difficulty algorithms available
+const (
+	// DifficultyInterval retargets every RetargetInterval blocks, same as bitcoin
+	DifficultyInterval = "interval"
+	// DifficultyLWMA retargets every block using a linearly weighted moving average of the last LWMAWindow blocks
+	DifficultyLWMA = "lwma"
+	// DifficultyFixed never changes the target, meant for testing networks
+	DifficultyFixed = "fixed"
 )
 
 var ErrInvalidValue = errors.New("invalid value")
@@ -0,0 +1,37 @@
+package params
+
+import "math"
+
+// DeploymentID identifies a consensus change rolled out with version bits signalling, as described in BIP9
+type DeploymentID int
+
+const (
+	// DeploymentTestDummy changes no rules, it is used to test the signalling
+	DeploymentTestDummy DeploymentID = iota
+
+	// DefinedDeployments is the number of deployments, new ones should be added before it
+	DefinedDeployments
+)
+
+const (
+	// DeploymentAlwaysActive as the start time makes a deployment active from the genesis
+	DeploymentAlwaysActive int64 = -1
+	// DeploymentNeverActive as the start time disables a deployment
+	DeploymentNeverActive int64 = -2
+	// NoTimeout as the timeout lets a deployment be signalled forever
+	NoTimeout int64 = math.MaxInt64
+)
+
+// Deployment holds the signalling parameters of a consensus change.
+// Signalling is counted over every retarget period of the chain.
+type Deployment struct {
+	Name string
+	// Bit is the bit of the block version miners set to signal for the deployment, 0 to 28
+	Bit uint8
+	// StartTime is the median-time-past after which signalling starts
+	StartTime int64
+	// Timeout is the median-time-past after which the deployment fails, if it has not locked in
+	Timeout int64
+	// Threshold is the number of blocks of a retarget period that should signal for the deployment to lock in
+	Threshold uint32
+}
@@ -0,0 +1,143 @@
+package rpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"plairo/core"
+	"plairo/utils"
+)
+
+type templateRequest struct {
+	LongPollID string `json:"longpollid"`
+}
+
+type templateTx struct {
+	Data string `json:"data"`
+	TXID string `json:"txid"`
+	Fee  uint64 `json:"fee"`
+}
+
+// blockTemplateResult follows the BIP22 getblocktemplate response
+type blockTemplateResult struct {
+	Version           uint32       `json:"version"`
+	Height            uint32       `json:"height"`
+	PreviousBlockHash string       `json:"previousblockhash"`
+	Transactions      []templateTx `json:"transactions"`
+	CoinbaseValue     uint64       `json:"coinbasevalue"`
+	Target            string       `json:"target"`
+	Bits              string       `json:"bits"`
+	CurTime           int64        `json:"curtime"`
+	MinTime           int64        `json:"mintime"`
+	Mutable           []string     `json:"mutable"`
+	NonceRange        string       `json:"noncerange"`
+	LongPollID        string       `json:"longpollid"`
+}
+
+func handleGetBlockTemplate(ctx context.Context, s *Server, params []json.RawMessage) (interface{}, error) {
+	var req templateRequest
+	if _, err := parseParam(params, 0, &req); err != nil {
+		return nil, err
+	}
+	// when a long poll ID is provided, the response is delayed until the template changes
+	if req.LongPollID != "" {
+		if err := s.bchain.WaitForTemplateChange(ctx, req.LongPollID); err != nil {
+			return nil, err
+		}
+	}
+	tmpl := s.bchain.NewBlockTemplate()
+
+	res := &blockTemplateResult{
+		Version:           tmpl.Version,
+		Height:            tmpl.Height,
+		PreviousBlockHash: hex.EncodeToString(tmpl.PreviousBlockHash),
+		Transactions:      make([]templateTx, len(tmpl.Transactions)),
+		CoinbaseValue:     tmpl.CoinbaseValue,
+		Target:            hex.EncodeToString(utils.ExpandBits(utils.SerializeUint32(tmpl.TargetBits, false))),
+		Bits:              hex.EncodeToString(utils.SerializeUint32(tmpl.TargetBits, false)),
+		CurTime:           tmpl.CurTime,
+		MinTime:           tmpl.MinTime,
+		Mutable:           []string{"time", "transactions", "prevblock"},
+		NonceRange:        "00000000ffffffff",
+		LongPollID:        tmpl.LongPollID,
+	}
+	for i, tx := range tmpl.Transactions {
+		res.Transactions[i] = templateTx{
+			Data: hex.EncodeToString(tx.Serialize()),
+			TXID: hex.EncodeToString(tx.TXID),
+			Fee:  tx.GetFees(),
+		}
+	}
+	return res, nil
+}
+
+// handleSubmitBlock returns nil if the block was accepted, or the reason it was rejected, as described in BIP22
+func handleSubmitBlock(ctx context.Context, s *Server, params []json.RawMessage) (interface{}, error) {
+	var hexData string
+	if ok, err := parseParam(params, 0, &hexData); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, &Error{ErrCodeInvalidParams, "block data is required"}
+	}
+	data, err := hex.DecodeString(hexData)
+	if err != nil {
+		return nil, &Error{ErrCodeDeserialization, "block decode failed"}
+	}
+	block, err := core.DeserializeBlock(data)
+	if err != nil {
+		return nil, &Error{ErrCodeDeserialization, fmt.Sprintf("block decode failed: %v", err)}
+	}
+
+	if err := s.bchain.SubmitBlock(block); err != nil {
+		if errors.Is(err, core.ErrDuplicateBlock) {
+			return "duplicate", nil
+		}
+		return fmt.Sprintf("rejected: %v", err), nil
+	}
+	return nil, nil
+}
+
+// handleGenerate mines the number of blocks given, paying the rewards to the mining key of the server
+func handleGenerate(ctx context.Context, s *Server, params []json.RawMessage) (interface{}, error) {
+	if s.miningKey == nil {
+		return nil, &Error{ErrCodeMisc, "no mining key set, use generatetoaddress"}
+	}
+	return generateBlocks(ctx, s, params, s.miningKey)
+}
+
+// handleGenerateToAddress mines the number of blocks given, paying the rewards to the hex encoded public key given
+func handleGenerateToAddress(ctx context.Context, s *Server, params []json.RawMessage) (interface{}, error) {
+	var address string
+	if ok, err := parseParam(params, 1, &address); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, &Error{ErrCodeInvalidParams, "address is required"}
+	}
+	key, err := utils.ConvertStringToPubKey(address)
+	if err != nil {
+		return nil, &Error{ErrCodeInvalidParams, fmt.Sprintf("invalid address: %v", err)}
+	}
+	return generateBlocks(ctx, s, params, key)
+}
+
+// generateBlocks mines the number of blocks in the first parameter and returns their hashes
+func generateBlocks(ctx context.Context, s *Server, params []json.RawMessage, key *ecdsa.PublicKey) (interface{}, error) {
+	var nblocks int
+	if ok, err := parseParam(params, 0, &nblocks); err != nil {
+		return nil, err
+	} else if !ok || nblocks <= 0 {
+		return nil, &Error{ErrCodeInvalidParams, "a positive number of blocks is required"}
+	}
+	hashes, err := core.NewMiner(s.bchain, key, 0).Generate(ctx, nblocks)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, len(hashes))
+	for i, hash := range hashes {
+		res[i] = hex.EncodeToString(hash)
+	}
+	return res, nil
+}
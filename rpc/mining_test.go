@@ -0,0 +1,292 @@
+package rpc
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"plairo/core"
+	"plairo/db"
+	"plairo/params"
+	"plairo/utils"
+	"testing"
+	"time"
+)
+
+// mocking the block storage, blocks are only kept in memory
+type mockStorage struct {
+	blocks  map[string][]byte
+	heights map[string]uint32
+}
+
+func (ms *mockStorage) WriteBlock(block core.IBlock, height uint32) error {
+	ms.blocks[string(block.GetBlockHash())] = block.Serialize()
+	ms.heights[string(block.GetBlockHash())] = height
+	return nil
+}
+
+func (ms *mockStorage) GetBlockData(bkey []byte) ([]byte, bool) {
+	data, ok := ms.blocks[string(bkey)]
+	return data, ok
+}
+
+func (ms *mockStorage) HasBlock(bkey []byte) bool {
+	_, ok := ms.blocks[string(bkey)]
+	return ok
+}
+
+func (ms *mockStorage) DisconnectBlock(block core.IBlock) error {
+	return nil
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+}
+
+// setupTestServer creates a blockchain with an easy target and starts an RPC server for it
+func setupTestServer(t *testing.T) (*httptest.Server, *core.Blockchain) {
+	cstate, err := db.NewChainstate(db.NewMemStore(), true)
+	if err != nil {
+		t.Fatalf("Error creating chainstate: %v\n", err)
+	}
+	t.Cleanup(func() { cstate.Close() })
+	core.SetChainstate(cstate)
+	core.BStorage = &mockStorage{make(map[string][]byte), make(map[string]uint32)}
+
+	cparams := *params.RegTestParams
+	cparams.Genesis.TargetBits = 0x2000ffff
+	if err := core.MineGenesisBlock(&cparams); err != nil {
+		t.Fatalf("Error mining genesis block: %v\n", err)
+	}
+	bc, err := core.CreateBlockchain(&cparams)
+	if err != nil {
+		t.Fatalf("Error creating blockchain: %v\n", err)
+	}
+	srv := httptest.NewServer(NewServer(bc))
+	t.Cleanup(srv.Close)
+	return srv, bc
+}
+
+func callRPC(t *testing.T, url, method string, params ...interface{}) *rpcResponse {
+	body, err := json.Marshal(map[string]interface{}{"id": 1, "method": method, "params": params})
+	if err != nil {
+		t.Fatalf("Error encoding request: %v\n", err)
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error calling %s: %v\n", method, err)
+	}
+	defer resp.Body.Close()
+	var res rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("Error decoding response of %s: %v\n", method, err)
+	}
+	return &res
+}
+
+func getTemplate(t *testing.T, url string, params ...interface{}) *blockTemplateResult {
+	res := callRPC(t, url, "getblocktemplate", params...)
+	if res.Error != nil {
+		t.Fatalf("Error getting block template: %v\n", res.Error)
+	}
+	var tmpl blockTemplateResult
+	if err := json.Unmarshal(res.Result, &tmpl); err != nil {
+		t.Fatalf("Error decoding block template: %v\n", err)
+	}
+	return &tmpl
+}
+
+// mineTemplate constructs and mines a block from the template, the same way an external miner would
+func mineTemplate(t *testing.T, tmpl *blockTemplateResult, pubkey *ecdsa.PublicKey) string {
+	cb, err := core.NewCoinbaseTransaction("external miner", tmpl.CoinbaseValue, pubkey, tmpl.Height-1)
+	if err != nil {
+		t.Fatalf("Error creating coinbase: %v\n", err)
+	}
+	txids := [][]byte{cb.TXID}
+	txdata := [][]byte{cb.Serialize()}
+	for _, tx := range tmpl.Transactions {
+		data, _ := hex.DecodeString(tx.Data)
+		txid, _ := hex.DecodeString(tx.TXID)
+		txids = append(txids, txid)
+		txdata = append(txdata, data)
+	}
+	prevHash, _ := hex.DecodeString(tmpl.PreviousBlockHash)
+	bits, _ := hex.DecodeString(tmpl.Bits)
+	target, _ := hex.DecodeString(tmpl.Target)
+	header := &core.BlockHeader{
+		Version:           tmpl.Version,
+		PreviousBlockHash: prevHash,
+		MerkleRoot:        utils.ComputeMerkleRoot(txids),
+		Timestamp:         tmpl.CurTime,
+		TargetBits:        utils.DeserializeUint32(bits, false),
+	}
+	for bytes.Compare(header.GetHash(), target) >= 0 {
+		header.Nonce++
+	}
+
+	res := header.Serialize()
+	res = append(res, utils.SerializeUint32(uint32(len(txdata)), false)...)
+	for _, data := range txdata {
+		res = append(res, utils.SerializeUint32(uint32(len(data)), false)...)
+		res = append(res, data...)
+	}
+	return hex.EncodeToString(res)
+}
+
+func TestGetBlockTemplateSubmitBlock(t *testing.T) {
+	srv, bc := setupTestServer(t)
+	_, pubkey, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+
+	genesis, _ := bc.GetHeaderAt(0)
+	tmpl := getTemplate(t, srv.URL)
+	if tmpl.Height != 1 || tmpl.PreviousBlockHash != hex.EncodeToString(genesis.GetHash()) {
+		t.Fatalf("Unexpected template height %d and previous hash %s\n", tmpl.Height, tmpl.PreviousBlockHash)
+	}
+	if subsidy := core.GetBlockSubsidy(bc.Params(), 1); tmpl.CoinbaseValue != subsidy {
+		t.Errorf("Expected coinbase value %d, got %d\n", subsidy, tmpl.CoinbaseValue)
+	}
+
+	blockData := mineTemplate(t, tmpl, pubkey)
+	res := callRPC(t, srv.URL, "submitblock", blockData)
+	if res.Error != nil || string(res.Result) != "null" {
+		t.Fatalf("Expected block to be accepted, got result %s error %v\n", res.Result, res.Error)
+	}
+	if _, ok := bc.GetHeaderAt(1); !ok {
+		t.Fatalf("Submitted block was not inserted in the blockchain.\n")
+	}
+
+	// submitting the same block again
+	res = callRPC(t, srv.URL, "submitblock", blockData)
+	if string(res.Result) != `"duplicate"` {
+		t.Errorf("Expected duplicate block, got %s\n", res.Result)
+	}
+
+	// the next template should build on the new block
+	tmpl = getTemplate(t, srv.URL)
+	if tmpl.Height != 2 {
+		t.Errorf("Expected template for height 2, got %d\n", tmpl.Height)
+	}
+}
+
+func TestSubmitBlockInvalid(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	res := callRPC(t, srv.URL, "submitblock", "zz")
+	if res.Error == nil || res.Error.Code != ErrCodeDeserialization {
+		t.Errorf("Expected deserialization error for invalid hex, got %v\n", res.Error)
+	}
+	res = callRPC(t, srv.URL, "submitblock", "00aa")
+	if res.Error == nil || res.Error.Code != ErrCodeDeserialization {
+		t.Errorf("Expected deserialization error for short block, got %v\n", res.Error)
+	}
+
+	_, pubkey, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+	tmpl := getTemplate(t, srv.URL)
+	// claiming more than allowed in the coinbase
+	tmpl.CoinbaseValue++
+	res = callRPC(t, srv.URL, "submitblock", mineTemplate(t, tmpl, pubkey))
+	var reason string
+	if err := json.Unmarshal(res.Result, &reason); err != nil || reason == "" {
+		t.Errorf("Expected block to be rejected, got %s\n", res.Result)
+	}
+}
+
+func TestGetBlockTemplateLongPoll(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	_, pubkey, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+
+	tmpl := getTemplate(t, srv.URL)
+	done := make(chan *blockTemplateResult)
+	go func() {
+		done <- getTemplate(t, srv.URL, map[string]string{"longpollid": tmpl.LongPollID})
+	}()
+
+	// the long polling request should not return before the tip changes
+	select {
+	case <-done:
+		t.Fatalf("Long polling returned before the template changed.\n")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	res := callRPC(t, srv.URL, "submitblock", mineTemplate(t, tmpl, pubkey))
+	if res.Error != nil || string(res.Result) != "null" {
+		t.Fatalf("Expected block to be accepted, got result %s error %v\n", res.Result, res.Error)
+	}
+	select {
+	case newTmpl := <-done:
+		if newTmpl.Height != 2 || newTmpl.LongPollID == tmpl.LongPollID {
+			t.Errorf("Expected new template for height 2, got height %d\n", newTmpl.Height)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Long polling did not return after the tip changed.\n")
+	}
+}
+
+func TestUnknownMethod(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	res := callRPC(t, srv.URL, "nomethod")
+	if res.Error == nil || res.Error.Code != ErrCodeMethodNotFound {
+		t.Errorf("Expected method not found error, got %v\n", res.Error)
+	}
+}
+
+func TestGenerateToAddress(t *testing.T) {
+	srv, bc := setupTestServer(t)
+	_, pubkey, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+	address, _ := utils.ConvertPubKeyToString(pubkey)
+
+	res := callRPC(t, srv.URL, "generatetoaddress", 6, address)
+	if res.Error != nil {
+		t.Fatalf("Error generating blocks: %v\n", res.Error)
+	}
+	var hashes []string
+	if err := json.Unmarshal(res.Result, &hashes); err != nil || len(hashes) != 6 {
+		t.Fatalf("Expected 6 block hashes, got %s\n", res.Result)
+	}
+	for i, hash := range hashes {
+		header, ok := bc.GetHeaderAt(uint32(i + 1))
+		if !ok || hex.EncodeToString(header.GetHash()) != hash {
+			t.Errorf("Block #%d is not part of the main chain.\n", i+1)
+		}
+	}
+
+	res = callRPC(t, srv.URL, "generatetoaddress", 1, "zz")
+	if res.Error == nil || res.Error.Code != ErrCodeInvalidParams {
+		t.Errorf("Expected invalid params error for invalid address, got %v\n", res.Error)
+	}
+	res = callRPC(t, srv.URL, "generatetoaddress", 0, address)
+	if res.Error == nil || res.Error.Code != ErrCodeInvalidParams {
+		t.Errorf("Expected invalid params error for zero blocks, got %v\n", res.Error)
+	}
+	// no mining key was set for the server
+	res = callRPC(t, srv.URL, "generate", 1)
+	if res.Error == nil || res.Error.Code != ErrCodeMisc {
+		t.Errorf("Expected error for missing mining key, got %v\n", res.Error)
+	}
+}
+
+func TestGenerate_OnDemandOnly(t *testing.T) {
+	srv, bc := setupTestServer(t)
+	// the parameters belong to the test, turning off on-demand mining as on the main network
+	bc.Params().MineBlocksOnDemand = false
+	for _, method := range []string{"generate", "generatetoaddress"} {
+		if res := callRPC(t, srv.URL, method, 1); res.Error == nil || res.Error.Code != ErrCodeMethodNotFound {
+			t.Errorf("Expected method not found error for %s, got %v\n", method, res.Error)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"plairo/core"
+)
+
+// rawTransactionResult is the verbose getrawtransaction response
+type rawTransactionResult struct {
+	Hex           string `json:"hex"`
+	TXID          string `json:"txid"`
+	BlockHash     string `json:"blockhash"`
+	Confirmations uint32 `json:"confirmations"`
+}
+
+// handleGetRawTransaction returns the hex encoded data of a confirmed transaction, found through the transaction index.
+// If the second parameter is true, the hash of the block containing it and its confirmations are returned as well.
+func handleGetRawTransaction(ctx context.Context, s *Server, params []json.RawMessage) (interface{}, error) {
+	var txidHex string
+	if ok, err := parseParam(params, 0, &txidHex); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, &Error{ErrCodeInvalidParams, "txid is required"}
+	}
+	var verbose bool
+	if _, err := parseParam(params, 1, &verbose); err != nil {
+		return nil, err
+	}
+	txid, err := hex.DecodeString(txidHex)
+	if err != nil || len(txid) != 32 {
+		return nil, &Error{ErrCodeInvalidParams, "txid must be 32 hex encoded bytes"}
+	}
+	if s.txIndex == nil {
+		return nil, &Error{ErrCodeMisc, "transaction index is not enabled, start the node with -txindex"}
+	}
+
+	data, blockHash, err := s.txIndex.GetTransaction(txid)
+	if errors.Is(err, core.ErrBlockPruned) {
+		return nil, &Error{ErrCodeMisc, "transaction not available, the block containing it was pruned"}
+	}
+	if err != nil {
+		return nil, &Error{ErrCodeInvalidAddressOrKey, fmt.Sprintf("no such transaction: %v", err)}
+	}
+	if !verbose {
+		return hex.EncodeToString(data), nil
+	}
+	_, height, err := s.txIndex.ReadBlockHeader(blockHash)
+	if err != nil {
+		return nil, err
+	}
+	res := &rawTransactionResult{
+		Hex:       hex.EncodeToString(data),
+		TXID:      txidHex,
+		BlockHash: hex.EncodeToString(blockHash),
+	}
+	// blocks that are not part of the main chain have no confirmations
+	if header, ok := s.bchain.GetHeaderAt(height); ok && bytes.Equal(header.GetHash(), blockHash) {
+		res.Confirmations = s.bchain.GetTip().GetHeight() - height + 1
+	}
+	return res, nil
+}
@@ -0,0 +1,97 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"plairo/core"
+	"plairo/utils"
+	"testing"
+)
+
+var errTestTxNotFound = errors.New("transaction not found")
+
+// GetTransaction looks up the transaction in every stored block, the same way a transaction index would find it
+func (ms *mockStorage) GetTransaction(txid []byte) ([]byte, []byte, error) {
+	for hash, data := range ms.blocks {
+		block, err := core.DeserializeBlock(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, loc := range block.TxLocations() {
+			if bytes.Equal(loc.TXID, txid) {
+				return data[loc.Offset : loc.Offset+loc.Length], []byte(hash), nil
+			}
+		}
+	}
+	return nil, nil, errTestTxNotFound
+}
+
+func (ms *mockStorage) ReadBlockHeader(bkey []byte) (*core.BlockHeader, uint32, error) {
+	data, ok := ms.blocks[string(bkey)]
+	if !ok || len(data) < core.BlockHeaderSize {
+		return nil, 0, core.ErrInvalidBlockData
+	}
+	header, err := core.DeserializeBlockHeader(data[:core.BlockHeaderSize])
+	return header, ms.heights[string(bkey)], err
+}
+
+func TestGetRawTransaction(t *testing.T) {
+	noIndexSrv, bc := setupTestServer(t)
+	s := NewServer(bc)
+	s.SetTxIndex(core.BStorage.(*mockStorage))
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	_, pubkey, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+	address, _ := utils.ConvertPubKeyToString(pubkey)
+	res := callRPC(t, srv.URL, "generatetoaddress", 3, address)
+	if res.Error != nil {
+		t.Fatalf("Error generating blocks: %v\n", res.Error)
+	}
+	var hashes []string
+	json.Unmarshal(res.Result, &hashes)
+
+	// looking up the coinbase of the first block generated
+	blockHash, _ := hex.DecodeString(hashes[0])
+	block, err := core.DeserializeBlock(core.BStorage.(*mockStorage).blocks[string(blockHash)])
+	if err != nil {
+		t.Fatalf("Error reading generated block: %v\n", err)
+	}
+	cb := block.AllBlockTx()[0]
+	txid := hex.EncodeToString(cb.TXID)
+
+	res = callRPC(t, srv.URL, "getrawtransaction", txid)
+	var rawHex string
+	if res.Error != nil || json.Unmarshal(res.Result, &rawHex) != nil || rawHex != hex.EncodeToString(cb.Serialize()) {
+		t.Errorf("Unexpected raw transaction: %s %v\n", res.Result, res.Error)
+	}
+
+	res = callRPC(t, srv.URL, "getrawtransaction", txid, true)
+	var verbose rawTransactionResult
+	if res.Error != nil || json.Unmarshal(res.Result, &verbose) != nil {
+		t.Fatalf("Error getting verbose transaction: %v\n", res.Error)
+	}
+	if verbose.BlockHash != hashes[0] || verbose.Confirmations != 3 || verbose.TXID != txid {
+		t.Errorf("Unexpected verbose transaction: %+v\n", verbose)
+	}
+
+	res = callRPC(t, srv.URL, "getrawtransaction", hex.EncodeToString(make([]byte, 32)))
+	if res.Error == nil || res.Error.Code != ErrCodeInvalidAddressOrKey {
+		t.Errorf("Expected an error for an unknown transaction, got %v\n", res.Error)
+	}
+	res = callRPC(t, srv.URL, "getrawtransaction", "zz")
+	if res.Error == nil || res.Error.Code != ErrCodeInvalidParams {
+		t.Errorf("Expected an error for an invalid TXID, got %v\n", res.Error)
+	}
+	// without a transaction index, no lookup is possible
+	res = callRPC(t, noIndexSrv.URL, "getrawtransaction", txid)
+	if res.Error == nil || res.Error.Code != ErrCodeMisc {
+		t.Errorf("Expected an error without a transaction index, got %v\n", res.Error)
+	}
+}
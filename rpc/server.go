@@ -0,0 +1,159 @@
+package rpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"plairo/core"
+)
+
+// Standard JSON-RPC error codes, along with the ones used by bitcoind for compatibility with mining software
+const (
+	ErrCodeParse               = -32700
+	ErrCodeInvalidRequest      = -32600
+	ErrCodeMethodNotFound      = -32601
+	ErrCodeInvalidParams       = -32602
+	ErrCodeMisc                = -1
+	ErrCodeInvalidAddressOrKey = -5
+	ErrCodeDeserialization     = -22
+)
+
+// Error is the error object returned to the client
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+type request struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type response struct {
+	Result interface{}     `json:"result"`
+	Error  *Error          `json:"error"`
+	ID     json.RawMessage `json:"id"`
+}
+
+// handler serves a single RPC method. The context is cancelled when the client disconnects.
+type handler func(ctx context.Context, s *Server, params []json.RawMessage) (interface{}, error)
+
+var handlers map[string]handler
+
+// onDemandHandlers are only available on networks mining blocks on demand, such as regtest
+var onDemandHandlers map[string]handler
+
+func init() {
+	handlers = map[string]handler{
+		"getblocktemplate":  handleGetBlockTemplate,
+		"submitblock":       handleSubmitBlock,
+		"getrawtransaction": handleGetRawTransaction,
+	}
+	onDemandHandlers = map[string]handler{
+		"generate":          handleGenerate,
+		"generatetoaddress": handleGenerateToAddress,
+	}
+}
+
+// Server is a JSON-RPC 1.0 server over HTTP, exposing the node functionality
+type Server struct {
+	bchain     *core.Blockchain
+	httpServer *http.Server
+	// miningKey receives the rewards of the blocks mined by generate
+	miningKey *ecdsa.PublicKey
+	// txIndex is nil unless the node keeps a transaction index
+	txIndex TxIndex
+}
+
+// TxIndex looks up confirmed transactions by TXID
+type TxIndex interface {
+	// GetTransaction returns the serialized transaction and the hash of the block containing it
+	GetTransaction([]byte) ([]byte, []byte, error)
+	ReadBlockHeader([]byte) (*core.BlockHeader, uint32, error)
+}
+
+func NewServer(bchain *core.Blockchain) *Server {
+	s := &Server{bchain: bchain}
+	s.httpServer = &http.Server{Handler: s}
+	return s
+}
+
+// SetMiningKey sets the key the rewards of blocks mined by the generate method are paid to
+func (s *Server) SetMiningKey(key *ecdsa.PublicKey) {
+	s.miningKey = key
+}
+
+// SetTxIndex enables the lookup of confirmed transactions by getrawtransaction
+func (s *Server) SetTxIndex(txIndex TxIndex) {
+	s.txIndex = txIndex
+}
+
+// Start listens on the address given and serves requests in the background
+func (s *Server) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go s.httpServer.Serve(listener)
+	return nil
+}
+
+// Close stops the server, interrupting any long-polling requests
+func (s *Server) Close() error {
+	return s.httpServer.Close()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST requests are accepted", http.StatusMethodNotAllowed)
+		return
+	}
+	var req request
+	var resp response
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.Error = &Error{ErrCodeParse, "parse error"}
+	} else {
+		resp.ID = req.ID
+		resp.Result, resp.Error = s.handleRequest(r.Context(), &req)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) handleRequest(ctx context.Context, req *request) (interface{}, *Error) {
+	h, ok := handlers[req.Method]
+	if !ok && s.bchain.Params().MineBlocksOnDemand {
+		h, ok = onDemandHandlers[req.Method]
+	}
+	if !ok {
+		return nil, &Error{ErrCodeMethodNotFound, "method not found"}
+	}
+	res, err := h(ctx, s, req.Params)
+	if err != nil {
+		var rpcErr *Error
+		if errors.As(err, &rpcErr) {
+			return nil, rpcErr
+		}
+		return nil, &Error{ErrCodeMisc, err.Error()}
+	}
+	return res, nil
+}
+
+// parseParam decodes the parameter at index into v. Returns false if the parameter was not provided.
+func parseParam(params []json.RawMessage, index int, v interface{}) (bool, error) {
+	if index >= len(params) || string(params[index]) == "null" {
+		return false, nil
+	}
+	if err := json.Unmarshal(params[index], v); err != nil {
+		return false, &Error{ErrCodeInvalidParams, "invalid parameter: " + err.Error()}
+	}
+	return true, nil
+}
@@ -0,0 +1,155 @@
+package stratum
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"plairo/core"
+	"plairo/utils"
+)
+
+// ExtraNonce1Size is the size of the extra-nonce part assigned by the server to each connection.
+// The rest of the coinbase extra-nonce is left to the miner.
+const ExtraNonce1Size = 4
+
+// ExtraNonce2Size is the size of the extra-nonce part chosen by the miner
+const ExtraNonce2Size = core.CoinbaseExtraNonceSize - ExtraNonce1Size
+
+var ErrJobNotFound = errors.New("job not found")
+var ErrInvalidShare = errors.New("invalid share")
+var ErrLowDifficultyShare = errors.New("low difficulty share")
+
+// diff1Target is the target corresponding to difficulty 1, same as bitcoin
+var diff1Target = new(big.Int).Lsh(big.NewInt(0xffff), 208)
+
+// job is a unit of work handed out to miners, built from a block template
+type job struct {
+	id       string
+	tmpl     *core.BlockTemplate
+	coinb1   []byte
+	coinb2   []byte
+	branch   [][]byte
+	txdata   [][]byte
+	target   []byte
+	cleanJob bool
+}
+
+// newJob builds a job from the template. The coinbase pays the full template value to payoutKey.
+func newJob(id string, tmpl *core.BlockTemplate, payoutKey *ecdsa.PublicKey, cleanJob bool) (*job, error) {
+	coinbase, err := core.NewCoinbaseTransaction("stratum", tmpl.CoinbaseValue, payoutKey, tmpl.Height-1)
+	if err != nil {
+		return nil, err
+	}
+	coinb1, coinb2 := coinbase.SplitAtExtraNonce()
+
+	// the coinbase TXID is a placeholder, the branch does not depend on it
+	txids := [][]byte{coinbase.TXID}
+	txdata := make([][]byte, len(tmpl.Transactions))
+	for i, tx := range tmpl.Transactions {
+		txids = append(txids, tx.TXID)
+		txdata[i] = tx.Serialize()
+	}
+	return &job{
+		id:       id,
+		tmpl:     tmpl,
+		coinb1:   coinb1,
+		coinb2:   coinb2,
+		branch:   utils.ComputeMerkleBranch(txids, 0),
+		txdata:   txdata,
+		target:   utils.ExpandBits(utils.SerializeUint32(tmpl.TargetBits, false)),
+		cleanJob: cleanJob,
+	}, nil
+}
+
+// notifyParams returns the parameters of the mining.notify message for this job
+func (j *job) notifyParams() []interface{} {
+	branch := make([]string, len(j.branch))
+	for i, h := range j.branch {
+		branch[i] = hex.EncodeToString(h)
+	}
+	return []interface{}{
+		j.id,
+		hex.EncodeToString(j.tmpl.PreviousBlockHash),
+		hex.EncodeToString(j.coinb1),
+		hex.EncodeToString(j.coinb2),
+		branch,
+		hex.EncodeToString(utils.SerializeUint32(j.tmpl.Version, false)),
+		hex.EncodeToString(utils.SerializeUint32(j.tmpl.TargetBits, false)),
+		hex.EncodeToString(utils.SerializeUint64(uint64(j.tmpl.CurTime), false)),
+		j.cleanJob,
+	}
+}
+
+// buildCoinbase joins the coinbase parts around the extra-nonce
+func (j *job) buildCoinbase(extraNonce1, extraNonce2 []byte) []byte {
+	res := make([]byte, 0, len(j.coinb1)+core.CoinbaseExtraNonceSize+len(j.coinb2))
+	res = append(res, j.coinb1...)
+	res = append(res, extraNonce1...)
+	res = append(res, extraNonce2...)
+	return append(res, j.coinb2...)
+}
+
+// buildHeader constructs the block header for the share submitted
+func (j *job) buildHeader(coinbase []byte, ntime int64, nonce uint32) *core.BlockHeader {
+	cbTXID := utils.CalculateSHA256Hash(utils.CalculateSHA256Hash(coinbase))
+	return &core.BlockHeader{
+		Version:           j.tmpl.Version,
+		PreviousBlockHash: j.tmpl.PreviousBlockHash,
+		MerkleRoot:        utils.ComputeMerkleRootFromBranch(cbTXID, j.branch, 0),
+		Timestamp:         ntime,
+		TargetBits:        j.tmpl.TargetBits,
+		Nonce:             nonce,
+	}
+}
+
+// buildBlock serializes the full block for the header and coinbase given
+func (j *job) buildBlock(header *core.BlockHeader, coinbase []byte) []byte {
+	res := header.Serialize()
+	res = append(res, utils.SerializeUint32(uint32(len(j.txdata)+1), false)...)
+	res = append(res, utils.SerializeUint32(uint32(len(coinbase)), false)...)
+	res = append(res, coinbase...)
+	for _, data := range j.txdata {
+		res = append(res, utils.SerializeUint32(uint32(len(data)), false)...)
+		res = append(res, data...)
+	}
+	return res
+}
+
+// checkShare validates a share against the share target. If the block target is also met,
+// the full block is returned.
+func (j *job) checkShare(shareTarget, extraNonce1, extraNonce2 []byte, ntime int64, nonce uint32) (*core.Block, error) {
+	if len(extraNonce2) != ExtraNonce2Size {
+		return nil, fmt.Errorf("%w: extranonce2 should be %d bytes", ErrInvalidShare, ExtraNonce2Size)
+	}
+	if ntime < j.tmpl.MinTime {
+		return nil, fmt.Errorf("%w: ntime is too old", ErrInvalidShare)
+	}
+	coinbase := j.buildCoinbase(extraNonce1, extraNonce2)
+	header := j.buildHeader(coinbase, ntime, nonce)
+	hash := header.GetHash()
+	if bytes.Compare(hash, shareTarget) >= 0 {
+		return nil, ErrLowDifficultyShare
+	}
+	if bytes.Compare(hash, j.target) >= 0 {
+		// valid share, but not a block solution
+		return nil, nil
+	}
+	return core.DeserializeBlock(j.buildBlock(header, coinbase))
+}
+
+// difficultyToTarget converts a share difficulty to the target a share hash must be lower than
+func difficultyToTarget(difficulty float64) []byte {
+	target, _ := new(big.Float).Quo(new(big.Float).SetInt(diff1Target), big.NewFloat(difficulty)).Int(nil)
+	res := make([]byte, 32)
+	// a target exceeding 256 bits is capped, every hash satisfies it either way
+	if target.BitLen() > 256 {
+		for i := range res {
+			res[i] = 0xff
+		}
+		return res
+	}
+	return target.FillBytes(res)
+}
@@ -0,0 +1,447 @@
+package stratum
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"plairo/core"
+	"plairo/utils"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrInvalidDifficulty = errors.New("share difficulty should be a positive finite number")
+
+// Stratum error codes
+const (
+	ErrCodeOther          = 20
+	ErrCodeJobNotFound    = 21
+	ErrCodeDuplicateShare = 22
+	ErrCodeLowDifficulty  = 23
+	ErrCodeUnauthorized   = 24
+	ErrCodeNotSubscribed  = 25
+)
+
+// maxActiveJobs is the number of jobs shares are accepted for, the oldest job expires when a new one is created
+const maxActiveJobs = 16
+
+// writeTimeout is the time a client has to receive a message before it is disconnected
+const writeTimeout = 10 * time.Second
+
+type request struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type response struct {
+	ID     json.RawMessage `json:"id"`
+	Result interface{}     `json:"result"`
+	Error  []interface{}   `json:"error"`
+}
+
+type notification struct {
+	ID     interface{}   `json:"id"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+// ShareStats holds the number of shares submitted by a worker
+type ShareStats struct {
+	Accepted uint64
+	Rejected uint64
+	Blocks   uint64
+}
+
+// Server is a stratum v1 mining server handing out jobs built from block templates
+type Server struct {
+	bchain      *core.Blockchain
+	payoutKey   *ecdsa.PublicKey
+	difficulty  float64
+	shareTarget []byte
+
+	listener net.Listener
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+
+	mtx  sync.Mutex
+	jobs map[string]*job
+	// jobOrder holds the IDs of the active jobs, oldest first
+	jobOrder   []string
+	currentJob *job
+	jobCounter uint64
+	// submitted is used to detect duplicate shares, keyed by job ID and dropped along with the job
+	submitted   map[string]map[string]bool
+	nextEN1     uint32
+	clients     map[*client]bool
+	workerStats map[string]*ShareStats
+}
+
+// NewServer creates a stratum server paying block rewards to payoutKey, accepting shares at the difficulty given
+func NewServer(bchain *core.Blockchain, payoutKey *ecdsa.PublicKey, difficulty float64) (*Server, error) {
+	// the share target cannot be computed for other values
+	if difficulty <= 0 || math.IsNaN(difficulty) || math.IsInf(difficulty, 0) {
+		return nil, ErrInvalidDifficulty
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		bchain:      bchain,
+		payoutKey:   payoutKey,
+		difficulty:  difficulty,
+		shareTarget: difficultyToTarget(difficulty),
+		ctx:         ctx,
+		cancel:      cancel,
+		jobs:        make(map[string]*job),
+		submitted:   make(map[string]map[string]bool),
+		clients:     make(map[*client]bool),
+		workerStats: make(map[string]*ShareStats),
+	}, nil
+}
+
+// Start listens on the address given and starts handing out jobs
+func (s *Server) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	// making sure a job exists before accepting connections
+	tmpl := s.bchain.NewBlockTemplate()
+	if err := s.updateJob(tmpl); err != nil {
+		listener.Close()
+		return err
+	}
+	s.wg.Add(2)
+	go s.jobLoop(tmpl)
+	go s.acceptLoop()
+	return nil
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops the server and disconnects every client
+func (s *Server) Close() error {
+	s.cancel()
+	err := s.listener.Close()
+	s.mtx.Lock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	s.mtx.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// WorkerStats returns the share statistics of a worker
+func (s *Server) WorkerStats(worker string) ShareStats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if st, ok := s.workerStats[worker]; ok {
+		return *st
+	}
+	return ShareStats{}
+}
+
+// jobLoop creates a new job every time the tip or the mempool changes
+func (s *Server) jobLoop(tmpl *core.BlockTemplate) {
+	defer s.wg.Done()
+	for {
+		if err := s.bchain.WaitForTemplateChange(s.ctx, tmpl.LongPollID); err != nil {
+			return
+		}
+		tmpl = s.bchain.NewBlockTemplate()
+		if err := s.updateJob(tmpl); err != nil {
+			continue
+		}
+	}
+}
+
+// updateJob creates a job from the template and sends it to every subscribed client
+func (s *Server) updateJob(tmpl *core.BlockTemplate) error {
+	s.mtx.Lock()
+	s.jobCounter++
+	// if the previous block changed, the work on older jobs is stale
+	cleanJob := s.currentJob == nil || !bytes.Equal(s.currentJob.tmpl.PreviousBlockHash, tmpl.PreviousBlockHash)
+	j, err := newJob(strconv.FormatUint(s.jobCounter, 16), tmpl, s.payoutKey, cleanJob)
+	if err != nil {
+		s.mtx.Unlock()
+		return err
+	}
+	if cleanJob {
+		s.jobs = make(map[string]*job)
+		s.jobOrder = nil
+		s.submitted = make(map[string]map[string]bool)
+	}
+	s.addJob(j)
+	s.currentJob = j
+	var subscribers []*client
+	for c := range s.clients {
+		if c.subscribed {
+			subscribers = append(subscribers, c)
+		}
+	}
+	s.mtx.Unlock()
+
+	// the job is sent without holding the lock, so that a slow client does not block the other ones
+	params := j.notifyParams()
+	for _, c := range subscribers {
+		c.notify("mining.notify", params)
+	}
+	return nil
+}
+
+// addJob makes the job active, expiring the oldest job and its shares above maxActiveJobs.
+// The caller should hold the lock.
+func (s *Server) addJob(j *job) {
+	s.jobs[j.id] = j
+	s.jobOrder = append(s.jobOrder, j.id)
+	s.submitted[j.id] = make(map[string]bool)
+	for len(s.jobOrder) > maxActiveJobs {
+		expired := s.jobOrder[0]
+		s.jobOrder = s.jobOrder[1:]
+		delete(s.jobs, expired)
+		delete(s.submitted, expired)
+	}
+}
+
+func (s *Server) acceptLoop() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := s.newClient(conn)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			c.serve()
+			s.mtx.Lock()
+			delete(s.clients, c)
+			s.mtx.Unlock()
+		}()
+	}
+}
+
+// client is a connection of a miner, which may authorize multiple workers
+type client struct {
+	server      *Server
+	conn        net.Conn
+	writeMtx    sync.Mutex
+	extraNonce1 []byte
+	// subscribed and workers are guarded by the server lock
+	subscribed bool
+	workers    map[string]bool
+}
+
+func (s *Server) newClient(conn net.Conn) *client {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	// every connection gets a unique extranonce1, so that miners never search the same space
+	en1 := utils.SerializeUint32(s.nextEN1, false)
+	s.nextEN1++
+	c := &client{server: s, conn: conn, extraNonce1: en1, workers: make(map[string]bool)}
+	s.clients[c] = true
+	return c
+}
+
+func (c *client) send(v interface{}) {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	// a client that stops reading is disconnected instead of blocking the server
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := c.conn.Write(append(data, '\n')); err != nil {
+		c.conn.Close()
+	}
+}
+
+func (c *client) notify(method string, params []interface{}) {
+	c.send(&notification{nil, method, params})
+}
+
+func (c *client) serve() {
+	defer c.conn.Close()
+	scanner := bufio.NewScanner(c.conn)
+	for scanner.Scan() {
+		var req request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			// the connection is dropped, since the stream can not be trusted
+			return
+		}
+		res, err := c.handle(&req)
+		resp := &response{ID: req.ID, Result: res}
+		if err != nil {
+			resp.Result = nil
+			resp.Error = stratumError(err)
+		}
+		c.send(resp)
+		// the difficulty and the current job are sent right after subscribing
+		if req.Method == "mining.subscribe" && err == nil {
+			c.sendWork()
+		}
+	}
+}
+
+func (c *client) sendWork() {
+	s := c.server
+	s.mtx.Lock()
+	j := s.currentJob
+	s.mtx.Unlock()
+	c.notify("mining.set_difficulty", []interface{}{s.difficulty})
+	c.notify("mining.notify", j.notifyParams())
+}
+
+// stratumError converts an error to the [code, message, traceback] error format
+func stratumError(err error) []interface{} {
+	code := ErrCodeOther
+	var se *shareError
+	if errors.As(err, &se) {
+		code = se.code
+	}
+	return []interface{}{code, err.Error(), nil}
+}
+
+type shareError struct {
+	code int
+	err  error
+}
+
+func (e *shareError) Error() string {
+	return e.err.Error()
+}
+
+func (e *shareError) Unwrap() error {
+	return e.err
+}
+
+func (c *client) handle(req *request) (interface{}, error) {
+	switch req.Method {
+	case "mining.subscribe":
+		return c.handleSubscribe()
+	case "mining.authorize":
+		return c.handleAuthorize(req.Params)
+	case "mining.submit":
+		return c.handleSubmit(req.Params)
+	default:
+		return nil, fmt.Errorf("unknown method %s", req.Method)
+	}
+}
+
+func (c *client) handleSubscribe() (interface{}, error) {
+	s := c.server
+	s.mtx.Lock()
+	c.subscribed = true
+	s.mtx.Unlock()
+
+	subID := hex.EncodeToString(c.extraNonce1)
+	return []interface{}{
+		[][]string{{"mining.set_difficulty", subID}, {"mining.notify", subID}},
+		hex.EncodeToString(c.extraNonce1),
+		ExtraNonce2Size,
+	}, nil
+}
+
+func (c *client) handleAuthorize(params []json.RawMessage) (interface{}, error) {
+	var worker string
+	if len(params) < 1 || json.Unmarshal(params[0], &worker) != nil || worker == "" {
+		return nil, errors.New("worker name is required")
+	}
+	// any worker name is accepted, it is only used to keep share statistics
+	s := c.server
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c.workers[worker] = true
+	if _, ok := s.workerStats[worker]; !ok {
+		s.workerStats[worker] = &ShareStats{}
+	}
+	return true, nil
+}
+
+func (c *client) handleSubmit(params []json.RawMessage) (interface{}, error) {
+	var args [5]string
+	if len(params) < len(args) {
+		return nil, errors.New("invalid submit parameters")
+	}
+	for i := range args {
+		if err := json.Unmarshal(params[i], &args[i]); err != nil {
+			return nil, errors.New("invalid submit parameters")
+		}
+	}
+	worker, jobID := args[0], args[1]
+	extraNonce2, err1 := hex.DecodeString(args[2])
+	rawNtime, err2 := hex.DecodeString(args[3])
+	rawNonce, err3 := hex.DecodeString(args[4])
+	if err1 != nil || err2 != nil || err3 != nil || len(rawNtime) != 8 || len(rawNonce) != 4 {
+		return nil, &shareError{ErrCodeOther, ErrInvalidShare}
+	}
+
+	s := c.server
+	s.mtx.Lock()
+	if !c.subscribed {
+		s.mtx.Unlock()
+		return nil, &shareError{ErrCodeNotSubscribed, errors.New("not subscribed")}
+	}
+	if !c.workers[worker] {
+		s.mtx.Unlock()
+		return nil, &shareError{ErrCodeUnauthorized, errors.New("unauthorized worker")}
+	}
+	stats := s.workerStats[worker]
+	j, ok := s.jobs[jobID]
+	// shares are only recorded for active jobs, so that unknown job IDs do not fill the map
+	duplicate := false
+	if ok {
+		shareKey := hex.EncodeToString(c.extraNonce1) + args[2] + args[3] + args[4]
+		duplicate = s.submitted[jobID][shareKey]
+		s.submitted[jobID][shareKey] = true
+	}
+	s.mtx.Unlock()
+
+	var block *core.Block
+	var err error
+	switch {
+	case !ok:
+		err = &shareError{ErrCodeJobNotFound, ErrJobNotFound}
+	case duplicate:
+		err = &shareError{ErrCodeDuplicateShare, errors.New("duplicate share")}
+	default:
+		block, err = j.checkShare(s.shareTarget, c.extraNonce1, extraNonce2, int64(utils.DeserializeUint64(rawNtime, false)), utils.DeserializeUint32(rawNonce, false))
+		if errors.Is(err, ErrLowDifficultyShare) {
+			err = &shareError{ErrCodeLowDifficulty, err}
+		}
+	}
+	if err == nil && block != nil {
+		// the share is also a block solution, submitting it to the chain
+		// the new tip will cause a clean job to be sent
+		if serr := s.bchain.SubmitBlock(block); serr != nil {
+			err = fmt.Errorf("block rejected: %w", serr)
+		}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err != nil {
+		stats.Rejected++
+		return nil, err
+	}
+	stats.Accepted++
+	if block != nil {
+		stats.Blocks++
+	}
+	return true, nil
+}
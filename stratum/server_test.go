@@ -0,0 +1,362 @@
+package stratum
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"plairo/core"
+	"plairo/db"
+	"plairo/params"
+	"plairo/utils"
+	"testing"
+	"time"
+)
+
+// mocking the block storage, blocks are only kept in memory
+type mockStorage struct {
+	blocks map[string][]byte
+}
+
+func (ms *mockStorage) WriteBlock(block core.IBlock, height uint32) error {
+	ms.blocks[string(block.GetBlockHash())] = block.Serialize()
+	return nil
+}
+
+func (ms *mockStorage) GetBlockData(bkey []byte) ([]byte, bool) {
+	data, ok := ms.blocks[string(bkey)]
+	return data, ok
+}
+
+func (ms *mockStorage) HasBlock(bkey []byte) bool {
+	_, ok := ms.blocks[string(bkey)]
+	return ok
+}
+
+func (ms *mockStorage) DisconnectBlock(block core.IBlock) error {
+	return nil
+}
+
+// testClient is a minimal stratum client used over loopback
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	scanner *bufio.Scanner
+	nextID  int
+
+	extraNonce1 []byte
+	job         *testJob
+	difficulty  float64
+}
+
+type testJob struct {
+	id       string
+	prevHash []byte
+	coinb1   []byte
+	coinb2   []byte
+	branch   [][]byte
+	version  uint32
+	bits     uint32
+	ntime    int64
+	clean    bool
+}
+
+type testMessage struct {
+	ID     *int              `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	Result json.RawMessage   `json:"result"`
+	Error  []interface{}     `json:"error"`
+}
+
+func dialTestClient(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting to stratum server: %v\n", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, scanner: bufio.NewScanner(conn)}
+}
+
+// call sends a request and returns its response, handling any notifications received before it
+func (tc *testClient) call(method string, params ...interface{}) *testMessage {
+	tc.nextID++
+	data, _ := json.Marshal(map[string]interface{}{"id": tc.nextID, "method": method, "params": params})
+	if _, err := tc.conn.Write(append(data, '\n')); err != nil {
+		tc.t.Fatalf("Error sending %s: %v\n", method, err)
+	}
+	for {
+		msg := tc.read()
+		if msg.ID != nil && *msg.ID == tc.nextID {
+			return msg
+		}
+	}
+}
+
+// read reads the next message, handling it if it is a notification
+func (tc *testClient) read() *testMessage {
+	tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if !tc.scanner.Scan() {
+		tc.t.Fatalf("Error reading from stratum server: %v\n", tc.scanner.Err())
+	}
+	var msg testMessage
+	if err := json.Unmarshal(tc.scanner.Bytes(), &msg); err != nil {
+		tc.t.Fatalf("Error decoding message: %v\n", err)
+	}
+	switch msg.Method {
+	case "mining.set_difficulty":
+		json.Unmarshal(msg.Params[0], &tc.difficulty)
+	case "mining.notify":
+		tc.job = parseTestJob(msg.Params)
+	}
+	return &msg
+}
+
+// waitForCleanJob reads messages until a job for a new previous block is received
+func (tc *testClient) waitForCleanJob(prevHash []byte) {
+	for tc.job == nil || bytes.Equal(tc.job.prevHash, prevHash) {
+		tc.read()
+	}
+}
+
+func parseTestJob(params []json.RawMessage) *testJob {
+	var id, prev, coinb1, coinb2, version, bits, ntime string
+	var branch []string
+	var clean bool
+	json.Unmarshal(params[0], &id)
+	json.Unmarshal(params[1], &prev)
+	json.Unmarshal(params[2], &coinb1)
+	json.Unmarshal(params[3], &coinb2)
+	json.Unmarshal(params[4], &branch)
+	json.Unmarshal(params[5], &version)
+	json.Unmarshal(params[6], &bits)
+	json.Unmarshal(params[7], &ntime)
+	json.Unmarshal(params[8], &clean)
+	j := &testJob{id: id, clean: clean}
+	j.prevHash, _ = hex.DecodeString(prev)
+	j.coinb1, _ = hex.DecodeString(coinb1)
+	j.coinb2, _ = hex.DecodeString(coinb2)
+	for _, h := range branch {
+		raw, _ := hex.DecodeString(h)
+		j.branch = append(j.branch, raw)
+	}
+	rawVersion, _ := hex.DecodeString(version)
+	j.version = utils.DeserializeUint32(rawVersion, false)
+	rawBits, _ := hex.DecodeString(bits)
+	j.bits = utils.DeserializeUint32(rawBits, false)
+	rawNtime, _ := hex.DecodeString(ntime)
+	j.ntime = int64(utils.DeserializeUint64(rawNtime, false))
+	return j
+}
+
+// findShare searches for a nonce whose hash satisfies accept, returning the submit parameters
+func (tc *testClient) findShare(extraNonce2 []byte, accept func(hash []byte) bool) []interface{} {
+	j := tc.job
+	coinbase := append(append(append(append([]byte(nil), j.coinb1...), tc.extraNonce1...), extraNonce2...), j.coinb2...)
+	cbTXID := utils.CalculateSHA256Hash(utils.CalculateSHA256Hash(coinbase))
+	header := &core.BlockHeader{
+		Version:           j.version,
+		PreviousBlockHash: j.prevHash,
+		MerkleRoot:        utils.ComputeMerkleRootFromBranch(cbTXID, j.branch, 0),
+		Timestamp:         j.ntime,
+		TargetBits:        j.bits,
+	}
+	for !accept(header.GetHash()) {
+		header.Nonce++
+	}
+	return []interface{}{
+		"worker1",
+		j.id,
+		hex.EncodeToString(extraNonce2),
+		hex.EncodeToString(utils.SerializeUint64(uint64(j.ntime), false)),
+		hex.EncodeToString(utils.SerializeUint32(header.Nonce, false)),
+	}
+}
+
+func setupTestServer(t *testing.T, difficulty float64) (*Server, *core.Blockchain) {
+	cstate, err := db.NewChainstate(db.NewMemStore(), true)
+	if err != nil {
+		t.Fatalf("Error creating chainstate: %v\n", err)
+	}
+	t.Cleanup(func() { cstate.Close() })
+	core.SetChainstate(cstate)
+	core.BStorage = &mockStorage{make(map[string][]byte)}
+
+	cparams := *params.RegTestParams
+	// target is 0x00ffff00...
+	cparams.Genesis.TargetBits = 0x2000ffff
+
+	_, pubkey, err := utils.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %v\n", err)
+	}
+	if err := core.MineGenesisBlock(&cparams); err != nil {
+		t.Fatalf("Error mining genesis block: %v\n", err)
+	}
+	bc, err := core.CreateBlockchain(&cparams)
+	if err != nil {
+		t.Fatalf("Error creating blockchain: %v\n", err)
+	}
+	s, err := NewServer(bc, pubkey, difficulty)
+	if err != nil {
+		t.Fatalf("Error creating stratum server: %v\n", err)
+	}
+	if err := s.Start("127.0.0.1:0"); err != nil {
+		t.Fatalf("Error starting stratum server: %v\n", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, bc
+}
+
+func TestServer_Shares(t *testing.T) {
+	// share target is twice the block target, 0x01fffe00...
+	s, bc := setupTestServer(t, 1.0/(1<<25))
+	tc := dialTestClient(t, s.Addr().String())
+
+	res := tc.call("mining.subscribe")
+	var sub []json.RawMessage
+	if res.Error != nil || json.Unmarshal(res.Result, &sub) != nil || len(sub) != 3 {
+		t.Fatalf("Unexpected subscribe response: %s %v\n", res.Result, res.Error)
+	}
+	var en1 string
+	var en2Size int
+	json.Unmarshal(sub[1], &en1)
+	json.Unmarshal(sub[2], &en2Size)
+	tc.extraNonce1, _ = hex.DecodeString(en1)
+	if len(tc.extraNonce1)+en2Size != core.CoinbaseExtraNonceSize {
+		t.Fatalf("Extra-nonce sizes do not add up to the coinbase extra-nonce size.\n")
+	}
+
+	if res := tc.call("mining.authorize", "worker1", "x"); res.Error != nil || string(res.Result) != "true" {
+		t.Fatalf("Unexpected authorize response: %s %v\n", res.Result, res.Error)
+	}
+	// the job should have been received right after subscribing
+	for tc.job == nil {
+		tc.read()
+	}
+	if tc.difficulty != s.difficulty {
+		t.Errorf("Expected difficulty %f, got %f\n", s.difficulty, tc.difficulty)
+	}
+
+	genesis, _ := bc.GetHeaderAt(0)
+	shareTarget := difficultyToTarget(s.difficulty)
+	blockTarget := utils.ExpandBits(utils.SerializeUint32(tc.job.bits, false))
+	en2 := []byte{0, 0, 0, 1}
+
+	// Test Case #1: share satisfying the share target only
+	share := tc.findShare(en2, func(hash []byte) bool {
+		return bytes.Compare(hash, shareTarget) < 0 && bytes.Compare(hash, blockTarget) >= 0
+	})
+	if res := tc.call("mining.submit", share...); res.Error != nil || string(res.Result) != "true" {
+		t.Errorf("Expected share to be accepted, got %s %v\n", res.Result, res.Error)
+	}
+
+	// Test Case #2: submitting the same share again
+	if res := tc.call("mining.submit", share...); res.Error == nil || res.Error[0].(float64) != ErrCodeDuplicateShare {
+		t.Errorf("Expected duplicate share error, got %v\n", res.Error)
+	}
+
+	// Test Case #3: share not satisfying the share target
+	low := tc.findShare(en2, func(hash []byte) bool {
+		return bytes.Compare(hash, shareTarget) >= 0
+	})
+	if res := tc.call("mining.submit", low...); res.Error == nil || res.Error[0].(float64) != ErrCodeLowDifficulty {
+		t.Errorf("Expected low difficulty error, got %v\n", res.Error)
+	}
+
+	// Test Case #4: unknown job
+	unknown := append([]interface{}(nil), share...)
+	unknown[1] = "nojob"
+	if res := tc.call("mining.submit", unknown...); res.Error == nil || res.Error[0].(float64) != ErrCodeJobNotFound {
+		t.Errorf("Expected job not found error, got %v\n", res.Error)
+	}
+
+	// Test Case #5: share solving the block
+	solution := tc.findShare([]byte{0, 0, 0, 2}, func(hash []byte) bool {
+		return bytes.Compare(hash, blockTarget) < 0
+	})
+	if res := tc.call("mining.submit", solution...); res.Error != nil || string(res.Result) != "true" {
+		t.Fatalf("Expected block solution to be accepted, got %s %v\n", res.Result, res.Error)
+	}
+	header, ok := bc.GetHeaderAt(1)
+	if !ok || !bytes.Equal(header.PreviousBlockHash, genesis.GetHash()) {
+		t.Fatalf("Block solution was not inserted in the blockchain.\n")
+	}
+
+	// a clean job should be sent for the new tip
+	tc.waitForCleanJob(genesis.GetHash())
+	if !tc.job.clean || !bytes.Equal(tc.job.prevHash, header.GetHash()) {
+		t.Errorf("Expected clean job on top of the new block.\n")
+	}
+
+	stats := s.WorkerStats("worker1")
+	if stats.Accepted != 2 || stats.Rejected != 3 || stats.Blocks != 1 {
+		t.Errorf("Unexpected worker stats: %+v\n", stats)
+	}
+}
+
+func TestServer_Unauthorized(t *testing.T) {
+	s, _ := setupTestServer(t, 1)
+	tc := dialTestClient(t, s.Addr().String())
+
+	tc.call("mining.subscribe")
+	for tc.job == nil {
+		tc.read()
+	}
+	share := []interface{}{"worker1", tc.job.id, "00000000", "0000000000000000", "00000000"}
+	if res := tc.call("mining.submit", share...); res.Error == nil || res.Error[0].(float64) != ErrCodeUnauthorized {
+		t.Errorf("Expected unauthorized error, got %v\n", res.Error)
+	}
+}
+
+func TestServer_JobExpiry(t *testing.T) {
+	s, bc := setupTestServer(t, 1)
+	tc := dialTestClient(t, s.Addr().String())
+	tc.call("mining.authorize", "worker1")
+	tc.call("mining.subscribe")
+	for tc.job == nil {
+		tc.read()
+	}
+	first := tc.job.id
+
+	// the tip does not change, so the new jobs are not clean and the older ones stay active until they expire
+	for i := 0; i < maxActiveJobs; i++ {
+		if err := s.updateJob(bc.NewBlockTemplate()); err != nil {
+			t.Fatalf("Error updating job: %v\n", err)
+		}
+	}
+	s.mtx.Lock()
+	jobs, submitted := len(s.jobs), len(s.submitted)
+	_, active := s.jobs[first]
+	s.mtx.Unlock()
+	if jobs != maxActiveJobs || submitted != maxActiveJobs || active {
+		t.Errorf("Unexpected active jobs: %d jobs, %d share sets, first job active: %v\n", jobs, submitted, active)
+	}
+
+	share := []interface{}{"worker1", first, "00000000", "0000000000000000", "00000000"}
+	if res := tc.call("mining.submit", share...); res.Error == nil || res.Error[0].(float64) != ErrCodeJobNotFound {
+		t.Errorf("Expected job not found error for an expired job, got %v\n", res.Error)
+	}
+}
+
+func TestDifficultyToTarget(t *testing.T) {
+	exp, _ := hex.DecodeString("00000000ffff0000000000000000000000000000000000000000000000000000")
+	if got := difficultyToTarget(1); !bytes.Equal(got, exp) {
+		t.Errorf("Unexpected target for difficulty 1.\nExp: %x\nGot: %x\n", exp, got)
+	}
+	exp, _ = hex.DecodeString("000000007fff8000000000000000000000000000000000000000000000000000")
+	if got := difficultyToTarget(2); !bytes.Equal(got, exp) {
+		t.Errorf("Unexpected target for difficulty 2.\nExp: %x\nGot: %x\n", exp, got)
+	}
+}
+
+func TestNewServer_InvalidDifficulty(t *testing.T) {
+	for _, difficulty := range []float64{0, -1, math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if _, err := NewServer(nil, nil, difficulty); !errors.Is(err, ErrInvalidDifficulty) {
+			t.Errorf("Expected ErrInvalidDifficulty for difficulty %v, got %v\n", difficulty, err)
+		}
+	}
+}
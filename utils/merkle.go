@@ -18,3 +18,48 @@ func ComputeMerkleRoot(hashSlice [][]byte) []byte {
 	}
 	return ComputeMerkleRoot(tempHashes)
 }
+
+// ComputeMerkleBranch returns the hashes needed to compute the merkle root starting from the hash at index
+func ComputeMerkleBranch(hashSlice [][]byte, index int) [][]byte {
+	var branch [][]byte
+	// copying to avoid appending to the array of the caller
+	hashSlice = append([][]byte(nil), hashSlice...)
+	for len(hashSlice) > 1 {
+		if len(hashSlice)%2 == 1 {
+			// duplicating the last hash, same as when computing the merkle root
+			hashSlice = append(hashSlice, hashSlice[len(hashSlice)-1])
+		}
+		// the sibling is the other hash of the pair this index belongs to
+		branch = append(branch, hashSlice[index^1])
+
+		var tempHashes [][]byte
+		for i := 0; i < len(hashSlice); i += 2 {
+			tempHashes = append(tempHashes, CalculateSHA256Hash(CalculateSHA256Hash(concatHashes(hashSlice[i], hashSlice[i+1]))))
+		}
+		hashSlice = tempHashes
+		index /= 2
+	}
+	return branch
+}
+
+// ComputeMerkleRootFromBranch computes the merkle root using the hash at index and its merkle branch.
+// Only the hashes on the path of the leaf are calculated.
+func ComputeMerkleRootFromBranch(leaf []byte, branch [][]byte, index int) []byte {
+	res := leaf
+	for _, sibling := range branch {
+		if index%2 == 0 {
+			res = CalculateSHA256Hash(CalculateSHA256Hash(concatHashes(res, sibling)))
+		} else {
+			res = CalculateSHA256Hash(CalculateSHA256Hash(concatHashes(sibling, res)))
+		}
+		index /= 2
+	}
+	return res
+}
+
+// concatHashes concatenates two hashes without modifying the underlying array of the first
+func concatHashes(a, b []byte) []byte {
+	res := make([]byte, 0, len(a)+len(b))
+	res = append(res, a...)
+	return append(res, b...)
+}
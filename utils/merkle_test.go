@@ -30,3 +30,21 @@ func TestComputeMerkleRoot(t *testing.T) {
 		t.Errorf("Invalid merkle root:\nExp: %x\nGot: %x\n", exp, ComputeMerkleRoot([][]byte{a, b, c, d, e, f}))
 	}
 }
+
+func TestComputeMerkleBranch(t *testing.T) {
+	var hashes [][]byte
+	for i := byte(0); i < 7; i++ {
+		hashes = append(hashes, CalculateSHA256Hash([]byte{i}))
+	}
+	// checking every leaf for every possible number of leaves, including odd levels
+	for n := 1; n <= len(hashes); n++ {
+		exp := ComputeMerkleRoot(append([][]byte(nil), hashes[:n]...))
+		for i := 0; i < n; i++ {
+			branch := ComputeMerkleBranch(append([][]byte(nil), hashes[:n]...), i)
+			got := ComputeMerkleRootFromBranch(hashes[i], branch, i)
+			if !bytes.Equal(got, exp) {
+				t.Errorf("Invalid merkle root from branch for leaf %d of %d:\nExp: %x\nGot: %x\n", i, n, exp, got)
+			}
+		}
+	}
+}
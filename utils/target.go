@@ -1,9 +1,6 @@
 package utils
 
-import (
-	"fmt"
-	"plairo/params"
-)
+import "math/big"
 
 func ExpandBits(bits []byte) []byte {
 	/*
@@ -23,74 +20,56 @@ func ExpandBits(bits []byte) []byte {
 	return res
 }
 
-func ApplyCoeffToTarget(coeff float64, prevTarget uint32) uint32 {
-	// limiting coefficient to limit the effect of a single retarget in block difficulty
-	if coeff > 4 {
-		coeff = 4
-	} else if coeff < 0.25 {
-		coeff = 0.25
+// CompactToBig converts target bits in compact form to the full target.
+// Unlike bitcoin, the coefficient has no sign bit, so the target is never negative.
+func CompactToBig(bits uint32) *big.Int {
+	size := uint(bits >> 24)
+	mantissa := big.NewInt(int64(bits & 0x00ffffff))
+	if size <= 3 {
+		return mantissa.Rsh(mantissa, 8*(3-size))
 	}
-	fmt.Printf("Prev target is: %d\n", prevTarget)
-	// prevTarget is in compressed form (0xEEXXYYZZ). To apply the coefficient, the exponent is not needed for now.
-	// using a mask to drop the exponent
-	rawBits := uint64(prevTarget) & 0x00ffffff
-	fmt.Printf("Raw bits is: %d\n", rawBits)
-	bitsExp := prevTarget & 0xff000000
-	fmt.Printf("Exp is: %d\n", bitsExp)
-	// shifting exponent bits to increment/decrement if needed
-	bitsExp >>= 24
-	fmt.Printf("Now exp is (after shifting): %d\n", bitsExp)
-	// The full target has a size of 32 bytes. For arithmetic calculations with operands of this size,
-	// precision of 256 bits would be needed ideally.
-	// We can avoid this by taking into account the limiting factor of 4.
-	// The coefficient which will be applied to the previous target cannot exceed 4 or be less than 0.25.
-	// This means that the previous target (in binary) will be shifted left or right by no more than 4 bits.
-	// To make sure no bits are missed when applying a coefficient < 1, we can shift left by a byte.
-	rawBits <<= 8
-	fmt.Printf("Now rawbits is (after shifting): %d\n", rawBits)
-	// now the rawBits form is 0x00000000XXYYZZ00
-	// applying the coefficient and keeping the integer part of the result
-	newTarget := uint64(float64(rawBits) * coeff)
-	fmt.Printf("New target is: %d\n", newTarget)
-	// checking "overflow" and "underflow" bytes
-	// overflow is of higher priority
-	if (newTarget & 0xff00000000) != 0 {
-		fmt.Printf("Overflow\n")
-		// if overflow is not zero, only the first 3 bytes should be kept
-		// exponent is therefore incremented and the last 2 bytes dropped
-		bitsExp++
-		newTarget >>= 16
-	} else if (newTarget & 0xff) != 0 {
-		// no overflow was found, but the last byte is non-zero
-		// need to check if it's necessary or just used for precision
-		if (newTarget & 0xff000000) != 0 {
-			fmt.Printf("Last byte was used for precision\n")
-			// last byte was only used for precision, so exponent stays the same
-			// last byte is dropped
-			newTarget >>= 8
-		} else {
-			fmt.Printf("Last byte was necessary\n")
-			// last byte was necessary, decrementing the exponent by one
-			if bitsExp != 0 {
-				bitsExp--
-			} else {
-				// exponent cannot decrement, last byte should be dropped
-				newTarget >>= 8
-			}
-			fmt.Printf("Exp is now: %d\n", bitsExp)
-			// no need to shift newTarget, it's already in the desired form
-		}
+	return mantissa.Lsh(mantissa, 8*(size-3))
+}
+
+// IsValidCompact checks that the target bits can be expanded to a target of 32 bytes at most.
+// Bits with the highest bit of the coefficient set are rejected as well, they would be negative for bitcoin.
+func IsValidCompact(bits uint32) bool {
+	return bits>>24 <= 32 && bits&0x00800000 == 0 && CompactToBig(bits).BitLen() <= 256
+}
+
+// BigToCompact converts a target to compact form, dropping any bits that do not fit in the coefficient.
+// The coefficient is normalized the same way as bitcoin, so that its highest bit is never set.
+func BigToCompact(target *big.Int) uint32 {
+	size := uint((target.BitLen() + 7) / 8)
+	var mantissa uint32
+	if size <= 3 {
+		mantissa = uint32(target.Uint64() << (8 * (3 - size)))
 	} else {
-		// bits remained in original form, shifting back into place
-		newTarget >>= 8
+		mantissa = uint32(new(big.Int).Rsh(target, 8*(size-3)).Uint64())
+	}
+	// moving to the next byte if the highest bit is set, so the bits remain valid for bitcoin-compatible software
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		size++
 	}
-	// shifting exponent back to the position it should be
-	bitsExp <<= 24
-	// adding the exponent in front of the bits coefficient
-	newTarget = uint64(bitsExp) | newTarget
-	if uint32(newTarget) > params.MaxDifficulty {
-		return params.MaxDifficulty
+	return uint32(size)<<24 | mantissa
+}
+
+// CalculateRetarget adjusts the previous target by the ratio of the actual to the expected timespan.
+// The actual timespan is clamped to a factor of 4 to limit the effect of a single retarget,
+// and the result never exceeds the limit target given.
+func CalculateRetarget(prevBits uint32, actualTimespan, expectedTimespan int64, limitBits uint32) uint32 {
+	if actualTimespan < expectedTimespan/4 {
+		actualTimespan = expectedTimespan / 4
+	} else if actualTimespan > expectedTimespan*4 {
+		actualTimespan = expectedTimespan * 4
+	}
+	newTarget := CompactToBig(prevBits)
+	newTarget.Mul(newTarget, big.NewInt(actualTimespan))
+	newTarget.Div(newTarget, big.NewInt(expectedTimespan))
+
+	if limit := CompactToBig(limitBits); newTarget.Cmp(limit) > 0 {
+		newTarget = limit
 	}
-	fmt.Printf("Result is: %x\n", newTarget)
-	return uint32(newTarget)
+	return BigToCompact(newTarget)
 }
@@ -3,7 +3,7 @@ package utils
 import (
 	"bytes"
 	"encoding/hex"
-	"fmt"
+	"math/big"
 	"testing"
 )
 
@@ -37,38 +37,103 @@ func TestExpandBits(t *testing.T) {
 	}
 }
 
-type targetTcase struct {
-	coeff        float64
-	prevTarget   uint32
-	expNewTarget uint32
+func TestCompactToBig(t *testing.T) {
+	tcases := []*bitsTcase{
+		newBitsTestCase("00000000", "0000000000000000000000000000000000000000000000000000000000000000"),
+		newBitsTestCase("02000010", "0000000000000000000000000000000000000000000000000000000000000000"),
+		newBitsTestCase("01100000", "0000000000000000000000000000000000000000000000000000000000000010"),
+		newBitsTestCase("04aaaaaa", "00000000000000000000000000000000000000000000000000000000aaaaaa00"),
+		newBitsTestCase("03aaaaaa", "0000000000000000000000000000000000000000000000000000000000aaaaaa"),
+		newBitsTestCase("20aaaaaa", "aaaaaa0000000000000000000000000000000000000000000000000000000000"),
+		newBitsTestCase("180696f4", "00000000000000000696f4000000000000000000000000000000000000000000"),
+	}
+	for _, tcase := range tcases {
+		got := CompactToBig(DeserializeUint32(tcase.bits, false)).FillBytes(make([]byte, 32))
+		if !bytes.Equal(tcase.expected, got) {
+			t.Errorf("Error converting %x\n Exp: %x\n Got: %x\n", tcase.bits, tcase.expected, got)
+		}
+		// the conversion should agree with ExpandBits
+		if !bytes.Equal(ExpandBits(tcase.bits), got) {
+			t.Errorf("CompactToBig and ExpandBits disagree for %x\n", tcase.bits)
+		}
+	}
+}
+
+func TestIsValidCompact(t *testing.T) {
+	tcases := []struct {
+		bits  uint32
+		valid bool
+	}{
+		{0x1d00ffff, true},
+		{0x207fffff, true},
+		{0x03000001, true},
+		// the exponent does not fit in a hash
+		{0x21000001, false},
+		{0xff000001, false},
+		// the sign bit of the coefficient is set
+		{0x1d800000, false},
+		{0x20aaaaaa, false},
+	}
+	for _, tcase := range tcases {
+		if IsValidCompact(tcase.bits) != tcase.valid {
+			t.Errorf("Expected validity of %08x to be %v\n", tcase.bits, tcase.valid)
+		}
+	}
+}
+
+func TestBigToCompact(t *testing.T) {
+	cases := []struct {
+		target  string
+		expBits uint32
+	}{
+		{"00", 0},
+		{"12", 0x01120000},
+		{"1234", 0x02123400},
+		{"123456", 0x03123456},
+		{"12345678", 0x04123456},
+		// highest coefficient bit set, moving to the next byte
+		{"80", 0x02008000},
+		{"ffffff", 0x0400ffff},
+		{"00000000ffff0000000000000000000000000000000000000000000000000000", 0x1d00ffff},
+		{"00000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 0x1d00ffff},
+	}
+	for i, c := range cases {
+		raw, _ := hex.DecodeString(c.target)
+		if bits := BigToCompact(new(big.Int).SetBytes(raw)); bits != c.expBits {
+			t.Errorf("Invalid bits for case #%d\n Exp: %08x\n Got: %08x\n", i, c.expBits, bits)
+		}
+	}
+	// converting back and forth should not change normalized bits
+	for _, bits := range []uint32{0x1d00ffff, 0x1c0168fd, 0x1b0404cb, 0x2000ffff, 0x03123456} {
+		if got := BigToCompact(CompactToBig(bits)); got != bits {
+			t.Errorf("Round trip of %08x returned %08x\n", bits, got)
+		}
+	}
 }
 
-func TestApplyCoeffToTarget(t *testing.T) {
-	cases := []*targetTcase{
-		{1, 1, 1},
-		{2, 1, 2},
-		{4, 1, 4},
-		{10, 1, 4},
-		{0.25, 1, 0},
-		{0.01, 1, 0},
-		{1, 0x01100000, 0x01100000},
-		{0.5, 0x01100000, 0x01080000},
-		{0.25, 4, 1},
-		{1.5, 4, 6},
-		{1, 0x12121212, 0x12121212},
-		{1, 0x12121212, 0x12121212},
-		{1, 0x12121212, 0x12121212},
-		{1, 0x05010000, 0x05010000},
-		{0.5, 0x04010000, 0x04008000},
-		{0.5, 0x04000001, 0x03000080},
-		{2, 0x03800000, 0x04010000},
-		{2, 0x03800000, 0x04010000},
-		{10, 0x03800000, 0x04020000},
+// test vectors are the same as bitcoin, using its timespan and limit
+func TestCalculateRetarget(t *testing.T) {
+	const expectedTimespan = 14 * 24 * 60 * 60
+	const limitBits = 0x1d00ffff
+	cases := []struct {
+		prevBits       uint32
+		actualTimespan int64
+		expBits        uint32
+	}{
+		// regular retarget
+		{0x1d00ffff, 1262152739 - 1261130161, 0x1d00d86a},
+		// result exceeding the limit
+		{0x1d00ffff, 1233061996 - 1231006505, 0x1d00ffff},
+		// timespan lower than allowed
+		{0x1c05a3f4, 1279297671 - 1279008237, 0x1c0168fd},
+		// timespan greater than allowed
+		{0x1c387f6f, 1263163443 - 1231006505, 0x1d00e1fd},
+		// same timespan
+		{0x1b0404cb, expectedTimespan, 0x1b0404cb},
 	}
 	for i, c := range cases {
-		fmt.Printf("Checking case #%d \n", i)
-		if c.expNewTarget != ApplyCoeffToTarget(c.coeff, c.prevTarget) {
-			t.Errorf("Invalid new target for case #%d\n", i)
+		if bits := CalculateRetarget(c.prevBits, c.actualTimespan, expectedTimespan, limitBits); bits != c.expBits {
+			t.Errorf("Invalid new target for case #%d\n Exp: %08x\n Got: %08x\n", i, c.expBits, bits)
 		}
 	}
 }